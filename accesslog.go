@@ -0,0 +1,251 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+	"github.com/ChacheGS/go-stream-tunnel/proto"
+)
+
+// Known access log formats.
+const (
+	// AccessLogAuto writes http tunnel connections in AccessLogCommon
+	// format and everything else in AccessLogJSON format.
+	AccessLogAuto = "auto"
+	// AccessLogCommon writes NCSA Common Log Format lines, extended with
+	// key=value pairs for the fields CLF has no place for.
+	AccessLogCommon = "common"
+	// AccessLogJSON writes one JSON object per line.
+	AccessLogJSON = "json"
+)
+
+// AccessLogEntry describes a single proxied public connection, from accept
+// to close, or a single request of an http tunnel.
+type AccessLogEntry struct {
+	// Start is the time the connection was accepted, or for a request
+	// after the first on a connection, the time it was read.
+	Start time.Time
+	// Duration is how long the connection was open.
+	Duration time.Duration
+	// RemoteAddr is the address of the user that opened the connection.
+	RemoteAddr string
+	// Identifier is the client the connection was proxied to.
+	Identifier id.ID
+	// Client is the CommonName of the client's certificate, if it was
+	// verified against trusted CAs.
+	Client string
+	// Proto is the tunnel protocol, see proto.ControlMessage.ForwardedProto.
+	Proto string
+	// Tunnel is what the client routes by, see
+	// proto.ControlMessage.ForwardedHost: the listener address for tcp
+	// tunnels, the subdomain slug for http tunnels.
+	Tunnel string
+	// Host is the requested host of an http tunnel connection.
+	Host string
+	// BytesIn is the number of bytes sent by the user to the client.
+	BytesIn int64
+	// BytesOut is the number of bytes sent by the client to the user.
+	BytesOut int64
+	// CloseReason tells which side ended the connection, or why it failed.
+	CloseReason string
+	// Method, Path and Status describe the request and response of an http
+	// tunnel; Status is 0 if no response line was seen.
+	Method string
+	Path   string
+	Status int
+}
+
+// Reasons a proxied connection ended, see AccessLogEntry.CloseReason.
+const (
+	closeUser   = "user closed"
+	closeClient = "client closed"
+	// closeResponse ends the entry of an http request answered in full,
+	// its connection may carry more.
+	closeResponse = "response sent"
+)
+
+// AccessLogger records one AccessLogEntry per proxied connection.
+// Implementations must be safe for concurrent use by multiple goroutines.
+type AccessLogger interface {
+	LogAccess(e *AccessLogEntry) error
+}
+
+type accessLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// NewAccessLogger returns an AccessLogger writing entries to w in the given
+// format, one of AccessLogAuto, AccessLogCommon or AccessLogJSON.
+func NewAccessLogger(w io.Writer, format string) (AccessLogger, error) {
+	switch format {
+	case "":
+		format = AccessLogAuto
+	case AccessLogAuto, AccessLogCommon, AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q, expected %s, %s or %s", format, AccessLogAuto, AccessLogCommon, AccessLogJSON)
+	}
+
+	return &accessLogger{w: w, format: format}, nil
+}
+
+func (l *accessLogger) LogAccess(e *AccessLogEntry) error {
+	var b []byte
+	switch {
+	case l.format == AccessLogCommon, l.format == AccessLogAuto && e.Proto == proto.HTTP:
+		b = formatCommon(e)
+	default:
+		var err error
+		if b, err = formatJSON(e); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(b)
+	return err
+}
+
+// formatCommon renders e as
+//
+//	remote - identifier [start] "METHOD path HTTP/1.1" status bytes_out key=value...
+//
+// with "-" for fields that don't apply, e.g. the request of a tcp
+// connection.
+func formatCommon(e *AccessLogEntry) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%s - %s [%s] ", clfField(trimPort(e.RemoteAddr)), e.Identifier, e.Start.Format("02/Jan/2006:15:04:05 -0700"))
+
+	if e.Method != "" {
+		fmt.Fprintf(&buf, "%q ", e.Method+" "+e.Path+" HTTP/1.1")
+	} else {
+		buf.WriteString(`"-" `)
+	}
+
+	if e.Status != 0 {
+		buf.WriteString(strconv.Itoa(e.Status))
+	} else {
+		buf.WriteByte('-')
+	}
+	fmt.Fprintf(&buf, " %d", e.BytesOut)
+
+	fmt.Fprintf(&buf, " proto=%s tunnel=%s", clfField(e.Proto), clfField(e.Tunnel))
+	if e.Client != "" {
+		fmt.Fprintf(&buf, " client=%s", clfField(e.Client))
+	}
+	if e.Host != "" {
+		fmt.Fprintf(&buf, " host=%s", clfField(e.Host))
+	}
+	fmt.Fprintf(&buf, " bytes_in=%d duration=%s reason=%q\n", e.BytesIn, e.Duration, e.CloseReason)
+
+	return buf.Bytes()
+}
+
+func clfField(s string) string {
+	if s == "" || strings.ContainsAny(s, " \"") {
+		return "-"
+	}
+	return s
+}
+
+func formatJSON(e *AccessLogEntry) ([]byte, error) {
+	v := struct {
+		Start       time.Time `json:"start"`
+		DurationMS  int64     `json:"duration_ms"`
+		RemoteAddr  string    `json:"remote_addr"`
+		Identifier  string    `json:"identifier"`
+		Client      string    `json:"client,omitempty"`
+		Proto       string    `json:"proto"`
+		Tunnel      string    `json:"tunnel"`
+		Host        string    `json:"host,omitempty"`
+		BytesIn     int64     `json:"bytes_in"`
+		BytesOut    int64     `json:"bytes_out"`
+		CloseReason string    `json:"close_reason"`
+		Method      string    `json:"method,omitempty"`
+		Path        string    `json:"path,omitempty"`
+		Status      int       `json:"status,omitempty"`
+	}{
+		Start:       e.Start,
+		DurationMS:  e.Duration.Milliseconds(),
+		RemoteAddr:  e.RemoteAddr,
+		Identifier:  e.Identifier.String(),
+		Client:      e.Client,
+		Proto:       e.Proto,
+		Tunnel:      e.Tunnel,
+		Host:        e.Host,
+		BytesIn:     e.BytesIn,
+		BytesOut:    e.BytesOut,
+		CloseReason: e.CloseReason,
+		Method:      e.Method,
+		Path:        e.Path,
+		Status:      e.Status,
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// statusSniffer passes writes through to w while parsing the HTTP status
+// code out of the first line written, i.e. the response line of the first
+// response on an http tunnel connection.
+type statusSniffer struct {
+	w      io.Writer
+	line   []byte
+	done   bool
+	status int
+}
+
+// maxStatusLine bounds how much of the stream statusSniffer buffers while
+// looking for the end of the response line.
+const maxStatusLine = 256
+
+func (s *statusSniffer) Write(p []byte) (int, error) {
+	if !s.done {
+		n := min(len(p), maxStatusLine-len(s.line))
+		s.line = append(s.line, p[:n]...)
+		if i := bytes.IndexByte(s.line, '\n'); i >= 0 || len(s.line) >= maxStatusLine {
+			if i >= 0 {
+				s.line = s.line[:i]
+			}
+			s.status = parseStatusLine(string(s.line))
+			s.line = nil
+			s.done = true
+		}
+	}
+	return s.w.Write(p)
+}
+
+// parseStatusLine returns the status code of an HTTP/1.x response line, or
+// 0 if line isn't one.
+func parseStatusLine(line string) int {
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasPrefix(line, "HTTP/") {
+		return 0
+	}
+	_, rest, ok := strings.Cut(line, " ")
+	if !ok || len(rest) < 3 {
+		return 0
+	}
+	code, err := strconv.Atoi(rest[:3])
+	if err != nil {
+		return 0
+	}
+	return code
+}
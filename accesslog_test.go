@@ -0,0 +1,212 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+	"github.com/ChacheGS/go-stream-tunnel/proto"
+)
+
+func testAccessLogEntry(protocol string) *AccessLogEntry {
+	e := &AccessLogEntry{
+		Start:       time.Date(2026, 10, 10, 13, 55, 36, 0, time.UTC),
+		Duration:    1500 * time.Millisecond,
+		RemoteAddr:  "203.0.113.7:51234",
+		Identifier:  id.New([]byte("client")),
+		Proto:       protocol,
+		BytesIn:     120,
+		BytesOut:    2326,
+		CloseReason: closeUser,
+	}
+	if protocol == proto.HTTP {
+		e.Tunnel = "myapp"
+		e.Host = "myapp.tunnel.example.com"
+		e.Method = "GET"
+		e.Path = "/index.html?q=1"
+		e.Status = 200
+	} else {
+		e.Tunnel = "0.0.0.0:8080"
+	}
+	return e
+}
+
+func TestNewAccessLogger_UnknownFormat(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewAccessLogger(&bytes.Buffer{}, "xml"); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
+
+func TestAccessLogger_AutoUsesCommonForHTTP(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l, err := NewAccessLogger(&buf, AccessLogAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := testAccessLogEntry(proto.HTTP)
+	if err := l.LogAccess(e); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "203.0.113.7 - " + e.Identifier.String() + ` [10/Oct/2026:13:55:36 +0000] "GET /index.html?q=1 HTTP/1.1" 200 2326 proto=http tunnel=myapp host=myapp.tunnel.example.com bytes_in=120 duration=1.5s reason="user closed"` + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("expected\n%q\ngot\n%q", want, got)
+	}
+}
+
+func TestAccessLogger_AutoUsesJSONForTCP(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l, err := NewAccessLogger(&buf, AccessLogAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.LogAccess(testAccessLogEntry(proto.TCP)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("expected JSON line, got %q: %v", buf.String(), err)
+	}
+	want := map[string]any{
+		"remote_addr":  "203.0.113.7:51234",
+		"proto":        "tcp",
+		"tunnel":       "0.0.0.0:8080",
+		"bytes_in":     float64(120),
+		"bytes_out":    float64(2326),
+		"duration_ms":  float64(1500),
+		"close_reason": closeUser,
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, got[k])
+		}
+	}
+	if _, ok := got["method"]; ok {
+		t.Errorf("expected no method for a tcp entry, got %v", got["method"])
+	}
+}
+
+func TestAccessLogger_CommonForTCP(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l, err := NewAccessLogger(&buf, AccessLogCommon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.LogAccess(testAccessLogEntry(proto.TCP)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), `] "-" - 2326 proto=tcp tunnel=0.0.0.0:8080 bytes_in=120`) {
+		t.Fatalf("unexpected common line for tcp entry: %q", buf.String())
+	}
+}
+
+func TestAccessLogger_Client(t *testing.T) {
+	t.Parallel()
+
+	e := testAccessLogEntry(proto.TCP)
+	e.Client = "laptop"
+
+	if got := string(formatCommon(e)); !strings.Contains(got, " tunnel=0.0.0.0:8080 client=laptop bytes_in=") {
+		t.Fatalf("expected the client in the common line, got %q", got)
+	}
+
+	b, err := formatJSON(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["client"] != "laptop" {
+		t.Fatalf("expected client laptop, got %v", got["client"])
+	}
+}
+
+func TestAccessLogger_JSONForHTTP(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l, err := NewAccessLogger(&buf, AccessLogJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.LogAccess(testAccessLogEntry(proto.HTTP)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["method"] != "GET" || got["path"] != "/index.html?q=1" || got["status"] != float64(200) || got["host"] != "myapp.tunnel.example.com" {
+		t.Fatalf("unexpected http fields: %v", got)
+	}
+}
+
+func TestStatusSniffer(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	s := &statusSniffer{w: &buf}
+
+	// response line split across writes
+	for _, p := range []string{"HTTP/1.1 40", "4 Not Found\r\nContent-Length: 0\r\n\r\n", "HTTP/1.1 200 OK\r\n"} {
+		if _, err := s.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.status != 404 {
+		t.Fatalf("expected status of the first response, 404, got %d", s.status)
+	}
+	if !strings.HasPrefix(buf.String(), "HTTP/1.1 404 Not Found\r\n") || !strings.HasSuffix(buf.String(), "HTTP/1.1 200 OK\r\n") {
+		t.Fatalf("expected writes to pass through unchanged, got %q", buf.String())
+	}
+}
+
+func TestStatusSniffer_NotHTTP(t *testing.T) {
+	t.Parallel()
+
+	s := &statusSniffer{w: &bytes.Buffer{}}
+	s.Write(bytes.Repeat([]byte("x"), 2*maxStatusLine))
+
+	if s.status != 0 || !s.done {
+		t.Fatalf("expected sniffing to give up without a status, got done=%v status=%d", s.done, s.status)
+	}
+}
+
+func TestParseStatusLine(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]int{
+		"HTTP/1.1 200 OK":                  200,
+		"HTTP/1.0 101 Switching Protocols": 101,
+		"HTTP/1.1 502":                     502,
+		"HTTP/1.1 abc":                     0,
+		"SSH-2.0-OpenSSH_9.6":              0,
+		"":                                 0,
+	}
+	for line, want := range tests {
+		if got := parseStatusLine(line); got != want {
+			t.Errorf("parseStatusLine(%q) = %d, want %d", line, got, want)
+		}
+	}
+}
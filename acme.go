@@ -0,0 +1,127 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeChallengePath is the path prefix of ACME http-01 challenge requests.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// ACMEConfig lets the HTTPS listener get a certificate for each http tunnel
+// host from an ACME CA such as Let's Encrypt, on first use. The CA validates
+// the host with the tls-alpn-01 challenge on the HTTPS listener, which must
+// be reachable on port 443 of the host, or with HTTPChallenge also the
+// http-01 one.
+type ACMEConfig struct {
+	// DirectoryURL is the ACME directory URL of the CA. If empty Let's
+	// Encrypt is used.
+	DirectoryURL string
+	// Email is an optional contact address for the account with the CA.
+	Email string
+	// CacheDir is the directory the account key and certificates are
+	// stored in, so they survive restarts.
+	CacheDir string
+	// RenewBefore is how long before they expire certificates are renewed,
+	// in the background. If zero, 30 days is used.
+	RenewBefore time.Duration
+	// HTTPClient is used to talk to the CA. If nil http.DefaultClient is
+	// used.
+	HTTPClient *http.Client
+	// HTTPChallenge makes the server also answer http-01 challenges on
+	// HTTPAddr, for when it's reachable on port 80 of the host, directly or
+	// through a proxy passing on /.well-known/acme-challenge/.
+	HTTPChallenge bool
+}
+
+func (c *ACMEConfig) validate() error {
+	if c.CacheDir == "" {
+		return errors.New("missing cache dir")
+	}
+	if c.RenewBefore < 0 {
+		return errors.New("renew before must not be negative")
+	}
+	return nil
+}
+
+// newACMEManager returns the autocert.Manager for c, getting certificates
+// only for the hosts known reports.
+func newACMEManager(c *ACMEConfig, known func(host string) bool) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(c.CacheDir),
+		HostPolicy: func(_ context.Context, host string) error {
+			if !known(strings.ToLower(host)) {
+				return fmt.Errorf("no http tunnel for host %q", host)
+			}
+			return nil
+		},
+		RenewBefore: c.RenewBefore,
+		Email:       c.Email,
+		Client: &acme.Client{
+			DirectoryURL: c.DirectoryURL,
+			HTTPClient:   c.HTTPClient,
+		},
+	}
+}
+
+// enableHTTPChallenge makes the ACME manager of c, if any, also try the
+// http-01 challenge, answered on the HTTP listener, if ACMEConfig asks for
+// it.
+func (c *httpsCerts) enableHTTPChallenge() {
+	if c.acme != nil && c.config.ACME.HTTPChallenge {
+		c.httpChallenge = c.acme.HTTPHandler(http.NotFoundHandler())
+	}
+}
+
+// isHTTPChallenge reports whether req is an ACME http-01 challenge request
+// to be answered by serveHTTPChallenge.
+func (c *httpsCerts) isHTTPChallenge(req *http.Request) bool {
+	return c != nil && c.httpChallenge != nil && strings.HasPrefix(req.URL.Path, acmeChallengePath)
+}
+
+// serveHTTPChallenge answers the ACME http-01 challenge request req, read
+// off conn, and closes conn.
+func (c *httpsCerts) serveHTTPChallenge(conn net.Conn, req *http.Request) error {
+	defer conn.Close()
+
+	w := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+	c.httpChallenge.ServeHTTP(w, req)
+
+	resp := &http.Response{
+		StatusCode:    w.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          io.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Close:         true,
+	}
+	return resp.Write(conn)
+}
+
+// bufferedResponse is an http.ResponseWriter keeping the response in
+// memory, for serveHTTPChallenge.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header         { return w.header }
+func (w *bufferedResponse) Write(p []byte) (int, error) { return w.body.Write(p) }
+func (w *bufferedResponse) WriteHeader(status int)      { w.status = status }
@@ -0,0 +1,463 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tunnel "github.com/ChacheGS/go-stream-tunnel"
+	"github.com/ChacheGS/go-stream-tunnel/ca"
+	"github.com/ChacheGS/go-stream-tunnel/log"
+	"github.com/ChacheGS/go-stream-tunnel/proto"
+)
+
+// acmeIdentifierOID is the certificate extension of tls-alpn-01 challenge
+// certificates, RFC 8737.
+var acmeIdentifierOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// acmeStandIn is a minimal ACME CA, just enough of RFC 8555 for autocert to
+// get certificates, which it issues with the ca package. JWS signatures are
+// not checked. It offers a single challenge type and validates it by
+// connecting to addr instead of resolving the domain.
+type acmeStandIn struct {
+	t         *testing.T
+	srv       *httptest.Server
+	caCertPEM []byte
+	caKeyPEM  []byte
+	challenge string
+
+	mu     sync.Mutex
+	addr   string
+	orders []*acmeOrder
+	issued int
+}
+
+type acmeOrder struct {
+	domain string
+	status string
+	authz  string
+	cert   []byte
+}
+
+func newACMEStandIn(t *testing.T, challenge string) *acmeStandIn {
+	t.Helper()
+
+	caCertPEM, caKeyPEM, err := ca.GenerateCA("ACME stand-in", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &acmeStandIn{t: t, caCertPEM: caCertPEM, caKeyPEM: caKeyPEM, challenge: challenge}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", a.directory)
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /account", a.account)
+	mux.HandleFunc("POST /order", a.newOrder)
+	mux.HandleFunc("POST /order/{i}", a.withOrder(a.order))
+	mux.HandleFunc("POST /authz/{i}", a.withOrder(a.authorization))
+	mux.HandleFunc("POST /challenge/{i}", a.withOrder(a.validate))
+	mux.HandleFunc("POST /finalize/{i}", a.withOrder(a.finalize))
+	mux.HandleFunc("POST /cert/{i}", a.withOrder(a.certificate))
+
+	a.srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(a.srv.Close)
+	return a
+}
+
+func (a *acmeStandIn) config(cacheDir string) *tunnel.ACMEConfig {
+	return &tunnel.ACMEConfig{
+		DirectoryURL: a.srv.URL + "/directory",
+		CacheDir:     cacheDir,
+		HTTPClient:   a.srv.Client(),
+	}
+}
+
+// resolve makes the stand-in validate challenges on addr.
+func (a *acmeStandIn) resolve(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.addr = addr
+}
+
+func (a *acmeStandIn) issuedCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.issued
+}
+
+func (a *acmeStandIn) roots() *x509.CertPool {
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(a.caCertPEM)
+	return roots
+}
+
+func (a *acmeStandIn) url(format string, args ...any) string {
+	return a.srv.URL + fmt.Sprintf(format, args...)
+}
+
+func (a *acmeStandIn) directory(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"newNonce":   a.url("/nonce"),
+		"newAccount": a.url("/account"),
+		"newOrder":   a.url("/order"),
+		"meta":       map[string]any{"termsOfService": a.url("/terms")},
+	})
+}
+
+func (a *acmeStandIn) account(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Location", a.url("/account/1"))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"status": "valid"})
+}
+
+func (a *acmeStandIn) newOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Identifiers []struct{ Value string }
+	}
+	if err := decodeJWSPayload(r, &req); err != nil || len(req.Identifiers) != 1 {
+		http.Error(w, "expected one identifier", http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	o := &acmeOrder{domain: req.Identifiers[0].Value, status: "pending", authz: "pending"}
+	a.orders = append(a.orders, o)
+	i := len(a.orders) - 1
+	a.mu.Unlock()
+
+	w.Header().Set("Location", a.url("/order/%d", i))
+	w.WriteHeader(http.StatusCreated)
+	a.writeOrder(w, o, i)
+}
+
+// withOrder looks up the order of the {i} path value for h, which is called
+// with a.mu held.
+func (a *acmeStandIn) withOrder(h func(http.ResponseWriter, *http.Request, *acmeOrder, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		i, err := strconv.Atoi(r.PathValue("i"))
+		if err != nil || i < 0 || i >= len(a.orders) {
+			http.Error(w, "no such order", http.StatusNotFound)
+			return
+		}
+		h(w, r, a.orders[i], i)
+	}
+}
+
+func (a *acmeStandIn) writeOrder(w http.ResponseWriter, o *acmeOrder, i int) {
+	resp := map[string]any{
+		"status":         o.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.domain}},
+		"authorizations": []string{a.url("/authz/%d", i)},
+		"finalize":       a.url("/finalize/%d", i),
+	}
+	if o.cert != nil {
+		resp["certificate"] = a.url("/cert/%d", i)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (a *acmeStandIn) order(w http.ResponseWriter, r *http.Request, o *acmeOrder, i int) {
+	a.writeOrder(w, o, i)
+}
+
+func (a *acmeStandIn) token(i int) string {
+	return "token-" + strconv.Itoa(i)
+}
+
+func (a *acmeStandIn) writeChallenge(w http.ResponseWriter, o *acmeOrder, i int) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"type":   a.challenge,
+		"url":    a.url("/challenge/%d", i),
+		"token":  a.token(i),
+		"status": o.authz,
+	})
+}
+
+func (a *acmeStandIn) authorization(w http.ResponseWriter, r *http.Request, o *acmeOrder, i int) {
+	var req struct{ Status string }
+	decodeJWSPayload(r, &req)
+	if req.Status == "deactivated" {
+		o.authz = req.Status
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     o.authz,
+		"identifier": map[string]string{"type": "dns", "value": o.domain},
+		"challenges": []map[string]string{{
+			"type":   a.challenge,
+			"url":    a.url("/challenge/%d", i),
+			"token":  a.token(i),
+			"status": o.authz,
+		}},
+	})
+}
+
+func (a *acmeStandIn) validate(w http.ResponseWriter, r *http.Request, o *acmeOrder, i int) {
+	var err error
+	switch a.challenge {
+	case "tls-alpn-01":
+		err = a.validateALPN(o.domain)
+	case "http-01":
+		err = a.validateHTTP(o.domain, a.token(i))
+	}
+	if err != nil {
+		a.t.Logf("ACME stand-in: %s for %s failed: %s", a.challenge, o.domain, err)
+		o.authz, o.status = "invalid", "invalid"
+	} else {
+		o.authz, o.status = "valid", "ready"
+	}
+
+	a.writeChallenge(w, o, i)
+}
+
+func (a *acmeStandIn) validateALPN(domain string) error {
+	conn, err := tls.Dial("tcp", a.addr, &tls.Config{
+		ServerName:         domain,
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "acme-tls/1" {
+		return fmt.Errorf("negotiated %q", state.NegotiatedProtocol)
+	}
+	leaf := state.PeerCertificates[0]
+	if err := leaf.VerifyHostname(domain); err != nil {
+		return err
+	}
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(acmeIdentifierOID) {
+			return nil
+		}
+	}
+	return errors.New("no acmeIdentifier extension")
+}
+
+func (a *acmeStandIn) validateHTTP(domain, token string) error {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, a.addr)
+		},
+	}}
+	resp, err := client.Get("http://" + domain + "/.well-known/acme-challenge/" + token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), token+".") {
+		return fmt.Errorf("unexpected response %s %q", resp.Status, body)
+	}
+	return nil
+}
+
+func (a *acmeStandIn) finalize(w http.ResponseWriter, r *http.Request, o *acmeOrder, i int) {
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := decodeJWSPayload(r, &req); err != nil || o.status != "ready" {
+		http.Error(w, "order not ready", http.StatusForbidden)
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	certPEM, err := ca.IssueCertForKey(a.caCertPEM, a.caKeyPEM, o.domain, []string{o.domain}, csr.PublicKey, time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	o.cert = append(certPEM, a.caCertPEM...)
+	o.status = "valid"
+	a.issued++
+
+	w.Header().Set("Location", a.url("/order/%d", i))
+	a.writeOrder(w, o, i)
+}
+
+func (a *acmeStandIn) certificate(w http.ResponseWriter, r *http.Request, o *acmeOrder, i int) {
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(o.cert)
+}
+
+// decodeJWSPayload decodes the payload of the JWS request body into v,
+// without checking the signature.
+func decodeJWSPayload(r *http.Request, v any) error {
+	var jws struct{ Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func TestNewServer_ACMEHTTPChallengeRequiresHTTPAddr(t *testing.T) {
+	_, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:       "127.0.0.1:0",
+		TLSConfig:  tlsConfig(),
+		BaseDomain: "tunnel.example.com",
+		HTTPS: &tunnel.HTTPSConfig{
+			Addr: "127.0.0.1:0",
+			ACME: &tunnel.ACMEConfig{CacheDir: t.TempDir(), HTTPChallenge: true},
+		},
+	})
+	if err == nil {
+		t.Fatal("expected error for the http-01 challenge without HTTPAddr")
+	}
+}
+
+func TestIntegration_ACME(t *testing.T) {
+	for _, challenge := range []string{"tls-alpn-01", "http-01"} {
+		t.Run(challenge, func(t *testing.T) {
+			testACME(t, challenge)
+		})
+	}
+}
+
+func testACME(t *testing.T, challenge string) {
+	standIn := newACMEStandIn(t, challenge)
+	cacheDir := t.TempDir()
+	acmeConfig := standIn.config(cacheDir)
+	acmeConfig.HTTPChallenge = challenge == "http-01"
+
+	startServer := func() *tunnel.Server {
+		s, err := tunnel.NewServer(&tunnel.ServerConfig{
+			Addr:          ":0",
+			AutoSubscribe: true,
+			TLSConfig:     tlsConfig(),
+			Logger:        log.NewStdLogger(),
+			BaseDomain:    "tunnel.example.com",
+			HTTPAddr:      "127.0.0.1:0",
+			HTTPS: &tunnel.HTTPSConfig{
+				Addr: "127.0.0.1:0",
+				ACME: acmeConfig,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Start(context.Background())
+
+		// The HTTPS listener is opened last.
+		waitListening(t, s.HTTPSAddr, 5*time.Second)
+		if challenge == "http-01" {
+			standIn.resolve(s.HTTPAddr())
+		} else {
+			standIn.resolve(s.HTTPSAddr())
+		}
+
+		c, err := tunnel.NewClient(&tunnel.ClientConfig{
+			ServerAddr:      s.Addr(),
+			TLSClientConfig: tlsConfig(),
+			Tunnels: map[string]*proto.Tunnel{
+				"myapp": {Protocol: proto.HTTP, Host: "myapp"},
+			},
+			Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+				Stream: tunnel.NewMultiStreamProxy(map[string]string{
+					"myapp": serveIdentity(t, "myapp"),
+				}, log.NewStdLogger()).Proxy,
+			}),
+			Logger: log.NewStdLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go c.Start(ctx)
+
+		waitConnected(t, c, 5*time.Second)
+		return s
+	}
+
+	request := func(s *tunnel.Server) {
+		conn, err := tls.Dial("tcp", s.HTTPSAddr(), &tls.Config{
+			ServerName: "myapp.tunnel.example.com",
+			RootCAs:    standIn.roots(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if body := doRequest(t, conn, "myapp.tunnel.example.com"); body != "myapp" {
+			t.Fatalf("expected %q, got %q", "myapp", body)
+		}
+	}
+
+	s := startServer()
+	request(s)
+	if n := standIn.issuedCount(); n != 1 {
+		t.Fatalf("expected 1 certificate to be issued, got %d", n)
+	}
+
+	// no certificate for a host without a tunnel
+	if _, err := tls.Dial("tcp", s.HTTPSAddr(), &tls.Config{
+		ServerName: "other.tunnel.example.com",
+		RootCAs:    standIn.roots(),
+	}); err == nil {
+		t.Fatal("expected handshake for a host without a tunnel to fail")
+	}
+	s.Stop()
+
+	if _, err := os.Stat(filepath.Join(cacheDir, "myapp.tunnel.example.com")); err != nil {
+		t.Fatalf("expected the certificate to be cached: %s", err)
+	}
+
+	// a restarted server uses the cached certificate
+	s = startServer()
+	defer s.Stop()
+	request(s)
+	if n := standIn.issuedCount(); n != 1 {
+		t.Fatalf("expected the cached certificate to be used, got %d issued", n)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// RevokeCert adds certPEM to the CA's certificate revocation list and
+// returns the re-signed CRL, PEM-encoded. crlPEM is the current CRL, as
+// returned by a previous RevokeCert, or nil if nothing was revoked yet. The
+// new CRL keeps every earlier entry, bumps the CRL number and is valid for
+// the given duration starting now.
+func RevokeCert(caCertPEM, caKeyPEM, crlPEM, certPEM []byte, validity time.Duration) ([]byte, error) {
+	cert, err := CheckIssued(caCertPEM, certPEM)
+	if err != nil {
+		return nil, err
+	}
+	return RevokeSerials(caCertPEM, caKeyPEM, crlPEM, []*big.Int{cert.SerialNumber}, validity)
+}
+
+// CheckIssued parses the PEM-encoded certificate certPEM and checks it was
+// issued by the CA in caCertPEM.
+func CheckIssued(caCertPEM, certPEM []byte) (*x509.Certificate, error) {
+	caBlock, _ := pem.Decode(caCertPEM)
+	if caBlock == nil {
+		return nil, fmt.Errorf("failed to decode CA certificate PEM")
+	}
+	caCert, err := x509.ParseCertificate(caBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %s", err)
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("failed to decode certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %s", err)
+	}
+	if err := cert.CheckSignatureFrom(caCert); err != nil {
+		return nil, fmt.Errorf("certificate was not issued by this CA: %s", err)
+	}
+	return cert, nil
+}
+
+// RevokeSerials is RevokeCert for the certificates with the given serials,
+// as recorded in the CA's index, at once. The serials aren't checked
+// against the certificates the CA issued.
+func RevokeSerials(caCertPEM, caKeyPEM, crlPEM []byte, serials []*big.Int, validity time.Duration) ([]byte, error) {
+	caCert, caKey, err := parseCAKeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if len(serials) == 0 {
+		return nil, fmt.Errorf("no certificate to revoke")
+	}
+
+	template := &x509.RevocationList{Number: big.NewInt(1)}
+
+	if len(crlPEM) > 0 {
+		prev, err := ParseCRL(caCertPEM, crlPEM)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range prev.RevokedCertificateEntries {
+			for _, serial := range serials {
+				if e.SerialNumber.Cmp(serial) == 0 {
+					return nil, fmt.Errorf("certificate with serial %s is already revoked", serial)
+				}
+			}
+		}
+		template.RevokedCertificateEntries = prev.RevokedCertificateEntries
+		if prev.Number != nil {
+			template.Number = new(big.Int).Add(prev.Number, big.NewInt(1))
+		}
+	}
+
+	now := time.Now()
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: now,
+		})
+	}
+	template.ThisUpdate = now
+	template.NextUpdate = now.Add(validity)
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, template, caCert, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CRL: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), nil
+}
+
+// ParseCRL decodes a PEM-encoded CRL and checks it was signed by the CA in
+// caCertPEM.
+func ParseCRL(caCertPEM, crlPEM []byte) (*x509.RevocationList, error) {
+	caBlock, _ := pem.Decode(caCertPEM)
+	if caBlock == nil {
+		return nil, fmt.Errorf("failed to decode CA certificate PEM")
+	}
+	caCert, err := x509.ParseCertificate(caBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %s", err)
+	}
+
+	block, _ := pem.Decode(crlPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode CRL PEM")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CRL: %s", err)
+	}
+	if err := crl.CheckSignatureFrom(caCert); err != nil {
+		return nil, fmt.Errorf("CRL was not signed by this CA: %s", err)
+	}
+
+	return crl, nil
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseCertPEM(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func serialOf(t *testing.T, certPEM []byte) string {
+	t.Helper()
+
+	return parseCertPEM(t, certPEM).SerialNumber.String()
+}
+
+func TestRevokeCert(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, _, err := IssueCert(caCertPEM, caKeyPEM, "laptop", nil, ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, _, err := IssueCert(caCertPEM, caKeyPEM, "phone", nil, ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crlPEM, err := RevokeCert(caCertPEM, caKeyPEM, nil, laptop, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlPEM, err = RevokeCert(caCertPEM, caKeyPEM, crlPEM, phone, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crl, err := ParseCRL(caCertPEM, crlPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 2 {
+		t.Fatalf("expected 2 revoked certificates, got %d", len(crl.RevokedCertificateEntries))
+	}
+	if s := crl.RevokedCertificateEntries[0].SerialNumber.String(); s != serialOf(t, laptop) {
+		t.Fatalf("expected the first revocation to be kept, got serial %s", s)
+	}
+	if s := crl.RevokedCertificateEntries[1].SerialNumber.String(); s != serialOf(t, phone) {
+		t.Fatalf("expected serial %s, got %s", serialOf(t, phone), s)
+	}
+	if crl.Number.Int64() != 2 {
+		t.Fatalf("expected CRL number 2, got %s", crl.Number)
+	}
+	if !crl.NextUpdate.After(time.Now()) {
+		t.Fatalf("expected NextUpdate in the future, got %v", crl.NextUpdate)
+	}
+
+	if _, err := RevokeCert(caCertPEM, caKeyPEM, crlPEM, laptop, time.Hour); err == nil || !strings.Contains(err.Error(), "already revoked") {
+		t.Fatalf("expected already revoked error, got %v", err)
+	}
+}
+
+func TestRevokeSerials(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, _, err := IssueCert(caCertPEM, caKeyPEM, "laptop", nil, ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := RenewCert(caCertPEM, caKeyPEM, laptop, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var serials []*big.Int
+	for _, certPEM := range [][]byte{laptop, renewed} {
+		e, err := NewIndexEntry(certPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serials = append(serials, e.Serial)
+	}
+	crlPEM, err := RevokeSerials(caCertPEM, caKeyPEM, nil, serials, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := ParseCRL(caCertPEM, crlPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 2 || crl.Number.Int64() != 1 {
+		t.Fatalf("expected both serials in CRL number 1, got %d in %s", len(crl.RevokedCertificateEntries), crl.Number)
+	}
+
+	if _, err := RevokeSerials(caCertPEM, caKeyPEM, crlPEM, serials[1:], time.Hour); err == nil || !strings.Contains(err.Error(), "already revoked") {
+		t.Fatalf("expected already revoked error, got %v", err)
+	}
+	if _, err := RevokeSerials(caCertPEM, caKeyPEM, crlPEM, nil, time.Hour); err == nil {
+		t.Fatal("expected error revoking nothing")
+	}
+}
+
+func TestRevokeCert_ForeignCert(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCertPEM, otherKeyPEM, err := GenerateCA("other CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, _, err := IssueCert(otherCertPEM, otherKeyPEM, "laptop", nil, ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RevokeCert(caCertPEM, caKeyPEM, nil, foreign, time.Hour); err == nil {
+		t.Fatal("expected error revoking a certificate of another CA")
+	}
+}
+
+func TestParseCRL_WrongCA(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCertPEM, _, err := GenerateCA("other CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, _, err := IssueCert(caCertPEM, caKeyPEM, "laptop", nil, ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlPEM, err := RevokeCert(caCertPEM, caKeyPEM, nil, laptop, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseCRL(otherCertPEM, crlPEM); err == nil {
+		t.Fatal("expected error for a CRL signed by another CA")
+	}
+	if _, err := ParseCRL(caCertPEM, []byte("garbage")); err == nil {
+		t.Fatal("expected error for invalid PEM")
+	}
+}
@@ -20,16 +20,16 @@ import (
 func TestIssuedCertsCompleteRealHandshake(t *testing.T) {
 	t.Parallel()
 
-	caCertPEM, caKeyPEM, err := GenerateCA("test CA", 24*time.Hour)
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	serverCertPEM, serverKeyPEM, err := IssueCert(caCertPEM, caKeyPEM, "server", []string{"127.0.0.1"}, time.Hour)
+	serverCertPEM, serverKeyPEM, err := IssueCert(caCertPEM, caKeyPEM, "server", []string{"127.0.0.1"}, ECDSAP256, time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
-	clientCertPEM, clientKeyPEM, err := IssueCert(caCertPEM, caKeyPEM, "client", nil, time.Hour)
+	clientCertPEM, clientKeyPEM, err := IssueCert(caCertPEM, caKeyPEM, "client", nil, ECDSAP256, time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,234 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+)
+
+// indexTimeFormat is the timestamp format of the index, as in OpenSSL's
+// index.txt but with a four digit year.
+const indexTimeFormat = "20060102150405Z"
+
+// Certificate statuses as written to the index. Expiry isn't recorded, it's
+// derived from NotAfter whenever the index is read.
+const (
+	StatusValid   = "valid"
+	StatusRevoked = "revoked"
+	StatusExpired = "expired"
+)
+
+// IndexEntry records one certificate issued by the CA.
+type IndexEntry struct {
+	Name      string
+	Serial    *big.Int
+	SANs      []string
+	NotAfter  time.Time
+	RevokedAt time.Time // zero unless revoked
+	ID        id.ID
+	// SPKIID is the certificate's ID in id.ModeSPKI. It's zero for entries
+	// recorded before the index kept it.
+	SPKIID id.ID
+}
+
+// Status returns StatusRevoked, StatusExpired or StatusValid as of now.
+func (e *IndexEntry) Status(now time.Time) string {
+	switch {
+	case !e.RevokedAt.IsZero():
+		return StatusRevoked
+	case now.After(e.NotAfter):
+		return StatusExpired
+	}
+	return StatusValid
+}
+
+// Index is the CA's record of every certificate it issued, in issue order.
+// Its text form is modelled on OpenSSL's index.txt: one tab-separated line
+// per certificate holding the status (V or R), expiry, revocation time,
+// hex serial, name, comma-separated SANs, client ID and SPKI client ID.
+// Lines without the last field, as written by older versions, are accepted.
+type Index []*IndexEntry
+
+// NewIndexEntry describes the PEM-encoded certificate certPEM for the
+// index.
+func NewIndexEntry(certPEM []byte) (*IndexEntry, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %s", err)
+	}
+
+	e := &IndexEntry{
+		Name:     cert.Subject.CommonName,
+		Serial:   cert.SerialNumber,
+		SANs:     append([]string(nil), cert.DNSNames...),
+		NotAfter: cert.NotAfter,
+		ID:       id.FromCert(cert, id.ModeCert),
+		SPKIID:   id.FromCert(cert, id.ModeSPKI),
+	}
+	for _, ip := range cert.IPAddresses {
+		e.SANs = append(e.SANs, ip.String())
+	}
+	for _, u := range cert.URIs {
+		e.SANs = append(e.SANs, u.String())
+	}
+
+	return e, nil
+}
+
+// ParseIndex parses the text form of an index. Empty data is an empty
+// index.
+func ParseIndex(data []byte) (Index, error) {
+	var idx Index
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 && len(fields) != 8 {
+			return nil, fmt.Errorf("line %d: expected 8 fields, got %d", n, len(fields))
+		}
+
+		e := &IndexEntry{Name: fields[4]}
+
+		var err error
+		if e.NotAfter, err = time.Parse(indexTimeFormat, fields[1]); err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry: %s", n, err)
+		}
+
+		switch fields[0] {
+		case "V":
+		case "R":
+			if e.RevokedAt, err = time.Parse(indexTimeFormat, fields[2]); err != nil {
+				return nil, fmt.Errorf("line %d: invalid revocation time: %s", n, err)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: invalid status %q", n, fields[0])
+		}
+
+		var ok bool
+		if e.Serial, ok = new(big.Int).SetString(fields[3], 16); !ok {
+			return nil, fmt.Errorf("line %d: invalid serial %q", n, fields[3])
+		}
+		if fields[5] != "" {
+			e.SANs = strings.Split(fields[5], ",")
+		}
+		if err := e.ID.UnmarshalText([]byte(fields[6])); err != nil {
+			return nil, fmt.Errorf("line %d: invalid client ID: %s", n, err)
+		}
+		if len(fields) == 8 && fields[7] != "" {
+			if err := e.SPKIID.UnmarshalText([]byte(fields[7])); err != nil {
+				return nil, fmt.Errorf("line %d: invalid SPKI client ID: %s", n, err)
+			}
+		}
+
+		idx = append(idx, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// Marshal returns the text form of the index.
+func (idx Index) Marshal() []byte {
+	var b bytes.Buffer
+	for _, e := range idx {
+		status, revoked := "V", ""
+		if !e.RevokedAt.IsZero() {
+			status, revoked = "R", e.RevokedAt.UTC().Format(indexTimeFormat)
+		}
+		spkiID := ""
+		if e.SPKIID != (id.ID{}) {
+			spkiID = e.SPKIID.String()
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%X\t%s\t%s\t%s\t%s\n",
+			status,
+			e.NotAfter.UTC().Format(indexTimeFormat),
+			revoked,
+			e.Serial,
+			e.Name,
+			strings.Join(e.SANs, ","),
+			e.ID,
+			spkiID,
+		)
+	}
+	return b.Bytes()
+}
+
+// Add appends e, refusing a name that would break the line format and a
+// serial that is already recorded.
+func (idx *Index) Add(e *IndexEntry) error {
+	if strings.ContainsAny(e.Name, "\t\r\n") {
+		return fmt.Errorf("name %q contains tabs or line breaks", e.Name)
+	}
+	if idx.Lookup(e.Serial) != nil {
+		return fmt.Errorf("serial %X is already in the index", e.Serial)
+	}
+	*idx = append(*idx, e)
+	return nil
+}
+
+// Lookup returns the entry with the given serial, or nil.
+func (idx Index) Lookup(serial *big.Int) *IndexEntry {
+	for _, e := range idx {
+		if e.Serial.Cmp(serial) == 0 {
+			return e
+		}
+	}
+	return nil
+}
+
+// Find returns every entry issued under name, oldest first.
+func (idx Index) Find(name string) []*IndexEntry {
+	var found []*IndexEntry
+	for _, e := range idx {
+		if e.Name == name {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// ClientIDs returns the IDs in the given mode of every certificate that is
+// valid as of now, comma-separated for the server's -client-ids flag.
+// Entries without a recorded SPKI ID are skipped in id.ModeSPKI. Renewals
+// share an SPKI ID, which is listed once.
+func (idx Index) ClientIDs(now time.Time, mode id.Mode) string {
+	var ids []string
+	seen := make(map[id.ID]bool)
+	for _, e := range idx {
+		if e.Status(now) != StatusValid {
+			continue
+		}
+		identifier := e.ID
+		if mode == id.ModeSPKI {
+			identifier = e.SPKIID
+		}
+		if identifier == (id.ID{}) || seen[identifier] {
+			continue
+		}
+		seen[identifier] = true
+		ids = append(ids, identifier.String())
+	}
+	return strings.Join(ids, ",")
+}
@@ -0,0 +1,175 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+)
+
+func TestNewIndexEntry(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, _, err := IssueCert(caCertPEM, caKeyPEM, "server", []string{"tunnel.example.com", "192.0.2.1"}, ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewIndexEntry(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := parseCertPEM(t, certPEM)
+	if e.Name != "server" {
+		t.Fatalf("expected name server, got %q", e.Name)
+	}
+	if e.Serial.Cmp(cert.SerialNumber) != 0 {
+		t.Fatalf("expected serial %s, got %s", cert.SerialNumber, e.Serial)
+	}
+	if strings.Join(e.SANs, ",") != "tunnel.example.com,192.0.2.1" {
+		t.Fatalf("unexpected SANs %v", e.SANs)
+	}
+	if !e.NotAfter.Equal(cert.NotAfter) {
+		t.Fatalf("expected expiry %v, got %v", cert.NotAfter, e.NotAfter)
+	}
+	if e.ID != id.New(cert.Raw) {
+		t.Fatalf("expected client ID %s, got %s", id.New(cert.Raw), e.ID)
+	}
+	if e.SPKIID != id.New(cert.RawSubjectPublicKeyInfo) {
+		t.Fatalf("expected SPKI client ID %s, got %s", id.New(cert.RawSubjectPublicKeyInfo), e.SPKIID)
+	}
+}
+
+func TestIndex_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	expiry := time.Date(2036, 10, 16, 12, 0, 0, 0, time.UTC)
+	var idx Index
+	for _, e := range []*IndexEntry{
+		{Name: "server", Serial: big.NewInt(0xABC), SANs: []string{"tunnel.example.com"}, NotAfter: expiry, ID: id.New([]byte("server")), SPKIID: id.New([]byte("server key"))},
+		{Name: "laptop", Serial: big.NewInt(0xDEF), NotAfter: expiry, RevokedAt: expiry.Add(-time.Hour), ID: id.New([]byte("laptop"))},
+	} {
+		if err := idx.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := idx.Marshal()
+	if !strings.HasPrefix(string(data), "V\t20361016120000Z\t\tABC\tserver\ttunnel.example.com\t") {
+		t.Fatalf("unexpected index line: %q", data)
+	}
+
+	parsed, err := ParseIndex(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(parsed))
+	}
+	for i, e := range parsed {
+		want := idx[i]
+		if e.Name != want.Name || e.Serial.Cmp(want.Serial) != 0 || !e.NotAfter.Equal(want.NotAfter) ||
+			!e.RevokedAt.Equal(want.RevokedAt) || e.ID != want.ID || e.SPKIID != want.SPKIID || strings.Join(e.SANs, ",") != strings.Join(want.SANs, ",") {
+			t.Fatalf("entry %d: expected %+v, got %+v", i, want, e)
+		}
+	}
+}
+
+func TestParseIndex_WithoutSPKIID(t *testing.T) {
+	t.Parallel()
+
+	clientID := id.New([]byte("laptop"))
+	idx, err := ParseIndex([]byte("V\t20361016120000Z\t\tABC\tlaptop\t\t" + clientID.String() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx) != 1 || idx[0].ID != clientID || idx[0].SPKIID != (id.ID{}) {
+		t.Fatalf("expected one entry without SPKI ID, got %+v", idx)
+	}
+	if ids := idx.ClientIDs(time.Now(), id.ModeSPKI); ids != "" {
+		t.Fatalf("expected no SPKI IDs, got %q", ids)
+	}
+}
+
+func TestIndex_Add(t *testing.T) {
+	t.Parallel()
+
+	var idx Index
+	if err := idx.Add(&IndexEntry{Name: "laptop", Serial: big.NewInt(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Add(&IndexEntry{Name: "other", Serial: big.NewInt(1)}); err == nil {
+		t.Fatal("expected error for a duplicate serial")
+	}
+	if err := idx.Add(&IndexEntry{Name: "bad\tname", Serial: big.NewInt(2)}); err == nil {
+		t.Fatal("expected error for a name with a tab")
+	}
+}
+
+func TestIndex_StatusAndClientIDs(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	key := id.New([]byte("laptop key"))
+	valid := &IndexEntry{Name: "laptop", Serial: big.NewInt(1), NotAfter: now.Add(time.Hour), ID: id.New([]byte("laptop")), SPKIID: key}
+	renewed := &IndexEntry{Name: "laptop", Serial: big.NewInt(4), NotAfter: now.Add(2 * time.Hour), ID: id.New([]byte("renewed")), SPKIID: key}
+	revoked := &IndexEntry{Name: "phone", Serial: big.NewInt(2), NotAfter: now.Add(time.Hour), RevokedAt: now, ID: id.New([]byte("phone"))}
+	expired := &IndexEntry{Name: "laptop", Serial: big.NewInt(3), NotAfter: now.Add(-time.Hour), ID: id.New([]byte("old"))}
+	idx := Index{valid, revoked, expired, renewed}
+
+	if s := valid.Status(now); s != StatusValid {
+		t.Fatalf("expected %s, got %s", StatusValid, s)
+	}
+	if s := revoked.Status(now); s != StatusRevoked {
+		t.Fatalf("expected %s, got %s", StatusRevoked, s)
+	}
+	if s := expired.Status(now); s != StatusExpired {
+		t.Fatalf("expected %s, got %s", StatusExpired, s)
+	}
+
+	if ids, want := idx.ClientIDs(now, id.ModeCert), valid.ID.String()+","+renewed.ID.String(); ids != want {
+		t.Fatalf("expected only the valid IDs %q, got %q", want, ids)
+	}
+	if ids := idx.ClientIDs(now, id.ModeSPKI); ids != key.String() {
+		t.Fatalf("expected the shared SPKI ID once, got %q", ids)
+	}
+	if found := idx.Find("laptop"); len(found) != 3 || found[0] != valid || found[1] != expired || found[2] != renewed {
+		t.Fatalf("expected all laptop entries, got %v", found)
+	}
+	if e := idx.Lookup(big.NewInt(2)); e != revoked {
+		t.Fatalf("expected lookup by serial to find phone, got %v", e)
+	}
+}
+
+func TestParseIndex_Invalid(t *testing.T) {
+	t.Parallel()
+
+	for _, line := range []string{
+		"V\t20361016120000Z\t\tABC\tlaptop\t",
+		"X\t20361016120000Z\t\tABC\tlaptop\t\t" + id.New(nil).String(),
+		"V\tnever\t\tABC\tlaptop\t\t" + id.New(nil).String(),
+		"R\t20361016120000Z\t\tABC\tlaptop\t\t" + id.New(nil).String(),
+		"V\t20361016120000Z\t\tXYZ\tlaptop\t\t" + id.New(nil).String(),
+		"V\t20361016120000Z\t\tABC\tlaptop\t\tnot-an-id",
+		"V\t20361016120000Z\t\tABC\tlaptop\t\t" + id.New(nil).String() + "\tnot-an-id",
+	} {
+		if _, err := ParseIndex([]byte(line + "\n")); err == nil {
+			t.Errorf("expected error parsing %q", line)
+		}
+	}
+
+	if idx, err := ParseIndex(nil); err != nil || len(idx) != 0 {
+		t.Fatalf("expected an empty index, got %v, %v", idx, err)
+	}
+}
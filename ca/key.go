@@ -0,0 +1,117 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// KeyType is the algorithm of a generated key.
+type KeyType string
+
+const (
+	ECDSAP256 KeyType = "ecdsa-p256"
+	ECDSAP384 KeyType = "ecdsa-p384"
+	Ed25519   KeyType = "ed25519"
+	RSA2048   KeyType = "rsa-2048"
+	RSA3072   KeyType = "rsa-3072"
+)
+
+// KeyTypes are the supported key types, the default first.
+var KeyTypes = []KeyType{ECDSAP256, ECDSAP384, Ed25519, RSA2048, RSA3072}
+
+// ParseKeyType parses a key type as given on the command line. An empty
+// string is ECDSAP256.
+func ParseKeyType(s string) (KeyType, error) {
+	if s == "" {
+		return ECDSAP256, nil
+	}
+	for _, t := range KeyTypes {
+		if KeyType(s) == t {
+			return t, nil
+		}
+	}
+
+	names := make([]string, len(KeyTypes))
+	for i, t := range KeyTypes {
+		names[i] = string(t)
+	}
+	return "", fmt.Errorf("unknown key type %q, expected one of %s", s, strings.Join(names, ", "))
+}
+
+// GenerateKey generates a keypair of the given type and returns it along
+// with the PEM-encoded PKCS#8 private key.
+func GenerateKey(keyType KeyType) (crypto.Signer, []byte, error) {
+	var (
+		key crypto.Signer
+		err error
+	)
+	switch keyType {
+	case ECDSAP256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAP384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case Ed25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case RSA2048:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case RSA3072:
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate %s key: %s", keyType, err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal key: %s", err)
+	}
+
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// parsePrivateKey parses a PEM-encoded PKCS#8 private key, or an SEC 1 EC
+// or PKCS#1 RSA one as written by earlier versions and other tools.
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode key PEM")
+	}
+
+	var (
+		key any
+		err error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported key PEM type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
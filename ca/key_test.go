@@ -0,0 +1,135 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func TestParseKeyType(t *testing.T) {
+	t.Parallel()
+
+	if kt, err := ParseKeyType(""); err != nil || kt != ECDSAP256 {
+		t.Fatalf("expected the default ecdsa-p256, got %q, %v", kt, err)
+	}
+	for _, want := range KeyTypes {
+		if kt, err := ParseKeyType(string(want)); err != nil || kt != want {
+			t.Fatalf("expected %q, got %q, %v", want, kt, err)
+		}
+	}
+	if _, err := ParseKeyType("dsa"); err == nil {
+		t.Fatal("expected error for an unknown key type")
+	}
+}
+
+func TestKeyTypes_IssueAndVerify(t *testing.T) {
+	t.Parallel()
+
+	for _, keyType := range KeyTypes {
+		t.Run(string(keyType), func(t *testing.T) {
+			t.Parallel()
+
+			caCertPEM, caKeyPEM, err := GenerateCA("test CA", keyType, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block, _ := pem.Decode(caKeyPEM); block == nil || block.Type != "PRIVATE KEY" {
+				t.Fatal("expected a PKCS#8 CA key")
+			}
+
+			certPEM, keyPEM, err := IssueCert(caCertPEM, caKeyPEM, "laptop", nil, keyType, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+				t.Fatalf("expected a usable TLS key pair: %v", err)
+			}
+
+			roots := x509.NewCertPool()
+			roots.AppendCertsFromPEM(caCertPEM)
+			leaf := parseCertPEM(t, certPEM)
+			if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+				t.Fatalf("expected the leaf to verify against the CA: %v", err)
+			}
+			_, isRSA := leaf.PublicKey.(*rsa.PublicKey)
+			if got := leaf.KeyUsage&x509.KeyUsageKeyEncipherment != 0; got != isRSA {
+				t.Fatalf("expected KeyUsageKeyEncipherment only for RSA keys, got %v", got)
+			}
+		})
+	}
+}
+
+func TestParseCAKeyPair_LegacyKeys(t *testing.T) {
+	t.Parallel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tt := range map[string]struct {
+		key    crypto.Signer
+		keyPEM []byte
+	}{
+		"SEC 1":   {ecKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})},
+		"PKCS #1": {rsaKey, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})},
+	} {
+		serial, err := randomSerial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          serial,
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, tt.key.Public(), tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caCertPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+		if _, _, err := IssueCert(caCertPEM, tt.keyPEM, "laptop", nil, ECDSAP256, time.Hour); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestParseCAKeyPair_MismatchedKey(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, _, err := GenerateCA("test CA", ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKeyPEM, err := GenerateCA("other CA", ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := IssueCert(caCertPEM, otherKeyPEM, "laptop", nil, ECDSAP256, time.Hour); err == nil {
+		t.Fatal("expected error for a CA key that doesn't match the certificate")
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PermissionScheme is the scheme of the URI SANs permissions are encoded
+// in, as in "go-stream-tunnel:allow-port:8000-8100".
+const PermissionScheme = "go-stream-tunnel"
+
+const (
+	permAllowPort      = "allow-port"
+	permAllowSubdomain = "allow-subdomain"
+)
+
+// subdomainPatternRE matches a subdomain pattern: a DNS label that may hold
+// the path.Match wildcards * and ?.
+var subdomainPatternRE = regexp.MustCompile(`^[a-z0-9*?]([a-z0-9*?-]{0,61}[a-z0-9*?])?$`)
+
+// Permissions limit the tunnels a client may open to what its certificate
+// allows. They are carried in the certificate as URI SANs, so issuing a
+// certificate also defines what the client may expose. A certificate
+// carrying permissions may only open tcp tunnels on Ports and http tunnels
+// on Subdomains; one without any is not limited.
+type Permissions struct {
+	Ports []PortRange
+	// Subdomains are path.Match patterns, e.g. "alice-*".
+	Subdomains []string
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First, Last int
+}
+
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(r.First)
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// ParsePortRanges parses a comma-separated list of ports and port ranges,
+// e.g. "8000-8100,9000".
+func ParsePortRanges(s string) ([]PortRange, error) {
+	var ranges []PortRange
+	for part := range strings.SplitSeq(s, ",") {
+		r, err := parsePortRange(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+
+	var (
+		r   PortRange
+		err error
+	)
+	if r.First, err = strconv.Atoi(first); err != nil || r.First < 1 || r.First > 65535 {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	if r.Last, err = strconv.Atoi(last); err != nil || r.Last < r.First || r.Last > 65535 {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return r, nil
+}
+
+// ValidSubdomainPattern reports whether pattern is a valid entry of
+// Permissions.Subdomains.
+func ValidSubdomainPattern(pattern string) bool {
+	if !subdomainPatternRE.MatchString(pattern) {
+		return false
+	}
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+// SANs returns the URI SANs encoding p, for IssueCert.
+func (p *Permissions) SANs() []string {
+	var sans []string
+	for _, r := range p.Ports {
+		sans = append(sans, PermissionScheme+":"+permAllowPort+":"+r.String())
+	}
+	for _, pattern := range p.Subdomains {
+		sans = append(sans, PermissionScheme+":"+permAllowSubdomain+":"+pattern)
+	}
+	return sans
+}
+
+// isPermissionSAN reports whether san is meant to encode a permission.
+func isPermissionSAN(san string) bool {
+	return strings.HasPrefix(san, PermissionScheme+":")
+}
+
+// PermissionsFromCert returns the permissions carried by cert, or nil if it
+// carries none. Malformed permissions are an error, so a certificate is
+// never taken to allow more than it was issued for.
+func PermissionsFromCert(cert *x509.Certificate) (*Permissions, error) {
+	var p *Permissions
+	for _, u := range cert.URIs {
+		if u.Scheme != PermissionScheme {
+			continue
+		}
+		if p == nil {
+			p = &Permissions{}
+		}
+		if err := p.add(u); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// parsePermissionSANs returns the permissions encoded in sans, as returned
+// by Permissions.SANs, or nil if sans is empty.
+func parsePermissionSANs(sans []string) (*Permissions, error) {
+	var p *Permissions
+	for _, san := range sans {
+		u, err := url.Parse(san)
+		if err != nil || u.Scheme != PermissionScheme {
+			return nil, fmt.Errorf("invalid permission %q", san)
+		}
+		if p == nil {
+			p = &Permissions{}
+		}
+		if err := p.add(u); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *Permissions) add(u *url.URL) error {
+	kind, value, _ := strings.Cut(u.Opaque, ":")
+	switch kind {
+	case permAllowPort:
+		r, err := parsePortRange(value)
+		if err != nil {
+			return err
+		}
+		p.Ports = append(p.Ports, r)
+	case permAllowSubdomain:
+		if !ValidSubdomainPattern(value) {
+			return fmt.Errorf("invalid subdomain pattern %q", value)
+		}
+		p.Subdomains = append(p.Subdomains, value)
+	default:
+		return fmt.Errorf("unknown permission %q", u)
+	}
+	return nil
+}
+
+// AllowsPort reports whether p allows a tcp tunnel on port.
+func (p *Permissions) AllowsPort(port int) bool {
+	for _, r := range p.Ports {
+		if port >= r.First && port <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsSubdomain reports whether p allows an http tunnel on subdomain. Only
+// its last label, the one right below the base domain, is matched against
+// Subdomains: a client allowed "alice" may also use "api.alice" and
+// "*.alice".
+func (p *Permissions) AllowsSubdomain(subdomain string) bool {
+	label := subdomain[strings.LastIndex(subdomain, ".")+1:]
+	for _, pattern := range p.Subdomains {
+		if ok, _ := path.Match(pattern, label); ok {
+			return true
+		}
+	}
+	return false
+}
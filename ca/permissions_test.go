@@ -0,0 +1,144 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"crypto/x509"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	t.Parallel()
+
+	got, err := ParsePortRanges("8000-8100, 9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PortRange{{First: 8000, Last: 8100}, {First: 9000, Last: 9000}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	for _, s := range []string{"", "0", "65536", "8100-8000", "80-", "http", "80,,81"} {
+		if _, err := ParsePortRanges(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestValidSubdomainPattern(t *testing.T) {
+	t.Parallel()
+
+	for _, p := range []string{"alice", "alice-*", "*", "app-?", "a1"} {
+		if !ValidSubdomainPattern(p) {
+			t.Errorf("expected %q to be valid", p)
+		}
+	}
+	for _, p := range []string{"", "Alice", "-alice", "alice.bob", "[a-z]", "alice_*"} {
+		if ValidSubdomainPattern(p) {
+			t.Errorf("expected %q to be invalid", p)
+		}
+	}
+}
+
+func TestPermissions_IssueAndRenew(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	perms := &Permissions{
+		Ports:      []PortRange{{First: 8000, Last: 8100}},
+		Subdomains: []string{"alice-*"},
+	}
+	certPEM, _, err := IssueCert(caCertPEM, caKeyPEM, "alice", append([]string{"alice.example.com"}, perms.SANs()...), ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := parseCertPEM(t, certPEM)
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "alice.example.com" {
+		t.Fatalf("expected the DNS SAN to be kept apart from permissions, got %v", cert.DNSNames)
+	}
+
+	got, err := PermissionsFromCert(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, perms) {
+		t.Fatalf("expected %+v, got %+v", perms, got)
+	}
+
+	// renewal keeps the permissions
+	renewedPEM, err := RenewCert(caCertPEM, caKeyPEM, certPEM, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = PermissionsFromCert(parseCertPEM(t, renewedPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, perms) {
+		t.Fatalf("expected the renewed certificate to keep %+v, got %+v", perms, got)
+	}
+
+	// a certificate without permissions isn't restricted
+	plainPEM, _, err := IssueCert(caCertPEM, caKeyPEM, "bob", nil, ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := PermissionsFromCert(parseCertPEM(t, plainPEM)); err != nil || got != nil {
+		t.Fatalf("expected no permissions, got %+v, %v", got, err)
+	}
+
+	if _, _, err := IssueCert(caCertPEM, caKeyPEM, "eve", []string{PermissionScheme + ":allow-everything"}, ECDSAP256, time.Hour); err == nil {
+		t.Fatal("expected error for an unknown permission")
+	}
+}
+
+func TestPermissionsFromCert_Malformed(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{
+		PermissionScheme + ":allow-port:0",
+		PermissionScheme + ":allow-subdomain:alice.bob",
+		PermissionScheme + ":allow-all",
+	} {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := PermissionsFromCert(&x509.Certificate{URIs: []*url.URL{u}}); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestPermissions_Allows(t *testing.T) {
+	t.Parallel()
+
+	p := &Permissions{
+		Ports:      []PortRange{{First: 8000, Last: 8100}, {First: 9000, Last: 9000}},
+		Subdomains: []string{"alice-*", "docs"},
+	}
+	for port, want := range map[int]bool{8000: true, 8050: true, 8100: true, 9000: true, 7999: false, 8101: false, 9001: false} {
+		if got := p.AllowsPort(port); got != want {
+			t.Errorf("AllowsPort(%d) = %v, want %v", port, got, want)
+		}
+	}
+	for label, want := range map[string]bool{"alice-app": true, "alice-": true, "docs": true, "alice": false, "bob-app": false, "docs2": false, "api.docs": true, "*.alice-app": true, "alice-app.bob": false} {
+		if got := p.AllowsSubdomain(label); got != want {
+			t.Errorf("AllowsSubdomain(%q) = %v, want %v", label, got, want)
+		}
+	}
+
+	if (&Permissions{Subdomains: []string{"*"}}).AllowsPort(8000) {
+		t.Error("expected a certificate without allowed ports to allow none")
+	}
+}
@@ -9,26 +9,51 @@
 package ca
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"bytes"
+	"crypto"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
 	"math/big"
 	"net"
+	"net/url"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 )
 
-// GenerateCA creates a self-signed CA root: an ECDSA P256 keypair and a
-// certificate with IsCA true, KeyUsageCertSign|KeyUsageCRLSign, and
+// GenerateCA creates a self-signed CA root: a keypair of the given type and
+// a certificate with IsCA true, KeyUsageCertSign|KeyUsageCRLSign, and
 // BasicConstraintsValid true, valid for the given duration starting now.
 // Returns the certificate and key both PEM-encoded.
-func GenerateCA(subject string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+func GenerateCA(subject string, keyType KeyType, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	return generateCA(subject, keyType, validity, nil, nil)
+}
+
+// GenerateIntermediateCA creates an intermediate CA signed by the CA in
+// rootCertPEM and rootKeyPEM, so the root can be kept offline while the
+// intermediate issues certificates. The intermediate can only issue leaf
+// certificates (MaxPathLen 0) and its validity is capped to the root's.
+// Returns the intermediate certificate and key both PEM-encoded.
+//
+// Leaf certificates issued by an intermediate carry it after the leaf, so
+// a client presents the chain up to the root.
+func GenerateIntermediateCA(rootCertPEM, rootKeyPEM []byte, subject string, keyType KeyType, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	rootCert, rootKey, err := parseCAKeyPair(rootCertPEM, rootKeyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	return generateCA(subject, keyType, validity, rootCert, rootKey)
+}
+
+// generateCA creates a CA signed by parent, or a self-signed root if parent
+// is nil.
+func generateCA(subject string, keyType KeyType, validity time.Duration, parent *x509.Certificate, parentKey crypto.Signer) (certPEM, keyPEM []byte, err error) {
+	key, keyPEM, err := GenerateKey(keyType)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to generate CA key: %s", err)
 	}
@@ -49,18 +74,21 @@ func GenerateCA(subject string, validity time.Duration) (certPEM, keyPEM []byte,
 		BasicConstraintsValid: true,
 	}
 
-	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create CA certificate: %s", err)
+	if parent == nil {
+		parent, parentKey = template, key
+	} else {
+		template.MaxPathLenZero = true
+		if template.NotAfter.After(parent.NotAfter) {
+			template.NotAfter = parent.NotAfter
+		}
 	}
 
-	keyDER, err := x509.MarshalECPrivateKey(key)
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to marshal CA key: %s", err)
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %s", err)
 	}
 
 	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
 
 	return certPEM, keyPEM, nil
 }
@@ -74,27 +102,166 @@ func randomSerial() (*big.Int, error) {
 	return serial, nil
 }
 
-// IssueCert signs a new leaf keypair (ECDSA P256) using the given CA's
+// IssueCert signs a new leaf keypair of the given type using the given CA's
 // certificate and key (both PEM-encoded, as produced by GenerateCA). sans
 // may be empty for a client-role cert; a server-role cert needs at least
 // one DNS name or IP address matching the address clients will dial —
-// entries that parse as an IP become an IP SAN, everything else becomes a
-// DNS SAN. Every issued leaf carries both ExtKeyUsageServerAuth and
-// ExtKeyUsageClientAuth, so one certificate works for either role.
-func IssueCert(caCertPEM, caKeyPEM []byte, name string, sans []string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
-	caCert, caKey, err := parseCAKeyPair(caCertPEM, caKeyPEM)
+// entries that parse as an IP become an IP SAN, those from
+// Permissions.SANs become URI SANs, everything else becomes a DNS SAN.
+// Every issued leaf carries both ExtKeyUsageServerAuth and
+// ExtKeyUsageClientAuth, so one certificate works for either role. The CA
+// may be an intermediate (see GenerateIntermediateCA), in which case
+// certPEM holds the leaf followed by the intermediate.
+func IssueCert(caCertPEM, caKeyPEM []byte, name string, sans []string, keyType KeyType, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	key, keyPEM, err := GenerateKey(keyType)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certPEM, err = IssueCertForKey(caCertPEM, caKeyPEM, name, sans, key.Public(), validity)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to generate certificate key: %s", err)
+		return nil, nil, err
 	}
 
+	return certPEM, keyPEM, nil
+}
+
+// IssueCertForKey is like IssueCert, but certifies the public key pub of a
+// keypair generated elsewhere, e.g. by a client enrolling with a token, and
+// returns only the certificate.
+func IssueCertForKey(caCertPEM, caKeyPEM []byte, name string, sans []string, pub crypto.PublicKey, validity time.Duration) ([]byte, error) {
+	caCert, caKey, err := parseCAKeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := leafTemplate(name, sans, pub, validity)
+	if err != nil {
+		return nil, err
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, pub, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %s", err)
+	}
+
+	return encodeLeaf(certDER, caCert), nil
+}
+
+// SignCSR issues a certificate for the key of the PEM-encoded certificate
+// signing request csrPEM, for keys kept in hardware or generated by other
+// tooling. The certificate is named name, or the CSR's CommonName if
+// empty, and gets the SANs sans; if these are no more than permissions (see
+// Permissions.SANs), the CSR's DNS/IP SANs are added. SANs go through
+// the same validation as IssueCert's, and a CSR asking for any other kind
+// of SAN is refused rather than silently narrowed. Returns only the
+// certificate.
+func SignCSR(caCertPEM, caKeyPEM, csrPEM []byte, name string, sans []string, validity time.Duration) ([]byte, error) {
+	csr, err := ParseCSR(csrPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = csr.Subject.CommonName
+	}
+	if name == "" {
+		return nil, fmt.Errorf("CSR has no CommonName and no name was given")
+	}
+
+	// Permissions restrict the certificate, they don't name it.
+	if !slices.ContainsFunc(sans, func(san string) bool { return !isPermissionSAN(san) }) {
+		if len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+			return nil, fmt.Errorf("CSR requests email or URI SANs, only DNS names and IP addresses are supported")
+		}
+		sans = append(sans, csr.DNSNames...)
+		for _, ip := range csr.IPAddresses {
+			sans = append(sans, ip.String())
+		}
+	}
+
+	return IssueCertForKey(caCertPEM, caKeyPEM, name, sans, csr.PublicKey, validity)
+}
+
+// ParseCSR parses the PEM-encoded certificate signing request csrPEM and
+// checks it's signed by the key it's for.
+func ParseCSR(csrPEM []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || (block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST") {
+		return nil, fmt.Errorf("failed to decode CSR PEM")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSR: %s", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature: %s", err)
+	}
+	return csr, nil
+}
+
+// RenewCert reissues the PEM-encoded certificate certPEM, previously issued
+// by the given CA, with a new serial and validity period but the same name,
+// SANs and public key. The holder keeps using its existing private key, so
+// the certificate's SPKI-based ID (see id.ModeSPKI) doesn't change.
+func RenewCert(caCertPEM, caKeyPEM, certPEM []byte, validity time.Duration) ([]byte, error) {
+	caCert, caKey, err := parseCAKeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode certificate PEM")
+	}
+	old, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %s", err)
+	}
+	if err := old.CheckSignatureFrom(caCert); err != nil {
+		return nil, fmt.Errorf("certificate was not issued by this CA: %s", err)
+	}
+
+	sans := append([]string(nil), old.DNSNames...)
+	for _, ip := range old.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	// Permissions must survive renewal, or it would lift them.
+	for _, u := range old.URIs {
+		if u.Scheme == PermissionScheme {
+			sans = append(sans, u.String())
+		}
+	}
+
+	template, err := leafTemplate(old.Subject.CommonName, sans, old.PublicKey, validity)
+	if err != nil {
+		return nil, err
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, old.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %s", err)
+	}
+
+	return encodeLeaf(certDER, caCert), nil
+}
+
+// encodeLeaf PEM-encodes the leaf certificate certDER issued by caCert,
+// followed by caCert if it's an intermediate.
+func encodeLeaf(certDER []byte, caCert *x509.Certificate) []byte {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	if !bytes.Equal(caCert.RawIssuer, caCert.RawSubject) {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})...)
+	}
+	return certPEM
+}
+
+// leafTemplate returns the template of a leaf certificate for pub as
+// described by IssueCert.
+func leafTemplate(name string, sans []string, pub crypto.PublicKey, validity time.Duration) (*x509.Certificate, error) {
 	serial, err := randomSerial()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	now := time.Now()
@@ -106,32 +273,34 @@ func IssueCert(caCertPEM, caKeyPEM []byte, name string, sans []string, validity
 		KeyUsage:     x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 	}
+	// RSA keys may also be used for RSA key exchange in TLS 1.2.
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
 
 	for _, san := range sans {
 		if ip := net.ParseIP(san); ip != nil {
 			template.IPAddresses = append(template.IPAddresses, ip)
 			continue
 		}
+		if isPermissionSAN(san) {
+			u, err := url.Parse(san)
+			if err == nil {
+				err = (&Permissions{}).add(u)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid SAN %q: %s", san, err)
+			}
+			template.URIs = append(template.URIs, u)
+			continue
+		}
 		if !isValidDNSName(san) {
-			return nil, nil, fmt.Errorf("invalid SAN %q: not a valid IP address or DNS name", san)
+			return nil, fmt.Errorf("invalid SAN %q: not a valid IP address or DNS name", san)
 		}
 		template.DNSNames = append(template.DNSNames, san)
 	}
 
-	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create certificate: %s", err)
-	}
-
-	keyDER, err := x509.MarshalECPrivateKey(key)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to marshal certificate key: %s", err)
-	}
-
-	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
-
-	return certPEM, keyPEM, nil
+	return template, nil
 }
 
 // dnsLabelRE matches a single valid DNS label: letters, digits, and
@@ -154,7 +323,7 @@ func isValidDNSName(name string) bool {
 	return true
 }
 
-func parseCAKeyPair(caCertPEM, caKeyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+func parseCAKeyPair(caCertPEM, caKeyPEM []byte) (*x509.Certificate, crypto.Signer, error) {
 	certBlock, _ := pem.Decode(caCertPEM)
 	if certBlock == nil {
 		return nil, nil, fmt.Errorf("failed to decode CA certificate PEM")
@@ -167,14 +336,13 @@ func parseCAKeyPair(caCertPEM, caKeyPEM []byte) (*x509.Certificate, *ecdsa.Priva
 		return nil, nil, fmt.Errorf("certificate is not a CA (IsCA false); did you point -ca-dir at an issued leaf cert instead of the CA?")
 	}
 
-	keyBlock, _ := pem.Decode(caKeyPEM)
-	if keyBlock == nil {
-		return nil, nil, fmt.Errorf("failed to decode CA key PEM")
-	}
-	caKey, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	caKey, err := parsePrivateKey(caKeyPEM)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to parse CA key: %s", err)
 	}
+	if pub, ok := caKey.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(caCert.PublicKey) {
+		return nil, nil, fmt.Errorf("CA key does not match the CA certificate")
+	}
 
 	return caCert, caKey, nil
 }
@@ -5,17 +5,24 @@
 package ca
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
+	"net"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
 )
 
 func TestGenerateCA(t *testing.T) {
 	t.Parallel()
 
-	certPEM, keyPEM, err := GenerateCA("test CA", 24*time.Hour)
+	certPEM, keyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,23 +60,25 @@ func TestGenerateCA(t *testing.T) {
 	}
 
 	keyBlock, _ := pem.Decode(keyPEM)
-	if keyBlock == nil || keyBlock.Type != "EC PRIVATE KEY" {
-		t.Fatal("expected an EC PRIVATE KEY PEM block")
+	if keyBlock == nil || keyBlock.Type != "PRIVATE KEY" {
+		t.Fatal("expected a PKCS#8 PRIVATE KEY PEM block")
 	}
-	if _, err := x509.ParseECPrivateKey(keyBlock.Bytes); err != nil {
-		t.Fatalf("expected key to parse as an EC private key: %v", err)
+	if key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes); err != nil {
+		t.Fatalf("expected key to parse as a PKCS#8 private key: %v", err)
+	} else if _, ok := key.(*ecdsa.PrivateKey); !ok {
+		t.Fatalf("expected an ECDSA key by default, got %T", key)
 	}
 }
 
 func TestIssueCert_ChainVerifiesAgainstCA(t *testing.T) {
 	t.Parallel()
 
-	caCertPEM, caKeyPEM, err := GenerateCA("test CA", 24*time.Hour)
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	certPEM, keyPEM, err := IssueCert(caCertPEM, caKeyPEM, "myapp", nil, time.Hour)
+	certPEM, keyPEM, err := IssueCert(caCertPEM, caKeyPEM, "myapp", nil, ECDSAP256, time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -116,23 +125,25 @@ func TestIssueCert_ChainVerifiesAgainstCA(t *testing.T) {
 	}
 
 	keyBlock, _ := pem.Decode(keyPEM)
-	if keyBlock == nil || keyBlock.Type != "EC PRIVATE KEY" {
-		t.Fatal("expected an EC PRIVATE KEY PEM block")
+	if keyBlock == nil || keyBlock.Type != "PRIVATE KEY" {
+		t.Fatal("expected a PKCS#8 PRIVATE KEY PEM block")
 	}
-	if _, err := x509.ParseECPrivateKey(keyBlock.Bytes); err != nil {
-		t.Fatalf("expected key to parse as an EC private key: %v", err)
+	if key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes); err != nil {
+		t.Fatalf("expected key to parse as a PKCS#8 private key: %v", err)
+	} else if _, ok := key.(*ecdsa.PrivateKey); !ok {
+		t.Fatalf("expected an ECDSA key by default, got %T", key)
 	}
 }
 
 func TestIssueCert_WithSANs(t *testing.T) {
 	t.Parallel()
 
-	caCertPEM, caKeyPEM, err := GenerateCA("test CA", 24*time.Hour)
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	certPEM, _, err := IssueCert(caCertPEM, caKeyPEM, "myserver", []string{"tunnel.example.com", "127.0.0.1"}, time.Hour)
+	certPEM, _, err := IssueCert(caCertPEM, caKeyPEM, "myserver", []string{"tunnel.example.com", "127.0.0.1"}, ECDSAP256, time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -154,12 +165,12 @@ func TestIssueCert_WithSANs(t *testing.T) {
 func TestIssueCert_WithIPv6SAN(t *testing.T) {
 	t.Parallel()
 
-	caCertPEM, caKeyPEM, err := GenerateCA("test CA", 24*time.Hour)
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	certPEM, _, err := IssueCert(caCertPEM, caKeyPEM, "myserver", []string{"2001:db8::1"}, time.Hour)
+	certPEM, _, err := IssueCert(caCertPEM, caKeyPEM, "myserver", []string{"2001:db8::1"}, ECDSAP256, time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -178,7 +189,7 @@ func TestIssueCert_WithIPv6SAN(t *testing.T) {
 func TestIssueCert_RejectsInvalidSAN(t *testing.T) {
 	t.Parallel()
 
-	caCertPEM, caKeyPEM, err := GenerateCA("test CA", 24*time.Hour)
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -192,7 +203,7 @@ func TestIssueCert_RejectsInvalidSAN(t *testing.T) {
 
 	for _, san := range tests {
 		t.Run(san, func(t *testing.T) {
-			_, _, err := IssueCert(caCertPEM, caKeyPEM, "myserver", []string{san}, time.Hour)
+			_, _, err := IssueCert(caCertPEM, caKeyPEM, "myserver", []string{san}, ECDSAP256, time.Hour)
 			if err == nil {
 				t.Fatalf("expected error for invalid SAN %q", san)
 			}
@@ -203,7 +214,7 @@ func TestIssueCert_RejectsInvalidSAN(t *testing.T) {
 func TestIssueCert_InvalidCAPEM(t *testing.T) {
 	t.Parallel()
 
-	_, _, err := IssueCert([]byte("not a valid PEM"), []byte("also not valid"), "myapp", nil, time.Hour)
+	_, _, err := IssueCert([]byte("not a valid PEM"), []byte("also not valid"), "myapp", nil, ECDSAP256, time.Hour)
 	if err == nil {
 		t.Fatal("expected error for invalid CA PEM")
 	}
@@ -214,16 +225,16 @@ func TestIssueCert_RejectsNonCACertificate(t *testing.T) {
 
 	// Generate a real CA, then issue a leaf from it and try to use that
 	// leaf (IsCA false) as if it were itself a CA to sign a second leaf.
-	caCertPEM, caKeyPEM, err := GenerateCA("test CA", 24*time.Hour)
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
-	leafCertPEM, leafKeyPEM, err := IssueCert(caCertPEM, caKeyPEM, "not-a-ca", nil, time.Hour)
+	leafCertPEM, leafKeyPEM, err := IssueCert(caCertPEM, caKeyPEM, "not-a-ca", nil, ECDSAP256, time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, _, err = IssueCert(leafCertPEM, leafKeyPEM, "myapp", nil, time.Hour)
+	_, _, err = IssueCert(leafCertPEM, leafKeyPEM, "myapp", nil, ECDSAP256, time.Hour)
 	if err == nil {
 		t.Fatal("expected error when the given certificate is not a CA")
 	}
@@ -231,3 +242,240 @@ func TestIssueCert_RejectsNonCACertificate(t *testing.T) {
 		t.Fatalf("expected 'not a CA' error, got: %v", err)
 	}
 }
+
+func TestRenewCert_KeepsKeyAndNames(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, _, err := IssueCert(caCertPEM, caKeyPEM, "laptop", []string{"laptop.example.com", "192.0.2.1"}, ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewedPEM, err := RenewCert(caCertPEM, caKeyPEM, certPEM, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, renewed := parseCertPEM(t, certPEM), parseCertPEM(t, renewedPEM)
+	if renewed.Subject.CommonName != "laptop" {
+		t.Fatalf("expected CN laptop, got %q", renewed.Subject.CommonName)
+	}
+	if strings.Join(renewed.DNSNames, ",") != "laptop.example.com" || len(renewed.IPAddresses) != 1 || renewed.IPAddresses[0].String() != "192.0.2.1" {
+		t.Fatalf("expected the original SANs, got %v %v", renewed.DNSNames, renewed.IPAddresses)
+	}
+	if renewed.SerialNumber.Cmp(old.SerialNumber) == 0 {
+		t.Fatal("expected a new serial")
+	}
+	if !renewed.NotAfter.After(old.NotAfter) {
+		t.Fatalf("expected expiry after %v, got %v", old.NotAfter, renewed.NotAfter)
+	}
+	if id.FromCert(renewed, id.ModeSPKI) != id.FromCert(old, id.ModeSPKI) {
+		t.Fatal("expected the SPKI ID to survive renewal")
+	}
+	if id.FromCert(renewed, id.ModeCert) == id.FromCert(old, id.ModeCert) {
+		t.Fatal("expected the certificate ID to change on renewal")
+	}
+}
+
+func TestRenewCert_RejectsForeignCertificate(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCertPEM, otherKeyPEM, err := GenerateCA("other CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, _, err := IssueCert(otherCertPEM, otherKeyPEM, "laptop", nil, ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RenewCert(caCertPEM, caKeyPEM, certPEM, time.Hour); err == nil {
+		t.Fatal("expected error renewing a certificate of another CA")
+	}
+}
+
+// createCSR returns a PEM-encoded CSR for template signed by a new Ed25519
+// key, standing in for a key IssueCert doesn't generate.
+func createCSR(t *testing.T, template *x509.CertificateRequest) ([]byte, ed25519.PublicKey) {
+	t.Helper()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), pub
+}
+
+func TestSignCSR_UsesCSRNamesAndKey(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM, pub := createCSR(t, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: "hsm-laptop"},
+		DNSNames:    []string{"laptop.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("192.0.2.1")},
+	})
+
+	certPEM, err := SignCSR(caCertPEM, caKeyPEM, csrPEM, "", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := parseCertPEM(t, certPEM)
+	if cert.Subject.CommonName != "hsm-laptop" {
+		t.Fatalf("expected CN hsm-laptop, got %q", cert.Subject.CommonName)
+	}
+	if strings.Join(cert.DNSNames, ",") != "laptop.example.com" || len(cert.IPAddresses) != 1 || cert.IPAddresses[0].String() != "192.0.2.1" {
+		t.Fatalf("expected the CSR's SANs, got %v %v", cert.DNSNames, cert.IPAddresses)
+	}
+	if !pub.Equal(cert.PublicKey) {
+		t.Fatal("expected the certificate to be for the CSR's key")
+	}
+	if err := cert.CheckSignatureFrom(parseCertPEM(t, caCertPEM)); err != nil {
+		t.Fatalf("expected the certificate to be signed by the CA: %v", err)
+	}
+
+	// explicit names override the CSR's
+	certPEM, err = SignCSR(caCertPEM, caKeyPEM, csrPEM, "laptop", []string{"other.example.com"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert = parseCertPEM(t, certPEM)
+	if cert.Subject.CommonName != "laptop" || strings.Join(cert.DNSNames, ",") != "other.example.com" || len(cert.IPAddresses) != 0 {
+		t.Fatalf("expected the given names, got %q %v %v", cert.Subject.CommonName, cert.DNSNames, cert.IPAddresses)
+	}
+
+	// permissions are added to the CSR's names
+	perms := &Permissions{Subdomains: []string{"laptop"}}
+	certPEM, err = SignCSR(caCertPEM, caKeyPEM, csrPEM, "", perms.SANs(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert = parseCertPEM(t, certPEM)
+	if strings.Join(cert.DNSNames, ",") != "laptop.example.com" || len(cert.IPAddresses) != 1 {
+		t.Fatalf("expected the CSR's SANs, got %v %v", cert.DNSNames, cert.IPAddresses)
+	}
+	got, err := PermissionsFromCert(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || strings.Join(got.Subdomains, ",") != "laptop" {
+		t.Fatalf("expected the permissions, got %+v", got)
+	}
+}
+
+func TestSignCSR_Rejects(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := GenerateCA("test CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalidSAN, _ := createCSR(t, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "laptop"},
+		DNSNames: []string{"bad_name.example.com"},
+	})
+	email, _ := createCSR(t, &x509.CertificateRequest{
+		Subject:        pkix.Name{CommonName: "laptop"},
+		EmailAddresses: []string{"alice@example.com"},
+	})
+	noName, _ := createCSR(t, &x509.CertificateRequest{})
+	tampered, _ := createCSR(t, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "laptop"}})
+	block, _ := pem.Decode(tampered)
+	block.Bytes[len(block.Bytes)-1] ^= 0xFF
+	tampered = pem.EncodeToMemory(block)
+
+	for name, csrPEM := range map[string][]byte{
+		"invalid SAN":       invalidSAN,
+		"email SAN":         email,
+		"no name":           noName,
+		"invalid signature": tampered,
+		"not a CSR":         caCertPEM,
+	} {
+		if _, err := SignCSR(caCertPEM, caKeyPEM, csrPEM, "", nil, time.Hour); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestGenerateIntermediateCA_IssuesChains(t *testing.T) {
+	t.Parallel()
+
+	rootCertPEM, rootKeyPEM, err := GenerateCA("root CA", ECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intCertPEM, intKeyPEM, err := GenerateIntermediateCA(rootCertPEM, rootKeyPEM, "intermediate CA", ECDSAP256, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, intermediate := parseCertPEM(t, rootCertPEM), parseCertPEM(t, intCertPEM)
+	if !intermediate.IsCA || intermediate.MaxPathLen != 0 || !intermediate.MaxPathLenZero {
+		t.Fatal("expected an intermediate CA limited to issuing leaves")
+	}
+	if err := intermediate.CheckSignatureFrom(root); err != nil {
+		t.Fatalf("expected the intermediate to be signed by the root: %v", err)
+	}
+	if intermediate.NotAfter.After(root.NotAfter) {
+		t.Fatalf("expected the intermediate to expire with the root at %v, got %v", root.NotAfter, intermediate.NotAfter)
+	}
+
+	certPEM, _, err := IssueCert(intCertPEM, intKeyPEM, "laptop", nil, ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, rest := pem.Decode(certPEM)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parseCertPEM(t, rest).Equal(intermediate) {
+		t.Fatal("expected the leaf to be followed by the intermediate")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediate)
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Fatalf("expected the chain to verify against the root: %v", err)
+	}
+
+	// renewals keep the chain
+	renewedPEM, err := RenewCert(intCertPEM, intKeyPEM, certPEM, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, rest := pem.Decode(renewedPEM); !parseCertPEM(t, rest).Equal(intermediate) {
+		t.Fatal("expected the renewed leaf to be followed by the intermediate")
+	}
+
+	// certificates of a root CA stay bare
+	certPEM, _, err = IssueCert(rootCertPEM, rootKeyPEM, "desktop", nil, ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, rest := pem.Decode(certPEM); len(rest) != 0 {
+		t.Fatal("expected a root-issued certificate without a chain")
+	}
+}
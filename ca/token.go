@@ -0,0 +1,196 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tokenSecretSize is the number of random bytes in an enrollment token.
+const tokenSecretSize = 32
+
+// ErrInvalidToken is returned by Tokens.Redeem for unknown, used and
+// expired tokens alike, so a caller can't tell them apart.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// TokenEntry records an unused enrollment token. Only a hash of the token's
+// secret is stored, so the token file doesn't hand out enrollments.
+type TokenEntry struct {
+	// Hash is the hex SHA-256 of the token secret.
+	Hash    string
+	Name    string
+	Expires time.Time
+	// Permissions, if set, are carried by the enrolled certificate.
+	Permissions *Permissions
+}
+
+// Tokens are the unused enrollment tokens of the CA. Its text form has one
+// tab-separated line per token holding the expiry, secret hash and the name
+// the enrolled certificate gets, followed by its space-separated permission
+// SANs if it has any.
+type Tokens []*TokenEntry
+
+// NewToken creates a one-time enrollment token for a certificate named name,
+// valid for ttl. The token is a secret followed by the SHA-256 of the CA
+// certificate caCertPEM, which the enrolling client pins the server's CA
+// to. Only the returned entry should be stored.
+func NewToken(caCertPEM []byte, name string, ttl time.Duration) (string, *TokenEntry, error) {
+	caHash, err := CAHash(caCertPEM)
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret := make([]byte, tokenSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %s", err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+
+	entry := &TokenEntry{
+		Hash:    hashSecret(encoded),
+		Name:    name,
+		Expires: time.Now().Add(ttl),
+	}
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(caHash), entry, nil
+}
+
+// ParseToken splits a token as returned by NewToken into the secret, sent to
+// the server, and the CA certificate hash.
+func ParseToken(token string) (secret string, caHash []byte, err error) {
+	secret, pin, ok := strings.Cut(strings.TrimSpace(token), ".")
+	if !ok || secret == "" {
+		return "", nil, errors.New("malformed token")
+	}
+	if caHash, err = base64.RawURLEncoding.DecodeString(pin); err != nil || len(caHash) != sha256.Size {
+		return "", nil, errors.New("malformed token: invalid CA hash")
+	}
+	return secret, caHash, nil
+}
+
+// CAHash returns the SHA-256 of the DER-encoded CA certificate caCertPEM.
+func CAHash(caCertPEM []byte) ([]byte, error) {
+	block, _ := pem.Decode(caCertPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode CA certificate PEM")
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %s", err)
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return sum[:], nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseTokens parses the text form of the tokens. Empty data means no
+// tokens.
+func ParseTokens(data []byte) (Tokens, error) {
+	var tokens Tokens
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: expected 3 or 4 fields, got %d", n, len(fields))
+		}
+
+		expires, err := time.Parse(indexTimeFormat, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry: %s", n, err)
+		}
+		if _, err := hex.DecodeString(fields[1]); err != nil || len(fields[1]) != 2*sha256.Size {
+			return nil, fmt.Errorf("line %d: invalid hash %q", n, fields[1])
+		}
+
+		var perms *Permissions
+		if len(fields) == 4 {
+			if perms, err = parsePermissionSANs(strings.Fields(fields[3])); err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+		}
+
+		tokens = append(tokens, &TokenEntry{
+			Hash:        fields[1],
+			Name:        fields[2],
+			Expires:     expires,
+			Permissions: perms,
+		})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Marshal returns the text form of the tokens.
+func (t Tokens) Marshal() []byte {
+	var b bytes.Buffer
+	for _, e := range t {
+		fmt.Fprintf(&b, "%s\t%s\t%s", e.Expires.UTC().Format(indexTimeFormat), e.Hash, e.Name)
+		if e.Permissions != nil {
+			fmt.Fprintf(&b, "\t%s", strings.Join(e.Permissions.SANs(), " "))
+		}
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// Add appends e, refusing a name that would break the line format. Expired
+// tokens are dropped.
+func (t *Tokens) Add(e *TokenEntry, now time.Time) error {
+	if strings.ContainsAny(e.Name, "\t\r\n") {
+		return fmt.Errorf("name %q contains tabs or line breaks", e.Name)
+	}
+	t.prune(now)
+	*t = append(*t, e)
+	return nil
+}
+
+// Redeem removes and returns the token with the given secret. It returns
+// ErrInvalidToken if there's no such token or it expired. Expired tokens
+// are dropped.
+func (t *Tokens) Redeem(secret string, now time.Time) (*TokenEntry, error) {
+	t.prune(now)
+
+	hash := hashSecret(secret)
+	for i, e := range *t {
+		if subtle.ConstantTimeCompare([]byte(e.Hash), []byte(hash)) == 1 {
+			*t = append((*t)[:i], (*t)[i+1:]...)
+			return e, nil
+		}
+	}
+	return nil, ErrInvalidToken
+}
+
+func (t *Tokens) prune(now time.Time) {
+	valid := (*t)[:0]
+	for _, e := range *t {
+		if now.Before(e.Expires) {
+			valid = append(valid, e)
+		}
+	}
+	*t = valid
+}
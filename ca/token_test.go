@@ -0,0 +1,138 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package ca
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewToken(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, _, err := GenerateCA("test CA", ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, entry, err := NewToken(caCertPEM, "laptop", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Name != "laptop" || time.Until(entry.Expires) <= 0 {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	secret, caHash, err := ParseToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := CAHash(caCertPEM); !bytes.Equal(caHash, want) {
+		t.Fatal("expected the token to pin the CA certificate")
+	}
+	if hashSecret(secret) != entry.Hash {
+		t.Fatal("expected the entry to hold the hash of the token secret")
+	}
+	if bytes.Contains(Tokens{entry}.Marshal(), []byte(secret)) {
+		t.Fatal("expected the secret not to be stored")
+	}
+}
+
+func TestParseToken_Malformed(t *testing.T) {
+	t.Parallel()
+
+	for _, token := range []string{"", "secret", ".abc", "secret.not-base64!", "secret.YWJj"} {
+		if _, _, err := ParseToken(token); err == nil {
+			t.Errorf("expected error parsing %q", token)
+		}
+	}
+}
+
+func TestTokens_Redeem(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, _, err := GenerateCA("test CA", ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	var tokens Tokens
+	laptop, laptopEntry, err := NewToken(caCertPEM, "laptop", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptopEntry.Permissions = &Permissions{
+		Ports:      []PortRange{{8000, 8100}},
+		Subdomains: []string{"laptop", "dev-*"},
+	}
+	expired, expiredEntry, err := NewToken(caCertPEM, "old", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []*TokenEntry{laptopEntry, expiredEntry} {
+		if err := tokens.Add(e, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// round trip through the text form
+	tokens, err = ParseTokens(tokens.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("expected 2 tokens, got %d", len(tokens))
+	}
+
+	later := now.Add(2 * time.Minute)
+	secret, _, _ := ParseToken(expired)
+	if _, err := tokens.Redeem(secret, later); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected ErrInvalidToken for an expired token, got %v", err)
+	}
+
+	secret, _, _ = ParseToken(laptop)
+	e, err := tokens.Redeem(secret, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Name != "laptop" {
+		t.Fatalf("expected laptop, got %q", e.Name)
+	}
+	if e.Permissions == nil || strings.Join(e.Permissions.SANs(), " ") != strings.Join(laptopEntry.Permissions.SANs(), " ") {
+		t.Fatalf("expected the permissions to survive the text form, got %+v", e.Permissions)
+	}
+	if _, err := tokens.Redeem(secret, later); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected a token to be usable once, got %v", err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("expected no tokens left, got %d", len(tokens))
+	}
+}
+
+func TestParseTokens_Invalid(t *testing.T) {
+	t.Parallel()
+
+	hash := hashSecret("secret")
+	for _, line := range []string{
+		"20361016120000Z\t" + hash,
+		"never\t" + hash + "\tlaptop",
+		"20361016120000Z\tnot-a-hash\tlaptop",
+		"20361016120000Z\t" + hash + "\tlaptop\tgo-stream-tunnel:allow-port:0",
+		"20361016120000Z\t" + hash + "\tlaptop\thttps://example.com",
+	} {
+		if _, err := ParseTokens([]byte(line + "\n")); err == nil {
+			t.Errorf("expected error parsing %q", line)
+		}
+	}
+
+	var tokens Tokens
+	if err := tokens.Add(&TokenEntry{Name: "bad\tname", Hash: hash, Expires: time.Now().Add(time.Hour)}, time.Now()); err == nil {
+		t.Fatal("expected error for a name with a tab")
+	}
+}
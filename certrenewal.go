@@ -0,0 +1,392 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/ca"
+	"github.com/ChacheGS/go-stream-tunnel/id"
+	"github.com/ChacheGS/go-stream-tunnel/proto"
+)
+
+// CertRenewalCheckInterval is how often the server checks whether the
+// certificates of connected clients are due for renewal. Clients are also
+// checked when they connect.
+var CertRenewalCheckInterval = time.Hour
+
+// CertRenewalConfig lets the server renew client certificates over the
+// control connection. A client whose certificate is due sends a certificate
+// signing request for its current key, and gets back a certificate with the
+// same name, SANs and key, signed by the CA the server holds. The client
+// stores it and uses it from its next reconnect.
+type CertRenewalConfig struct {
+	// CACertPEM and CAKeyPEM are the PEM-encoded CA certificate and key
+	// renewed certificates are signed with. Only certificates issued by this
+	// CA are renewed.
+	CACertPEM []byte
+	CAKeyPEM  []byte
+	// Validity is the validity period of renewed certificates.
+	Validity time.Duration
+	// RenewBefore is how long before it expires a certificate is renewed.
+	// If zero, a third of Validity is used.
+	RenewBefore time.Duration
+	// IndexFile, if set, is the index of the CA, as kept by 'ca', renewed
+	// certificates are recorded in, so revoking a client by name revokes
+	// its renewals as well. A certificate that can't be recorded isn't
+	// handed out.
+	IndexFile string
+}
+
+// maxCertSize limits the size of PEM-encoded CSRs and certificates
+// exchanged for renewal.
+const maxCertSize = 64 << 10
+
+var errCertRenewalUnsupported = errors.New("client does not renew its certificate")
+
+func (c *CertRenewalConfig) validate() error {
+	if _, err := tls.X509KeyPair(c.CACertPEM, c.CAKeyPEM); err != nil {
+		return fmt.Errorf("invalid CA key pair: %s", err)
+	}
+	if c.Validity <= 0 {
+		return errors.New("validity must be positive")
+	}
+	if c.RenewBefore < 0 || c.RenewBefore >= c.Validity {
+		return errors.New("renew before must be between zero and validity")
+	}
+	return nil
+}
+
+// due reports whether cert expires within RenewBefore of now.
+func (c *CertRenewalConfig) due(cert *x509.Certificate, now time.Time) bool {
+	before := c.RenewBefore
+	if before == 0 {
+		before = c.Validity / 3
+	}
+	return now.Add(before).After(cert.NotAfter)
+}
+
+// sign returns the renewal of cert requested by the PEM-encoded csrPEM.
+// Names are taken from cert, never from the CSR, and the CSR must be for
+// the key of cert so the client keeps its identity in id.ModeSPKI.
+func (c *CertRenewalConfig) sign(cert *x509.Certificate, csrPEM []byte) ([]byte, error) {
+	csr, err := ca.ParseCSR(csrPEM)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(csr.RawSubjectPublicKeyInfo, cert.RawSubjectPublicKeyInfo) {
+		return nil, errors.New("CSR key does not match the client certificate")
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return ca.RenewCert(c.CACertPEM, c.CAKeyPEM, certPEM, c.Validity)
+}
+
+// checkCertRenewals periodically renews the certificates of connected
+// clients until ctx is done.
+func (s *Server) checkCertRenewals(ctx context.Context) {
+	t := time.NewTicker(CertRenewalCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+
+		s.connPool.Each(func(identifier id.ID, conn net.Conn) {
+			tlsConn, ok := conn.(*tls.Conn)
+			if !ok {
+				return
+			}
+			if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+				s.renewCertIfDue(identifier, certs[0])
+			}
+		})
+	}
+}
+
+// renewCertIfDue starts renewing cert, presented by the client identified
+// by identifier, if it's due and no renewal for the connection was started
+// yet.
+func (s *Server) renewCertIfDue(identifier id.ID, cert *x509.Certificate) {
+	if s.config.CertRenewal == nil || !s.config.CertRenewal.due(cert, time.Now()) {
+		return
+	}
+
+	// A client identified by its legacy certificate ID in id.ModeSPKI would
+	// be locked out by a renewed certificate.
+	if identifier != id.FromCert(cert, s.config.IDMode) {
+		s.logger.Log(
+			"level", 2,
+			"msg", "certificate renewal skipped, client subscribed by certificate ID",
+			"identifier", identifier,
+			"client", s.clientName(identifier),
+		)
+		return
+	}
+
+	s.renewMu.Lock()
+	if s.renewing[identifier] {
+		s.renewMu.Unlock()
+		return
+	}
+	s.renewing[identifier] = true
+	s.renewMu.Unlock()
+
+	go func() {
+		err := s.renewCert(identifier, cert)
+		if err == nil {
+			return
+		}
+
+		level := 0
+		if errors.Is(err, errCertRenewalUnsupported) {
+			level = 2
+		} else {
+			// retry on the next check
+			s.renewMu.Lock()
+			delete(s.renewing, identifier)
+			s.renewMu.Unlock()
+		}
+		s.logger.Log(
+			"level", level,
+			"msg", "certificate renewal failed",
+			"identifier", identifier,
+			"client", s.clientName(identifier),
+			"err", err,
+		)
+	}()
+}
+
+// renewCert asks the client for a CSR, signs it and sends the certificate
+// back.
+func (s *Server) renewCert(identifier id.ID, cert *x509.Certificate) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	resp, err := s.requestClient(ctx, identifier, nil, func(h http.Header) {
+		h.Set(proto.HeaderCertRequest, "1")
+	})
+	if err != nil {
+		return fmt.Errorf("CSR request failed: %s", err)
+	}
+	csrPEM, err := io.ReadAll(io.LimitReader(resp.Body, maxCertSize))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotImplemented:
+		return errCertRenewalUnsupported
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("CSR request failed: %s", resp.Status)
+	case err != nil:
+		return fmt.Errorf("CSR request failed: %s", err)
+	}
+
+	certPEM, err := s.config.CertRenewal.sign(cert, csrPEM)
+	if err != nil {
+		return err
+	}
+	if err := s.recordCert(s.config.CertRenewal.IndexFile, certPEM); err != nil {
+		return err
+	}
+
+	resp, err = s.requestClient(ctx, identifier, bytes.NewReader(certPEM), func(h http.Header) {
+		h.Set(proto.HeaderCert, "1")
+	})
+	if err != nil {
+		return fmt.Errorf("certificate push failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("client failed to store certificate: %s", resp.Status)
+	}
+
+	s.logger.Log(
+		"level", 1,
+		"action", "certificate renewed",
+		"identifier", identifier,
+		"client", s.clientName(identifier),
+		"expires", time.Now().Add(s.config.CertRenewal.Validity).UTC().Format(time.RFC3339),
+	)
+	return nil
+}
+
+// recordCert adds certPEM, just issued, to the CA index in file. Nothing is
+// recorded if file is empty.
+func (s *Server) recordCert(file string, certPEM []byte) error {
+	if file == "" {
+		return nil
+	}
+	entry, err := ca.NewIndexEntry(certPEM)
+	if err != nil {
+		return err
+	}
+
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	data, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to record certificate: %s", err)
+	}
+	idx, err := ca.ParseIndex(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse %q: %s", file, err)
+	}
+	if err := idx.Add(entry); err != nil {
+		return fmt.Errorf("failed to record certificate: %s", err)
+	}
+	if err := WriteFileAtomic(file, idx.Marshal(), 0644); err != nil {
+		return fmt.Errorf("failed to record certificate: %s", err)
+	}
+	return nil
+}
+
+// clientCertificate returns the client's current certificate. It's used as
+// tls.Config.GetClientCertificate when the client renews its certificate.
+func (c *Client) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.certMu.Lock()
+	defer c.certMu.Unlock()
+	return c.cert, nil
+}
+
+// handleCertRequest answers the server's request for a CSR with one for the
+// client's current key.
+func (c *Client) handleCertRequest(w http.ResponseWriter, _ *http.Request) {
+	if c.config.CertFile == "" {
+		http.Error(w, errCertRenewalUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	csrPEM, err := c.certificateRequest()
+	if err != nil {
+		c.logger.Log(
+			"level", 0,
+			"msg", "failed to create certificate request",
+			"err", err,
+		)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.logger.Log(
+		"level", 1,
+		"action", "certificate renewal",
+	)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(csrPEM)
+}
+
+func (c *Client) certificateRequest() ([]byte, error) {
+	c.certMu.Lock()
+	cert := c.cert
+	c.certMu.Unlock()
+
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", cert.PrivateKey)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %s", err)
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: leaf.Subject,
+	}, signer)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), nil
+}
+
+// handleCert stores the renewed certificate pushed by the server in
+// CertFile and uses it from the next reconnect.
+func (c *Client) handleCert(w http.ResponseWriter, r *http.Request) {
+	certPEM, err := io.ReadAll(io.LimitReader(r.Body, maxCertSize))
+	if err == nil {
+		err = c.storeCert(certPEM)
+	}
+	if err != nil {
+		c.logger.Log(
+			"level", 0,
+			"msg", "failed to store renewed certificate",
+			"file", c.config.CertFile,
+			"err", err,
+		)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *Client) storeCert(certPEM []byte) error {
+	if c.config.CertFile == "" {
+		return errCertRenewalUnsupported
+	}
+
+	// The leaf may be followed by the intermediate CA that issued it.
+	var chain [][]byte
+	for rest := certPEM; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return errors.New("failed to decode certificate PEM")
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %s", err)
+	}
+
+	c.certMu.Lock()
+	defer c.certMu.Unlock()
+
+	current, err := x509.ParseCertificate(c.cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse current certificate: %s", err)
+	}
+	if !bytes.Equal(leaf.RawSubjectPublicKeyInfo, current.RawSubjectPublicKeyInfo) {
+		return errors.New("certificate does not match the client key")
+	}
+
+	if err := WriteFileAtomic(c.config.CertFile, certPEM, 0644); err != nil {
+		return err
+	}
+	c.cert = &tls.Certificate{
+		Certificate: chain,
+		PrivateKey:  c.cert.PrivateKey,
+		Leaf:        leaf,
+	}
+
+	c.logger.Log(
+		"level", 1,
+		"action", "certificate renewed",
+		"file", c.config.CertFile,
+		"expires", leaf.NotAfter.UTC().Format(time.RFC3339),
+	)
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/ca"
+	"github.com/ChacheGS/go-stream-tunnel/id"
+	"github.com/ChacheGS/go-stream-tunnel/proto"
+)
+
+func TestCertRenewalConfig_Due(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	cert := &x509.Certificate{NotAfter: now.Add(9 * 24 * time.Hour)}
+
+	c := &CertRenewalConfig{Validity: 30 * 24 * time.Hour}
+	if !c.due(cert, now) {
+		t.Fatal("expected a certificate with less than a third of its validity left to be due")
+	}
+	if c.due(cert, now.Add(-2*24*time.Hour)) {
+		t.Fatal("expected a certificate with 11 of 30 days left not to be due")
+	}
+
+	c.RenewBefore = 5 * 24 * time.Hour
+	if c.due(cert, now) {
+		t.Fatal("expected RenewBefore to override the default")
+	}
+}
+
+func TestCertRenewalConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := ca.GenerateCA("test CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := CertRenewalConfig{CACertPEM: caCertPEM, CAKeyPEM: caKeyPEM, Validity: time.Hour}
+	if err := valid.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]CertRenewalConfig{
+		"missing key":              {CACertPEM: caCertPEM, Validity: time.Hour},
+		"zero validity":            {CACertPEM: caCertPEM, CAKeyPEM: caKeyPEM},
+		"renew before >= validity": {CACertPEM: caCertPEM, CAKeyPEM: caKeyPEM, Validity: time.Hour, RenewBefore: time.Hour},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestCertRenewalConfig_Sign(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := ca.GenerateCA("test CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.IssueCert(caCertPEM, caKeyPEM, "laptop", []string{"laptop.example.com"}, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := parseCert(t, certPEM)
+
+	c := &CertRenewalConfig{CACertPEM: caCertPEM, CAKeyPEM: caKeyPEM, Validity: 48 * time.Hour}
+
+	client := &Client{config: &ClientConfig{}, cert: &tlsCert}
+	csrPEM, err := client.certificateRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewedPEM, err := c.sign(cert, csrPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed := parseCert(t, renewedPEM)
+	if renewed.Subject.CommonName != "laptop" || len(renewed.DNSNames) != 1 || renewed.DNSNames[0] != "laptop.example.com" {
+		t.Fatalf("expected the names of the current certificate, got %q %v", renewed.Subject.CommonName, renewed.DNSNames)
+	}
+	if id.FromCert(renewed, id.ModeSPKI) != id.FromCert(cert, id.ModeSPKI) {
+		t.Fatal("expected the renewed certificate to keep the key")
+	}
+
+	// a CSR for another key is refused
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: cert.Subject}, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.sign(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: otherDER})); err == nil {
+		t.Fatal("expected error for a CSR with another key")
+	}
+
+	// a tampered CSR is refused
+	block, _ := pem.Decode(csrPEM)
+	block.Bytes[len(block.Bytes)-1] ^= 0xFF
+	if _, err := c.sign(cert, pem.EncodeToMemory(block)); err == nil {
+		t.Fatal("expected error for a CSR with an invalid signature")
+	}
+
+	if _, err := c.sign(cert, []byte("not a CSR")); err == nil {
+		t.Fatal("expected error for invalid PEM")
+	}
+}
+
+func TestClient_StoreCert(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := ca.GenerateCA("test CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.IssueCert(caCertPEM, caKeyPEM, "laptop", nil, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewedPEM, err := ca.RenewCert(caCertPEM, caKeyPEM, certPEM, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPEM, _, err := ca.IssueCert(caCertPEM, caKeyPEM, "other", nil, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(t.TempDir(), "tls.crt")
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewClient(&ClientConfig{
+		ServerAddr:      "127.0.0.1:5223",
+		TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{tlsCert}},
+		Tunnels:         map[string]*proto.Tunnel{"tcp": {Protocol: proto.TCP, Addr: "127.0.0.1:0"}},
+		Proxy:           Proxy(ProxyFuncs{}),
+		CertFile:        certFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.storeCert(otherPEM); err == nil {
+		t.Fatal("expected error storing a certificate for another key")
+	}
+
+	if err := c.storeCert(renewedPEM); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != string(renewedPEM) {
+		t.Fatal("expected the renewed certificate to be written to CertFile")
+	}
+
+	current, err := c.tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Leaf == nil || current.Leaf.SerialNumber.Cmp(parseCert(t, renewedPEM).SerialNumber) != 0 {
+		t.Fatal("expected the renewed certificate to be used for the next connection")
+	}
+}
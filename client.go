@@ -41,6 +41,11 @@ type ClientConfig struct {
 	// Proxy is ProxyFunc responsible for transferring data between server
 	// and local services.
 	Proxy ProxyFunc
+	// CertFile, if set, enables certificate renewal. When the server offers
+	// to renew the client certificate, the first of TLSClientConfig's
+	// Certificates, the renewed certificate is written to CertFile and used
+	// from the next reconnect. The private key stays the same.
+	CertFile string
 	// Logger is optional logger. If nil logging is disabled.
 	Logger log.Logger
 }
@@ -58,6 +63,10 @@ type Client struct {
 	lastDisconnect time.Time
 	logger         log.Logger
 
+	tlsConfig *tls.Config
+	certMu    sync.Mutex
+	cert      *tls.Certificate
+
 	// onTunnelInfo, if set, is invoked with resolved tunnel-name -> full
 	// hostname pairs whenever the server pushes tunnel info. Exposed as a
 	// field (rather than only logging) so tests can observe it directly;
@@ -91,6 +100,17 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		config:     config,
 		httpServer: &http2.Server{},
 		logger:     logger,
+		tlsConfig:  config.TLSClientConfig,
+	}
+
+	if config.CertFile != "" {
+		if len(config.TLSClientConfig.Certificates) == 0 {
+			return nil, errors.New("CertFile requires a certificate in TLSClientConfig")
+		}
+		cert := config.TLSClientConfig.Certificates[0]
+		c.cert = &cert
+		c.tlsConfig = config.TLSClientConfig.Clone()
+		c.tlsConfig.GetClientCertificate = c.clientCertificate
 	}
 
 	return c, nil
@@ -184,7 +204,7 @@ func (c *Client) dial() (net.Conn, error) {
 	var (
 		network   = "tcp"
 		addr      = c.config.ServerAddr
-		tlsConfig = c.config.TLSClientConfig
+		tlsConfig = c.tlsConfig
 	)
 
 	doDial := func() (conn net.Conn, err error) {
@@ -271,6 +291,10 @@ func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
 			c.handleHandshakeError(w, r)
 		case r.Header.Get(proto.HeaderTunnelInfo) != "":
 			c.handleTunnelInfo(w, r)
+		case r.Header.Get(proto.HeaderCertRequest) != "":
+			c.handleCertRequest(w, r)
+		case r.Header.Get(proto.HeaderCert) != "":
+			c.handleCert(w, r)
 		default:
 			c.handleHandshake(w, r)
 		}
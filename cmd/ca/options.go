@@ -5,13 +5,13 @@
 package ca
 
 import (
-	"crypto/x509"
-	"encoding/pem"
 	"flag"
 	"fmt"
+	"math/big"
 	"os"
 	"path/filepath"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	tunnel "github.com/ChacheGS/go-stream-tunnel"
@@ -25,24 +25,57 @@ options:
 
 const usage2 string = `
 Commands:
-	go-stream-tunnel ca [-ca-dir ./ca] init
-	go-stream-tunnel ca -name <label> [-addr <host>] [-ca-dir ./ca] [-out-dir ...] issue
-
-Note: flags must come before the command (init/issue), not after.
+	go-stream-tunnel ca [-ca-dir ./ca] [-key-type ...] [-validity ...] init
+	go-stream-tunnel ca -root-dir <root ca-dir> [-ca-dir ./ca] [-key-type ...] [-validity ...] init-intermediate
+	go-stream-tunnel ca -name <label> [-addr <host>] [-allow-ports ...] [-allow-subdomains ...] [-ca-dir ./ca] [-out-dir ...] [-key-type ...] [-validity ...] issue
+	go-stream-tunnel ca -csr <file.csr> [-name <label>] [-addr <host>] [-allow-ports ...] [-allow-subdomains ...] [-ca-dir ./ca] [-out-dir ...] [-validity ...] sign
+	go-stream-tunnel ca -name <label> [-ca-dir ./ca] [-out-dir ...] [-validity ...] renew
+	go-stream-tunnel ca -name <label> [-ca-dir ./ca] [-out-dir ...] revoke
+	go-stream-tunnel ca -serial <hex> [-ca-dir ./ca] revoke
+	go-stream-tunnel ca [-ca-dir ./ca] [-ids [-id-mode spki]] list
+	go-stream-tunnel ca -name <label> [-ca-dir ./ca] show
+	go-stream-tunnel ca -name <label> [-ttl 1h] [-allow-ports ...] [-allow-subdomains ...] [-ca-dir ./ca] token
+
+Note: flags may come before or after the command.
 
 Examples:
 	go-stream-tunnel ca init
+	go-stream-tunnel ca -ca-dir ca-root init
+	go-stream-tunnel ca init-intermediate -root-dir ca-root -ca-dir ca
 	go-stream-tunnel ca -name laptop issue
 	go-stream-tunnel ca -name server -addr tunnel.example.com issue
+	go-stream-tunnel ca issue -name partner -key-type rsa-3072
+	go-stream-tunnel ca issue -name laptop -key-type ed25519 -validity 720h
+	go-stream-tunnel ca issue -name alice -allow-ports 8000-8100 -allow-subdomains 'alice-*'
+	go-stream-tunnel ca sign -csr laptop.csr
+	go-stream-tunnel ca renew -name laptop
+	go-stream-tunnel ca revoke -name laptop
+	go-stream-tunnel ca revoke -serial 5F3A9C
+	go-stream-tunnel ca list -ids
+	go-stream-tunnel ca list -ids -id-mode spki
+	go-stream-tunnel ca token -name laptop -ttl 1h
+	go-stream-tunnel ca token -name bob -allow-subdomains bob
 
 `
 
 type options struct {
-	caDir   string
-	name    string
-	addr    string
-	outDir  string
-	command string
+	caDir    string
+	rootDir  string
+	name     string
+	addr     string
+	outDir   string
+	ids      bool
+	idMode   string
+	ttl      time.Duration
+	csr      string
+	serial   string
+	keyType  string
+	validity time.Duration
+	// allowPorts and allowSubdomains are the tunnel permissions for 'issue',
+	// 'sign' and 'token'.
+	allowPorts      string
+	allowSubdomains string
+	command         string
 }
 
 var opts options
@@ -56,50 +89,207 @@ func Command() *flag.FlagSet {
 	}
 
 	cmd.StringVar(&opts.caDir, "ca-dir", "ca", "Directory holding (or to write) the CA's ca.crt/ca.key")
-	cmd.StringVar(&opts.name, "name", "", "Name for the issued certificate (its CommonName); required for 'issue'")
+	cmd.StringVar(&opts.rootDir, "root-dir", "", "For 'init-intermediate', directory holding the ca.crt/ca.key of the root CA that signs the intermediate written to -ca-dir")
+	cmd.StringVar(&opts.keyType, "key-type", string(capki.ECDSAP256), "For 'init', 'init-intermediate' and 'issue', the type of key to generate: "+keyTypes())
+	cmd.DurationVar(&opts.validity, "validity", defaultValidity(), "For 'init', 'init-intermediate', 'issue', 'sign' and 'renew', how long the certificate is valid, e.g. 720h")
+	cmd.StringVar(&opts.name, "name", "", "Name for the issued certificate (its CommonName); required for 'issue', for 'sign' defaults to the CSR's")
 	cmd.StringVar(&opts.addr, "addr", "", "DNS name or IP address to include as a Subject Alternative Name; only needed for a server-role cert")
-	cmd.StringVar(&opts.outDir, "out-dir", "", "Directory to write the issued tls.crt/tls.key to; defaults to ./<name>")
+	cmd.BoolVar(&opts.ids, "ids", false, "For 'list', print only the IDs of valid certificates, comma-separated for the server's -client-ids")
+	cmd.StringVar(&opts.idMode, "id-mode", string(id.ModeCert), "For 'list -ids', the server's -id-mode the IDs are for: cert or spki")
+	cmd.StringVar(&opts.csr, "csr", "", "For 'sign', path to a PEM-encoded certificate signing request for a key generated elsewhere")
+	cmd.StringVar(&opts.serial, "serial", "", "For 'revoke', the hex serial of the one certificate to revoke, as shown by 'list', instead of every certificate of -name")
+	cmd.DurationVar(&opts.ttl, "ttl", time.Hour, "For 'token', how long the enrollment token can be used")
+	cmd.StringVar(&opts.allowPorts, "allow-ports", "", "For 'issue', 'sign' and 'token', comma-separated ports and port ranges the client may open tcp tunnels on, e.g. 8000-8100,9000; restricts the certificate")
+	cmd.StringVar(&opts.allowSubdomains, "allow-subdomains", "", "For 'issue', 'sign' and 'token', comma-separated subdomains the client may open http tunnels on and below, with * and ? wildcards, e.g. 'alice-*'; restricts the certificate")
+	cmd.StringVar(&opts.outDir, "out-dir", "", "Directory to write the issued tls.crt/tls.key to, or for 'renew' to read tls.crt from and for 'revoke' to read a tls.crt missing from the index from; defaults to ./<name>")
 
 	return cmd
 }
 
 func CompleteArgs(fs *flag.FlagSet) error {
 	opts.command = fs.Arg(0)
+	// Flags after the command, as in "ca revoke -name laptop", are left
+	// unparsed by the first pass since parsing stops at the command.
+	if fs.NArg() > 0 {
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+	}
+
 	switch opts.command {
 	case "init":
-		if len(fs.Args()) > 1 {
+		if fs.NArg() > 0 {
 			return fmt.Errorf("init takes no arguments")
 		}
 		// -name/-addr/-out-dir only apply to issue; init always writes the
 		// CA to -ca-dir. Silently accepting and ignoring them would leave
 		// someone who passed -out-dir expecting it to control where init
 		// writes with no indication it did nothing.
-		var badFlags []string
-		fs.Visit(func(f *flag.Flag) {
-			switch f.Name {
-			case "name", "addr", "out-dir":
-				badFlags = append(badFlags, "-"+f.Name)
-			}
-		})
-		if len(badFlags) > 0 {
-			return fmt.Errorf("init does not use %s; init only takes -ca-dir", strings.Join(badFlags, ", "))
+		if badFlags := visited(fs, "name", "addr", "out-dir", "ids", "id-mode", "ttl", "csr", "root-dir", "allow-ports", "allow-subdomains", "serial"); len(badFlags) > 0 {
+			return fmt.Errorf("init does not use %s; init only takes -ca-dir, -key-type and -validity", strings.Join(badFlags, ", "))
+		}
+	case "init-intermediate":
+		if opts.rootDir == "" {
+			return fmt.Errorf("init-intermediate requires -root-dir")
+		}
+		if badFlags := visited(fs, "name", "addr", "out-dir", "ids", "id-mode", "ttl", "csr", "allow-ports", "allow-subdomains", "serial"); len(badFlags) > 0 {
+			return fmt.Errorf("init-intermediate does not use %s; init-intermediate only takes -root-dir, -ca-dir, -key-type and -validity", strings.Join(badFlags, ", "))
+		}
+		if filepath.Clean(opts.rootDir) == filepath.Clean(opts.caDir) {
+			return fmt.Errorf("-root-dir and -ca-dir must differ")
 		}
 	case "issue":
 		if opts.name == "" {
 			return fmt.Errorf("issue requires -name")
 		}
+		if badFlags := visited(fs, "ids", "id-mode", "ttl", "csr", "root-dir", "serial"); len(badFlags) > 0 {
+			return fmt.Errorf("issue does not use %s", strings.Join(badFlags, ", "))
+		}
+		if _, err := permissions(); err != nil {
+			return err
+		}
 		if opts.outDir == "" {
 			opts.outDir = opts.name
 		}
+	case "sign":
+		if opts.csr == "" {
+			return fmt.Errorf("sign requires -csr")
+		}
+		// -name, -addr and -out-dir are optional; without them the CSR's
+		// CommonName and SANs are used and the certificate is written to
+		// ./<CommonName>.
+		if badFlags := visited(fs, "ids", "id-mode", "ttl", "root-dir", "key-type", "serial"); len(badFlags) > 0 {
+			return fmt.Errorf("sign does not use %s", strings.Join(badFlags, ", "))
+		}
+		if _, err := permissions(); err != nil {
+			return err
+		}
+	case "renew":
+		if opts.name == "" {
+			return fmt.Errorf("renew requires -name")
+		}
+		// The renewed certificate keeps the names of the old one.
+		if badFlags := visited(fs, "addr", "ids", "id-mode", "ttl", "csr", "root-dir", "key-type", "allow-ports", "allow-subdomains", "serial"); len(badFlags) > 0 {
+			return fmt.Errorf("renew does not use %s", strings.Join(badFlags, ", "))
+		}
+		if opts.outDir == "" {
+			opts.outDir = opts.name
+		}
+	case "revoke":
+		if (opts.name == "") == (opts.serial == "") {
+			return fmt.Errorf("revoke requires one of -name and -serial")
+		}
+		if opts.serial != "" {
+			if _, ok := new(big.Int).SetString(opts.serial, 16); !ok {
+				return fmt.Errorf("-serial: invalid hex serial %q", opts.serial)
+			}
+			if badFlags := visited(fs, "out-dir"); len(badFlags) > 0 {
+				return fmt.Errorf("revoke -serial does not use %s", strings.Join(badFlags, ", "))
+			}
+		}
+		if badFlags := visited(fs, "addr", "ids", "id-mode", "ttl", "csr", "root-dir", "key-type", "validity", "allow-ports", "allow-subdomains"); len(badFlags) > 0 {
+			return fmt.Errorf("revoke does not use %s", strings.Join(badFlags, ", "))
+		}
+		if opts.outDir == "" && opts.name != "" {
+			opts.outDir = opts.name
+		}
+	case "list":
+		if badFlags := visited(fs, "name", "addr", "out-dir", "ttl", "csr", "root-dir", "key-type", "validity", "allow-ports", "allow-subdomains", "serial"); len(badFlags) > 0 {
+			return fmt.Errorf("list does not use %s; list only takes -ca-dir, -ids and -id-mode", strings.Join(badFlags, ", "))
+		}
+		if _, err := id.ParseMode(opts.idMode); err != nil {
+			return err
+		}
+	case "show":
+		if opts.name == "" {
+			return fmt.Errorf("show requires -name")
+		}
+		if badFlags := visited(fs, "addr", "out-dir", "ids", "id-mode", "ttl", "csr", "root-dir", "key-type", "validity", "allow-ports", "allow-subdomains", "serial"); len(badFlags) > 0 {
+			return fmt.Errorf("show does not use %s", strings.Join(badFlags, ", "))
+		}
+	case "token":
+		if opts.name == "" {
+			return fmt.Errorf("token requires -name")
+		}
+		// The enrolled certificate gets only a name and permissions; the
+		// key and certificate are written by the client.
+		if badFlags := visited(fs, "addr", "out-dir", "ids", "id-mode", "csr", "root-dir", "key-type", "validity", "serial"); len(badFlags) > 0 {
+			return fmt.Errorf("token does not use %s", strings.Join(badFlags, ", "))
+		}
+		if _, err := permissions(); err != nil {
+			return err
+		}
+		if opts.ttl <= 0 {
+			return fmt.Errorf("-ttl must be positive")
+		}
 	default:
 		return fmt.Errorf("unknown command %q", opts.command)
 	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("%s takes no arguments", opts.command)
+	}
+	if _, err := capki.ParseKeyType(opts.keyType); err != nil {
+		return fmt.Errorf("-key-type: %s", err)
+	}
+	if opts.validity <= 0 {
+		return fmt.Errorf("-validity must be positive")
+	}
 	return nil
 }
 
+// permissions returns the tunnel permissions given by -allow-ports and
+// -allow-subdomains, or nil if neither was given.
+func permissions() (*capki.Permissions, error) {
+	if opts.allowPorts == "" && opts.allowSubdomains == "" {
+		return nil, nil
+	}
+
+	perms := &capki.Permissions{}
+	if opts.allowPorts != "" {
+		ports, err := capki.ParsePortRanges(opts.allowPorts)
+		if err != nil {
+			return nil, fmt.Errorf("-allow-ports: %s", err)
+		}
+		perms.Ports = ports
+	}
+	if opts.allowSubdomains != "" {
+		for pattern := range strings.SplitSeq(opts.allowSubdomains, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if !capki.ValidSubdomainPattern(pattern) {
+				return nil, fmt.Errorf("-allow-subdomains: invalid subdomain pattern %q", pattern)
+			}
+			perms.Subdomains = append(perms.Subdomains, pattern)
+		}
+	}
+	return perms, nil
+}
+
+func keyTypes() string {
+	names := make([]string, len(capki.KeyTypes))
+	for i, t := range capki.KeyTypes {
+		names[i] = string(t)
+	}
+	return strings.Join(names, ", ")
+}
+
+// visited returns the given flags that were set on the command line, as
+// "-name" for error messages.
+func visited(fs *flag.FlagSet, names ...string) []string {
+	var set []string
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range names {
+			if f.Name == name {
+				set = append(set, "-"+f.Name)
+			}
+		}
+	})
+	return set
+}
+
 const validityYears = 10
 
-func validity() time.Duration {
+// defaultValidity is the default of -validity, and how long CRLs are valid.
+func defaultValidity() time.Duration {
 	return validityYears * 365 * 24 * time.Hour
 }
 
@@ -122,28 +312,80 @@ func Execute() error {
 	switch opts.command {
 	case "init":
 		return executeInit()
+	case "init-intermediate":
+		return executeInitIntermediate()
 	case "issue":
 		return executeIssue()
+	case "sign":
+		return executeSign()
+	case "renew":
+		return executeRenew()
+	case "revoke":
+		return executeRevoke()
+	case "list":
+		return executeList()
+	case "show":
+		return executeShow()
+	case "token":
+		return executeToken()
 	}
 	return fmt.Errorf("unknown command %q", opts.command)
 }
 
 func executeInit() error {
-	caCrtPath := filepath.Join(opts.caDir, "ca.crt")
-	caKeyPath := filepath.Join(opts.caDir, "ca.key")
+	if err := checkNoCA(); err != nil {
+		return err
+	}
 
-	if _, err := os.Stat(caCrtPath); err == nil {
-		return fmt.Errorf("CA already exists at %s; refusing to overwrite your root of trust", caCrtPath)
+	keyType, _ := capki.ParseKeyType(opts.keyType)
+	certPEM, keyPEM, err := capki.GenerateCA("go-stream-tunnel CA", keyType, opts.validity)
+	if err != nil {
+		return fmt.Errorf("failed to generate CA: %s", err)
 	}
-	if _, err := os.Stat(caKeyPath); err == nil {
-		return fmt.Errorf("CA already exists at %s; refusing to overwrite your root of trust", caKeyPath)
+
+	return writeCA(certPEM, keyPEM, "CA created")
+}
+
+func executeInitIntermediate() error {
+	if err := checkNoCA(); err != nil {
+		return err
 	}
 
-	certPEM, keyPEM, err := capki.GenerateCA("go-stream-tunnel CA", validity())
+	rootCertPEM, rootKeyPEM, err := readCA(opts.rootDir)
 	if err != nil {
-		return fmt.Errorf("failed to generate CA: %s", err)
+		return err
+	}
+
+	keyType, _ := capki.ParseKeyType(opts.keyType)
+	certPEM, keyPEM, err := capki.GenerateIntermediateCA(rootCertPEM, rootKeyPEM, "go-stream-tunnel intermediate CA", keyType, opts.validity)
+	if err != nil {
+		return fmt.Errorf("failed to generate intermediate CA: %s", err)
 	}
 
+	// ca.crt holds the chain up to the root, so it can be given to the
+	// server's -ca-crt and a client's -ca-crt as is.
+	if err := writeCA(append(certPEM, rootCertPEM...), keyPEM, "Intermediate CA created"); err != nil {
+		return err
+	}
+	fmt.Printf("\nThe root CA in %s is only needed again to create another intermediate;\nkeep its ca.key offline.\n", opts.rootDir)
+	return nil
+}
+
+// checkNoCA refuses to go on if -ca-dir already holds a CA.
+func checkNoCA() error {
+	for _, path := range []string{filepath.Join(opts.caDir, "ca.crt"), filepath.Join(opts.caDir, "ca.key")} {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("CA already exists at %s; refusing to overwrite your root of trust", path)
+		}
+	}
+	return nil
+}
+
+// writeCA writes a new CA to -ca-dir and reports it with msg.
+func writeCA(certPEM, keyPEM []byte, msg string) error {
+	caCrtPath := filepath.Join(opts.caDir, "ca.crt")
+	caKeyPath := filepath.Join(opts.caDir, "ca.key")
+
 	if err := os.MkdirAll(opts.caDir, 0755); err != nil {
 		return fmt.Errorf("failed to create %s: %s", opts.caDir, err)
 	}
@@ -151,33 +393,51 @@ func executeInit() error {
 		return err
 	}
 
-	fmt.Printf("CA created:\n  %s\n  %s\n", caCrtPath, caKeyPath)
+	fmt.Printf("%s:\n  %s\n  %s\n", msg, caCrtPath, caKeyPath)
 	return nil
 }
 
-func executeIssue() error {
-	caCrtPath := filepath.Join(opts.caDir, "ca.crt")
-	caKeyPath := filepath.Join(opts.caDir, "ca.key")
+// readCA reads the CA certificate and key from dir, usually -ca-dir.
+func readCA(dir string) (caCertPEM, caKeyPEM []byte, err error) {
+	caCrtPath := filepath.Join(dir, "ca.crt")
+	caKeyPath := filepath.Join(dir, "ca.key")
 
-	caCertPEM, err := os.ReadFile(caCrtPath)
+	caCertPEM, err = os.ReadFile(caCrtPath)
 	if err != nil {
-		return fmt.Errorf("failed to read %s: %s (run 'go-stream-tunnel ca init' first)", caCrtPath, err)
+		return nil, nil, fmt.Errorf("failed to read %s: %s (run 'go-stream-tunnel ca init' first)", caCrtPath, err)
 	}
 
 	if err := tunnel.CheckPrivateKeyPermissions(caKeyPath); err != nil {
-		return fmt.Errorf("failed to read %s: %s", caKeyPath, err)
+		return nil, nil, fmt.Errorf("failed to read %s: %s", caKeyPath, err)
 	}
-	caKeyPEM, err := os.ReadFile(caKeyPath)
+	caKeyPEM, err = os.ReadFile(caKeyPath)
 	if err != nil {
-		return fmt.Errorf("failed to read %s: %s (run 'go-stream-tunnel ca init' first)", caKeyPath, err)
+		return nil, nil, fmt.Errorf("failed to read %s: %s (run 'go-stream-tunnel ca init' first)", caKeyPath, err)
+	}
+
+	return caCertPEM, caKeyPEM, nil
+}
+
+func executeIssue() error {
+	caCertPEM, caKeyPEM, err := readCA(opts.caDir)
+	if err != nil {
+		return err
 	}
 
 	var sans []string
 	if opts.addr != "" {
 		sans = []string{opts.addr}
 	}
+	perms, err := permissions()
+	if err != nil {
+		return err
+	}
+	if perms != nil {
+		sans = append(sans, perms.SANs()...)
+	}
 
-	certPEM, keyPEM, err := capki.IssueCert(caCertPEM, caKeyPEM, opts.name, sans, validity())
+	keyType, _ := capki.ParseKeyType(opts.keyType)
+	certPEM, keyPEM, err := capki.IssueCert(caCertPEM, caKeyPEM, opts.name, sans, keyType, opts.validity)
 	if err != nil {
 		return fmt.Errorf("failed to issue certificate: %s", err)
 	}
@@ -199,13 +459,391 @@ func executeIssue() error {
 		return err
 	}
 
-	block, _ := pem.Decode(certPEM)
-	cert, err := x509.ParseCertificate(block.Bytes)
+	entry, err := capki.NewIndexEntry(certPEM)
+	if err != nil {
+		return fmt.Errorf("failed to parse issued certificate: %s", err)
+	}
+	if err := updateIndex(func(idx *capki.Index) error {
+		return idx.Add(entry)
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Certificate issued:\n  %s\n  %s\n\nClient ID (for -client-ids): %s\nSPKI client ID (for -client-ids with -id-mode spki): %s\n",
+		crtPath, keyPath, entry.ID, entry.SPKIID)
+	return nil
+}
+
+func executeSign() error {
+	caCertPEM, caKeyPEM, err := readCA(opts.caDir)
+	if err != nil {
+		return err
+	}
+
+	csrPEM, err := os.ReadFile(opts.csr)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", opts.csr, err)
+	}
+
+	var sans []string
+	if opts.addr != "" {
+		sans = []string{opts.addr}
+	}
+	perms, err := permissions()
+	if err != nil {
+		return err
+	}
+	if perms != nil {
+		sans = append(sans, perms.SANs()...)
+	}
+
+	certPEM, err := capki.SignCSR(caCertPEM, caKeyPEM, csrPEM, opts.name, sans, opts.validity)
+	if err != nil {
+		return fmt.Errorf("failed to sign %s: %s", opts.csr, err)
+	}
+
+	entry, err := capki.NewIndexEntry(certPEM)
 	if err != nil {
 		return fmt.Errorf("failed to parse issued certificate: %s", err)
 	}
-	fingerprint := id.New(cert.Raw)
+	if opts.outDir == "" {
+		// The name comes from the CSR, so don't let it pick a path.
+		if entry.Name != filepath.Base(entry.Name) || entry.Name == ".." {
+			return fmt.Errorf("CSR name %q is not usable as a directory; use -out-dir", entry.Name)
+		}
+		opts.outDir = entry.Name
+	}
+
+	crtPath := filepath.Join(opts.outDir, "tls.crt")
+	if _, err := os.Stat(crtPath); err == nil {
+		return fmt.Errorf("%s already exists; refusing to overwrite", crtPath)
+	}
+	if err := os.MkdirAll(opts.outDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %s", opts.outDir, err)
+	}
+	if err := os.WriteFile(crtPath, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %s", crtPath, err)
+	}
+
+	if err := updateIndex(func(idx *capki.Index) error {
+		return idx.Add(entry)
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Certificate signed for %q:\n  %s\n\nClient ID (for -client-ids): %s\nSPKI client ID (for -client-ids with -id-mode spki): %s\n",
+		entry.Name, crtPath, entry.ID, entry.SPKIID)
+	return nil
+}
+
+func executeRenew() error {
+	caCertPEM, caKeyPEM, err := readCA(opts.caDir)
+	if err != nil {
+		return err
+	}
+
+	crtPath := filepath.Join(opts.outDir, "tls.crt")
+	certPEM, err := os.ReadFile(crtPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s (use -out-dir if it was issued elsewhere)", crtPath, err)
+	}
+
+	old, err := capki.NewIndexEntry(certPEM)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %s", crtPath, err)
+	}
+	idx, err := readIndex()
+	if err != nil {
+		return err
+	}
+	if e := idx.Lookup(old.Serial); e != nil && !e.RevokedAt.IsZero() {
+		return fmt.Errorf("%s (serial %X) is revoked; issue a new certificate instead", crtPath, old.Serial)
+	}
+
+	renewedPEM, err := capki.RenewCert(caCertPEM, caKeyPEM, certPEM, opts.validity)
+	if err != nil {
+		return fmt.Errorf("failed to renew certificate: %s", err)
+	}
+
+	entry, err := capki.NewIndexEntry(renewedPEM)
+	if err != nil {
+		return fmt.Errorf("failed to parse renewed certificate: %s", err)
+	}
+	// The key is unchanged, so only the certificate is replaced.
+	if err := tunnel.WriteFileAtomic(crtPath, renewedPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %s", crtPath, err)
+	}
+	if err := updateIndex(func(idx *capki.Index) error {
+		return idx.Add(entry)
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Certificate renewed:\n  %s (serial %X, expires %s)\n\nClient ID (for -client-ids): %s (was %s)\nSPKI client ID (for -client-ids with -id-mode spki): %s (unchanged)\n",
+		crtPath, entry.Serial, entry.NotAfter.UTC().Format(time.DateOnly), entry.ID, old.ID, entry.SPKIID)
+	return nil
+}
+
+// executeRevoke revokes the certificate with -serial, or every certificate
+// recorded under -name that hasn't expired, as renewals by 'renew' and by
+// the server share the name, along with <out-dir>/tls.crt if the index
+// doesn't know it.
+func executeRevoke() error {
+	caCertPEM, caKeyPEM, err := readCA(opts.caDir)
+	if err != nil {
+		return err
+	}
+
+	idx, err := readIndex()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var entries []*capki.IndexEntry
+	if opts.serial != "" {
+		entries, err = revokedBySerial(idx, now)
+	} else {
+		entries, err = revokedByName(caCertPEM, idx, now)
+	}
+	if err != nil {
+		return err
+	}
+
+	serials := make([]*big.Int, len(entries))
+	for i, e := range entries {
+		serials[i] = e.Serial
+	}
+
+	crlPath := filepath.Join(opts.caDir, "crl.pem")
+	crlPEM, err := os.ReadFile(crlPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %s", crlPath, err)
+	}
+
+	newCRL, err := capki.RevokeSerials(caCertPEM, caKeyPEM, crlPEM, serials, defaultValidity())
+	if err != nil {
+		return fmt.Errorf("failed to revoke certificate: %s", err)
+	}
+
+	if err := tunnel.WriteFileAtomic(crlPath, newCRL, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %s", crlPath, err)
+	}
+
+	if err := updateIndex(func(idx *capki.Index) error {
+		for _, entry := range entries {
+			e := idx.Lookup(entry.Serial)
+			if e == nil {
+				if err := idx.Add(entry); err != nil {
+					return err
+				}
+				e = entry
+			}
+			e.RevokedAt = now
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Certificates revoked:\n")
+	for _, e := range entries {
+		fmt.Printf("  %s (serial %X, client ID %s)\n", e.Name, e.Serial, e.ID)
+	}
+	fmt.Printf("\nCRL updated: %s\nStart the server with -crl %s; a running server picks up changes on its own.\n",
+		crlPath, crlPath)
+	return nil
+}
+
+// revokedBySerial returns the index entry of -serial, if it's valid.
+func revokedBySerial(idx capki.Index, now time.Time) ([]*capki.IndexEntry, error) {
+	serial, _ := new(big.Int).SetString(opts.serial, 16)
+	e := idx.Lookup(serial)
+	if e == nil {
+		return nil, fmt.Errorf("no certificate with serial %X in %s", serial, indexPath())
+	}
+	if status := e.Status(now); status != capki.StatusValid {
+		return nil, fmt.Errorf("certificate with serial %X is already %s", serial, status)
+	}
+	return []*capki.IndexEntry{e}, nil
+}
+
+// revokedByName returns the valid index entries of -name, and an entry for
+// <out-dir>/tls.crt if the index doesn't hold it under that name.
+// Certificates issued before the CA kept an index are added as they get
+// revoked.
+func revokedByName(caCertPEM []byte, idx capki.Index, now time.Time) ([]*capki.IndexEntry, error) {
+	crtPath := filepath.Join(opts.outDir, "tls.crt")
+	certPEM, err := os.ReadFile(crtPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %s", crtPath, err)
+	}
+	var unindexed *capki.IndexEntry
+	if err == nil {
+		if _, err := capki.CheckIssued(caCertPEM, certPEM); err != nil {
+			return nil, fmt.Errorf("%s: %s", crtPath, err)
+		}
+		entry, err := capki.NewIndexEntry(certPEM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", crtPath, err)
+		}
+		if e := idx.Lookup(entry.Serial); e == nil {
+			unindexed = entry
+		} else if e.Name != opts.name && e.Status(now) == capki.StatusValid {
+			// tls.crt was signed from a CSR naming itself differently.
+			unindexed = e
+		}
+	}
+
+	var entries []*capki.IndexEntry
+	for _, e := range idx.Find(opts.name) {
+		if e.Status(now) == capki.StatusValid {
+			entries = append(entries, e)
+		}
+	}
+	if unindexed != nil {
+		entries = append(entries, unindexed)
+	}
+	if len(entries) == 0 {
+		if len(idx.Find(opts.name)) > 0 {
+			return nil, fmt.Errorf("no valid certificate for %q left to revoke", opts.name)
+		}
+		return nil, fmt.Errorf("no certificate for %q in %s and no %s (use -out-dir if it was issued elsewhere)", opts.name, indexPath(), crtPath)
+	}
+	return entries, nil
+}
+
+func indexPath() string {
+	return filepath.Join(opts.caDir, "index.txt")
+}
+
+// readIndex reads -ca-dir's index. A CA without one yet has an empty index.
+func readIndex() (capki.Index, error) {
+	data, err := os.ReadFile(indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %s", indexPath(), err)
+	}
+	idx, err := capki.ParseIndex(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", indexPath(), err)
+	}
+	return idx, nil
+}
+
+// updateIndex applies fn to -ca-dir's index and writes it back.
+func updateIndex(fn func(idx *capki.Index) error) error {
+	idx, err := readIndex()
+	if err != nil {
+		return err
+	}
+	if err := fn(&idx); err != nil {
+		return fmt.Errorf("failed to update %s: %s", indexPath(), err)
+	}
+	if err := tunnel.WriteFileAtomic(indexPath(), idx.Marshal(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %s", indexPath(), err)
+	}
+	return nil
+}
+
+func executeList() error {
+	idx, err := readIndex()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if opts.ids {
+		mode, _ := id.ParseMode(opts.idMode)
+		fmt.Println(idx.ClientIDs(now, mode))
+		return nil
+	}
+
+	if len(idx) == 0 {
+		fmt.Printf("No certificates recorded in %s\n", indexPath())
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tEXPIRES\tSERIAL\tCLIENT ID")
+	for _, e := range idx {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%X\t%s\n", e.Name, e.Status(now), e.NotAfter.UTC().Format(time.DateOnly), e.Serial, e.ID)
+	}
+	return w.Flush()
+}
+
+func executeShow() error {
+	idx, err := readIndex()
+	if err != nil {
+		return err
+	}
+
+	entries := idx.Find(opts.name)
+	if len(entries) == 0 {
+		return fmt.Errorf("no certificate named %q in %s", opts.name, indexPath())
+	}
+
+	now := time.Now()
+	for i, e := range entries {
+		if i > 0 {
+			fmt.Println()
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+		fmt.Fprintf(w, "Name:\t%s\n", e.Name)
+		fmt.Fprintf(w, "Serial:\t%X\n", e.Serial)
+		fmt.Fprintf(w, "Status:\t%s\n", e.Status(now))
+		if len(e.SANs) > 0 {
+			fmt.Fprintf(w, "SANs:\t%s\n", strings.Join(e.SANs, ", "))
+		}
+		fmt.Fprintf(w, "Expires:\t%s\n", e.NotAfter.UTC().Format(time.RFC3339))
+		if !e.RevokedAt.IsZero() {
+			fmt.Fprintf(w, "Revoked:\t%s\n", e.RevokedAt.UTC().Format(time.RFC3339))
+		}
+		fmt.Fprintf(w, "Client ID:\t%s\n", e.ID)
+		if e.SPKIID != (id.ID{}) {
+			fmt.Fprintf(w, "SPKI client ID:\t%s\n", e.SPKIID)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tokensPath() string {
+	return filepath.Join(opts.caDir, "tokens.txt")
+}
+
+func executeToken() error {
+	caCertPEM, _, err := readCA(opts.caDir)
+	if err != nil {
+		return err
+	}
+
+	token, entry, err := capki.NewToken(caCertPEM, opts.name, opts.ttl)
+	if err != nil {
+		return fmt.Errorf("failed to create token: %s", err)
+	}
+	if entry.Permissions, err = permissions(); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(tokensPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %s", tokensPath(), err)
+	}
+	tokens, err := capki.ParseTokens(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %s", tokensPath(), err)
+	}
+	if err := tokens.Add(entry, time.Now()); err != nil {
+		return fmt.Errorf("failed to update %s: %s", tokensPath(), err)
+	}
+	if err := tunnel.WriteFileAtomic(tokensPath(), tokens.Marshal(), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %s", tokensPath(), err)
+	}
 
-	fmt.Printf("Certificate issued:\n  %s\n  %s\n\nClient ID (for -client-ids): %s\n", crtPath, keyPath, fingerprint)
+	fmt.Printf("Enrollment token for %q (expires %s, usable once):\n\n  %s\n\nStart the server with -ca-key %s -enroll-tokens %s, then on the client run:\n  go-stream-tunnel client enroll -server <host:port> -token %s\n",
+		opts.name, entry.Expires.UTC().Format(time.RFC3339), token,
+		filepath.Join(opts.caDir, "ca.key"), tokensPath(), token)
 	return nil
 }
@@ -5,11 +5,21 @@
 package ca
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
 	"io"
 	"os"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
+
+	capki "github.com/ChacheGS/go-stream-tunnel/ca"
 )
 
 func TestCommand_Defaults(t *testing.T) {
@@ -30,6 +40,12 @@ func TestCommand_Defaults(t *testing.T) {
 	if opts.outDir != "" {
 		t.Fatalf("expected default out-dir empty, got %s", opts.outDir)
 	}
+	if opts.keyType != "ecdsa-p256" {
+		t.Fatalf("expected default key-type ecdsa-p256, got %s", opts.keyType)
+	}
+	if opts.validity != 10*365*24*time.Hour {
+		t.Fatalf("expected default validity of 10 years, got %s", opts.validity)
+	}
 }
 
 func TestCommand_CustomFlags(t *testing.T) {
@@ -433,3 +449,937 @@ func captureStdout(t *testing.T, fn func()) string {
 	}
 	return string(out)
 }
+
+func TestCompleteArgs_FlagsAfterCommand(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"revoke", "-name", "laptop"})
+
+	if err := CompleteArgs(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if opts.command != "revoke" || opts.name != "laptop" || opts.outDir != "laptop" {
+		t.Fatalf("expected revoke of laptop, got %q %q %q", opts.command, opts.name, opts.outDir)
+	}
+}
+
+func TestCompleteArgs_RevokeRequiresName(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"revoke"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for revoke without -name")
+	}
+}
+
+func TestCompleteArgs_RevokeRejectsAddr(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"revoke", "-name", "laptop", "-addr", "tunnel.example.com"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for revoke with -addr")
+	}
+}
+
+func TestCompleteArgs_RejectsTrailingArgs(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"issue", "-name", "laptop", "extra"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for trailing arguments")
+	}
+}
+
+func TestExecuteRevoke_WritesCRL(t *testing.T) {
+	dir := t.TempDir()
+	caDir := dir + "/ca"
+
+	Command()
+	opts.caDir = caDir
+	opts.command = "init"
+	if err := Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"laptop", "phone"} {
+		opts.command = "issue"
+		opts.name = name
+		opts.outDir = dir + "/" + name
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"laptop", "phone"} {
+		opts.command = "revoke"
+		opts.name = name
+		opts.outDir = dir + "/" + name
+		stdout := captureStdout(t, func() {
+			if err := Execute(); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if !strings.Contains(stdout, "-crl "+caDir+"/crl.pem") {
+			t.Fatalf("expected output to point at the CRL, got: %s", stdout)
+		}
+	}
+
+	caCertPEM, err := os.ReadFile(caDir + "/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlPEM, err := os.ReadFile(caDir + "/crl.pem")
+	if err != nil {
+		t.Fatalf("expected crl.pem to be created: %v", err)
+	}
+	crl, err := capki.ParseCRL(caCertPEM, crlPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 2 {
+		t.Fatalf("expected 2 revoked certificates, got %d", len(crl.RevokedCertificateEntries))
+	}
+
+	// revoking again fails and leaves the CRL alone
+	opts.name = "laptop"
+	opts.outDir = dir + "/laptop"
+	if err := Execute(); err == nil {
+		t.Fatal("expected error revoking an already revoked certificate")
+	}
+	after, err := os.ReadFile(caDir + "/crl.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(crlPEM) {
+		t.Fatal("expected the CRL to be unchanged")
+	}
+}
+
+func TestExecuteRevoke_MissingCert(t *testing.T) {
+	dir := t.TempDir()
+
+	Command()
+	opts.caDir = dir + "/ca"
+	opts.command = "init"
+	if err := Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.command = "revoke"
+	opts.name = "laptop"
+	opts.outDir = dir + "/laptop"
+	if err := Execute(); err == nil || !strings.Contains(err.Error(), "-out-dir") {
+		t.Fatalf("expected error pointing at -out-dir, got %v", err)
+	}
+}
+
+func TestExecuteRevoke_RevokesRenewals(t *testing.T) {
+	dir := t.TempDir()
+	caDir := dir + "/ca"
+
+	Command()
+	opts.caDir = caDir
+	opts.command = "init"
+	if err := Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.command = "issue"
+	opts.name = "laptop"
+	opts.outDir = dir + "/laptop"
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	opts.command = "renew"
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// a renewal by the server is only in the index, not in tls.crt
+	if err := os.Remove(dir + "/laptop/tls.crt"); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.command = "revoke"
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	caCertPEM, err := os.ReadFile(caDir + "/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlPEM, err := os.ReadFile(caDir + "/crl.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := capki.ParseCRL(caCertPEM, crlPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 2 {
+		t.Fatalf("expected the certificate and its renewal revoked, got %d", len(crl.RevokedCertificateEntries))
+	}
+	idx, err := readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range idx {
+		if e.Status(time.Now()) != capki.StatusRevoked {
+			t.Fatalf("expected serial %X to be revoked in the index", e.Serial)
+		}
+	}
+}
+
+func TestCompleteArgs_RevokeSerial(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{args: []string{"revoke", "-serial", "5F3A9C"}},
+		{args: []string{"revoke", "-serial", "5F3A9C", "-name", "laptop"}, wantErr: true},
+		{args: []string{"revoke", "-serial", "5F3A9C", "-out-dir", "laptop"}, wantErr: true},
+		{args: []string{"revoke", "-serial", "laptop"}, wantErr: true},
+		{args: []string{"issue", "-name", "laptop", "-serial", "5F3A9C"}, wantErr: true},
+	} {
+		cmd := Command()
+		cmd.Parse(tc.args)
+		if err := CompleteArgs(cmd); (err != nil) != tc.wantErr {
+			t.Fatalf("%v: expected error %v, got %v", tc.args, tc.wantErr, err)
+		}
+	}
+}
+
+func TestExecuteRevoke_Serial(t *testing.T) {
+	dir := t.TempDir()
+	caDir := dir + "/ca"
+
+	Command()
+	opts.caDir = caDir
+	opts.command = "init"
+	if err := Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.command = "issue"
+	opts.name = "laptop"
+	opts.outDir = dir + "/laptop"
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	opts.command = "renew"
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	idx, err := readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx) != 2 {
+		t.Fatalf("expected 2 index entries, got %d", len(idx))
+	}
+
+	opts.command = "revoke"
+	opts.name = ""
+	opts.outDir = ""
+	opts.serial = fmt.Sprintf("%X", idx[0].Serial)
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	idx, err = readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx[0].Status(time.Now()) != capki.StatusRevoked || idx[1].Status(time.Now()) != capki.StatusValid {
+		t.Fatal("expected only the first certificate to be revoked")
+	}
+
+	if err := Execute(); err == nil {
+		t.Fatal("expected error revoking a revoked serial again")
+	}
+	opts.serial = "ABCDEF"
+	if err := Execute(); err == nil {
+		t.Fatal("expected error revoking an unknown serial")
+	}
+	opts.serial = ""
+}
+
+func TestCompleteArgs_ShowRequiresName(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"show"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for show without -name")
+	}
+}
+
+func TestCompleteArgs_ListRejectsName(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"list", "-name", "laptop"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for list with -name")
+	}
+}
+
+func TestCompleteArgs_IDsOnlyForList(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"issue", "-name", "laptop", "-ids"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for issue with -ids")
+	}
+}
+
+func TestExecute_IndexListAndShow(t *testing.T) {
+	dir := t.TempDir()
+	caDir := dir + "/ca"
+
+	Command()
+	opts.caDir = caDir
+	opts.command = "init"
+	if err := Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[string]string{}
+	for _, name := range []string{"laptop", "phone"} {
+		opts.command = "issue"
+		opts.name = name
+		opts.outDir = dir + "/" + name
+		out := captureStdout(t, func() {
+			if err := Execute(); err != nil {
+				t.Fatal(err)
+			}
+		})
+		ids[name] = printedID(t, out, "Client ID (for -client-ids):")
+	}
+
+	opts.command = "revoke"
+	opts.name = "phone"
+	opts.outDir = dir + "/phone"
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	idx, err := os.ReadFile(caDir + "/index.txt")
+	if err != nil {
+		t.Fatalf("expected index.txt to be created: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(idx)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "V\t") || !strings.HasPrefix(lines[1], "R\t") {
+		t.Fatalf("expected laptop valid and phone revoked, got:\n%s", idx)
+	}
+
+	opts.command = "list"
+	opts.ids = true
+	out := captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if strings.TrimSpace(out) != ids["laptop"] {
+		t.Fatalf("expected only laptop's ID %q, got %q", ids["laptop"], out)
+	}
+
+	opts.ids = false
+	out = captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(out, "laptop") || !strings.Contains(out, "phone") || !strings.Contains(out, "revoked") {
+		t.Fatalf("expected both certificates in the list, got:\n%s", out)
+	}
+
+	opts.command = "show"
+	opts.name = "phone"
+	out = captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	for _, want := range []string{"Name:", "phone", "Status:", "revoked", "Revoked:", ids["phone"]} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected show output to contain %q, got:\n%s", want, out)
+		}
+	}
+
+	opts.name = "tablet"
+	if err := Execute(); err == nil {
+		t.Fatal("expected error showing an unknown name")
+	}
+}
+
+// printedID returns the ID printed after label in out.
+func printedID(t *testing.T, out, label string) string {
+	t.Helper()
+
+	_, rest, ok := strings.Cut(out, label)
+	if !ok {
+		t.Fatalf("expected %q in output, got:\n%s", label, out)
+	}
+	return strings.Fields(rest)[0]
+}
+
+func TestCompleteArgs_RenewDefaultsOutDir(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"renew", "-name", "laptop"})
+
+	if err := CompleteArgs(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if opts.outDir != "laptop" {
+		t.Fatalf("expected out-dir laptop, got %q", opts.outDir)
+	}
+}
+
+func TestCompleteArgs_RenewRejectsAddr(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"renew", "-name", "laptop", "-addr", "example.com"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for renew with -addr")
+	}
+}
+
+func TestCompleteArgs_ListRejectsUnknownIDMode(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"list", "-ids", "-id-mode", "key"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for an unknown -id-mode")
+	}
+}
+
+func TestExecuteRenew_KeepsKeyAndSPKIID(t *testing.T) {
+	dir := t.TempDir()
+
+	Command()
+	opts.caDir = dir + "/ca"
+	opts.command = "init"
+	if err := Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.command = "issue"
+	opts.name = "laptop"
+	opts.outDir = dir + "/laptop"
+	out := captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	issuedID := printedID(t, out, "Client ID (for -client-ids):")
+	spkiID := printedID(t, out, "SPKI client ID (for -client-ids with -id-mode spki):")
+
+	keyBefore, err := os.ReadFile(dir + "/laptop/tls.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crtBefore, err := os.ReadFile(dir + "/laptop/tls.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.command = "renew"
+	out = captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if got := printedID(t, out, "SPKI client ID (for -client-ids with -id-mode spki):"); got != spkiID {
+		t.Fatalf("expected SPKI ID %s to be unchanged, got %s", spkiID, got)
+	}
+	if got := printedID(t, out, "Client ID (for -client-ids):"); got == issuedID {
+		t.Fatal("expected a new certificate ID")
+	}
+
+	keyAfter, err := os.ReadFile(dir + "/laptop/tls.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(keyAfter) != string(keyBefore) {
+		t.Fatal("expected tls.key to be left alone")
+	}
+	crtAfter, err := os.ReadFile(dir + "/laptop/tls.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(crtAfter) == string(crtBefore) {
+		t.Fatal("expected tls.crt to be replaced")
+	}
+	if _, err := tls.X509KeyPair(crtAfter, keyAfter); err != nil {
+		t.Fatalf("expected the renewed certificate to match the key: %v", err)
+	}
+
+	opts.command = "list"
+	opts.name = ""
+	opts.ids = true
+	opts.idMode = "spki"
+	out = captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if strings.TrimSpace(out) != spkiID {
+		t.Fatalf("expected the SPKI ID once, got %q", out)
+	}
+
+	opts.command = "revoke"
+	opts.name = "laptop"
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	opts.command = "renew"
+	if err := Execute(); err == nil {
+		t.Fatal("expected error renewing a revoked certificate")
+	}
+}
+
+func TestCompleteArgs_TokenRequiresName(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"token", "-ttl", "1h"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for token without -name")
+	}
+}
+
+func TestCompleteArgs_TTLOnlyForToken(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"issue", "-name", "laptop", "-ttl", "1h"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for issue with -ttl")
+	}
+}
+
+func TestExecuteToken_AppendsTokens(t *testing.T) {
+	dir := t.TempDir()
+
+	Command()
+	opts.caDir = dir + "/ca"
+	opts.command = "init"
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	caCertPEM, err := os.ReadFile(dir + "/ca/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.command = "token"
+	var tokens []string
+	for _, name := range []string{"laptop", "desktop"} {
+		opts.name = name
+		if name == "desktop" {
+			opts.allowSubdomains = "desktop"
+		}
+		out := captureStdout(t, func() {
+			if err := Execute(); err != nil {
+				t.Fatal(err)
+			}
+		})
+		lines := strings.Split(out, "\n")
+		if len(lines) < 3 {
+			t.Fatalf("unexpected output %q", out)
+		}
+		token := strings.TrimSpace(lines[2])
+		_, caHash, err := capki.ParseToken(token)
+		if err != nil {
+			t.Fatalf("expected a token on the third line, got %q: %v", lines[2], err)
+		}
+		if want, _ := capki.CAHash(caCertPEM); string(caHash) != string(want) {
+			t.Fatal("expected the token to pin the CA")
+		}
+		tokens = append(tokens, token)
+	}
+
+	info, err := os.Stat(dir + "/ca/tokens.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Fatalf("expected tokens.txt mode 0600, got %o", info.Mode().Perm())
+	}
+	data, err := os.ReadFile(dir + "/ca/tokens.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := capki.ParseTokens(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("expected 2 tokens, got %d", len(stored))
+	}
+	if stored[0].Permissions != nil {
+		t.Fatalf("expected no permissions for laptop, got %+v", stored[0].Permissions)
+	}
+	if p := stored[1].Permissions; p == nil || !p.AllowsSubdomain("desktop") || p.AllowsSubdomain("laptop") {
+		t.Fatalf("expected desktop's token to carry its permissions, got %+v", p)
+	}
+	for _, token := range tokens {
+		secret, _, _ := capki.ParseToken(token)
+		if strings.Contains(string(data), secret) {
+			t.Fatal("expected token secrets not to be stored")
+		}
+	}
+}
+
+func TestCompleteArgs_SignRequiresCSR(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"sign", "-name", "laptop"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for sign without -csr")
+	}
+}
+
+func TestCompleteArgs_CSROnlyForSign(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"issue", "-name", "laptop", "-csr", "laptop.csr"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for issue with -csr")
+	}
+}
+
+func TestExecuteSign_WritesOnlyCert(t *testing.T) {
+	dir := t.TempDir()
+
+	Command()
+	opts.caDir = dir + "/ca"
+	opts.command = "init"
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	key, keyPEM, err := capki.GenerateKey(capki.ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "hsm-laptop"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPath := dir + "/laptop.csr"
+	if err := os.WriteFile(csrPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.command = "sign"
+	opts.csr = csrPath
+	opts.outDir = dir + "/laptop"
+	opts.allowPorts = "8000"
+	out := captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	certPEM, err := os.ReadFile(dir + "/laptop/tls.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatalf("expected the certificate to match the CSR's key: %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms, err := capki.PermissionsFromCert(cert); err != nil || perms == nil || !perms.AllowsPort(8000) || perms.AllowsPort(8001) {
+		t.Fatalf("expected the certificate to carry -allow-ports, got %+v, %v", perms, err)
+	}
+	if _, err := os.Stat(dir + "/laptop/tls.key"); !os.IsNotExist(err) {
+		t.Fatal("expected no key to be written")
+	}
+	if !strings.Contains(out, `"hsm-laptop"`) {
+		t.Fatalf("expected the CSR's name in the output, got %q", out)
+	}
+
+	idx, err := readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Find("hsm-laptop")) != 1 {
+		t.Fatal("expected the signed certificate to be recorded in the index")
+	}
+
+	if err := Execute(); err == nil {
+		t.Fatal("expected error overwriting an existing certificate")
+	}
+}
+
+func TestCompleteArgs_InitIntermediateRequiresRootDir(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"init-intermediate"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for init-intermediate without -root-dir")
+	}
+
+	cmd = Command()
+	cmd.Parse([]string{"init-intermediate", "-root-dir", "ca"})
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for -root-dir equal to -ca-dir")
+	}
+}
+
+func TestExecuteInitIntermediate_IssuesChains(t *testing.T) {
+	dir := t.TempDir()
+
+	Command()
+	opts.caDir = dir + "/root"
+	opts.command = "init"
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	opts.caDir = dir + "/ca"
+	opts.rootDir = dir + "/root"
+	opts.command = "init-intermediate"
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err := Execute(); err == nil {
+		t.Fatal("expected error overwriting an existing intermediate")
+	}
+
+	opts.command = "issue"
+	opts.name = "laptop"
+	opts.outDir = dir + "/laptop"
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	rootPEM, err := os.ReadFile(dir + "/root/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainPEM, err := os.ReadFile(dir + "/ca/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(chainPEM), string(rootPEM)) {
+		t.Fatal("expected the intermediate's ca.crt to end with the root")
+	}
+
+	crtPEM, err := os.ReadFile(dir + "/laptop/tls.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certs []*x509.Certificate
+	for rest := crtPEM; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("expected tls.crt to hold the leaf and the intermediate, got %d certificates", len(certs))
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(rootPEM)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(certs[1])
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Fatalf("expected the issued chain to verify against the root: %v", err)
+	}
+}
+
+func TestCompleteArgs_KeyTypeAndValidity(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{args: []string{"init", "-key-type", "rsa-3072", "-validity", "720h"}},
+		{args: []string{"issue", "-name", "laptop", "-key-type", "ed25519"}},
+		{args: []string{"issue", "-name", "laptop", "-key-type", "dsa"}, wantErr: true},
+		{args: []string{"issue", "-name", "laptop", "-validity", "0s"}, wantErr: true},
+		{args: []string{"renew", "-name", "laptop", "-validity", "720h"}},
+		{args: []string{"renew", "-name", "laptop", "-key-type", "ed25519"}, wantErr: true},
+		{args: []string{"sign", "-csr", "laptop.csr", "-key-type", "ed25519"}, wantErr: true},
+		{args: []string{"revoke", "-name", "laptop", "-validity", "720h"}, wantErr: true},
+	} {
+		cmd := Command()
+		cmd.Parse(tt.args)
+
+		err := CompleteArgs(cmd)
+		if tt.wantErr && err == nil {
+			t.Errorf("%v: expected error", tt.args)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.args, err)
+		}
+	}
+}
+
+func TestExecuteIssue_KeyTypeAndValidity(t *testing.T) {
+	dir := t.TempDir()
+
+	cmd := Command()
+	cmd.Parse([]string{"init", "-ca-dir", dir + "/ca", "-key-type", "ecdsa-p384"})
+	if err := CompleteArgs(cmd); err != nil {
+		t.Fatal(err)
+	}
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	cmd = Command()
+	cmd.Parse([]string{"issue", "-ca-dir", dir + "/ca", "-name", "laptop", "-out-dir", dir + "/laptop", "-key-type", "ed25519", "-validity", "720h"})
+	if err := CompleteArgs(cmd); err != nil {
+		t.Fatal(err)
+	}
+	captureStdout(t, func() {
+		if err := Execute(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	keyPEM, err := os.ReadFile(dir + "/laptop/tls.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatal("expected a PKCS#8 key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(ed25519.PrivateKey); !ok {
+		t.Fatalf("expected an Ed25519 key, got %T", key)
+	}
+
+	certPEM, err := os.ReadFile(dir + "/laptop/tls.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ = pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left := time.Until(cert.NotAfter); left > 720*time.Hour || left < 719*time.Hour {
+		t.Fatalf("expected the certificate to be valid for 720h, got %s", left)
+	}
+}
+
+func TestCompleteArgs_AllowFlagsOnlyForIssueSignAndToken(t *testing.T) {
+	cmd := Command()
+	cmd.Parse([]string{"renew", "-name", "laptop", "-allow-ports", "8000"})
+
+	if err := CompleteArgs(cmd); err == nil {
+		t.Fatal("expected error for renew with -allow-ports")
+	}
+
+	for _, args := range [][]string{
+		{"sign", "-csr", "laptop.csr", "-allow-ports", "8000"},
+		{"token", "-name", "laptop", "-allow-subdomains", "laptop"},
+	} {
+		cmd := Command()
+		cmd.Parse(args)
+
+		if err := CompleteArgs(cmd); err != nil {
+			t.Errorf("%v: %s", args, err)
+		}
+	}
+}
+
+func TestCompleteArgs_IssueRejectsInvalidPermissions(t *testing.T) {
+	for _, args := range [][]string{
+		{"issue", "-name", "alice", "-allow-ports", "8100-8000"},
+		{"issue", "-name", "alice", "-allow-subdomains", "alice.example.com"},
+		{"sign", "-csr", "alice.csr", "-allow-ports", "0"},
+		{"token", "-name", "alice", "-allow-subdomains", "alice.example.com"},
+	} {
+		cmd := Command()
+		cmd.Parse(args)
+
+		if err := CompleteArgs(cmd); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
+
+func TestExecuteIssue_EmbedsPermissions(t *testing.T) {
+	dir := t.TempDir()
+
+	Command()
+	opts.caDir = dir + "/ca"
+	opts.command = "init"
+	if err := Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.command = "issue"
+	opts.name = "alice"
+	opts.outDir = dir + "/alice"
+	opts.allowPorts = "8000-8100"
+	opts.allowSubdomains = "alice-*"
+	if err := Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM, err := os.ReadFile(opts.outDir + "/tls.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	perms, err := capki.PermissionsFromCert(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms == nil || !perms.AllowsPort(8050) || perms.AllowsPort(9000) || !perms.AllowsSubdomain("alice-app") || perms.AllowsSubdomain("bob") {
+		t.Fatalf("unexpected permissions %+v", perms)
+	}
+}
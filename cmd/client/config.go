@@ -40,10 +40,66 @@ type Tunnel struct {
 	Protocol   string `yaml:"proto,omitempty"`
 	Addr       string `yaml:"addr,omitempty"`
 	RemoteAddr string `yaml:"remote_addr,omitempty"`
-	// Subdomain is used by proto "http" tunnels: the tunnel becomes
-	// reachable at <Subdomain>.<server's base domain>. Defaults to the
-	// tunnel's own key in the tunnels map if omitted.
+	// Subdomain is used by proto "http" and "tls" tunnels: the tunnel becomes
+	// reachable at <Subdomain>.<server's base domain>. It may span several
+	// labels, "api.alice", or be a wildcard, "*.alice", matching every
+	// subdomain below alice. Defaults to the tunnel's own key in the
+	// tunnels map if omitted.
 	Subdomain string `yaml:"subdomain,omitempty"`
+	// Hostname, set instead of Subdomain, makes a proto "http" tunnel
+	// reachable at a custom hostname outside of the server's base domain,
+	// typically a CNAME to it. The server must allow the hostname.
+	Hostname string `yaml:"hostname,omitempty"`
+	// PathPrefix limits a proto "http" tunnel to the requests for paths
+	// under it, e.g. "/api", so other tunnels, of this or other clients,
+	// can serve the rest of the same host.
+	PathPrefix string `yaml:"path_prefix,omitempty"`
+	// HostHeader sets the Host header of the requests a proto "http"
+	// tunnel forwards: "preserve", the default, keeps the public host,
+	// "rewrite" replaces it with Addr, anything else with itself.
+	HostHeader string `yaml:"host_header,omitempty"`
+	// RequestHeaders and ResponseHeaders add and remove headers of the
+	// requests and responses a proto "http" tunnel forwards.
+	RequestHeaders  *HeaderRules `yaml:"request_headers,omitempty"`
+	ResponseHeaders *HeaderRules `yaml:"response_headers,omitempty"`
+}
+
+// HeaderRules add and remove headers. Removing and adding the same header
+// replaces it.
+type HeaderRules struct {
+	Add    map[string]string `yaml:"add,omitempty"`
+	Remove []string          `yaml:"remove,omitempty"`
+}
+
+// protoRules returns r as sent to the server, nil if r is.
+func (r *HeaderRules) protoRules() *proto.HeaderRules {
+	if r == nil {
+		return nil
+	}
+	return &proto.HeaderRules{Add: r.Add, Remove: r.Remove}
+}
+
+// hostHeader returns the Host header the server sets on the requests to
+// the http tunnel t, empty to keep the public host.
+func (t *Tunnel) hostHeader() string {
+	switch t.HostHeader {
+	case "", "preserve":
+		return ""
+	case "rewrite":
+		return t.Addr
+	default:
+		return t.HostHeader
+	}
+}
+
+// key returns what the server identifies the http or tls tunnel t by when
+// forwarding connections to it: its Hostname if set, otherwise its
+// Subdomain, followed by its PathPrefix.
+func (t *Tunnel) key() string {
+	if t.Hostname != "" {
+		return t.Hostname + t.PathPrefix
+	}
+	return t.Subdomain + t.PathPrefix
 }
 
 // ClientConfig is a tunnel client configuration.
@@ -107,17 +163,17 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 			if err := completeTCP(t); err != nil {
 				return nil, fmt.Errorf("%s %s", name, err)
 			}
-		case proto.HTTP:
+		case proto.HTTP, proto.TLS:
 			if err := completeHTTP(t, name); err != nil {
 				return nil, fmt.Errorf("%s %s", name, err)
 			}
 			// Two tunnels sharing a subdomain would silently overwrite
 			// each other's local target in the proxy's dial-target map,
 			// with no error surfaced at connection time.
-			if other, ok := subdomains[t.Subdomain]; ok {
-				return nil, fmt.Errorf("%s and %s: subdomain %q used by more than one tunnel", other, name, t.Subdomain)
+			if other, ok := subdomains[t.key()]; ok {
+				return nil, fmt.Errorf("%s and %s: %q used by more than one tunnel", other, name, t.key())
 			}
-			subdomains[t.Subdomain] = name
+			subdomains[t.key()] = name
 		default:
 			return nil, fmt.Errorf("%s invalid protocol %q", name, t.Protocol)
 		}
@@ -149,11 +205,11 @@ func completeTCP(t *Tunnel) error {
 	return nil
 }
 
-// completeHTTP validates and fills in defaults for an http tunnel. name is
-// the tunnel's own key in the tunnels map, used as the default subdomain
-// when one isn't given explicitly, so a config doesn't have to repeat the
-// same name twice (tunnels: myapp: proto: http ... rather than also writing
-// subdomain: myapp).
+// completeHTTP validates and fills in defaults for an http or tls tunnel.
+// name is the tunnel's own key in the tunnels map, used as the default
+// subdomain when one isn't given explicitly, so a config doesn't have to
+// repeat the same name twice (tunnels: myapp: proto: http ... rather than
+// also writing subdomain: myapp).
 func completeHTTP(t *Tunnel, name string) error {
 	var err error
 	if t.Addr == "" {
@@ -163,20 +219,75 @@ func completeHTTP(t *Tunnel, name string) error {
 		return fmt.Errorf("addr: %s", err)
 	}
 
+	if t.PathPrefix != "" {
+		if t.Protocol != proto.HTTP {
+			return fmt.Errorf("path_prefix: not supported for proto %s", t.Protocol)
+		}
+		if !proto.ValidPathPrefix(t.PathPrefix) {
+			return fmt.Errorf("path_prefix: %q is not a valid path prefix (an absolute path like /api, without a trailing slash)", t.PathPrefix)
+		}
+	}
+
+	if err := completeHeaders(t); err != nil {
+		return err
+	}
+
+	if t.Hostname != "" {
+		if t.Protocol != proto.HTTP {
+			return fmt.Errorf("hostname: not supported for proto %s", t.Protocol)
+		}
+		if t.Subdomain != "" {
+			return fmt.Errorf("hostname: can't be used with subdomain")
+		}
+		if !proto.ValidHostname(t.Hostname) {
+			return fmt.Errorf("hostname: %q is not a valid hostname", t.Hostname)
+		}
+		if t.RemoteAddr != "" {
+			return fmt.Errorf("remote_addr: not supported for proto %s, use hostname instead", t.Protocol)
+		}
+		return nil
+	}
+
 	defaulted := false
 	if t.Subdomain == "" {
 		t.Subdomain = name
 		defaulted = true
 	}
-	if !proto.ValidSubdomainLabel(t.Subdomain) {
+	if !proto.ValidSubdomain(t.Subdomain) {
 		if defaulted {
-			return fmt.Errorf("subdomain: tunnel name %q is not a valid DNS label (lowercase letters, digits, hyphens only, no leading/trailing hyphen); add an explicit subdomain field to override it", t.Subdomain)
+			return fmt.Errorf("subdomain: tunnel name %q is not a valid subdomain (dot-separated DNS labels of lowercase letters, digits, hyphens only, no leading/trailing hyphen); add an explicit subdomain field to override it", t.Subdomain)
 		}
-		return fmt.Errorf("subdomain: %q is not a valid DNS label (lowercase letters, digits, hyphens only, no leading/trailing hyphen)", t.Subdomain)
+		return fmt.Errorf("subdomain: %q is not a valid subdomain (dot-separated DNS labels of lowercase letters, digits, hyphens only, no leading/trailing hyphen, optionally starting with \"*.\")", t.Subdomain)
 	}
 	if t.RemoteAddr != "" {
-		return fmt.Errorf("remote_addr: not supported for proto http, use subdomain instead")
+		return fmt.Errorf("remote_addr: not supported for proto %s, use subdomain instead", t.Protocol)
+	}
+
+	return nil
+}
+
+// completeHeaders validates the header options of an http or tls tunnel.
+func completeHeaders(t *Tunnel) error {
+	if t.Protocol != proto.HTTP {
+		switch {
+		case t.HostHeader != "":
+			return fmt.Errorf("host_header: not supported for proto %s", t.Protocol)
+		case t.RequestHeaders != nil:
+			return fmt.Errorf("request_headers: not supported for proto %s", t.Protocol)
+		case t.ResponseHeaders != nil:
+			return fmt.Errorf("response_headers: not supported for proto %s", t.Protocol)
+		}
+		return nil
 	}
 
+	if h := t.hostHeader(); h != "" && !proto.ValidHostHeader(h) {
+		return fmt.Errorf("host_header: %q is not rewrite, preserve or a valid host", t.HostHeader)
+	}
+	if t.RequestHeaders != nil && !proto.ValidHeaderRules(t.RequestHeaders.protoRules()) {
+		return fmt.Errorf("request_headers: invalid header name or value, or a header framing messages like Content-Length")
+	}
+	if t.ResponseHeaders != nil && !proto.ValidHeaderRules(t.ResponseHeaders.protoRules()) {
+		return fmt.Errorf("response_headers: invalid header name or value, or a header framing messages like Content-Length")
+	}
 	return nil
 }
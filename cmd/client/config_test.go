@@ -350,6 +350,49 @@ tunnels:
 	}
 }
 
+func TestLoadClientConfigFromFile_TLSTunnel(t *testing.T) {
+	t.Parallel()
+
+	content := `
+server_addr: 192.168.1.1:5223
+tunnels:
+  secure:
+    proto: tls
+    addr: localhost:8443
+`
+	f := writeTempFile(t, content)
+
+	c, err := loadClientConfigFromFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secure := c.Tunnels["secure"]
+	if secure.Addr != "localhost:8443" {
+		t.Fatalf("expected addr localhost:8443, got %s", secure.Addr)
+	}
+	if secure.Subdomain != "secure" {
+		t.Fatalf("expected subdomain to default to tunnel name secure, got %s", secure.Subdomain)
+	}
+
+	// the proxy's dial-target map is shared with http tunnels
+	content = `
+server_addr: 192.168.1.1:5223
+tunnels:
+  web:
+    proto: http
+    addr: localhost:3000
+    subdomain: shared
+  secure:
+    proto: tls
+    addr: localhost:8443
+    subdomain: shared
+`
+	if _, err := loadClientConfigFromFile(writeTempFile(t, content)); err == nil {
+		t.Fatal("expected error for a subdomain shared by an http and a tls tunnel")
+	}
+}
+
 func TestLoadClientConfigFromFile_HTTPTunnel_SubdomainDefaultsToName(t *testing.T) {
 	t.Parallel()
 
@@ -423,6 +466,76 @@ tunnels:
 	}
 }
 
+func TestLoadClientConfigFromFile_PathPrefix(t *testing.T) {
+	t.Parallel()
+
+	// tunnels sharing a subdomain are told apart by their path prefixes
+	content := `
+server_addr: 192.168.1.1:5223
+tunnels:
+  web:
+    proto: http
+    addr: localhost:3000
+    subdomain: shared
+  api:
+    proto: http
+    addr: localhost:4000
+    subdomain: shared
+    path_prefix: /api
+`
+	c, err := loadClientConfigFromFile(writeTempFile(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := c.Tunnels["api"].key(); key != "shared/api" {
+		t.Fatalf("expected key shared/api, got %q", key)
+	}
+
+	content += `
+  api2:
+    proto: http
+    addr: localhost:5000
+    subdomain: shared
+    path_prefix: /api
+`
+	if _, err := loadClientConfigFromFile(writeTempFile(t, content)); err == nil {
+		t.Fatal("expected error for a path prefix used by more than one tunnel")
+	}
+}
+
+func TestLoadClientConfigFromFile_HeaderRules(t *testing.T) {
+	t.Parallel()
+
+	content := `
+server_addr: 192.168.1.1:5223
+tunnels:
+  web:
+    proto: http
+    addr: localhost:3000
+    host_header: rewrite
+    request_headers:
+      add:
+        X-Env: dev
+      remove: [Cookie]
+    response_headers:
+      remove: [Server]
+`
+	c, err := loadClientConfigFromFile(writeTempFile(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := c.Tunnels["web"]
+	if web.HostHeader != "rewrite" {
+		t.Fatalf("expected host_header rewrite, got %q", web.HostHeader)
+	}
+	if web.RequestHeaders.Add["X-Env"] != "dev" || len(web.RequestHeaders.Remove) != 1 || web.RequestHeaders.Remove[0] != "Cookie" {
+		t.Fatalf("unexpected request_headers %+v", web.RequestHeaders)
+	}
+	if len(web.ResponseHeaders.Remove) != 1 || web.ResponseHeaders.Remove[0] != "Server" {
+		t.Fatalf("unexpected response_headers %+v", web.ResponseHeaders)
+	}
+}
+
 func TestCompleteHTTP(t *testing.T) {
 	t.Parallel()
 
@@ -458,7 +571,7 @@ func TestCompleteHTTP(t *testing.T) {
 			tunnelName:  "My_App",
 			tunnel:      Tunnel{Protocol: "http", Addr: "localhost:8080"},
 			wantErr:     true,
-			errContains: "not a valid DNS label",
+			errContains: "not a valid subdomain",
 		},
 		{
 			name:        "remote_addr not allowed",
@@ -468,18 +581,112 @@ func TestCompleteHTTP(t *testing.T) {
 			errContains: "remote_addr: not supported",
 		},
 		{
-			name:        "subdomain with dot rejected",
+			name:       "multi-level subdomain",
+			tunnelName: "myapp",
+			tunnel:     Tunnel{Protocol: "http", Addr: "localhost:8080", Subdomain: "api.alice"},
+			wantSubdom: "api.alice",
+		},
+		{
+			name:       "wildcard subdomain",
+			tunnelName: "myapp",
+			tunnel:     Tunnel{Protocol: "http", Addr: "localhost:8080", Subdomain: "*.alice"},
+			wantSubdom: "*.alice",
+		},
+		{
+			name:        "subdomain with empty label rejected",
 			tunnelName:  "myapp",
-			tunnel:      Tunnel{Protocol: "http", Addr: "localhost:8080", Subdomain: "my.app"},
+			tunnel:      Tunnel{Protocol: "http", Addr: "localhost:8080", Subdomain: "my..app"},
 			wantErr:     true,
-			errContains: "not a valid DNS label",
+			errContains: "not a valid subdomain",
+		},
+		{
+			name:        "bare wildcard rejected",
+			tunnelName:  "myapp",
+			tunnel:      Tunnel{Protocol: "http", Addr: "localhost:8080", Subdomain: "*"},
+			wantErr:     true,
+			errContains: "not a valid subdomain",
 		},
 		{
 			name:        "uppercase subdomain rejected",
 			tunnelName:  "myapp",
 			tunnel:      Tunnel{Protocol: "http", Addr: "localhost:8080", Subdomain: "MyApp"},
 			wantErr:     true,
-			errContains: "not a valid DNS label",
+			errContains: "not a valid subdomain",
+		},
+		{
+			name:       "hostname leaves subdomain empty",
+			tunnelName: "myapp",
+			tunnel:     Tunnel{Protocol: "http", Addr: "localhost:8080", Hostname: "app.example.org"},
+			wantSubdom: "",
+		},
+		{
+			name:        "hostname with subdomain rejected",
+			tunnelName:  "myapp",
+			tunnel:      Tunnel{Protocol: "http", Addr: "localhost:8080", Subdomain: "myapp", Hostname: "app.example.org"},
+			wantErr:     true,
+			errContains: "can't be used with subdomain",
+		},
+		{
+			name:        "single label hostname rejected",
+			tunnelName:  "myapp",
+			tunnel:      Tunnel{Protocol: "http", Addr: "localhost:8080", Hostname: "localhost"},
+			wantErr:     true,
+			errContains: "not a valid hostname",
+		},
+		{
+			name:       "path prefix",
+			tunnelName: "myapp",
+			tunnel:     Tunnel{Protocol: "http", Addr: "localhost:8080", PathPrefix: "/api/v1"},
+			wantSubdom: "myapp",
+		},
+		{
+			name:        "path prefix with trailing slash rejected",
+			tunnelName:  "myapp",
+			tunnel:      Tunnel{Protocol: "http", Addr: "localhost:8080", PathPrefix: "/api/"},
+			wantErr:     true,
+			errContains: "not a valid path prefix",
+		},
+		{
+			name:        "path prefix on tls tunnel rejected",
+			tunnelName:  "myapp",
+			tunnel:      Tunnel{Protocol: "tls", Addr: "localhost:8443", PathPrefix: "/api"},
+			wantErr:     true,
+			errContains: "path_prefix: not supported for proto tls",
+		},
+		{
+			name:       "header rules",
+			tunnelName: "myapp",
+			tunnel: Tunnel{Protocol: "http", Addr: "localhost:8080", HostHeader: "rewrite",
+				RequestHeaders: &HeaderRules{Add: map[string]string{"X-Env": "dev"}, Remove: []string{"Cookie"}}},
+			wantSubdom: "myapp",
+		},
+		{
+			name:        "invalid host header rejected",
+			tunnelName:  "myapp",
+			tunnel:      Tunnel{Protocol: "http", Addr: "localhost:8080", HostHeader: "local host"},
+			wantErr:     true,
+			errContains: "host_header: \"local host\" is not rewrite, preserve or a valid host",
+		},
+		{
+			name:        "framing response header rejected",
+			tunnelName:  "myapp",
+			tunnel:      Tunnel{Protocol: "http", Addr: "localhost:8080", ResponseHeaders: &HeaderRules{Remove: []string{"Transfer-Encoding"}}},
+			wantErr:     true,
+			errContains: "response_headers: invalid header",
+		},
+		{
+			name:        "header rules on tls tunnel rejected",
+			tunnelName:  "myapp",
+			tunnel:      Tunnel{Protocol: "tls", Addr: "localhost:8443", RequestHeaders: &HeaderRules{}},
+			wantErr:     true,
+			errContains: "request_headers: not supported for proto tls",
+		},
+		{
+			name:        "hostname on tls tunnel rejected",
+			tunnelName:  "myapp",
+			tunnel:      Tunnel{Protocol: "tls", Addr: "localhost:8443", Hostname: "app.example.org"},
+			wantErr:     true,
+			errContains: "not supported for proto tls",
 		},
 	}
 
@@ -10,6 +10,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"net"
@@ -17,6 +18,7 @@ import (
 	"sort"
 
 	tunnel "github.com/ChacheGS/go-stream-tunnel"
+	capki "github.com/ChacheGS/go-stream-tunnel/ca"
 	"github.com/ChacheGS/go-stream-tunnel/id"
 	"github.com/ChacheGS/go-stream-tunnel/log"
 	"github.com/ChacheGS/go-stream-tunnel/proto"
@@ -31,14 +33,18 @@ options:
 const usage2 string = `
 Commands:
 	go-stream-tunnel client id                      Show client identifier
+	go-stream-tunnel client -id-mode spki id        Show client identifier for a server run with -id-mode spki
 	go-stream-tunnel client list                    List tunnel names from config file
 	go-stream-tunnel client start [tunnel] [...]    Start tunnels by name from config file
 	go-stream-tunnel client start-all               Start all tunnels defined in config file
+	go-stream-tunnel client enroll -server <host[:port]> -token <token>
+	                                                Get a certificate from the server with a token from 'go-stream-tunnel ca token'
 
 Examples:
 	go-stream-tunnel client start www ssh
 	go-stream-tunnel client -config config.yaml -log-level 2 start ssh
 	go-stream-tunnel client start-all
+	go-stream-tunnel client enroll -server tunnel.example.com -token <token>
 
 config.yaml:
 	server_addr: SERVER_IP:5223
@@ -57,6 +63,10 @@ config.yaml:
 
 `
 
+// defaultServerPort is the port of the server's default -addr, used by
+// 'enroll' when -server has none.
+const defaultServerPort = "5223"
+
 type options struct {
 	config    string
 	tlsCrt    string
@@ -65,9 +75,13 @@ type options struct {
 	tlsCrtSet bool
 	tlsKeySet bool
 	rootCASet bool
+	idMode    string
+	server    string
+	token     string
 	command   string
 	args      []string
 	logLevel  int
+	logFormat string
 }
 
 var opts options
@@ -88,7 +102,11 @@ func Command() *flag.FlagSet {
 	cmd.StringVar(&opts.tlsCrt, "tls-crt", "tls.crt", "Path to a TLS certificate file; falls back to tls_crt in the config file if not set")
 	cmd.StringVar(&opts.tlsKey, "tls-key", "tls.key", "Path to a TLS key file; falls back to tls_key in the config file if not set")
 	cmd.StringVar(&opts.rootCA, "ca-crt", "ca.crt", "Path to the trusted certificate chain used for server certificate authentication; falls back to ca_crt in the config file if not set")
+	cmd.StringVar(&opts.idMode, "id-mode", string(id.ModeCert), "For 'id', the server's -id-mode to show the identifier for: cert or spki")
+	cmd.StringVar(&opts.server, "server", "", "For 'enroll', the server address; defaults to server_addr in the config file")
+	cmd.StringVar(&opts.token, "token", "", "For 'enroll', the enrollment token from 'go-stream-tunnel ca token'")
 	cmd.IntVar(&opts.logLevel, "log-level", 1, "Level of messages to log, 0-3")
+	cmd.StringVar(&opts.logFormat, "log-format", log.FormatText, "Log output format: text, json or logfmt")
 
 	return cmd
 }
@@ -133,6 +151,19 @@ func CompleteArgs(fs *flag.FlagSet) error {
 		if len(opts.args) > 0 {
 			return fmt.Errorf("start-all takes no arguments")
 		}
+	case "enroll":
+		// -server and -token come after the command, as in
+		// "client enroll -token ...".
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+		opts.args = fs.Args()
+		if len(opts.args) > 0 {
+			return fmt.Errorf("enroll takes no arguments")
+		}
+		if opts.token == "" {
+			return fmt.Errorf("enroll requires -token")
+		}
 	default:
 		return fmt.Errorf("unknown command %q", opts.command)
 	}
@@ -140,7 +171,15 @@ func CompleteArgs(fs *flag.FlagSet) error {
 }
 
 func Execute(ctx context.Context) error {
-	logger := log.NewFilterLogger(log.NewStdLogger(), opts.logLevel)
+	base, err := log.NewFormatLogger(opts.logFormat, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("-log-format: %s", err)
+	}
+	logger := log.NewFilterLogger(base, opts.logLevel)
+
+	if opts.command == "enroll" {
+		return executeEnroll(ctx)
+	}
 
 	// read configuration file
 	config, err := loadClientConfigFromFile(opts.config)
@@ -154,6 +193,10 @@ func Execute(ctx context.Context) error {
 
 	switch opts.command {
 	case "id":
+		idMode, err := id.ParseMode(opts.idMode)
+		if err != nil {
+			return fmt.Errorf("-id-mode: %s", err)
+		}
 		if err := tunnel.CheckPrivateKeyPermissions(opts.tlsKey); err != nil {
 			return fmt.Errorf("failed to load key pair: %s", err)
 		}
@@ -165,7 +208,7 @@ func Execute(ctx context.Context) error {
 		if err != nil {
 			return fmt.Errorf("failed to parse certificate: %s", err)
 		}
-		fmt.Println(id.New(x509Cert.Raw))
+		fmt.Println(id.FromCert(x509Cert, idMode))
 
 		return nil
 	case "list":
@@ -214,7 +257,10 @@ func Execute(ctx context.Context) error {
 		Backoff:         expBackoff(config.Backoff),
 		Tunnels:         tunnels(config.Tunnels),
 		Proxy:           proxy(config.Tunnels, logger),
-		Logger:          logger,
+		// renewed certificates replace the one we started with, servers
+		// run without -ca-key never offer one
+		CertFile: opts.tlsCrt,
+		Logger:   logger,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create client: %s", err)
@@ -223,6 +269,70 @@ func Execute(ctx context.Context) error {
 	return client.Start(ctx)
 }
 
+// executeEnroll generates a key pair and gets its certificate from the
+// server. The config file is optional here, as enrolling is usually done
+// before there is one; if it exists, its server_addr and paths are used.
+func executeEnroll(ctx context.Context) error {
+	if _, err := os.Stat(opts.config); err == nil {
+		config, err := loadClientConfigFromFile(opts.config)
+		if err != nil {
+			return fmt.Errorf("configuration error: %s", err)
+		}
+		opts.tlsCrt = resolvePath(opts.tlsCrt, opts.tlsCrtSet, config.TLSCrt)
+		opts.tlsKey = resolvePath(opts.tlsKey, opts.tlsKeySet, config.TLSKey)
+		opts.rootCA = resolvePath(opts.rootCA, opts.rootCASet, config.CACrt)
+		if opts.server == "" {
+			opts.server = config.ServerAddr
+		}
+	}
+
+	if opts.server == "" {
+		return fmt.Errorf("enroll requires -server")
+	}
+	addr := opts.server
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultServerPort)
+	}
+
+	for _, path := range []string{opts.tlsCrt, opts.tlsKey} {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists; refusing to overwrite", path)
+		}
+	}
+
+	key, keyPEM, err := capki.GenerateKey(capki.ECDSAP256)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %s", err)
+	}
+
+	certPEM, caCertPEM, err := tunnel.Enroll(ctx, addr, opts.token, key)
+	if err != nil {
+		return fmt.Errorf("enrollment failed: %s", err)
+	}
+
+	if err := os.WriteFile(opts.tlsKey, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %s", opts.tlsKey, err)
+	}
+	if err := os.WriteFile(opts.tlsCrt, certPEM, 0644); err != nil {
+		os.Remove(opts.tlsKey)
+		return fmt.Errorf("failed to write %s: %s", opts.tlsCrt, err)
+	}
+	if err := tunnel.WriteFileAtomic(opts.rootCA, caCertPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %s", opts.rootCA, err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %s", err)
+	}
+
+	fmt.Printf("Enrolled as %q:\n  %s\n  %s\n  %s\n\nClient ID (for -client-ids): %s\nSPKI client ID (for -client-ids with -id-mode spki): %s\n",
+		cert.Subject.CommonName, opts.tlsCrt, opts.tlsKey, opts.rootCA,
+		id.FromCert(cert, id.ModeCert), id.FromCert(cert, id.ModeSPKI))
+	return nil
+}
+
 func tlsConfig(config *ClientConfig) (*tls.Config, error) {
 	if err := tunnel.CheckPrivateKeyPermissions(opts.tlsKey); err != nil {
 		return nil, err
@@ -278,8 +388,15 @@ func tunnels(m map[string]*Tunnel) map[string]*proto.Tunnel {
 			Protocol: t.Protocol,
 			Addr:     t.RemoteAddr,
 		}
-		if t.Protocol == proto.HTTP {
+		if t.Protocol == proto.HTTP || t.Protocol == proto.TLS {
 			pt.Host = t.Subdomain
+			pt.Hostname = t.Hostname
+			pt.PathPrefix = t.PathPrefix
+		}
+		if t.Protocol == proto.HTTP {
+			pt.HostHeader = t.hostHeader()
+			pt.RequestHeaders = t.RequestHeaders.protoRules()
+			pt.ResponseHeaders = t.ResponseHeaders.protoRules()
 		}
 		p[name] = pt
 	}
@@ -294,8 +411,8 @@ func proxy(m map[string]*Tunnel, logger log.Logger) tunnel.ProxyFunc {
 		switch t.Protocol {
 		case proto.TCP, proto.TCP4, proto.TCP6:
 			tcpAddr[t.RemoteAddr] = t.Addr
-		case proto.HTTP:
-			tcpAddr[t.Subdomain] = t.Addr
+		case proto.HTTP, proto.TLS:
+			tcpAddr[t.key()] = t.Addr
 		}
 	}
 
@@ -99,6 +99,53 @@ func TestCompleteArgs(t *testing.T) {
 	}
 }
 
+func TestCompleteArgs_Enroll(t *testing.T) {
+	fs := Command()
+	fs.Parse([]string{"enroll", "-server", "tunnel.example.com", "-token", "secret.hash"})
+	if err := CompleteArgs(fs); err != nil {
+		t.Fatal(err)
+	}
+	if opts.server != "tunnel.example.com" || opts.token != "secret.hash" {
+		t.Fatalf("expected -server and -token after the command to be parsed, got %q %q", opts.server, opts.token)
+	}
+
+	fs = Command()
+	fs.Parse([]string{"enroll", "-server", "tunnel.example.com"})
+	if err := CompleteArgs(fs); err == nil {
+		t.Fatal("expected error for enroll without -token")
+	}
+
+	fs = Command()
+	fs.Parse([]string{"enroll", "-token", "secret.hash", "extra"})
+	if err := CompleteArgs(fs); err == nil {
+		t.Fatal("expected error for enroll with arguments")
+	}
+}
+
+func TestExecute_EnrollRefusesToOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	crt := filepath.Join(dir, "tls.crt")
+	if err := os.WriteFile(crt, []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	Command()
+	opts.config = filepath.Join(dir, "tunnel.yml")
+	opts.command = "enroll"
+	opts.server = "127.0.0.1:1"
+	opts.token = "secret.hash"
+	opts.tlsCrt = crt
+	opts.tlsKey = filepath.Join(dir, "tls.key")
+
+	err := Execute(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "refusing to overwrite") {
+		t.Fatalf("expected error for an existing certificate, got: %v", err)
+	}
+	if data, _ := os.ReadFile(crt); string(data) != "existing" {
+		t.Fatal("expected the existing certificate to be left alone")
+	}
+}
+
 func TestResolvePath(t *testing.T) {
 	t.Parallel()
 
@@ -288,6 +335,36 @@ func TestTunnels_HTTP(t *testing.T) {
 	if got.Host != "myapp" {
 		t.Fatalf("expected host myapp, got %s", got.Host)
 	}
+
+	m = map[string]*Tunnel{
+		"custom": {Protocol: proto.HTTP, Addr: "localhost:8080", Hostname: "app.example.org", PathPrefix: "/api"},
+	}
+
+	got = tunnels(m)["custom"]
+	if got.Host != "" || got.Hostname != "app.example.org" {
+		t.Fatalf("expected hostname app.example.org and no host, got %q and %q", got.Hostname, got.Host)
+	}
+	if got.PathPrefix != "/api" {
+		t.Fatalf("expected path prefix /api, got %q", got.PathPrefix)
+	}
+
+	m = map[string]*Tunnel{
+		"preserve": {Protocol: proto.HTTP, Addr: "localhost:8080", Subdomain: "preserve", HostHeader: "preserve"},
+		"rewrite": {Protocol: proto.HTTP, Addr: "localhost:8080", Subdomain: "rewrite", HostHeader: "rewrite",
+			ResponseHeaders: &HeaderRules{Remove: []string{"Server"}}},
+		"value": {Protocol: proto.HTTP, Addr: "localhost:8080", Subdomain: "value", HostHeader: "app.local"},
+	}
+
+	p = tunnels(m)
+	if got := p["preserve"]; got.HostHeader != "" || got.RequestHeaders != nil || got.ResponseHeaders != nil {
+		t.Fatalf("expected no header rules, got %+v", got)
+	}
+	if got := p["rewrite"]; got.HostHeader != "localhost:8080" || got.ResponseHeaders == nil || got.ResponseHeaders.Remove[0] != "Server" {
+		t.Fatalf("expected the host header rewritten to addr and response rules, got %+v", got)
+	}
+	if got := p["value"].HostHeader; got != "app.local" {
+		t.Fatalf("expected host header app.local, got %q", got)
+	}
 }
 
 func TestProxy_HTTP_BuildsTargetMap(t *testing.T) {
@@ -361,6 +438,9 @@ func TestCommand_ClientDefaults(t *testing.T) {
 	if opts.logLevel != 1 {
 		t.Fatalf("expected default log-level 1, got %d", opts.logLevel)
 	}
+	if opts.logFormat != "text" {
+		t.Fatalf("expected default log-format text, got %s", opts.logFormat)
+	}
 }
 
 func TestCommand_ClientCustomFlags(t *testing.T) {
@@ -371,6 +451,7 @@ func TestCommand_ClientCustomFlags(t *testing.T) {
 		"-tls-key", "custom.key",
 		"-ca-crt", "custom-ca.crt",
 		"-log-level", "2",
+		"-log-format", "logfmt",
 	}
 	if err := cmd.Parse(args); err != nil {
 		t.Fatal(err)
@@ -391,6 +472,9 @@ func TestCommand_ClientCustomFlags(t *testing.T) {
 	if opts.logLevel != 2 {
 		t.Fatalf("expected log-level 2, got %d", opts.logLevel)
 	}
+	if opts.logFormat != "logfmt" {
+		t.Fatalf("expected log-format logfmt, got %s", opts.logFormat)
+	}
 }
 
 func TestTLSConfig_Client_MissingCertFile(t *testing.T) {
@@ -617,6 +701,30 @@ tunnels:
 	}
 }
 
+func TestExecute_IDCommand_InvalidIDMode(t *testing.T) {
+	content := `
+server_addr: 192.168.1.1:5223
+tunnels:
+  web:
+    proto: tcp
+    addr: localhost:8080
+`
+	f := writeTempFile(t, content)
+
+	Command()
+	opts.config = f
+	opts.command = "id"
+	opts.idMode = "key"
+
+	err := Execute(context.Background())
+	if err == nil {
+		t.Fatal("expected error for unknown id mode")
+	}
+	if !strings.Contains(err.Error(), "-id-mode") {
+		t.Fatalf("expected -id-mode error, got: %v", err)
+	}
+}
+
 func TestExecute_TLSConfigError(t *testing.T) {
 	content := `
 server_addr: 192.168.1.1:5223
@@ -641,3 +749,16 @@ tunnels:
 		t.Fatalf("expected tls configuration error, got: %v", err)
 	}
 }
+
+func TestExecute_InvalidLogFormat(t *testing.T) {
+	Command()
+	opts.logFormat = "xml"
+
+	err := Execute(context.Background())
+	if err == nil {
+		t.Fatal("expected error for unknown log format")
+	}
+	if !strings.Contains(err.Error(), "-log-format") {
+		t.Fatalf("expected -log-format error, got: %v", err)
+	}
+}
@@ -10,10 +10,16 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	tunnel "github.com/ChacheGS/go-stream-tunnel"
 	"github.com/ChacheGS/go-stream-tunnel/id"
@@ -29,6 +35,11 @@ Example:
 	go-stream-tunnel server
 	go-stream-tunnel server -clients YMBKT3V-ESUTZ2Z-7MRILIJ-T35FHGO-D2DHO7D-FXMGSSR-V4LBSZX-BNDONQ4
 	go-stream-tunnel server -ca-crt client.crt -tls-crt server.crt -tls-key server.key
+	go-stream-tunnel server -ca-crt ca/ca.crt -ca-key ca/ca.key -id-mode spki -renew-validity 720h
+	go-stream-tunnel server -ca-crt ca/ca.crt -ca-key ca/ca.key -id-mode spki -enroll-tokens ca/tokens.txt
+	go-stream-tunnel server -base-domain tunnel.example.com -https-addr :443 -https-crt wildcard.crt -https-key wildcard.key
+	go-stream-tunnel server -base-domain tunnel.internal -https-addr :443 -https-ca-crt ca/ca.crt -https-ca-key ca/ca.key
+	go-stream-tunnel server -base-domain tunnel.example.com -https-addr :443 -acme -acme-email admin@example.com
 
 `
 
@@ -42,14 +53,37 @@ func init() {
 
 // options specify arguments read command line arguments.
 type options struct {
-	tunnelAddr string
-	tlsCrt     string
-	tlsKey     string
-	clientCA   string
-	clientIDs  string
-	baseDomain string
-	httpAddr   string
-	logLevel   int
+	tunnelAddr  string
+	tlsCrt      string
+	tlsKey      string
+	clientCA    string
+	clientIDs   string
+	idMode      string
+	crl         string
+	caKey       string
+	caIndex     string
+	renewValid  time.Duration
+	renewAhead  time.Duration
+	enroll      string
+	enrollValid time.Duration
+	baseDomain  string
+	httpAddr    string
+	httpsAddr   string
+	httpsCrt    string
+	httpsKey    string
+	httpsCACrt  string
+	httpsCAKey  string
+	httpsValid  time.Duration
+	acme        bool
+	acmeDir     string
+	acmeEmail   string
+	acmeCache   string
+	acmeHTTP    bool
+	logLevel    int
+	logFormat   string
+	accessLog   string
+	accessFmt   string
+	policy      string
 }
 
 var opts options
@@ -66,32 +100,126 @@ func Command() *flag.FlagSet {
 	cmd.StringVar(&opts.tlsCrt, "tls-crt", "tls.crt", "Path to a TLS certificate file")
 	cmd.StringVar(&opts.tlsKey, "tls-key", "tls.key", "Path to a TLS key file")
 	cmd.StringVar(&opts.clientCA, "ca-crt", "ca.crt", "Path to the trusted certificate chain used for client certificate authentication")
-	cmd.StringVar(&opts.clientIDs, "client-ids", "", "Comma-separated list of tunnel client ids, if empty accept all clients with valid client certificate")
+	cmd.StringVar(&opts.clientIDs, "client-ids", "", "Comma-separated list of tunnel client ids, or certificate CommonNames prefixed with cn: (e.g. cn:laptop) matching certificates issued by the -ca-crt CA; if empty accept all clients with valid client certificate")
+	cmd.StringVar(&opts.idMode, "id-mode", string(id.ModeCert), "How client ids are derived from client certificates: cert (hash of the certificate, changes on renewal) or spki (hash of the public key, survives 'go-stream-tunnel ca renew'). In spki mode, ids listed in -client-ids in cert form are still accepted with a warning")
+	cmd.StringVar(&opts.crl, "crl", "", "Path to a certificate revocation list signed by the -ca-crt CA, e.g. ca/crl.pem from 'go-stream-tunnel ca revoke'. Reloaded when it changes")
+	cmd.StringVar(&opts.caKey, "ca-key", "", "Path to the private key of the -ca-crt CA (its first certificate). If set, clients renew their certificates over the control connection before they expire; requires -id-mode spki or no -client-ids")
+	cmd.StringVar(&opts.caIndex, "ca-index", "", "Path to the index of the -ca-key CA, as kept by 'go-stream-tunnel ca', that certificates renewed or enrolled by the server are recorded in so 'go-stream-tunnel ca revoke' revokes them too; defaults to index.txt next to -ca-key")
+	cmd.DurationVar(&opts.renewValid, "renew-validity", 30*24*time.Hour, "Validity of client certificates renewed with -ca-key")
+	cmd.DurationVar(&opts.renewAhead, "renew-before", 0, "How long before expiry client certificates are renewed with -ca-key; 0 means a third of -renew-validity")
+	cmd.StringVar(&opts.enroll, "enroll-tokens", "", "Path to the enrollment tokens written by 'go-stream-tunnel ca token', e.g. ca/tokens.txt. If set, clients without a certificate can get one from -ca-key with 'go-stream-tunnel client enroll'; requires -ca-key")
+	cmd.DurationVar(&opts.enrollValid, "enroll-validity", 30*24*time.Hour, "Validity of client certificates issued on enrollment")
 	cmd.StringVar(&opts.baseDomain, "base-domain", "", "Base domain for subdomain-routed http tunnels, e.g. tunnel.example.com. Leave empty to disable http tunnels")
-	cmd.StringVar(&opts.httpAddr, "http-addr", "127.0.0.1:9000", "Internal address to listen on for subdomain-routed http tunnel traffic; point your reverse proxy here. Only used if -base-domain is set. WARNING: this listener trusts the Host header of any connection and performs no authentication of its own -- keep it bound to loopback or a private network, never expose it directly to the public internet")
+	cmd.StringVar(&opts.httpAddr, "http-addr", "127.0.0.1:9000", "Internal address to listen on for subdomain-routed http and tls tunnel traffic; point your reverse proxy here. Only used if -base-domain is set. WARNING: this listener trusts the Host header of any connection and performs no authentication of its own -- keep it bound to loopback or a private network, never expose it directly to the public internet")
+	cmd.StringVar(&opts.httpsAddr, "https-addr", "", "Public address to terminate TLS for http tunnels on, e.g. :443, as an alternative to a reverse proxy in front of -http-addr. Requires -https-crt and -https-key, -https-ca-crt and -https-ca-key, or -acme. Only used if -base-domain is set")
+	cmd.StringVar(&opts.httpsCrt, "https-crt", "", "Path to the certificate served on -https-addr, typically a wildcard one for *.<base-domain>")
+	cmd.StringVar(&opts.httpsKey, "https-key", "", "Path to the key of -https-crt")
+	cmd.StringVar(&opts.httpsCACrt, "https-ca-crt", "", "Path to a CA certificate, e.g. ca/ca.crt from 'go-stream-tunnel ca init', to issue a certificate with for each http tunnel host on -https-addr when it's first requested. Alternative to -https-crt")
+	cmd.StringVar(&opts.httpsCAKey, "https-ca-key", "", "Path to the key of -https-ca-crt")
+	cmd.DurationVar(&opts.httpsValid, "https-validity", 7*24*time.Hour, "Validity of certificates issued with -https-ca-key")
+	cmd.BoolVar(&opts.acme, "acme", false, "Get the certificate of each http tunnel host on -https-addr from an ACME CA, Let's Encrypt by default, on first use. The CA validates hosts on -https-addr (tls-alpn-01), so it must be reachable on port 443. Alternative to -https-crt")
+	cmd.StringVar(&opts.acmeDir, "acme-directory", "", "ACME directory URL of the CA used with -acme; if empty Let's Encrypt is used")
+	cmd.StringVar(&opts.acmeEmail, "acme-email", "", "Optional contact address for the account with the ACME CA")
+	cmd.StringVar(&opts.acmeCache, "acme-cache", "acme", "Directory to store the ACME account key and certificates in")
+	cmd.BoolVar(&opts.acmeHTTP, "acme-http", false, "Also answer the ACME http-01 challenge on -http-addr, for when it's reachable on port 80 of the tunnel hosts, directly or through a proxy passing on /.well-known/acme-challenge/")
+	cmd.StringVar(&opts.policy, "policy", "", "Path to an optional YAML policy file with per-identity and per-tunnel settings such as bandwidth, connection and transfer limits")
 	cmd.IntVar(&opts.logLevel, "log-level", 1, "Level of messages to log, 0-3")
+	cmd.StringVar(&opts.logFormat, "log-format", log.FormatText, "Log output format: text, json or logfmt")
+	cmd.StringVar(&opts.accessLog, "access-log", "", "Path of a file to append one access log entry per proxied connection to, or - for stdout. The file is reopened on SIGHUP, for log rotation. Leave empty to disable")
+	cmd.StringVar(&opts.accessFmt, "access-log-format", tunnel.AccessLogAuto, "Access log format: auto (common for http tunnels, json for tcp), common or json")
 
 	return cmd
 }
 
 func Execute(ctx context.Context) error {
-	logger := log.NewFilterLogger(log.NewStdLogger(), opts.logLevel)
+	base, err := log.NewFormatLogger(opts.logFormat, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("-log-format: %s", err)
+	}
+	logger := log.NewFilterLogger(base, opts.logLevel)
+
+	idMode, err := id.ParseMode(opts.idMode)
+	if err != nil {
+		return fmt.Errorf("-id-mode: %s", err)
+	}
 
 	tlsconf, err := tlsConfig()
 	if err != nil {
 		return fmt.Errorf("failed to configure tls: %s", err)
 	}
 
+	crl, err := loadCRL()
+	if err != nil {
+		return fmt.Errorf("failed to load CRL: %s", err)
+	}
+
+	certRenewal, err := certRenewalConfig()
+	if err != nil {
+		return fmt.Errorf("failed to configure certificate renewal: %s", err)
+	}
+
+	enrollment, err := enrollmentConfig(certRenewal)
+	if err != nil {
+		return fmt.Errorf("failed to configure enrollment: %s", err)
+	}
+
+	https, err := httpsConfig()
+	if err != nil {
+		return fmt.Errorf("failed to configure https: %s", err)
+	}
+
+	accessLog, accessFile, err := accessLogger()
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %s", err)
+	}
+	if accessFile != nil {
+		defer accessFile.Close()
+		go reopenOnHangup(ctx, accessFile, logger)
+	}
+
+	policy := &Policy{}
+	if opts.policy != "" {
+		if policy, err = loadPolicyFromFile(opts.policy); err != nil {
+			return fmt.Errorf("policy error: %s", err)
+		}
+	}
+	bandwidth, err := policy.bandwidthConfig()
+	if err != nil {
+		return fmt.Errorf("policy error: %s", err)
+	}
+	connLimits, err := policy.connLimitConfig()
+	if err != nil {
+		return fmt.Errorf("policy error: %s", err)
+	}
+	quotas, err := policy.quotaConfig()
+	if err != nil {
+		return fmt.Errorf("policy error: %s", err)
+	}
+	hostnames, err := policy.hostnameConfig()
+	if err != nil {
+		return fmt.Errorf("policy error: %s", err)
+	}
+
 	autoSubscribe := opts.clientIDs == ""
 
 	// setup server
 	server, err := tunnel.NewServer(&tunnel.ServerConfig{
 		Addr:          opts.tunnelAddr,
 		AutoSubscribe: autoSubscribe,
+		IDMode:        idMode,
 		TLSConfig:     tlsconf,
 		Logger:        logger,
 		BaseDomain:    opts.baseDomain,
 		HTTPAddr:      opts.httpAddr,
+		HTTPS:         https,
+		Hostnames:     hostnames,
+		AccessLog:     accessLog,
+		Bandwidth:     bandwidth,
+		ConnLimits:    connLimits,
+		Quotas:        quotas,
+		CRL:           crl,
+		CertRenewal:   certRenewal,
+		Enrollment:    enrollment,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create server: %s", err)
@@ -102,18 +230,262 @@ func Execute(ctx context.Context) error {
 			if c == "" {
 				return fmt.Errorf("empty client id")
 			}
-			identifier := id.ID{}
-			err := identifier.UnmarshalText([]byte(c))
+			identifier, name, err := parseClient(c)
 			if err != nil {
-				return fmt.Errorf("invalid identifier %q: %s", c, err)
+				return err
+			}
+			if name != "" {
+				server.SubscribeName(name)
+			} else {
+				server.Subscribe(identifier)
 			}
-			server.Subscribe(identifier)
 		}
 	}
 
 	return server.Start(ctx)
 }
 
+// accessLogger returns the AccessLogger configured by -access-log and
+// -access-log-format, or nil if access logging is disabled, along with the
+// file it writes to, if any.
+func accessLogger() (tunnel.AccessLogger, *logFile, error) {
+	if opts.accessLog == "" {
+		return nil, nil, nil
+	}
+
+	if opts.accessLog == "-" {
+		l, err := tunnel.NewAccessLogger(os.Stdout, opts.accessFmt)
+		return l, nil, err
+	}
+
+	f, err := openLogFile(opts.accessLog)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := tunnel.NewAccessLogger(f, opts.accessFmt)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return l, f, nil
+}
+
+// logFile is a file appended to that can be reopened at its path, once log
+// rotation moved it away.
+type logFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{path: path, f: f}, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// Reopen closes the file and opens its path again. On error the file stays
+// open.
+func (l *logFile) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.f.Close()
+	l.f = f
+	return nil
+}
+
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// reopenOnHangup reopens f on every SIGHUP until ctx is done, so rotating
+// it only takes a kill -HUP.
+func reopenOnHangup(ctx context.Context, f *logFile, logger log.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := f.Reopen(); err != nil {
+				logger.Log(
+					"level", 0,
+					"msg", "failed to reopen access log",
+					"path", f.path,
+					"err", err,
+				)
+				continue
+			}
+			logger.Log(
+				"level", 1,
+				"action", "access log reopened",
+				"path", f.path,
+			)
+		}
+	}
+}
+
+// loadCRL returns the CRL given by -crl, verified against the -ca-crt
+// certificates, or nil if none is given.
+func loadCRL() (*tunnel.CRL, error) {
+	if opts.crl == "" {
+		return nil, nil
+	}
+
+	caPEM, err := os.ReadFile(opts.clientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	var issuers []*x509.Certificate
+	for rest := caPEM; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", opts.clientCA, err)
+		}
+		issuers = append(issuers, cert)
+	}
+
+	return tunnel.NewCRL(opts.crl, issuers)
+}
+
+// certRenewalConfig returns the certificate renewal configuration given by
+// -ca-key, or nil if renewal is disabled.
+func certRenewalConfig() (*tunnel.CertRenewalConfig, error) {
+	if opts.caKey == "" {
+		return nil, nil
+	}
+
+	caCertPEM, err := os.ReadFile(opts.clientCA)
+	if err != nil {
+		return nil, err
+	}
+	if err := tunnel.CheckPrivateKeyPermissions(opts.caKey); err != nil {
+		return nil, err
+	}
+	caKeyPEM, err := os.ReadFile(opts.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	index := opts.caIndex
+	if index == "" {
+		index = filepath.Join(filepath.Dir(opts.caKey), "index.txt")
+	}
+
+	return &tunnel.CertRenewalConfig{
+		CACertPEM:   caCertPEM,
+		CAKeyPEM:    caKeyPEM,
+		Validity:    opts.renewValid,
+		RenewBefore: opts.renewAhead,
+		IndexFile:   index,
+	}, nil
+}
+
+// enrollmentConfig returns the enrollment configuration given by
+// -enroll-tokens, signing with the CA of certRenewal, or nil if enrollment
+// is disabled.
+func enrollmentConfig(certRenewal *tunnel.CertRenewalConfig) (*tunnel.EnrollmentConfig, error) {
+	if opts.enroll == "" {
+		return nil, nil
+	}
+	if certRenewal == nil {
+		return nil, fmt.Errorf("-enroll-tokens requires -ca-key")
+	}
+
+	return &tunnel.EnrollmentConfig{
+		CACertPEM: certRenewal.CACertPEM,
+		CAKeyPEM:  certRenewal.CAKeyPEM,
+		TokenFile: opts.enroll,
+		Validity:  opts.enrollValid,
+		IndexFile: certRenewal.IndexFile,
+	}, nil
+}
+
+// httpsConfig returns the configuration of the HTTPS listener given by
+// -https-addr, or nil if it's disabled.
+func httpsConfig() (*tunnel.HTTPSConfig, error) {
+	if opts.httpsAddr == "" {
+		return nil, nil
+	}
+
+	sources := 0
+	for _, set := range []bool{opts.httpsCrt != "", opts.httpsCACrt != "", opts.acme} {
+		if set {
+			sources++
+		}
+	}
+	switch {
+	case sources > 1:
+		return nil, fmt.Errorf("-https-crt, -https-ca-crt and -acme are mutually exclusive")
+	case sources == 0:
+		return nil, fmt.Errorf("-https-addr requires -https-crt, -https-ca-crt or -acme")
+	case opts.acme:
+		return &tunnel.HTTPSConfig{
+			Addr: opts.httpsAddr,
+			ACME: &tunnel.ACMEConfig{
+				DirectoryURL:  opts.acmeDir,
+				Email:         opts.acmeEmail,
+				CacheDir:      opts.acmeCache,
+				HTTPChallenge: opts.acmeHTTP,
+			},
+		}, nil
+	}
+
+	crt, key := opts.httpsCrt, opts.httpsKey
+	if crt == "" {
+		crt, key = opts.httpsCACrt, opts.httpsCAKey
+	}
+	if key == "" {
+		return nil, fmt.Errorf("missing key for %s", crt)
+	}
+
+	certPEM, err := os.ReadFile(crt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tunnel.CheckPrivateKeyPermissions(key); err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tunnel.HTTPSConfig{Addr: opts.httpsAddr}
+	if opts.httpsCrt != "" {
+		c.CertPEM, c.KeyPEM = certPEM, keyPEM
+	} else {
+		c.CACertPEM, c.CAKeyPEM, c.Validity = certPEM, keyPEM, opts.httpsValid
+	}
+	return c, nil
+}
+
 func tlsConfig() (*tls.Config, error) {
 	if err := tunnel.CheckPrivateKeyPermissions(opts.tlsKey); err != nil {
 		return nil, err
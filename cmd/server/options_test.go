@@ -13,6 +13,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -53,9 +54,48 @@ func TestCommand_Defaults(t *testing.T) {
 	if opts.httpAddr != "127.0.0.1:9000" {
 		t.Fatalf("expected default http-addr 127.0.0.1:9000, got %s", opts.httpAddr)
 	}
+	if opts.httpsAddr != "" {
+		t.Fatalf("expected default https-addr empty, got %s", opts.httpsAddr)
+	}
+	if opts.httpsValid != 7*24*time.Hour {
+		t.Fatalf("expected default https-validity 168h, got %s", opts.httpsValid)
+	}
+	if opts.acme || opts.acmeDir != "" || opts.acmeCache != "acme" {
+		t.Fatalf("expected ACME to be disabled with cache dir acme, got %v %q %q", opts.acme, opts.acmeDir, opts.acmeCache)
+	}
+	if opts.crl != "" {
+		t.Fatalf("expected default crl empty, got %s", opts.crl)
+	}
+	if opts.idMode != "cert" {
+		t.Fatalf("expected default id-mode cert, got %s", opts.idMode)
+	}
+	if opts.caKey != "" {
+		t.Fatalf("expected default ca-key empty, got %s", opts.caKey)
+	}
+	if opts.renewValid != 30*24*time.Hour {
+		t.Fatalf("expected default renew-validity 720h, got %s", opts.renewValid)
+	}
+	if opts.enroll != "" {
+		t.Fatalf("expected default enroll-tokens empty, got %s", opts.enroll)
+	}
+	if opts.enrollValid != 30*24*time.Hour {
+		t.Fatalf("expected default enroll-validity 720h, got %s", opts.enrollValid)
+	}
+	if opts.policy != "" {
+		t.Fatalf("expected default policy empty, got %s", opts.policy)
+	}
 	if opts.logLevel != 1 {
 		t.Fatalf("expected default log-level 1, got %d", opts.logLevel)
 	}
+	if opts.logFormat != "text" {
+		t.Fatalf("expected default log-format text, got %s", opts.logFormat)
+	}
+	if opts.accessLog != "" {
+		t.Fatalf("expected default access-log empty, got %s", opts.accessLog)
+	}
+	if opts.accessFmt != "auto" {
+		t.Fatalf("expected default access-log-format auto, got %s", opts.accessFmt)
+	}
 }
 
 func TestCommand_CustomFlags(t *testing.T) {
@@ -66,9 +106,14 @@ func TestCommand_CustomFlags(t *testing.T) {
 		"-tls-key", "custom.key",
 		"-ca-crt", "custom-ca.crt",
 		"-client-ids", "ID1,ID2",
+		"-crl", "crl.pem",
 		"-base-domain", "tunnel.example.com",
 		"-http-addr", "127.0.0.1:9001",
+		"-policy", "policy.yml",
 		"-log-level", "3",
+		"-log-format", "json",
+		"-access-log", "access.log",
+		"-access-log-format", "common",
 	}
 	if err := cmd.Parse(args); err != nil {
 		t.Fatal(err)
@@ -95,9 +140,24 @@ func TestCommand_CustomFlags(t *testing.T) {
 	if opts.httpAddr != "127.0.0.1:9001" {
 		t.Fatalf("expected http-addr 127.0.0.1:9001, got %s", opts.httpAddr)
 	}
+	if opts.crl != "crl.pem" {
+		t.Fatalf("expected crl crl.pem, got %s", opts.crl)
+	}
+	if opts.policy != "policy.yml" {
+		t.Fatalf("expected policy policy.yml, got %s", opts.policy)
+	}
 	if opts.logLevel != 3 {
 		t.Fatalf("expected log-level 3, got %d", opts.logLevel)
 	}
+	if opts.logFormat != "json" {
+		t.Fatalf("expected log-format json, got %s", opts.logFormat)
+	}
+	if opts.accessLog != "access.log" {
+		t.Fatalf("expected access-log access.log, got %s", opts.accessLog)
+	}
+	if opts.accessFmt != "common" {
+		t.Fatalf("expected access-log-format common, got %s", opts.accessFmt)
+	}
 }
 
 func TestTLSConfig_MissingCertFile(t *testing.T) {
@@ -260,3 +320,239 @@ func TestExecute_InvalidClientID(t *testing.T) {
 		t.Fatalf("expected 'invalid identifier' error, got: %v", err)
 	}
 }
+
+func TestExecute_EmptyClientName(t *testing.T) {
+	Command()
+	opts.tunnelAddr = "127.0.0.1:0"
+	opts.tlsCrt = "../../testdata/selfsigned.crt"
+	opts.tlsKey = "../../testdata/selfsigned.key"
+	opts.clientCA = "../../testdata/selfsigned.crt"
+	opts.clientIDs = "cn:laptop,cn:"
+
+	err := Execute(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "empty name") {
+		t.Fatalf("expected 'empty name' error, got: %v", err)
+	}
+}
+
+func TestExecute_MissingCAKey(t *testing.T) {
+	Command()
+	opts.tunnelAddr = "127.0.0.1:0"
+	opts.tlsCrt = "../../testdata/selfsigned.crt"
+	opts.tlsKey = "../../testdata/selfsigned.key"
+	opts.clientCA = "../../testdata/selfsigned.crt"
+	opts.caKey = "/nonexistent/ca.key"
+
+	err := Execute(context.Background())
+	if err == nil {
+		t.Fatal("expected error for a missing CA key")
+	}
+	if !strings.Contains(err.Error(), "failed to configure certificate renewal") {
+		t.Fatalf("expected certificate renewal error, got: %v", err)
+	}
+}
+
+func TestExecute_EnrollRequiresCAKey(t *testing.T) {
+	Command()
+	opts.tunnelAddr = "127.0.0.1:0"
+	opts.tlsCrt = "../../testdata/selfsigned.crt"
+	opts.tlsKey = "../../testdata/selfsigned.key"
+	opts.clientCA = "../../testdata/selfsigned.crt"
+	opts.enroll = "tokens.txt"
+
+	err := Execute(context.Background())
+	if err == nil {
+		t.Fatal("expected error for -enroll-tokens without -ca-key")
+	}
+	if !strings.Contains(err.Error(), "-enroll-tokens requires -ca-key") {
+		t.Fatalf("expected enrollment error, got: %v", err)
+	}
+}
+
+func TestHTTPSConfig(t *testing.T) {
+	Command()
+	if c, err := httpsConfig(); err != nil || c != nil {
+		t.Fatalf("expected https to be disabled by default, got %v, %v", c, err)
+	}
+
+	opts.httpsAddr = ":443"
+	if _, err := httpsConfig(); err == nil || !strings.Contains(err.Error(), "requires -https-crt, -https-ca-crt or -acme") {
+		t.Fatalf("expected error for -https-addr without certificate, got %v", err)
+	}
+
+	opts.httpsCrt = "../../testdata/selfsigned.crt"
+	opts.httpsCACrt = "../../testdata/selfsigned.crt"
+	if _, err := httpsConfig(); err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Fatalf("expected error for both -https-crt and -https-ca-crt, got %v", err)
+	}
+
+	opts.httpsCACrt = ""
+	opts.httpsKey = "../../testdata/selfsigned.key"
+	c, err := httpsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != ":443" || c.CertPEM == nil || c.KeyPEM == nil || c.CACertPEM != nil {
+		t.Fatalf("expected a certificate configuration, got %+v", c)
+	}
+
+	opts.httpsCrt, opts.httpsKey = "", ""
+	opts.httpsCACrt = "../../testdata/selfsigned.crt"
+	opts.httpsCAKey = "../../testdata/selfsigned.key"
+	if c, err = httpsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if c.CACertPEM == nil || c.CAKeyPEM == nil || c.CertPEM != nil || c.Validity != opts.httpsValid {
+		t.Fatalf("expected a CA configuration, got %+v", c)
+	}
+
+	opts.acme = true
+	if _, err := httpsConfig(); err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Fatalf("expected error for both -https-ca-crt and -acme, got %v", err)
+	}
+
+	opts.httpsCACrt, opts.httpsCAKey = "", ""
+	opts.acmeEmail = "admin@example.com"
+	if c, err = httpsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if c.ACME == nil || c.ACME.CacheDir != "acme" || c.ACME.Email != "admin@example.com" || c.ACME.DirectoryURL != "" {
+		t.Fatalf("expected an ACME configuration, got %+v", c.ACME)
+	}
+}
+
+func TestExecute_InvalidIDMode(t *testing.T) {
+	Command()
+	opts.idMode = "key"
+
+	err := Execute(context.Background())
+	if err == nil {
+		t.Fatal("expected error for unknown id mode")
+	}
+	if !strings.Contains(err.Error(), "-id-mode") {
+		t.Fatalf("expected -id-mode error, got: %v", err)
+	}
+}
+
+func TestExecute_InvalidLogFormat(t *testing.T) {
+	Command()
+	opts.logFormat = "xml"
+
+	err := Execute(context.Background())
+	if err == nil {
+		t.Fatal("expected error for unknown log format")
+	}
+	if !strings.Contains(err.Error(), "-log-format") {
+		t.Fatalf("expected -log-format error, got: %v", err)
+	}
+}
+
+func TestAccessLogger_Disabled(t *testing.T) {
+	Command()
+
+	l, f, err := accessLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != nil || f != nil {
+		t.Fatal("expected no access logger without -access-log")
+	}
+}
+
+func TestAccessLogger_File(t *testing.T) {
+	Command()
+	opts.accessLog = filepath.Join(t.TempDir(), "access.log")
+
+	l, f, err := accessLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if l == nil {
+		t.Fatal("expected an access logger")
+	}
+	if _, err := os.Stat(opts.accessLog); err != nil {
+		t.Fatalf("expected access log file to be created: %v", err)
+	}
+}
+
+func TestLogFile_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write([]byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("after\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{path + ".1": "before\n", path: "after\n"} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Fatalf("%s: expected %q, got %q", name, want, b)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("closed\n")); err == nil {
+		t.Fatal("expected error writing after close")
+	}
+}
+
+func TestAccessLogger_InvalidFormat(t *testing.T) {
+	Command()
+	opts.accessLog = filepath.Join(t.TempDir(), "access.log")
+	opts.accessFmt = "xml"
+
+	if _, _, err := accessLogger(); err == nil {
+		t.Fatal("expected error for unknown access log format")
+	}
+}
+
+func TestExecute_PolicyError(t *testing.T) {
+	Command()
+	opts.tlsCrt = "../../testdata/selfsigned.crt"
+	opts.tlsKey = "../../testdata/selfsigned.key"
+	opts.clientCA = "../../testdata/selfsigned.crt"
+	opts.policy = "/nonexistent/policy.yml"
+
+	err := Execute(context.Background())
+	if err == nil {
+		t.Fatal("expected error for missing policy file")
+	}
+	if !strings.Contains(err.Error(), "policy error") {
+		t.Fatalf("expected policy error, got: %v", err)
+	}
+}
+
+func TestExecute_CRLError(t *testing.T) {
+	Command()
+	opts.tlsCrt = "../../testdata/selfsigned.crt"
+	opts.tlsKey = "../../testdata/selfsigned.key"
+	opts.clientCA = "../../testdata/selfsigned.crt"
+	opts.crl = "/nonexistent/crl.pem"
+
+	err := Execute(context.Background())
+	if err == nil {
+		t.Fatal("expected error for missing CRL file")
+	}
+	if !strings.Contains(err.Error(), "failed to load CRL") {
+		t.Fatalf("expected CRL error, got: %v", err)
+	}
+}
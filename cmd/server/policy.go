@@ -0,0 +1,326 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	tunnel "github.com/ChacheGS/go-stream-tunnel"
+	"github.com/ChacheGS/go-stream-tunnel/id"
+)
+
+// Policy is the optional server policy file given by -policy. It holds
+// settings that are keyed by client identity or tunnel and so don't fit on
+// the command line.
+type Policy struct {
+	Bandwidth   BandwidthPolicy  `yaml:"bandwidth"`
+	Connections ConnectionPolicy `yaml:"connections"`
+	Quotas      QuotaPolicy      `yaml:"quotas"`
+	Hostnames   HostnamePolicy   `yaml:"hostnames"`
+}
+
+// BandwidthPolicy defines bandwidth limits, see tunnel.BandwidthConfig.
+type BandwidthPolicy struct {
+	// Default limits each identity not listed in Identities.
+	Default RateLimitPolicy `yaml:"default"`
+	// Identities is keyed by client ID, or by certificate CommonName
+	// prefixed with "cn:".
+	Identities map[string]RateLimitPolicy `yaml:"identities"`
+	// Tunnels is keyed by the full hostname of an http tunnel, followed by
+	// its path prefix if it has one, or the port of a tcp tunnel.
+	Tunnels map[string]RateLimitPolicy `yaml:"tunnels"`
+}
+
+// ConnectionPolicy defines connection limits, see tunnel.ConnLimitConfig.
+type ConnectionPolicy struct {
+	// MaxPerIdentity caps concurrent connections of each identity not
+	// listed in Identities.
+	MaxPerIdentity int `yaml:"max_per_identity"`
+	// Identities is keyed like BandwidthPolicy.Identities.
+	Identities map[string]int `yaml:"identities"`
+	// Tunnels is keyed like BandwidthPolicy.Tunnels.
+	Tunnels map[string]int `yaml:"tunnels"`
+	// AcceptRate is new connections per second per source IP.
+	AcceptRate int `yaml:"accept_rate"`
+	// AcceptBurst defaults to AcceptRate.
+	AcceptBurst int `yaml:"accept_burst"`
+}
+
+// QuotaPolicy defines transfer quotas, see tunnel.QuotaConfig.
+type QuotaPolicy struct {
+	// File is where usage is persisted across restarts.
+	File string `yaml:"file"`
+	// Default applies to each identity not listed in Identities.
+	Default QuotaLimitPolicy `yaml:"default"`
+	// Identities is keyed like BandwidthPolicy.Identities.
+	Identities map[string]QuotaLimitPolicy `yaml:"identities"`
+}
+
+// HostnamePolicy lists the custom hostnames clients may expose http
+// tunnels on, see tunnel.HostnameConfig. Entries are hostnames or patterns
+// like "*.example.com".
+type HostnamePolicy struct {
+	// Allowed hostnames may be used by every client.
+	Allowed []string `yaml:"allowed"`
+	// Identities is keyed like BandwidthPolicy.Identities.
+	Identities map[string][]string `yaml:"identities"`
+}
+
+// QuotaLimitPolicy is a number of bytes per rolling daily or monthly period.
+type QuotaLimitPolicy struct {
+	Bytes  ByteSize `yaml:"bytes"`
+	Period string   `yaml:"period"`
+}
+
+// RateLimitPolicy is a token bucket limit in bytes per second.
+type RateLimitPolicy struct {
+	Rate  ByteSize `yaml:"rate"`
+	Burst ByteSize `yaml:"burst,omitempty"`
+}
+
+// ByteSize is a number of bytes, written in YAML either as a plain integer
+// or with a unit suffix: KB, MB, GB (powers of 1000) or KiB, MiB, GiB
+// (powers of 1024).
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// ParseByteSize parses s as described on ByteSize.
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.n
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(n * mult), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (b *ByteSize) UnmarshalYAML(unmarshal func(any) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// namePrefix marks a client given by the CommonName of its certificate
+// instead of its ID, in -client-ids and policy identities, e.g.
+// "cn:laptop".
+const namePrefix = "cn:"
+
+// parseClient parses a client ID, or a certificate CommonName prefixed with
+// namePrefix, in which case name is set.
+func parseClient(s string) (identifier id.ID, name string, err error) {
+	if name, ok := strings.CutPrefix(s, namePrefix); ok {
+		if name == "" {
+			return id.ID{}, "", fmt.Errorf("empty name in %q", s)
+		}
+		return id.ID{}, name, nil
+	}
+	if err := identifier.UnmarshalText([]byte(s)); err != nil {
+		return id.ID{}, "", fmt.Errorf("invalid identifier %q: %s", s, err)
+	}
+	return identifier, "", nil
+}
+
+func loadPolicyFromFile(file string) (*Policy, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %q: %s", file, err)
+	}
+
+	var p Policy
+	if err := yaml.UnmarshalStrict(buf, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse file %q: %s", file, err)
+	}
+
+	return &p, nil
+}
+
+func (r RateLimitPolicy) rateLimit() tunnel.RateLimit {
+	return tunnel.RateLimit{Rate: int64(r.Rate), Burst: int64(r.Burst)}
+}
+
+// bandwidthConfig converts the bandwidth section to a
+// tunnel.BandwidthConfig, or returns nil if it sets no limits at all.
+func (p *Policy) bandwidthConfig() (*tunnel.BandwidthConfig, error) {
+	b := p.Bandwidth
+	if b.Default.Rate == 0 && len(b.Identities) == 0 && len(b.Tunnels) == 0 {
+		return nil, nil
+	}
+
+	c := &tunnel.BandwidthConfig{
+		Default:    b.Default.rateLimit(),
+		Identities: make(map[id.ID]tunnel.RateLimit),
+		Names:      make(map[string]tunnel.RateLimit),
+		Tunnels:    make(map[string]tunnel.RateLimit),
+	}
+	for k, v := range b.Identities {
+		identifier, name, err := parseClient(k)
+		if err != nil {
+			return nil, fmt.Errorf("bandwidth: %s", err)
+		}
+		if name != "" {
+			c.Names[name] = v.rateLimit()
+		} else {
+			c.Identities[identifier] = v.rateLimit()
+		}
+	}
+	for k, v := range b.Tunnels {
+		c.Tunnels[tunnelKey(k)] = v.rateLimit()
+	}
+
+	return c, nil
+}
+
+// connLimitConfig converts the connections section to a
+// tunnel.ConnLimitConfig, or returns nil if it sets no limits at all.
+func (p *Policy) connLimitConfig() (*tunnel.ConnLimitConfig, error) {
+	cp := p.Connections
+	if cp.MaxPerIdentity == 0 && len(cp.Identities) == 0 && len(cp.Tunnels) == 0 && cp.AcceptRate == 0 {
+		return nil, nil
+	}
+	if cp.MaxPerIdentity < 0 || cp.AcceptRate < 0 || cp.AcceptBurst < 0 {
+		return nil, fmt.Errorf("connections: limits must not be negative")
+	}
+
+	c := &tunnel.ConnLimitConfig{
+		MaxConns:    cp.MaxPerIdentity,
+		Identities:  make(map[id.ID]int),
+		Names:       make(map[string]int),
+		Tunnels:     make(map[string]int),
+		AcceptRate:  cp.AcceptRate,
+		AcceptBurst: cp.AcceptBurst,
+	}
+	for k, v := range cp.Identities {
+		identifier, name, err := parseClient(k)
+		if err != nil {
+			return nil, fmt.Errorf("connections: %s", err)
+		}
+		if name != "" {
+			c.Names[name] = v
+		} else {
+			c.Identities[identifier] = v
+		}
+	}
+	for k, v := range cp.Tunnels {
+		c.Tunnels[tunnelKey(k)] = v
+	}
+
+	return c, nil
+}
+
+func (q QuotaLimitPolicy) quota() tunnel.Quota {
+	return tunnel.Quota{Bytes: int64(q.Bytes), Period: tunnel.QuotaPeriod(q.Period)}
+}
+
+// quotaConfig converts the quotas section to a tunnel.QuotaConfig, or
+// returns nil if it sets no quotas at all. Periods are validated by
+// tunnel.NewServer.
+func (p *Policy) quotaConfig() (*tunnel.QuotaConfig, error) {
+	qp := p.Quotas
+	if qp.Default.Bytes == 0 && len(qp.Identities) == 0 {
+		return nil, nil
+	}
+
+	c := &tunnel.QuotaConfig{
+		Default:    qp.Default.quota(),
+		Identities: make(map[id.ID]tunnel.Quota),
+		Names:      make(map[string]tunnel.Quota),
+		File:       qp.File,
+	}
+	for k, v := range qp.Identities {
+		identifier, name, err := parseClient(k)
+		if err != nil {
+			return nil, fmt.Errorf("quotas: %s", err)
+		}
+		if name != "" {
+			c.Names[name] = v.quota()
+		} else {
+			c.Identities[identifier] = v.quota()
+		}
+	}
+
+	return c, nil
+}
+
+// hostnameConfig converts the hostnames section to a tunnel.HostnameConfig,
+// or returns nil if it allows no hostnames at all. Hostnames are validated
+// by tunnel.NewServer.
+func (p *Policy) hostnameConfig() (*tunnel.HostnameConfig, error) {
+	hp := p.Hostnames
+	if len(hp.Allowed) == 0 && len(hp.Identities) == 0 {
+		return nil, nil
+	}
+
+	c := &tunnel.HostnameConfig{
+		Allowed:    lowerAll(hp.Allowed),
+		Identities: make(map[id.ID][]string),
+		Names:      make(map[string][]string),
+	}
+	for k, v := range hp.Identities {
+		identifier, name, err := parseClient(k)
+		if err != nil {
+			return nil, fmt.Errorf("hostnames: %s", err)
+		}
+		if name != "" {
+			c.Names[name] = lowerAll(v)
+		} else {
+			c.Identities[identifier] = lowerAll(v)
+		}
+	}
+
+	return c, nil
+}
+
+// tunnelKey normalizes a key of the tunnels sections: hosts are lowercased,
+// the path prefix of a tunnel routed by path is left alone.
+func tunnelKey(k string) string {
+	host, prefix, _ := strings.Cut(k, "/")
+	if prefix != "" {
+		return strings.ToLower(host) + "/" + prefix
+	}
+	return strings.ToLower(host)
+}
+
+// lowerAll returns a copy of s with all strings lowercased.
+func lowerAll(s []string) []string {
+	l := make([]string, len(s))
+	for i, v := range s {
+		l[i] = strings.ToLower(v)
+	}
+	return l
+}
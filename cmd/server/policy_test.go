@@ -0,0 +1,358 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tunnel "github.com/ChacheGS/go-stream-tunnel"
+	"github.com/ChacheGS/go-stream-tunnel/id"
+)
+
+func writePolicy(t *testing.T, content string) string {
+	t.Helper()
+
+	f := filepath.Join(t.TempDir(), "policy.yml")
+	if err := os.WriteFile(f, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestParseByteSize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in      string
+		want    ByteSize
+		wantErr bool
+	}{
+		{"1000", 1000, false},
+		{"512B", 512, false},
+		{"10KB", 10000, false},
+		{"10 KiB", 10240, false},
+		{"2MB", 2000000, false},
+		{"1MiB", 1 << 20, false},
+		{"1GiB", 1 << 30, false},
+		{"", 0, true},
+		{"fast", 0, true},
+		{"-1", 0, true},
+		{"1.5MB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseByteSize(%q): expected error", tt.in)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseByteSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoadPolicyFromFile_Bandwidth(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+	f := writePolicy(t, `
+bandwidth:
+  default:
+    rate: 1MB
+    burst: 4MB
+  identities:
+    `+alice.String()+`:
+      rate: 10MiB
+  tunnels:
+    MyApp.tunnel.example.com:
+      rate: 500KB
+    "2222":
+      rate: 100000
+`)
+
+	p, err := loadPolicyFromFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := p.bandwidthConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Default.Rate != 1000000 || c.Default.Burst != 4000000 {
+		t.Errorf("unexpected default limit %+v", c.Default)
+	}
+	if l := c.Identities[alice]; l.Rate != 10<<20 || l.Burst != 0 {
+		t.Errorf("unexpected identity limit %+v", l)
+	}
+	if l := c.Tunnels["myapp.tunnel.example.com"]; l.Rate != 500000 {
+		t.Errorf("expected tunnel keys to be lowercased, got %v", c.Tunnels)
+	}
+	if l := c.Tunnels["2222"]; l.Rate != 100000 {
+		t.Errorf("unexpected tcp tunnel limit %+v", l)
+	}
+}
+
+func TestLoadPolicyFromFile_Empty(t *testing.T) {
+	t.Parallel()
+
+	p, err := loadPolicyFromFile(writePolicy(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := p.bandwidthConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != nil {
+		t.Fatalf("expected no bandwidth config, got %+v", c)
+	}
+}
+
+func TestLoadPolicyFromFile_InvalidIdentifier(t *testing.T) {
+	t.Parallel()
+
+	p, err := loadPolicyFromFile(writePolicy(t, `
+bandwidth:
+  identities:
+    not-an-id:
+      rate: 1MB
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.bandwidthConfig(); err == nil || !strings.Contains(err.Error(), "invalid identifier") {
+		t.Fatalf("expected invalid identifier error, got %v", err)
+	}
+}
+
+func TestLoadPolicyFromFile_InvalidSize(t *testing.T) {
+	t.Parallel()
+
+	_, err := loadPolicyFromFile(writePolicy(t, `
+bandwidth:
+  default:
+    rate: fast
+`))
+	if err == nil {
+		t.Fatal("expected error for invalid size")
+	}
+}
+
+func TestLoadPolicyFromFile_UnknownField(t *testing.T) {
+	t.Parallel()
+
+	_, err := loadPolicyFromFile(writePolicy(t, `
+bandwith:
+  default:
+    rate: 1MB
+`))
+	if err == nil {
+		t.Fatal("expected error for misspelled section")
+	}
+}
+
+func TestLoadPolicyFromFile_NotFound(t *testing.T) {
+	t.Parallel()
+
+	if _, err := loadPolicyFromFile("/nonexistent/policy.yml"); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
+
+func TestLoadPolicyFromFile_Connections(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+	f := writePolicy(t, `
+connections:
+  max_per_identity: 100
+  identities:
+    `+alice.String()+`: 10
+  tunnels:
+    MyApp.tunnel.example.com: 20
+    Shop.tunnel.example.com/API: 5
+  accept_rate: 5
+  accept_burst: 50
+`)
+
+	p, err := loadPolicyFromFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := p.connLimitConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.MaxConns != 100 || c.AcceptRate != 5 || c.AcceptBurst != 50 {
+		t.Errorf("unexpected limits %+v", c)
+	}
+	if c.Identities[alice] != 10 {
+		t.Errorf("unexpected identity limit %d", c.Identities[alice])
+	}
+	if c.Tunnels["myapp.tunnel.example.com"] != 20 {
+		t.Errorf("expected tunnel keys to be lowercased, got %v", c.Tunnels)
+	}
+	if c.Tunnels["shop.tunnel.example.com/API"] != 5 {
+		t.Errorf("expected path prefixes to keep their case, got %v", c.Tunnels)
+	}
+
+	if c, err := (&Policy{}).connLimitConfig(); err != nil || c != nil {
+		t.Fatalf("expected no connection limits, got %+v, %v", c, err)
+	}
+}
+
+func TestLoadPolicyFromFile_InvalidConnections(t *testing.T) {
+	t.Parallel()
+
+	p, err := loadPolicyFromFile(writePolicy(t, `
+connections:
+  accept_rate: -1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.connLimitConfig(); err == nil {
+		t.Fatal("expected error for negative accept rate")
+	}
+}
+
+func TestLoadPolicyFromFile_Quotas(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+	f := writePolicy(t, `
+quotas:
+  file: /var/lib/go-stream-tunnel/quota.json
+  default:
+    bytes: 10GB
+    period: monthly
+  identities:
+    `+alice.String()+`:
+      bytes: 1GiB
+      period: daily
+`)
+
+	p, err := loadPolicyFromFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := p.quotaConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.File != "/var/lib/go-stream-tunnel/quota.json" {
+		t.Errorf("unexpected file %q", c.File)
+	}
+	if c.Default.Bytes != 10*1000*1000*1000 || c.Default.Period != tunnel.QuotaMonthly {
+		t.Errorf("unexpected default quota %+v", c.Default)
+	}
+	if q := c.Identities[alice]; q.Bytes != 1<<30 || q.Period != tunnel.QuotaDaily {
+		t.Errorf("unexpected identity quota %+v", q)
+	}
+
+	if c, err := (&Policy{}).quotaConfig(); err != nil || c != nil {
+		t.Fatalf("expected no quotas, got %+v, %v", c, err)
+	}
+}
+
+func TestLoadPolicyFromFile_Hostnames(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+	f := writePolicy(t, `
+hostnames:
+  allowed:
+    - Shop.Example.org
+  identities:
+    `+alice.String()+`:
+      - "*.alice.example.net"
+    cn:laptop:
+      - laptop.example.net
+`)
+
+	p, err := loadPolicyFromFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := p.hostnameConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Allowed) != 1 || c.Allowed[0] != "shop.example.org" {
+		t.Errorf("unexpected allowed hostnames %v", c.Allowed)
+	}
+	if h := c.Identities[alice]; len(h) != 1 || h[0] != "*.alice.example.net" {
+		t.Errorf("unexpected identity hostnames %v", h)
+	}
+	if h := c.Names["laptop"]; len(h) != 1 || h[0] != "laptop.example.net" {
+		t.Errorf("unexpected name hostnames %v", h)
+	}
+
+	if c, err := (&Policy{}).hostnameConfig(); err != nil || c != nil {
+		t.Fatalf("expected no hostnames, got %+v, %v", c, err)
+	}
+}
+
+func TestLoadPolicyFromFile_Names(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+	f := writePolicy(t, `
+bandwidth:
+  identities:
+    `+alice.String()+`:
+      rate: 1MB
+    cn:laptop:
+      rate: 2MB
+connections:
+  identities:
+    cn:laptop: 5
+quotas:
+  identities:
+    cn:laptop:
+      bytes: 1GB
+      period: daily
+`)
+
+	p, err := loadPolicyFromFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.bandwidthConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Identities[alice].Rate != 1000*1000 || b.Names["laptop"].Rate != 2*1000*1000 {
+		t.Errorf("unexpected bandwidth limits %+v", b)
+	}
+	c, err := p.connLimitConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Names["laptop"] != 5 {
+		t.Errorf("unexpected connection limits %+v", c)
+	}
+	q, err := p.quotaConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Names["laptop"].Bytes != 1000*1000*1000 {
+		t.Errorf("unexpected quotas %+v", q)
+	}
+
+	p = &Policy{Bandwidth: BandwidthPolicy{Identities: map[string]RateLimitPolicy{"cn:": {Rate: 1}}}}
+	if _, err := p.bandwidthConfig(); err == nil {
+		t.Fatal("expected error for an empty name")
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+)
+
+// ConnLimitConfig limits the public connections the server accepts for
+// tunnels. Connections over a limit are closed right after accept, before
+// anything is sent to the client.
+type ConnLimitConfig struct {
+	// MaxConns caps concurrent connections per identity for every identity
+	// not listed in Identities or Names. Zero means no limit.
+	MaxConns int
+	// Identities caps concurrent connections of specific identities.
+	Identities map[id.ID]int
+	// Names caps concurrent connections of identities by certificate
+	// CommonName, see BandwidthConfig.Names.
+	Names map[string]int
+	// Tunnels caps concurrent connections of specific tunnels, keyed like
+	// BandwidthConfig.Tunnels.
+	Tunnels map[string]int
+	// AcceptRate is the number of new connections per second accepted from
+	// a single source IP, across all tunnels. Zero means no limit.
+	AcceptRate int
+	// AcceptBurst is how many connections a source IP may open at once
+	// after a quiet period. If zero, AcceptRate is used.
+	AcceptBurst int
+}
+
+// ConnLimitStats counts connections refused because of ConnLimitConfig.
+type ConnLimitStats struct {
+	// AcceptRate counts connections whose source IP exceeded AcceptRate.
+	AcceptRate uint64
+	// Identity counts connections over their identity's cap.
+	Identity uint64
+	// Tunnel counts connections over their tunnel's cap.
+	Tunnel uint64
+}
+
+var (
+	errAcceptRate    = errors.New("accept rate exceeded")
+	errIdentityConns = errors.New("too many connections for identity")
+	errTunnelConns   = errors.New("too many connections for tunnel")
+)
+
+// pruneInterval is how often idle token buckets, per source IP and per
+// identity or tunnel, are dropped.
+const pruneInterval = time.Minute
+
+// connLimiter enforces a ConnLimitConfig. Its methods are safe to call on a
+// nil connLimiter, which imposes no limits.
+type connLimiter struct {
+	config *ConnLimitConfig
+	// names returns the certificate CommonName of an identity.
+	names func(id.ID) string
+
+	mu         sync.Mutex
+	identities map[id.ID]int
+	tunnels    map[string]int
+	sources    map[string]*tokenBucket
+	lastPrune  time.Time
+
+	refusedRate     atomic.Uint64
+	refusedIdentity atomic.Uint64
+	refusedTunnel   atomic.Uint64
+}
+
+func newConnLimiter(config *ConnLimitConfig) *connLimiter {
+	return &connLimiter{
+		config:     config,
+		identities: make(map[id.ID]int),
+		tunnels:    make(map[string]int),
+		sources:    make(map[string]*tokenBucket),
+		lastPrune:  time.Now(),
+	}
+}
+
+// accept checks a freshly accepted connection from addr against the per
+// source IP accept rate.
+func (l *connLimiter) accept(addr net.Addr) error {
+	if l == nil || l.config.AcceptRate <= 0 {
+		return nil
+	}
+
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.lastPrune) >= pruneInterval {
+		for k, b := range l.sources {
+			if b.idle(now) {
+				delete(l.sources, k)
+			}
+		}
+		l.lastPrune = now
+	}
+	b, ok := l.sources[ip]
+	if !ok {
+		b = newTokenBucket(RateLimit{
+			Rate:  int64(l.config.AcceptRate),
+			Burst: int64(l.config.AcceptBurst),
+		})
+		l.sources[ip] = b
+	}
+	l.mu.Unlock()
+
+	if !b.allow() {
+		l.refusedRate.Add(1)
+		return errAcceptRate
+	}
+	return nil
+}
+
+// acquire takes a connection slot of identifier and tunnel. On success the
+// returned func must be called once the connection is closed.
+func (l *connLimiter) acquire(identifier id.ID, tunnel string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit, ok := lookupIdentity(l.config.Identities, l.config.Names, l.names, identifier)
+	if !ok {
+		limit = l.config.MaxConns
+	}
+	if limit > 0 && l.identities[identifier] >= limit {
+		l.refusedIdentity.Add(1)
+		return nil, errIdentityConns
+	}
+	if limit, ok := l.config.Tunnels[tunnel]; ok && limit > 0 && l.tunnels[tunnel] >= limit {
+		l.refusedTunnel.Add(1)
+		return nil, errTunnelConns
+	}
+
+	l.identities[identifier]++
+	l.tunnels[tunnel]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			if l.identities[identifier]--; l.identities[identifier] <= 0 {
+				delete(l.identities, identifier)
+			}
+			if l.tunnels[tunnel]--; l.tunnels[tunnel] <= 0 {
+				delete(l.tunnels, tunnel)
+			}
+		})
+	}, nil
+}
+
+func (l *connLimiter) stats() ConnLimitStats {
+	if l == nil {
+		return ConnLimitStats{}
+	}
+	return ConnLimitStats{
+		AcceptRate: l.refusedRate.Load(),
+		Identity:   l.refusedIdentity.Load(),
+		Tunnel:     l.refusedTunnel.Load(),
+	}
+}
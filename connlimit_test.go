@@ -0,0 +1,101 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+)
+
+func TestConnLimiter_Acquire(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+	bob := id.New([]byte("bob"))
+
+	l := newConnLimiter(&ConnLimitConfig{
+		MaxConns:   2,
+		Identities: map[id.ID]int{bob: 0},
+		Tunnels:    map[string]int{"2222": 1},
+	})
+
+	r1, err := l.acquire(alice, "1111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire(alice, "1111"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire(alice, "1111"); err != errIdentityConns {
+		t.Fatalf("expected %v, got %v", errIdentityConns, err)
+	}
+
+	r1()
+	r1() // releasing twice must not free a second slot
+	if _, err := l.acquire(alice, "1111"); err != nil {
+		t.Fatalf("expected a released slot to be reusable, got %v", err)
+	}
+	if _, err := l.acquire(alice, "1111"); err != errIdentityConns {
+		t.Fatalf("expected %v, got %v", errIdentityConns, err)
+	}
+
+	// bob is exempt from the default cap, but not from the tunnel's
+	if _, err := l.acquire(bob, "2222"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire(bob, "2222"); err != errTunnelConns {
+		t.Fatalf("expected %v, got %v", errTunnelConns, err)
+	}
+
+	if s := l.stats(); s.Identity != 2 || s.Tunnel != 1 || s.AcceptRate != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestConnLimiter_Accept(t *testing.T) {
+	t.Parallel()
+
+	l := newConnLimiter(&ConnLimitConfig{AcceptRate: 1, AcceptBurst: 2})
+
+	a := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	b := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}
+
+	for i := 0; i < 2; i++ {
+		// a different port is still the same source
+		a.Port++
+		if err := l.accept(a); err != nil {
+			t.Fatalf("expected connection %d within burst, got %v", i, err)
+		}
+	}
+	if err := l.accept(a); err != errAcceptRate {
+		t.Fatalf("expected %v, got %v", errAcceptRate, err)
+	}
+	if err := l.accept(b); err != nil {
+		t.Fatalf("expected other sources to be unaffected, got %v", err)
+	}
+
+	if s := l.stats(); s.AcceptRate != 1 {
+		t.Fatalf("expected 1 refused connection, got %+v", s)
+	}
+}
+
+func TestConnLimiter_Nil(t *testing.T) {
+	t.Parallel()
+
+	var l *connLimiter
+	if err := l.accept(&net.TCPAddr{}); err != nil {
+		t.Fatal(err)
+	}
+	release, err := l.acquire(id.ID{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if s := l.stats(); s != (ConnLimitStats{}) {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
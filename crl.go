@@ -0,0 +1,152 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultCRLReloadInterval is used if ServerConfig.CRLReloadInterval is
+// zero.
+const defaultCRLReloadInterval = time.Minute
+
+// CRL is a certificate revocation list loaded from a file. It's reloaded
+// whenever the file changes, so revoking a client takes effect without a
+// server restart.
+type CRL struct {
+	file    string
+	issuers []*x509.Certificate
+
+	mu         sync.RWMutex
+	modTime    time.Time
+	nextUpdate time.Time
+	revoked    map[string]struct{}
+}
+
+// NewCRL loads the PEM or DER encoded CRL in file. The CRL must be signed by
+// one of issuers, usually the CA certificates clients are verified against.
+func NewCRL(file string, issuers []*x509.Certificate) (*CRL, error) {
+	c := &CRL{
+		file:    file,
+		issuers: issuers,
+	}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload re-reads the CRL file if it was modified since the last load, and
+// reports whether it did. On error the previously loaded list stays in use.
+func (c *CRL) Reload() (bool, error) {
+	fi, err := os.Stat(c.file)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	unchanged := fi.ModTime().Equal(c.modTime) && c.revoked != nil
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	buf, err := os.ReadFile(c.file)
+	if err != nil {
+		return false, err
+	}
+	if block, _ := pem.Decode(buf); block != nil {
+		buf = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(buf)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse CRL %q: %s", c.file, err)
+	}
+	if err := c.checkSignature(crl); err != nil {
+		return false, fmt.Errorf("CRL %q: %s", c.file, err)
+	}
+
+	revoked := make(map[string]struct{}, len(crl.RevokedCertificateEntries))
+	for _, e := range crl.RevokedCertificateEntries {
+		revoked[revokedKey(crl.RawIssuer, e.SerialNumber.String())] = struct{}{}
+	}
+
+	c.mu.Lock()
+	c.revoked = revoked
+	c.modTime = fi.ModTime()
+	c.nextUpdate = crl.NextUpdate
+	c.mu.Unlock()
+
+	return true, nil
+}
+
+func (c *CRL) checkSignature(crl *x509.RevocationList) error {
+	err := fmt.Errorf("no issuer certificate given")
+	for _, issuer := range c.issuers {
+		if err = crl.CheckSignatureFrom(issuer); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature check failed: %s", err)
+}
+
+// IsRevoked reports whether cert is listed in the CRL.
+func (c *CRL) IsRevoked(cert *x509.Certificate) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.revoked[revokedKey(cert.RawIssuer, cert.SerialNumber.String())]
+	return ok
+}
+
+// IsConnRevoked reports whether the peer certificate of a connection in
+// state cs, or any certificate of the chains it was verified through, is
+// listed in the CRL, so revoking an intermediate CA revokes every client
+// certificate it issued.
+func (c *CRL) IsConnRevoked(cs tls.ConnectionState) bool {
+	if len(cs.PeerCertificates) > 0 && c.IsRevoked(cs.PeerCertificates[0]) {
+		return true
+	}
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if c.IsRevoked(cert) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Stale reports whether the CRL is past its NextUpdate at now, so a newer
+// one should have been published. A CRL without a NextUpdate never goes
+// stale.
+func (c *CRL) Stale(now time.Time) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return !c.nextUpdate.IsZero() && now.After(c.nextUpdate)
+}
+
+// NextUpdate returns the time by which the issuer of the CRL promised to
+// publish a newer one.
+func (c *CRL) NextUpdate() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.nextUpdate
+}
+
+// revokedKey identifies a certificate by issuer and serial number, which
+// are only unique together.
+func revokedKey(rawIssuer []byte, serial string) string {
+	return string(rawIssuer) + "/" + serial
+}
@@ -0,0 +1,221 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/ca"
+)
+
+func parseCert(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCRL(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := ca.GenerateCA("test CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, _, err := ca.IssueCert(caCertPEM, caKeyPEM, "laptop", nil, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, _, err := ca.IssueCert(caCertPEM, caKeyPEM, "phone", nil, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crlPEM, err := ca.RevokeCert(caCertPEM, caKeyPEM, nil, laptop, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "crl.pem")
+	if err := os.WriteFile(file, crlPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	crl, err := NewCRL(file, []*x509.Certificate{parseCert(t, caCertPEM)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !crl.IsRevoked(parseCert(t, laptop)) {
+		t.Fatal("expected laptop to be revoked")
+	}
+	if crl.IsRevoked(parseCert(t, phone)) {
+		t.Fatal("expected phone not to be revoked")
+	}
+
+	if changed, err := crl.Reload(); err != nil || changed {
+		t.Fatalf("expected no reload of an unchanged file, got %v, %v", changed, err)
+	}
+
+	crlPEM, err = ca.RevokeCert(caCertPEM, caKeyPEM, crlPEM, phone, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// DER works as well as PEM
+	block, _ := pem.Decode(crlPEM)
+	if err := os.WriteFile(file, block.Bytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, err := crl.Reload(); err != nil || !changed {
+		t.Fatalf("expected a reload of the changed file, got %v, %v", changed, err)
+	}
+	if !crl.IsRevoked(parseCert(t, phone)) {
+		t.Fatal("expected phone to be revoked after reload")
+	}
+
+	// a broken file keeps the last good list
+	if err := os.WriteFile(file, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Second)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crl.Reload(); err == nil {
+		t.Fatal("expected error reloading a broken CRL")
+	}
+	if !crl.IsRevoked(parseCert(t, laptop)) {
+		t.Fatal("expected the previous list to stay in use")
+	}
+}
+
+func TestCRL_Intermediate(t *testing.T) {
+	t.Parallel()
+
+	rootCertPEM, rootKeyPEM, err := ca.GenerateCA("test CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interCertPEM, interKeyPEM, err := ca.GenerateIntermediateCA(rootCertPEM, rootKeyPEM, "test intermediate", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, _, err := ca.IssueCert(interCertPEM, interKeyPEM, "laptop", nil, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crlPEM, err := ca.RevokeCert(rootCertPEM, rootKeyPEM, nil, interCertPEM, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "crl.pem")
+	if err := os.WriteFile(file, crlPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := parseCert(t, rootCertPEM)
+	crl, err := NewCRL(file, []*x509.Certificate{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, inter := parseCert(t, laptop), parseCert(t, interCertPEM)
+	if crl.IsRevoked(leaf) {
+		t.Fatal("expected the leaf itself not to be listed")
+	}
+	cs := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{leaf, inter},
+		VerifiedChains:   [][]*x509.Certificate{{leaf, inter, root}},
+	}
+	if !crl.IsConnRevoked(cs) {
+		t.Fatal("expected a leaf issued by a revoked intermediate to be revoked")
+	}
+	cs.VerifiedChains = nil
+	if crl.IsConnRevoked(cs) {
+		t.Fatal("expected only the leaf to be checked without verified chains")
+	}
+}
+
+func TestCRL_Stale(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := ca.GenerateCA("test CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, _, err := ca.IssueCert(caCertPEM, caKeyPEM, "laptop", nil, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlPEM, err := ca.RevokeCert(caCertPEM, caKeyPEM, nil, laptop, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "crl.pem")
+	if err := os.WriteFile(file, crlPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	crl, err := NewCRL(file, []*x509.Certificate{parseCert(t, caCertPEM)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if crl.Stale(now) {
+		t.Fatal("expected a fresh CRL not to be stale")
+	}
+	if !crl.Stale(now.Add(2 * time.Hour)) {
+		t.Fatal("expected the CRL to be stale past its next update")
+	}
+	// a stale CRL is still enforced
+	if !crl.IsRevoked(parseCert(t, laptop)) {
+		t.Fatal("expected laptop to stay revoked")
+	}
+}
+
+func TestNewCRL_WrongIssuer(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := ca.GenerateCA("test CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCertPEM, _, err := ca.GenerateCA("other CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, _, err := ca.IssueCert(caCertPEM, caKeyPEM, "laptop", nil, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlPEM, err := ca.RevokeCert(caCertPEM, caKeyPEM, nil, laptop, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "crl.pem")
+	if err := os.WriteFile(file, crlPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewCRL(file, []*x509.Certificate{parseCert(t, otherCertPEM)}); err == nil {
+		t.Fatal("expected error for a CRL signed by another CA")
+	}
+	if _, err := NewCRL(filepath.Join(t.TempDir(), "missing.pem"), nil); err == nil {
+		t.Fatal("expected error for a missing file")
+	}
+}
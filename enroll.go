@@ -0,0 +1,355 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/ChacheGS/go-stream-tunnel/ca"
+	"github.com/ChacheGS/go-stream-tunnel/id"
+	"github.com/ChacheGS/go-stream-tunnel/log"
+	"github.com/ChacheGS/go-stream-tunnel/proto"
+)
+
+// EnrollmentConfig lets clients without a certificate get one from the
+// server in exchange for a one-time token created by 'ca token'. The client
+// generates its key itself and sends a certificate signing request, so the
+// private key never leaves the client, and gets a certificate with the name
+// and permissions the token was created with. Enrollment happens on the control
+// address, on TLS connections negotiating proto.EnrollProtocol.
+type EnrollmentConfig struct {
+	// CACertPEM and CAKeyPEM are the PEM-encoded CA certificate and key
+	// enrolled certificates are signed with. The CA certificate is sent to
+	// enrolling clients, which check it against the hash in their token.
+	CACertPEM []byte
+	CAKeyPEM  []byte
+	// TokenFile holds the unused tokens, as written by 'ca token'. Tokens
+	// are removed from it as they are redeemed.
+	TokenFile string
+	// Validity is the validity period of enrolled certificates.
+	Validity time.Duration
+	// IndexFile, if set, is the index of the CA, as kept by 'ca', enrolled
+	// certificates are recorded in, so they can be listed and revoked on
+	// the CA host. A certificate that can't be recorded isn't handed out.
+	IndexFile string
+}
+
+func (c *EnrollmentConfig) validate() error {
+	if _, err := tls.X509KeyPair(c.CACertPEM, c.CAKeyPEM); err != nil {
+		return fmt.Errorf("invalid CA key pair: %s", err)
+	}
+	if c.TokenFile == "" {
+		return errors.New("missing token file")
+	}
+	if c.Validity <= 0 {
+		return errors.New("validity must be positive")
+	}
+	return nil
+}
+
+// enrollmentTLSConfig returns base extended to accept enrollment
+// connections. These don't require a client certificate, and the server
+// sends its certificate chain along with the CA certificate the client's
+// token pins.
+func enrollmentTLSConfig(base *tls.Config, caCertPEM []byte) *tls.Config {
+	block, _ := pem.Decode(caCertPEM)
+
+	enroll := base.Clone()
+	enroll.ClientAuth = tls.NoClientCert
+	enroll.NextProtos = []string{proto.EnrollProtocol}
+	enroll.Certificates = nil
+	for _, cert := range base.Certificates {
+		// a server certificate issued by an intermediate CA already
+		// carries it
+		if !slices.ContainsFunc(cert.Certificate, func(der []byte) bool { return bytes.Equal(der, block.Bytes) }) {
+			cert.Certificate = append(slices.Clone(cert.Certificate), block.Bytes)
+		}
+		enroll.Certificates = append(enroll.Certificates, cert)
+	}
+
+	config := base.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if slices.Contains(hello.SupportedProtos, proto.EnrollProtocol) {
+			return enroll, nil
+		}
+		return nil, nil
+	}
+	return config
+}
+
+// handleEnrollment serves a single enrollment request on conn.
+func (s *Server) handleEnrollment(conn *tls.Conn, logger log.Logger) {
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(DefaultTimeout)); err != nil {
+		return
+	}
+
+	(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.serveEnrollment(w, r, logger)
+		}),
+	})
+}
+
+func (s *Server) serveEnrollment(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	csrPEM, err := io.ReadAll(io.LimitReader(r.Body, maxCertSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	csr, err := ca.ParseCSR(csrPEM)
+	if err != nil {
+		logger.Log(
+			"level", 1,
+			"msg", "enrollment rejected",
+			"err", err,
+		)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, err := s.redeemToken(secret)
+	if err != nil {
+		logger.Log(
+			"level", 1,
+			"msg", "enrollment rejected",
+			"err", err,
+		)
+		if errors.Is(err, ca.ErrInvalidToken) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else {
+			http.Error(w, "token check failed", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var sans []string
+	if entry.Permissions != nil {
+		sans = entry.Permissions.SANs()
+	}
+
+	c := s.config.Enrollment
+	certPEM, err := ca.IssueCertForKey(c.CACertPEM, c.CAKeyPEM, entry.Name, sans, csr.PublicKey, c.Validity)
+	if err != nil {
+		logger.Log(
+			"level", 0,
+			"msg", "enrollment failed",
+			"name", entry.Name,
+			"err", err,
+		)
+		http.Error(w, "certificate issuance failed", http.StatusInternalServerError)
+		return
+	}
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		http.Error(w, "certificate issuance failed", http.StatusInternalServerError)
+		return
+	}
+	if err := s.recordCert(c.IndexFile, certPEM); err != nil {
+		logger.Log(
+			"level", 0,
+			"msg", "enrollment failed",
+			"name", entry.Name,
+			"err", err,
+		)
+		http.Error(w, "certificate issuance failed", http.StatusInternalServerError)
+		return
+	}
+	logger.Log(
+		"level", 1,
+		"action", "client enrolled",
+		"name", entry.Name,
+		"serial", fmt.Sprintf("%X", cert.SerialNumber),
+		"identifier", id.FromCert(cert, id.ModeCert),
+		"spki_identifier", id.FromCert(cert, id.ModeSPKI),
+	)
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.WriteHeader(http.StatusOK)
+	w.Write(certPEM)
+}
+
+// redeemToken removes the token with the given secret from the token file
+// and returns it. The token is only handed out once it's removed from the
+// file.
+func (s *Server) redeemToken(secret string) (*ca.TokenEntry, error) {
+	file := s.config.Enrollment.TokenFile
+
+	s.enrollMu.Lock()
+	defer s.enrollMu.Unlock()
+
+	data, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	tokens, err := ca.ParseTokens(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %s", file, err)
+	}
+
+	entry, err := tokens.Redeem(secret, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteFileAtomic(file, tokens.Marshal(), 0600); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Enroll gets a certificate for key from the server at addr in exchange for
+// token, as created by 'ca token'. The server must present a certificate
+// for the host of addr issued by the CA the token pins. The certificate is
+// returned along with that CA certificate, both PEM-encoded, for the client
+// to use as its -ca-crt.
+func Enroll(ctx context.Context, addr, token string, key crypto.Signer) (certPEM, caCertPEM []byte, err error) {
+	secret, caHash, err := ca.ParseToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var caCert *x509.Certificate
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: DefaultTimeout},
+		Config: &tls.Config{
+			NextProtos: []string{proto.EnrollProtocol},
+			ServerName: host,
+			// The server is verified against the CA pinned by the token
+			// in VerifyConnection instead of system roots.
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				var err error
+				caCert, err = verifyPinnedChain(cs.PeerCertificates, caHash, host)
+				return err
+			},
+		},
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	if conn.(*tls.Conn).ConnectionState().NegotiatedProtocol != proto.EnrollProtocol {
+		return nil, nil, errors.New("server does not accept enrollment")
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CSR: %s", err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+addr+"/enroll", bytes.NewReader(csrPEM))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+secret)
+
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCertSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("server refused enrollment: %s", strings.TrimSpace(string(body)))
+	}
+
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, nil, errors.New("failed to decode certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse certificate: %s", err)
+	}
+	if err := cert.CheckSignatureFrom(caCert); err != nil {
+		return nil, nil, fmt.Errorf("certificate was not issued by the pinned CA: %s", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(pub, cert.RawSubjectPublicKeyInfo) {
+		return nil, nil, errors.New("certificate does not match the key")
+	}
+
+	return body, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), nil
+}
+
+// verifyPinnedChain verifies that certs, as presented by a server, hold the
+// CA certificate with the SHA-256 caHash and a leaf for host issued by it,
+// and returns the CA certificate.
+func verifyPinnedChain(certs []*x509.Certificate, caHash []byte, host string) (*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("server presented no certificate")
+	}
+
+	var caCert *x509.Certificate
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		if sum := sha256.Sum256(cert.Raw); bytes.Equal(sum[:], caHash) {
+			caCert = cert
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if caCert == nil {
+		return nil, errors.New("server did not present the CA certificate pinned by the token")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	}); err != nil {
+		return nil, fmt.Errorf("server certificate: %s", err)
+	}
+	return caCert, nil
+}
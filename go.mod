@@ -1,12 +1,13 @@
 module github.com/ChacheGS/go-stream-tunnel
 
-go 1.26
+go 1.26.0
 
 require (
 	github.com/cenkalti/backoff/v4 v4.1.2
 	github.com/golang/mock v1.6.0
-	golang.org/x/net v0.0.0-20220225172249-27dd8689420f
+	golang.org/x/crypto v0.57.0
+	golang.org/x/net v0.58.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
-require golang.org/x/text v0.3.7 // indirect
+require golang.org/x/text v0.42.0 // indirect
@@ -0,0 +1,161 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/ChacheGS/go-stream-tunnel/proto"
+)
+
+// isH2CPreface reports whether req, read off a public connection, is the
+// preface of an HTTP/2 connection with prior knowledge (RFC 9113 §3.4).
+func isH2CPreface(req *http.Request) bool {
+	return req.Method == "PRI" && req.URL.Path == "*" && req.Proto == "HTTP/2.0"
+}
+
+// h2cStreamKey is the context key of the h2cStream of a request.
+type h2cStreamKey struct{}
+
+// h2cStream is what the proxy of an HTTP/2 stream needs of its tunnel.
+type h2cStream struct {
+	// dial opens the stream to the tunnel.
+	dial    func() net.Conn
+	headers *headerRules
+}
+
+// serveH2C serves the HTTP/2 connection conn, whose preface was read off
+// into replay. Each of its streams is routed by :authority and path on its
+// own, and forwarded to its tunnel as an HTTP/1.1 request over a stream of
+// its own.
+func (s *Server) serveH2C(conn net.Conn, replay io.Reader) {
+	defer conn.Close()
+
+	c := &h2cConn{s: s, conn: conn}
+	c.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = pr.In.Host
+			setForwardedHeaders(pr.Out.Header, pr.In, conn)
+			pr.In.Context().Value(h2cStreamKey{}).(*h2cStream).headers.rewriteRequest(pr.Out)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Request.Context().Value(h2cStreamKey{}).(*h2cStream).headers.rewriteResponse(resp.Header)
+			return nil
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return ctx.Value(h2cStreamKey{}).(*h2cStream).dial(), nil
+			},
+			DisableKeepAlives: true,
+		},
+		FlushInterval: -1,
+		// Errors copying bodies are logged by proxyConn already.
+		ErrorLog:     stdlog.New(io.Discard, "", 0),
+		ErrorHandler: c.proxyError,
+	}
+
+	(&http2.Server{}).ServeConn(&replayConn{Conn: conn, r: replay}, &http2.ServeConnOpts{
+		Handler: c,
+	})
+}
+
+// h2cConn is an HTTP/2 connection whose streams are routed one by one.
+type h2cConn struct {
+	s     *Server
+	conn  net.Conn
+	proxy *httputil.ReverseProxy
+}
+
+func (c *h2cConn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s := c.s
+	start := time.Now()
+	fullHost := strings.ToLower(trimPort(req.Host))
+
+	identifier, route, ok := s.registry.matchRoute(fullHost, req.URL.Path)
+	if !ok {
+		s.logger.Log(
+			"level", 1,
+			"msg", "no tunnel registered for host",
+			"host", fullHost,
+			"path", req.URL.Path,
+		)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	host, prefix := splitRoute(route)
+	msg := &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  httpSlugFromHost(s.config.BaseDomain, host) + prefix,
+		ForwardedProto: proto.HTTP,
+	}
+
+	release, err := s.connLimits.acquire(identifier, route)
+	if err != nil {
+		s.logger.Log(
+			"level", 2,
+			"action", "stream refused",
+			"remote_addr", c.conn.RemoteAddr(),
+			"reason", err,
+			"identifier", identifier,
+			"client", s.clientName(identifier),
+			"host", fullHost,
+		)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	entry := s.newAccessLogEntry(identifier, c.conn, msg)
+	entry.Start = start
+	entry.Host = fullHost
+	entry.Method = req.Method
+	entry.Path = req.URL.RequestURI()
+
+	dial := func() net.Conn {
+		stream, tunnelSide := net.Pipe()
+		go func() {
+			if err := s.proxyConn(identifier, &pipeConn{Conn: tunnelSide, remote: c.conn.RemoteAddr()}, msg, route, entry); err != nil {
+				s.logger.Log(
+					"level", 0,
+					"msg", "http proxy error",
+					"identifier", identifier,
+					"client", s.clientName(identifier),
+					"ctrlMsg", msg,
+					"err", err,
+				)
+			}
+		}()
+		return stream
+	}
+	stream := &h2cStream{dial: dial, headers: s.registry.headers(route)}
+	c.proxy.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), h2cStreamKey{}, stream)))
+}
+
+// proxyError answers an HTTP/2 stream whose request failed before a
+// response was read from the tunnel.
+func (c *h2cConn) proxyError(w http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	c.s.logger.Log(
+		"level", 1,
+		"msg", "http/2 stream failed",
+		"host", req.Host,
+		"err", err,
+	)
+	w.WriteHeader(http.StatusBadGateway)
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ChacheGS/go-stream-tunnel/proto"
+)
+
+// headerRules are the header changes of an http tunnel, see proto.Tunnel.
+type headerRules struct {
+	host     string
+	request  *proto.HeaderRules
+	response *proto.HeaderRules
+}
+
+// newHeaderRules returns the header rules of t, or nil if it has none.
+func newHeaderRules(t *proto.Tunnel) *headerRules {
+	if t.HostHeader == "" && t.RequestHeaders == nil && t.ResponseHeaders == nil {
+		return nil
+	}
+	return &headerRules{
+		host:     t.HostHeader,
+		request:  t.RequestHeaders,
+		response: t.ResponseHeaders,
+	}
+}
+
+// rewriteRequest changes the Host and headers of req, a request to the
+// tunnel. A nil r changes nothing.
+func (r *headerRules) rewriteRequest(req *http.Request) {
+	if r == nil {
+		return
+	}
+	if r.host != "" {
+		req.Host = r.host
+	}
+	r.request.Apply(req.Header)
+}
+
+// rewriteResponse changes h, the header of a response from the tunnel. A
+// nil r changes nothing.
+func (r *headerRules) rewriteResponse(h http.Header) {
+	if r != nil {
+		r.response.Apply(h)
+	}
+}
+
+// setForwardedHeaders sets the X-Forwarded-For, -Proto and -Host headers of
+// h, the header of req or of the request it's forwarded as, req being read
+// off conn. A proxy in front of HTTPAddr is trusted with the headers, the
+// address of conn is appended to its X-Forwarded-For. Connections the
+// server decrypted itself come from the public, their headers are always
+// the server's own.
+func setForwardedHeaders(h http.Header, req *http.Request, conn net.Conn) {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+	forwardedFor := append(req.Header.Values("X-Forwarded-For"), ip)
+
+	scheme, host := req.Header.Get("X-Forwarded-Proto"), req.Header.Get("X-Forwarded-Host")
+	if _, decrypted := conn.(*tls.Conn); decrypted {
+		forwardedFor = []string{ip}
+		scheme, host = "https", req.Host
+	}
+	h.Set("X-Forwarded-For", strings.Join(forwardedFor, ", "))
+	if scheme == "" {
+		scheme = "http"
+	}
+	if host == "" {
+		host = req.Host
+	}
+	h.Set("X-Forwarded-Proto", scheme)
+	h.Set("X-Forwarded-Host", host)
+}
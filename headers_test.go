@@ -0,0 +1,114 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/ChacheGS/go-stream-tunnel/proto"
+)
+
+func TestSetForwardedHeaders(t *testing.T) {
+	t.Parallel()
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	plain := &pipeConn{Conn: a, remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}}
+	decrypted := tls.Server(&pipeConn{Conn: b, remote: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}}, &tls.Config{})
+
+	tests := []struct {
+		name   string
+		conn   net.Conn
+		header http.Header
+		want   http.Header
+	}{
+		{
+			name:   "plain",
+			conn:   plain,
+			header: http.Header{},
+			want: http.Header{
+				"X-Forwarded-For":   {"127.0.0.1"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"myapp.tunnel.example.com"},
+			},
+		},
+		{
+			name: "behind a proxy",
+			conn: plain,
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1, 10.0.0.1", "10.0.0.2"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"public.example.com"},
+			},
+			want: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1, 10.0.0.1, 10.0.0.2, 127.0.0.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"public.example.com"},
+			},
+		},
+		{
+			name: "decrypted",
+			conn: decrypted,
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"evil.example.com"},
+			},
+			want: http.Header{
+				"X-Forwarded-For":   {"203.0.113.7"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"myapp.tunnel.example.com"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{Host: "myapp.tunnel.example.com", Header: tt.header}
+			setForwardedHeaders(req.Header, req, tt.conn)
+			for name, want := range tt.want {
+				if got := req.Header.Get(name); got != want[0] {
+					t.Errorf("%s: expected %q, got %q", name, want[0], got)
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderRules_Rewrite(t *testing.T) {
+	t.Parallel()
+
+	if r := newHeaderRules(&proto.Tunnel{Protocol: proto.HTTP, Host: "myapp"}); r != nil {
+		t.Fatalf("expected no header rules, got %+v", r)
+	}
+
+	r := newHeaderRules(&proto.Tunnel{
+		Protocol:        proto.HTTP,
+		Host:            "myapp",
+		HostHeader:      "localhost:3000",
+		RequestHeaders:  &proto.HeaderRules{Add: map[string]string{"X-Env": "dev"}, Remove: []string{"Cookie"}},
+		ResponseHeaders: &proto.HeaderRules{Remove: []string{"Server"}},
+	})
+
+	req := &http.Request{Host: "myapp.tunnel.example.com", Header: http.Header{"Cookie": {"a=1"}}}
+	r.rewriteRequest(req)
+	if req.Host != "localhost:3000" || req.Header.Get("X-Env") != "dev" || req.Header.Get("Cookie") != "" {
+		t.Fatalf("unexpected request: host %q, header %v", req.Host, req.Header)
+	}
+
+	h := http.Header{"Server": {"local"}, "Content-Type": {"text/plain"}}
+	r.rewriteResponse(h)
+	if h.Get("Server") != "" || h.Get("Content-Type") != "text/plain" {
+		t.Fatalf("unexpected response header %v", h)
+	}
+
+	var none *headerRules
+	none.rewriteRequest(req)
+	none.rewriteResponse(h)
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+	"github.com/ChacheGS/go-stream-tunnel/proto"
+)
+
+// HostnameConfig lists the custom hostnames, outside of the base domain,
+// clients may expose http tunnels on with proto.Tunnel's Hostname. Entries
+// are hostnames, or patterns like "*.example.com" matching any hostname
+// under example.com but not example.com itself.
+type HostnameConfig struct {
+	// Allowed hostnames may be used by any client.
+	Allowed []string
+	// Identities lists the hostnames specific identities may use, on top
+	// of Allowed.
+	Identities map[id.ID][]string
+	// Names lists the hostnames identities may use by certificate
+	// CommonName, see BandwidthConfig.Names.
+	Names map[string][]string
+}
+
+func (c *HostnameConfig) validate() error {
+	check := func(hostnames []string) error {
+		for _, h := range hostnames {
+			if !proto.ValidHostname(strings.TrimPrefix(h, "*.")) {
+				return fmt.Errorf("invalid hostname %q", h)
+			}
+		}
+		return nil
+	}
+	if err := check(c.Allowed); err != nil {
+		return err
+	}
+	for _, hostnames := range c.Identities {
+		if err := check(hostnames); err != nil {
+			return err
+		}
+	}
+	for _, hostnames := range c.Names {
+		if err := check(hostnames); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allows reports whether c lets identifier use hostname, names returns the
+// certificate CommonName of an identity. A nil c allows no hostname.
+func (c *HostnameConfig) allows(hostname string, identifier id.ID, names func(id.ID) string) bool {
+	if c == nil {
+		return false
+	}
+	if matchHostname(c.Allowed, hostname) {
+		return true
+	}
+	hostnames, _ := lookupIdentity(c.Identities, c.Names, names, identifier)
+	return matchHostname(hostnames, hostname)
+}
+
+// matchHostname reports whether hostname is one of patterns, or under the
+// domain of a "*." one.
+func matchHostname(patterns []string, hostname string) bool {
+	for _, p := range patterns {
+		if domain, ok := strings.CutPrefix(p, "*."); ok {
+			if strings.HasSuffix(hostname, "."+domain) {
+				return true
+			}
+		} else if p == hostname {
+			return true
+		}
+	}
+	return false
+}
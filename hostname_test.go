@@ -0,0 +1,79 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+)
+
+func TestHostnameConfig_Allows(t *testing.T) {
+	t.Parallel()
+
+	alice := newTestID("alice")
+	bob := newTestID("bob")
+	names := func(identifier id.ID) string {
+		if identifier == bob {
+			return "laptop"
+		}
+		return ""
+	}
+	c := &HostnameConfig{
+		Allowed:    []string{"shop.example.org"},
+		Identities: map[id.ID][]string{alice: {"*.alice.example.net"}},
+		Names:      map[string][]string{"laptop": {"laptop.example.net"}},
+	}
+
+	tests := []struct {
+		host       string
+		identifier id.ID
+		want       bool
+	}{
+		{"shop.example.org", alice, true},
+		{"shop.example.org", bob, true},
+		{"www.shop.example.org", alice, false},
+		{"app.alice.example.net", alice, true},
+		{"a.b.alice.example.net", alice, true},
+		{"alice.example.net", alice, false},
+		{"app.alice.example.net", bob, false},
+		{"laptop.example.net", bob, true},
+		{"laptop.example.net", alice, false},
+	}
+	for _, tt := range tests {
+		if got := c.allows(tt.host, tt.identifier, names); got != tt.want {
+			t.Errorf("allows(%q, %s) = %v, want %v", tt.host, tt.identifier, got, tt.want)
+		}
+	}
+
+	var nilConfig *HostnameConfig
+	if nilConfig.allows("shop.example.org", alice, names) {
+		t.Error("expected a nil config to allow no hostname")
+	}
+}
+
+func TestHostnameConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	valid := &HostnameConfig{
+		Allowed: []string{"shop.example.org", "*.example.net"},
+		Names:   map[string][]string{"laptop": {"laptop.example.net"}},
+	}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, c := range []*HostnameConfig{
+		{Allowed: []string{"localhost"}},
+		{Allowed: []string{"*"}},
+		{Allowed: []string{"app.*.example.net"}},
+		{Identities: map[id.ID][]string{newTestID("alice"): {"Shop.example.org"}}},
+		{Names: map[string][]string{"laptop": {"laptop..example.net"}}},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
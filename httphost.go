@@ -13,6 +13,8 @@ import (
 	"net"
 	"net/http"
 	"strings"
+
+	"github.com/ChacheGS/go-stream-tunnel/proto"
 )
 
 // httpFullHost composes the full public hostname for an http tunnel's
@@ -26,11 +28,21 @@ func httpFullHost(baseDomain, slug string) string {
 // by httpFullHost. It assumes fullHost was in fact composed by httpFullHost
 // for the same baseDomain, which holds for every host the registry can ever
 // return from a lookup, since addTunnels is the only writer of registered
-// hosts and always uses httpFullHost.
+// hosts and always uses httpFullHost, except for a tunnel's custom Hostname,
+// which never is under baseDomain and so is returned unchanged.
 func httpSlugFromHost(baseDomain, fullHost string) string {
 	return strings.TrimSuffix(fullHost, "."+baseDomain)
 }
 
+// tunnelRoute returns the route of the http or tls tunnel t, see
+// RegistryItem.Hosts: its full public hostname followed by its path prefix.
+func tunnelRoute(baseDomain string, t *proto.Tunnel) string {
+	if t.Hostname != "" {
+		return t.Hostname + t.PathPrefix
+	}
+	return httpFullHost(baseDomain, t.Host) + t.PathPrefix
+}
+
 // peekHostHeader reads an HTTP request's start-line and headers from r,
 // returning the Host header value and a reader that reproduces the exact
 // bytes already consumed during parsing followed by the remainder of r. It
@@ -39,16 +51,27 @@ func httpSlugFromHost(baseDomain, fullHost string) string {
 // WebSocket frames after a 101 response) byte-for-byte intact for
 // downstream proxying.
 func peekHostHeader(r io.Reader) (host string, replay io.Reader, err error) {
+	req, replay, err := peekRequest(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return req.Host, replay, nil
+}
+
+// peekRequest is peekHostHeader returning the whole parsed request rather
+// than just its Host. The request's Body must not be read: its bytes belong
+// to replay.
+func peekRequest(r io.Reader) (req *http.Request, replay io.Reader, err error) {
 	var buf bytes.Buffer
 	tee := io.TeeReader(r, &buf)
 	br := bufio.NewReader(tee)
 
-	req, err := http.ReadRequest(br)
+	req, err = http.ReadRequest(br)
 	if err != nil {
-		return "", nil, err
+		return nil, nil, err
 	}
 
-	return req.Host, io.MultiReader(&buf, r), nil
+	return req, io.MultiReader(&buf, r), nil
 }
 
 // replayConn wraps a net.Conn so that Read is served from r first (typically
@@ -0,0 +1,311 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+	"github.com/ChacheGS/go-stream-tunnel/proto"
+)
+
+// serveHTTPRequests serves the HTTP/1.x requests read from br, which reads
+// conn, routing each by its Host and path on its own, until conn is closed
+// or can't carry another request. start is when conn was accepted.
+func (s *Server) serveHTTPRequests(conn net.Conn, br *bufio.Reader, start time.Time) {
+	c := &httpConn{s: s, conn: conn, br: br}
+	defer c.close()
+
+	for first := true; ; first = false {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				s.logger.Log(
+					"level", 1,
+					"msg", "failed to read request",
+					"err", err,
+				)
+			}
+			return
+		}
+		if !first {
+			start = time.Now()
+		}
+		if !c.serve(req, start) {
+			return
+		}
+	}
+}
+
+// httpConn is a public connection whose requests are routed one by one.
+type httpConn struct {
+	s    *Server
+	conn net.Conn
+	br   *bufio.Reader
+	// stream is the stream the last request was proxied over, reused by
+	// the next one if it's routed to the same tunnel.
+	stream *httpStream
+}
+
+// httpStream is a stream to a tunnel, proxied by proxyConn from the other
+// end of a net.Pipe.
+type httpStream struct {
+	net.Conn
+	r          *bufio.Reader
+	identifier id.ID
+	route      string
+}
+
+func (c *httpConn) close() {
+	c.closeStream()
+	c.conn.Close()
+}
+
+func (c *httpConn) closeStream() {
+	if c.stream != nil {
+		c.stream.Close()
+		c.stream = nil
+	}
+}
+
+// serve proxies req to the tunnel its Host and path are routed to, and
+// writes the response to c.conn. It reports whether c.conn may carry
+// another request.
+func (c *httpConn) serve(req *http.Request, start time.Time) bool {
+	fullHost := strings.ToLower(trimPort(req.Host))
+
+	identifier, route, ok := c.s.registry.matchRoute(fullHost, req.URL.Path)
+	if !ok {
+		c.s.logger.Log(
+			"level", 1,
+			"msg", "no tunnel registered for host",
+			"host", fullHost,
+			"path", req.URL.Path,
+		)
+		io.WriteString(c.conn, "HTTP/1.1 404 Not Found\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return false
+	}
+
+	if c.stream != nil && (c.stream.identifier != identifier || c.stream.route != route) {
+		c.closeStream()
+	}
+
+	// X-Forwarded-Host is the Host asked for, before any rewrite.
+	headers := c.s.registry.headers(route)
+	setForwardedHeaders(req.Header, req, c.conn)
+	headers.rewriteRequest(req)
+
+	// The client knows the tunnel by its registered subdomain and path
+	// prefix, e.g. "myapp/api".
+	host, prefix := splitRoute(route)
+	msg := &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  httpSlugFromHost(c.s.config.BaseDomain, host) + prefix,
+		ForwardedProto: proto.HTTP,
+	}
+
+	// A reused stream may have been closed by the local service meanwhile,
+	// a request that is safe to repeat is sent again over a new one then.
+	reused := c.stream != nil
+	if !reused && !c.openStream(msg, identifier, route, fullHost) {
+		return false
+	}
+
+	// Each request gets an access log entry of its own, the streams don't.
+	entry := c.s.newAccessLogEntry(identifier, c.conn, msg)
+	entry.Start = start
+	entry.Host = fullHost
+	entry.Method = req.Method
+	entry.Path = req.URL.RequestURI()
+	out := &countingConn{Conn: c.conn}
+	defer func() {
+		entry.BytesOut = out.n.Load()
+		c.s.logAccess(entry)
+	}()
+
+	in := &countingConn{Conn: c.stream}
+	keep, err := roundTrip(out, c.br, in, c.stream.r, req, headers, entry)
+	if err != nil && reused && retryable(req) {
+		c.closeStream()
+		if !c.openStream(msg, identifier, route, fullHost) {
+			entry.CloseReason = err.Error()
+			return false
+		}
+		in = &countingConn{Conn: c.stream}
+		keep, err = roundTrip(out, c.br, in, c.stream.r, req, headers, entry)
+	}
+	entry.BytesIn = in.n.Load()
+	if err != nil {
+		entry.CloseReason = err.Error()
+		io.WriteString(c.conn, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return false
+	}
+	if !keep {
+		c.closeStream()
+	}
+	return keep
+}
+
+// retryable reports whether req may be sent again after the stream it was
+// sent over failed to answer: its method must be idempotent (RFC 9110
+// §9.2.2), as for net/http's Transport, and it must have no body, which the
+// first attempt used up.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.ContentLength == 0 && len(req.TransferEncoding) == 0
+	}
+	return false
+}
+
+// openStream opens c.stream to the tunnel of route as described by msg, for
+// the request on fullHost about to be sent and those after it routed there
+// too.
+func (c *httpConn) openStream(msg *proto.ControlMessage, identifier id.ID, route, fullHost string) bool {
+	s := c.s
+
+	release, err := s.connLimits.acquire(identifier, route)
+	if err != nil {
+		io.WriteString(c.conn, "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		s.refuse(c.conn, err, "identifier", identifier, "client", s.clientName(identifier), "host", fullHost)
+		return false
+	}
+
+	stream, tunnelSide := net.Pipe()
+	go func() {
+		defer release()
+		if err := s.proxyConn(identifier, &pipeConn{Conn: tunnelSide, remote: c.conn.RemoteAddr()}, msg, route, nil); err != nil {
+			s.logger.Log(
+				"level", 0,
+				"msg", "http proxy error",
+				"identifier", identifier,
+				"client", s.clientName(identifier),
+				"ctrlMsg", msg,
+				"err", err,
+			)
+		}
+	}()
+
+	c.stream = &httpStream{
+		Conn:       stream,
+		r:          bufio.NewReader(stream),
+		identifier: identifier,
+		route:      route,
+	}
+	return true
+}
+
+// roundTrip writes req to stream and the response read from sr, which
+// reads stream, to conn, with headers' response rules applied. After a
+// 101 Switching Protocols response the rest of conn, read by br, and
+// stream are passed through as is until either is closed. It reports
+// whether conn and stream may carry another request, or an error if no
+// response was read, and nothing was written to conn. The status of the
+// response and why the exchange ended are recorded in entry.
+func roundTrip(conn net.Conn, br *bufio.Reader, stream net.Conn, sr *bufio.Reader, req *http.Request, headers *headerRules, entry *AccessLogEntry) (bool, error) {
+	// req.Write would add a User-Agent of its own.
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
+	}
+
+	// The request is written while the response is read, since a tunnel
+	// may answer before it has read the whole body.
+	written := make(chan error, 1)
+	go func() {
+		written <- req.Write(stream)
+	}()
+	// What's left of a body the tunnel didn't read can't be told apart
+	// from what follows it on conn.
+	wroteRequest := func() bool {
+		select {
+		case err := <-written:
+			return err == nil
+		case <-time.After(DefaultTimeout):
+			return false
+		}
+	}
+
+	resp, err := http.ReadResponse(sr, req)
+	if err != nil {
+		return false, err
+	}
+	for resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+		if err := writeResponseHeader(conn, resp); err != nil {
+			return false, nil
+		}
+		if resp, err = http.ReadResponse(sr, req); err != nil {
+			return false, nil
+		}
+	}
+	defer resp.Body.Close()
+	headers.rewriteResponse(resp.Header)
+	entry.Status = resp.StatusCode
+	entry.CloseReason = closeUser
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if !wroteRequest() || writeResponseHeader(conn, resp) != nil {
+			return false, nil
+		}
+		go func() {
+			io.Copy(stream, br)
+			stream.Close()
+		}()
+		if _, err := io.Copy(conn, sr); err == nil {
+			entry.CloseReason = closeClient
+		}
+		return false, nil
+	}
+
+	if err := resp.Write(conn); err != nil || !wroteRequest() {
+		return false, nil
+	}
+	entry.CloseReason = closeResponse
+
+	// resp.Write delimits a body of unknown length by closing conn.
+	unknownLength := resp.ContentLength < 0 && len(resp.TransferEncoding) == 0
+	return !req.Close && !resp.Close && !unknownLength, nil
+}
+
+// writeResponseHeader writes the status line and header of resp, with no
+// body, for 1xx responses.
+func writeResponseHeader(w io.Writer, resp *http.Response) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	resp.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// countingConn counts the bytes written to a net.Conn.
+type countingConn struct {
+	net.Conn
+	n atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// pipeConn is one end of a net.Pipe standing in for a public connection,
+// reporting the remote address of the latter.
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,234 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/ChacheGS/go-stream-tunnel/ca"
+)
+
+// HTTPSConfig lets the server terminate TLS for http tunnels itself on a
+// public address, instead of a reverse proxy in front of HTTPAddr. The
+// decrypted connections are routed like those accepted on HTTPAddr.
+type HTTPSConfig struct {
+	// Addr is the address to listen on, e.g. ":443".
+	Addr string
+	// CertPEM and KeyPEM are the PEM-encoded certificate, typically for
+	// *.<BaseDomain>, and key served for every host.
+	CertPEM []byte
+	KeyPEM  []byte
+	// CACertPEM and CAKeyPEM are the PEM-encoded CA certificate and key a
+	// certificate is issued with for each http tunnel host on first use.
+	// Hosts only covered by a wildcard host get none, serving them takes
+	// CertPEM. Only used if CertPEM is not set.
+	CACertPEM []byte
+	CAKeyPEM  []byte
+	// Validity is the validity period of issued certificates. They are
+	// issued again once less than a third of it is left, and dropped once
+	// their host has no http tunnel left.
+	Validity time.Duration
+	// ACME, if set, gets the certificate of each http tunnel host from an
+	// ACME CA instead, again not for hosts only covered by a wildcard
+	// host. Only used if neither CertPEM nor CACertPEM is set.
+	ACME *ACMEConfig
+}
+
+func (c *HTTPSConfig) validate() error {
+	if c.Addr == "" {
+		return errors.New("missing Addr")
+	}
+	if c.CertPEM != nil {
+		if _, err := tls.X509KeyPair(c.CertPEM, c.KeyPEM); err != nil {
+			return fmt.Errorf("invalid key pair: %s", err)
+		}
+		return nil
+	}
+	if c.CACertPEM == nil && c.ACME != nil {
+		return c.ACME.validate()
+	}
+	if _, err := tls.X509KeyPair(c.CACertPEM, c.CAKeyPEM); err != nil {
+		return fmt.Errorf("invalid CA key pair: %s", err)
+	}
+	if c.Validity <= 0 {
+		return errors.New("validity must be positive")
+	}
+	return nil
+}
+
+// httpsCerts picks the certificate for a TLS connection to the HTTPS
+// listener.
+type httpsCerts struct {
+	config *HTTPSConfig
+	// cert is the certificate given by config.CertPEM, if any.
+	cert *tls.Certificate
+	// acme gets the certificates if config.ACME is used, httpChallenge
+	// answers its http-01 challenges if they're enabled.
+	acme          *autocert.Manager
+	httpChallenge http.Handler
+	// known reports whether there is an http tunnel for host itself,
+	// certificates are only issued for those. A wildcard host would let
+	// anyone have certificates issued for as many hosts as they like.
+	known func(host string) bool
+
+	mu     sync.Mutex
+	issued map[string]*tls.Certificate
+	// issuing holds the certificates being issued, by host, so handshakes
+	// for one host wait for the same certificate and those for others
+	// don't wait at all.
+	issuing map[string]*issueCall
+}
+
+// issueCall is a certificate being issued, done is closed once cert or
+// err is set.
+type issueCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// maxIssuedCerts bounds the certificates issued with HTTPSConfig.CACertPEM
+// kept for reuse.
+const maxIssuedCerts = 1024
+
+func newHTTPSCerts(config *HTTPSConfig, known func(host string) bool) (*httpsCerts, error) {
+	c := &httpsCerts{
+		config:  config,
+		known:   known,
+		issued:  make(map[string]*tls.Certificate),
+		issuing: make(map[string]*issueCall),
+	}
+	if config.CertPEM != nil {
+		cert, err := tls.X509KeyPair(config.CertPEM, config.KeyPEM)
+		if err != nil {
+			return nil, err
+		}
+		c.cert = &cert
+	} else if config.CACertPEM == nil && config.ACME != nil {
+		c.acme = newACMEManager(config.ACME, known)
+	}
+	return c, nil
+}
+
+// tlsConfig returns the configuration of the HTTPS listener. Only HTTP/1.1
+// is offered, since that's what routing by Host header reads, along with
+// the protocol of the ACME tls-alpn-01 challenge when ACME is used.
+func (c *httpsCerts) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+		GetCertificate: c.getCertificate,
+	}
+	if c.acme != nil {
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	}
+	return config
+}
+
+func (c *httpsCerts) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c.cert != nil {
+		return c.cert, nil
+	}
+	if c.acme != nil {
+		return c.acme.GetCertificate(hello)
+	}
+
+	host := strings.ToLower(hello.ServerName)
+	if host == "" || !c.known(host) {
+		return nil, fmt.Errorf("no http tunnel for host %q", host)
+	}
+
+	c.mu.Lock()
+	if cert, ok := c.issued[host]; ok && c.fresh(cert, time.Now()) {
+		c.mu.Unlock()
+		return cert, nil
+	}
+	if call, ok := c.issuing[host]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.cert, call.err
+	}
+	call := &issueCall{done: make(chan struct{})}
+	c.issuing[host] = call
+	c.mu.Unlock()
+
+	call.cert, call.err = c.issue(host)
+
+	c.mu.Lock()
+	delete(c.issuing, host)
+	if call.err == nil {
+		if _, ok := c.issued[host]; !ok && len(c.issued) >= maxIssuedCerts {
+			c.pruneLocked(time.Now())
+			if len(c.issued) >= maxIssuedCerts {
+				c.evictLocked()
+			}
+		}
+		c.issued[host] = call.cert
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.cert, call.err
+}
+
+// issue issues a certificate for host with HTTPSConfig.CACertPEM.
+func (c *httpsCerts) issue(host string) (*tls.Certificate, error) {
+	certPEM, keyPEM, err := ca.IssueCert(c.config.CACertPEM, c.config.CAKeyPEM, host, []string{host}, ca.ECDSAP256, c.config.Validity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate for %q: %s", host, err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// fresh reports whether the issued cert is still served at now.
+func (c *httpsCerts) fresh(cert *tls.Certificate, now time.Time) bool {
+	return now.Add(c.config.Validity / 3).Before(cert.Leaf.NotAfter)
+}
+
+// prune drops the issued certificates that are due for reissue or whose
+// host has no http tunnel anymore. It's called as tunnels go away.
+func (c *httpsCerts) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pruneLocked(time.Now())
+}
+
+// pruneLocked is prune with c.mu held.
+func (c *httpsCerts) pruneLocked(now time.Time) {
+	for host, cert := range c.issued {
+		if !c.fresh(cert, now) || !c.known(host) {
+			delete(c.issued, host)
+		}
+	}
+}
+
+// evictLocked drops the issued certificate that expires first. c.mu must
+// be held.
+func (c *httpsCerts) evictLocked() {
+	var (
+		oldest   string
+		notAfter time.Time
+	)
+	for host, cert := range c.issued {
+		if oldest == "" || cert.Leaf.NotAfter.Before(notAfter) {
+			oldest, notAfter = host, cert.Leaf.NotAfter
+		}
+	}
+	delete(c.issued, oldest)
+}
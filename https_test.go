@@ -0,0 +1,155 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/ca"
+)
+
+func TestHTTPSConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := ca.GenerateCA("test CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.IssueCert(caCertPEM, caKeyPEM, "myapp", []string{"myapp.tunnel.example.com"}, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]HTTPSConfig{
+		"certificate": {Addr: ":443", CertPEM: certPEM, KeyPEM: keyPEM},
+		"CA":          {Addr: ":443", CACertPEM: caCertPEM, CAKeyPEM: caKeyPEM, Validity: time.Hour},
+		"ACME":        {Addr: ":443", ACME: &ACMEConfig{CacheDir: t.TempDir()}},
+	} {
+		if err := c.validate(); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	for name, c := range map[string]HTTPSConfig{
+		"missing addr":  {CertPEM: certPEM, KeyPEM: keyPEM},
+		"missing key":   {Addr: ":443", CertPEM: certPEM},
+		"missing CA":    {Addr: ":443", Validity: time.Hour},
+		"zero validity": {Addr: ":443", CACertPEM: caCertPEM, CAKeyPEM: caKeyPEM},
+		"ACME no cache": {Addr: ":443", ACME: &ACMEConfig{}},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestHTTPSCerts_Issue(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := ca.GenerateCA("test CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := newHTTPSCerts(&HTTPSConfig{
+		Addr:      ":443",
+		CACertPEM: caCertPEM,
+		CAKeyPEM:  caKeyPEM,
+		Validity:  time.Hour,
+	}, func(host string) bool { return host == "myapp.tunnel.example.com" || host == "api.tunnel.example.com" })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.getCertificate(&tls.ClientHelloInfo{ServerName: "other.tunnel.example.com"}); err == nil {
+		t.Fatal("expected no certificate for a host without a tunnel")
+	}
+	if _, err := c.getCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Fatal("expected no certificate without server name")
+	}
+
+	cert, err := c.getCertificate(&tls.ClientHelloInfo{ServerName: "MyApp.tunnel.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("myapp.tunnel.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.CheckSignatureFrom(parseCert(t, caCertPEM)); err != nil {
+		t.Fatalf("expected a certificate issued by the CA: %s", err)
+	}
+
+	again, err := c.getCertificate(&tls.ClientHelloInfo{ServerName: "myapp.tunnel.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != cert {
+		t.Fatal("expected the issued certificate to be reused")
+	}
+
+	// concurrent handshakes for a new host wait for one certificate
+	certs := make([]*tls.Certificate, 8)
+	var wg sync.WaitGroup
+	for i := range certs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			certs[i], _ = c.getCertificate(&tls.ClientHelloInfo{ServerName: "api.tunnel.example.com"})
+		}()
+	}
+	wg.Wait()
+	for _, got := range certs {
+		if got == nil || got != certs[0] {
+			t.Fatal("expected concurrent handshakes to share one certificate")
+		}
+	}
+}
+
+func TestHTTPSCerts_Prune(t *testing.T) {
+	t.Parallel()
+
+	caCertPEM, caKeyPEM, err := ca.GenerateCA("test CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	wildcard := true
+	c, err := newHTTPSCerts(&HTTPSConfig{
+		Addr:      ":443",
+		CACertPEM: caCertPEM,
+		CAKeyPEM:  caKeyPEM,
+		Validity:  time.Hour,
+	}, func(host string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return wildcard && strings.HasSuffix(host, ".alice.tunnel.example.com")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range maxIssuedCerts + 10 {
+		if _, err := c.getCertificate(&tls.ClientHelloInfo{ServerName: fmt.Sprintf("h%d.alice.tunnel.example.com", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(c.issued); n != maxIssuedCerts {
+		t.Fatalf("expected the cache to be capped at %d, got %d", maxIssuedCerts, n)
+	}
+
+	mu.Lock()
+	wildcard = false
+	mu.Unlock()
+	c.prune()
+	if n := len(c.issued); n != 0 {
+		t.Fatalf("expected the certificates of gone tunnels to be dropped, %d left", n)
+	}
+}
@@ -8,8 +8,10 @@ package id
 
 import (
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base32"
 	"errors"
+	"fmt"
 	"regexp"
 	"strings"
 )
@@ -30,6 +32,37 @@ func New(data []byte) ID {
 	return id
 }
 
+// Mode selects which part of a certificate its ID is derived from.
+type Mode string
+
+const (
+	// ModeCert derives the ID from the whole certificate, so renewing the
+	// certificate changes the ID. This is the default.
+	ModeCert Mode = "cert"
+	// ModeSPKI derives the ID from the certificate's SubjectPublicKeyInfo,
+	// so the ID survives renewals that keep the same key.
+	ModeSPKI Mode = "spki"
+)
+
+// ParseMode parses a Mode, where "" means ModeCert.
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case "", ModeCert:
+		return ModeCert, nil
+	case ModeSPKI:
+		return ModeSPKI, nil
+	}
+	return "", fmt.Errorf("unknown ID mode %q, expected cert or spki", s)
+}
+
+// FromCert returns the ID of cert in the given mode.
+func FromCert(cert *x509.Certificate, mode Mode) ID {
+	if mode == ModeSPKI {
+		return New(cert.RawSubjectPublicKeyInfo)
+	}
+	return New(cert.Raw)
+}
+
 // String returns the canonical representation of the ID.
 func (i ID) String() string {
 	ss := base32.StdEncoding.EncodeToString(i[:])
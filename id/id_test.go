@@ -2,6 +2,7 @@ package id
 
 import (
 	"crypto/sha256"
+	"crypto/x509"
 	"strings"
 	"testing"
 )
@@ -40,6 +41,32 @@ func TestNew_SameInput(t *testing.T) {
 	}
 }
 
+func TestFromCert(t *testing.T) {
+	t.Parallel()
+
+	cert := &x509.Certificate{Raw: []byte("cert"), RawSubjectPublicKeyInfo: []byte("key")}
+
+	if got := FromCert(cert, ModeCert); got != New(cert.Raw) {
+		t.Fatalf("expected the certificate hash, got %s", got)
+	}
+	if got := FromCert(cert, ModeSPKI); got != New(cert.RawSubjectPublicKeyInfo) {
+		t.Fatalf("expected the SPKI hash, got %s", got)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	t.Parallel()
+
+	for in, want := range map[string]Mode{"": ModeCert, "cert": ModeCert, "spki": ModeSPKI} {
+		if got, err := ParseMode(in); err != nil || got != want {
+			t.Fatalf("ParseMode(%q): expected %s, got %s, %v", in, want, got, err)
+		}
+	}
+	if _, err := ParseMode("key"); err == nil {
+		t.Fatal("expected error for an unknown mode")
+	}
+}
+
 func TestString(t *testing.T) {
 	t.Parallel()
 
@@ -8,38 +8,84 @@ package id
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"time"
 )
 
 var emptyID [32]byte
 
 // PeerID is modified https://github.com/andrew-d/ptls/blob/b89c7dcc94630a77f225a48befd3710144c7c10e/ptls.go#L81
 func PeerID(conn *tls.Conn) (ID, error) {
+	remoteCert, err := PeerCert(conn)
+	if err != nil {
+		return emptyID, err
+	}
+
+	// Get remote cert's ID.
+	return FromCert(remoteCert, ModeCert), nil
+}
+
+// Info describes the certificate a peer was identified by, so people reading
+// logs and listings don't have to go by its ID alone.
+type Info struct {
+	CommonName string
+	// SANs are the DNS names and IP addresses of the certificate.
+	SANs     []string
+	NotAfter time.Time
+}
+
+// InfoFromCert returns the Info of cert.
+func InfoFromCert(cert *x509.Certificate) *Info {
+	i := &Info{
+		CommonName: cert.Subject.CommonName,
+		SANs:       append([]string(nil), cert.DNSNames...),
+		NotAfter:   cert.NotAfter,
+	}
+	for _, ip := range cert.IPAddresses {
+		i.SANs = append(i.SANs, ip.String())
+	}
+	return i
+}
+
+// VerifiedInfo returns the Info of the leaf certificate the peer presented
+// in the completed handshake on conn. It returns nil unless the certificate
+// was verified against trusted CAs, since the names in any other
+// certificate are whatever the peer chose.
+func VerifiedInfo(conn *tls.Conn) *Info {
+	chains := conn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return InfoFromCert(chains[0][0])
+}
+
+// PeerCert completes the handshake on conn and returns the leaf
+// certificate the peer presented. The leaf may be followed by intermediate
+// CA certificates; the peer's identity is always taken from the leaf, whose
+// key the handshake proves the peer holds.
+func PeerCert(conn *tls.Conn) (*x509.Certificate, error) {
 	// Try a TLS connection over the given connection. We explicitly perform
 	// the handshake, since we want to maintain the invariant that, if this
 	// function returns successfully, then the connection should be valid
 	// and verified.
 	if err := conn.Handshake(); err != nil {
-		return emptyID, err
+		return nil, err
 	}
 
 	cs := conn.ConnectionState()
 
-	// We should have exactly one peer certificate.
+	// We should have a peer certificate, possibly followed by its chain.
 	certs := cs.PeerCertificates
-	if cl := len(certs); cl != 1 {
-		return emptyID, ImproperCertsNumberError{cl}
+	if cl := len(certs); cl == 0 {
+		return nil, ImproperCertsNumberError{cl}
 	}
 
-	// Get remote cert's ID.
-	remoteCert := certs[0]
-	remoteID := New(remoteCert.Raw)
-
-	return remoteID, nil
+	return certs[0], nil
 }
 
 // ImproperCertsNumberError is returned from Server/Client whenever the remote
-// peer presents a number of PeerCertificates that is not 1.
+// peer presents no PeerCertificates.
 type ImproperCertsNumberError struct {
 	n int
 }
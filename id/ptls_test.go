@@ -6,10 +6,12 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"math/big"
 	"net"
 	"strings"
 	"testing"
+	"time"
 )
 
 func generateSelfSignedCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
@@ -114,6 +116,157 @@ func TestPeerID_Success(t *testing.T) {
 	}
 }
 
+func TestPeerCert_Chain(t *testing.T) {
+	t.Parallel()
+
+	clientCert, rawCert := generateSelfSignedCert(t)
+	intermediate, _ := generateSelfSignedCert(t)
+	serverCert, _ := generateSelfSignedCert(t)
+
+	// a leaf followed by the intermediate that issued it
+	clientCert.Certificate = append(clientCert.Certificate, intermediate.Certificate...)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	errCh := make(chan error, 1)
+	certCh := make(chan *x509.Certificate, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+
+		cert, err := PeerCert(conn.(*tls.Conn))
+		if err != nil {
+			errCh <- err
+			return
+		}
+		certCh <- cert
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		Certificates:       []tls.Certificate{clientCert},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case err := <-errCh:
+		t.Fatal("server error:", err)
+	case cert := <-certCh:
+		if !cert.Equal(rawCert) {
+			t.Fatal("expected the leaf certificate of the chain")
+		}
+	}
+}
+
+func TestVerifiedInfo(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "laptop"},
+		DNSNames:     []string{"laptop.example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour).Truncate(time.Second),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawCert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert := tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: key, Leaf: rawCert}
+	serverCert, _ := generateSelfSignedCert(t)
+
+	trusted := x509.NewCertPool()
+	trusted.AddCert(rawCert)
+
+	for _, clientAuth := range []tls.ClientAuthType{tls.RequireAndVerifyClientCert, tls.RequireAnyClientCert} {
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   clientAuth,
+			ClientCAs:    trusted,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		type result struct {
+			id   ID
+			info *Info
+			err  error
+		}
+		resCh := make(chan result, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				resCh <- result{err: err}
+				return
+			}
+			defer conn.Close()
+
+			var r result
+			if r.id, r.err = PeerID(conn.(*tls.Conn)); r.err == nil {
+				r.info = VerifiedInfo(conn.(*tls.Conn))
+			}
+			resCh <- r
+		}()
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			Certificates:       []tls.Certificate{clientCert},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		r := <-resCh
+		if r.err != nil {
+			t.Fatal("server error:", r.err)
+		}
+		if r.id != New(rawCert.Raw) {
+			t.Fatalf("expected ID %v, got %v", New(rawCert.Raw), r.id)
+		}
+
+		if clientAuth == tls.RequireAnyClientCert {
+			if r.info != nil {
+				t.Fatalf("expected no info for an unverified certificate, got %+v", r.info)
+			}
+			continue
+		}
+		if r.info == nil {
+			t.Fatal("expected info for a verified certificate")
+		}
+		if r.info.CommonName != "laptop" || strings.Join(r.info.SANs, ",") != "laptop.example.com,127.0.0.1" || !r.info.NotAfter.Equal(template.NotAfter) {
+			t.Fatalf("unexpected info %+v", r.info)
+		}
+	}
+}
+
 func TestPeerID_NoCert(t *testing.T) {
 	t.Parallel()
 
@@ -11,19 +11,28 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	tunnel "github.com/ChacheGS/go-stream-tunnel"
+	"github.com/ChacheGS/go-stream-tunnel/ca"
+	"github.com/ChacheGS/go-stream-tunnel/id"
 	"github.com/ChacheGS/go-stream-tunnel/log"
 	"github.com/ChacheGS/go-stream-tunnel/proto"
+	"golang.org/x/net/http2"
 	"golang.org/x/net/websocket"
 )
 
@@ -125,6 +134,44 @@ func waitConnected(t *testing.T, c *tunnel.Client, timeout time.Duration) {
 	}
 }
 
+// waitListening waits until addr, e.g. Server.HTTPAddr, returns the address
+// of a listener opened by Server.Start, and returns it.
+func waitListening(t *testing.T, addr func() string, timeout time.Duration) string {
+	t.Helper()
+
+	deadline := time.After(timeout)
+	for addr() == "" {
+		select {
+		case <-deadline:
+			t.Fatal("server did not listen within timeout")
+		default:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return addr()
+}
+
+// waitTunnel waits until the server listens on addr for a tcp tunnel, which
+// happens a little after the client got connected.
+func waitTunnel(t *testing.T, addr net.Addr, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		conn, err := net.Dial("tcp", addr.String())
+		if err == nil {
+			conn.Close()
+			return
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("tunnel %s not listening within timeout: %s", addr, err)
+		default:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
 func TestIntegration(t *testing.T) {
 	// local services
 	tcp := makeEcho(t)
@@ -539,18 +586,10 @@ func tlsConfig() *tls.Config {
 	return c
 }
 
-// TestIntegration_HTTPSubdomainTunnel_CrossTenantIsolation proves the
-// documented caveat in the README's "Subdomain-routed HTTP tunnels" section:
-// the server decides which tunnel a connection belongs to exactly once, by
-// peeking the Host header at accept time, then relays everything else on
-// that connection byte-for-byte with no further awareness of HTTP framing.
-// A reverse proxy that reuses one backend connection across requests for
-// *different* subdomains would silently leak the second request to the
-// first request's tunnel -- this test demonstrates that leak actually
-// happening when a connection is reused across hosts, and confirms it does
-// not happen when each request gets its own connection (the documented
-// mitigation, e.g. Caddy's keepalive -1s or Traefik's
-// maxIdleConnsPerHost: -1).
+// TestIntegration_HTTPSubdomainTunnel_CrossTenantIsolation proves that a
+// connection is never committed to one tenant: both separate connections
+// and a single keep-alive connection reused across hosts, as a reverse
+// proxy's backend pool does, reach the backend of each request's own Host.
 func TestIntegration_HTTPSubdomainTunnel_CrossTenantIsolation(t *testing.T) {
 	// Two independent local backends, each answering with its own identity
 	// regardless of what Host header a request claims -- this is what lets
@@ -615,7 +654,7 @@ func TestIntegration_HTTPSubdomainTunnel_CrossTenantIsolation(t *testing.T) {
 		}
 	})
 
-	t.Run("reusing one connection across hosts leaks to the first tunnel", func(t *testing.T) {
+	t.Run("reusing one connection across hosts stays isolated", func(t *testing.T) {
 		conn, err := net.Dial("tcp", s.HTTPAddr())
 		if err != nil {
 			t.Fatal(err)
@@ -629,76 +668,1896 @@ func TestIntegration_HTTPSubdomainTunnel_CrossTenantIsolation(t *testing.T) {
 		}
 
 		// Second request, same connection, different Host -- exactly what
-		// a reverse proxy's backend connection pool would do if it isn't
-		// configured to disable keep-alive reuse across hosts. The server
-		// already committed this connection to backend A at accept time
-		// and never looks at the Host header again, so this is expected
-		// to come back as "A", not "B": that mismatch (a request claiming
-		// svcb answered by tenant A's backend) is the leak.
+		// a reverse proxy's backend connection pool does. Answered by
+		// backend A, a request claiming svcb would leak to tenant A.
 		second := doRequest(t, conn, "svcb.tunnel.example.com")
-		if second != "A" {
-			t.Fatalf("expected the reused connection to demonstrate the documented leak (still routed to backend A), got %q -- if this now reads B, the server's routing model changed and the README's caveat needs revisiting", second)
+		if second != "B" {
+			t.Fatalf("expected the second request on the reused connection to reach backend B, got %q", second)
 		}
 	})
 }
 
-// serveIdentity starts a local HTTP server that always responds with body,
-// regardless of the request's Host header, and returns its address.
-func serveIdentity(t *testing.T, body string) string {
-	t.Helper()
+// TestIntegration_TLSPassthroughTunnel proves that a proto tls tunnel is
+// routed by SNI on the HTTP listener and reaches the local TLS server with
+// the handshake untouched, while http tunnels on the same listener keep
+// working.
+func TestIntegration_TLSPassthroughTunnel(t *testing.T) {
+	local := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tls " + r.TLS.ServerName))
+	}))
+	defer local.Close()
+	localAddr := local.Listener.Addr().String()
 
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+		BaseDomain:    "tunnel.example.com",
+		HTTPAddr:      "127.0.0.1:0",
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Cleanup(func() { ln.Close() })
+	go s.Start(context.Background())
+	defer s.Stop()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(body))
+	time.Sleep(50 * time.Millisecond)
+
+	tcpProxy := tunnel.NewMultiStreamProxy(map[string]string{
+		"secure": localAddr,
+		"plain":  serveIdentity(t, "plain"),
+	}, log.NewStdLogger())
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"secure": {Protocol: proto.TLS, Host: "secure"},
+			"plain":  {Protocol: proto.HTTP, Host: "plain"},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Stream: tcpProxy.Proxy,
+		}),
+		Logger: log.NewStdLogger(),
 	})
-	go http.Serve(ln, mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Start(ctx)
 
-	return ln.Addr().String()
+	waitConnected(t, c, 5*time.Second)
+
+	conn, err := tls.Dial("tcp", s.HTTPAddr(), &tls.Config{
+		ServerName:         "secure.tunnel.example.com",
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if !conn.ConnectionState().PeerCertificates[0].Equal(local.Certificate()) {
+		t.Fatal("expected the certificate of the local TLS server")
+	}
+	if body := doRequest(t, conn, "secure.tunnel.example.com"); body != "tls secure.tunnel.example.com" {
+		t.Fatalf("expected the local TLS server to see the server name, got %q", body)
+	}
+
+	if body := requestOverFreshConn(t, s.HTTPAddr(), "plain.tunnel.example.com"); body != "plain" {
+		t.Fatalf("expected %q, got %q", "plain", body)
+	}
+
+	// a plain request for the tls host and a handshake for the http one are
+	// not routed
+	if _, err := tls.Dial("tcp", s.HTTPAddr(), &tls.Config{
+		ServerName:         "plain.tunnel.example.com",
+		InsecureSkipVerify: true,
+	}); err == nil {
+		t.Fatal("expected handshake for an http tunnel host to fail")
+	}
+	plainConn, err := net.Dial("tcp", s.HTTPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plainConn.Close()
+	plainConn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest(http.MethodGet, "http://secure.tunnel.example.com/", nil)
+	req.Write(plainConn)
+	resp, err := http.ReadResponse(bufio.NewReader(plainConn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a plain request to a tls tunnel host, got %d", resp.StatusCode)
+	}
 }
 
-// requestOverFreshConn dials a new connection to httpAddr, issues a single
-// request with the given host, and returns the response body.
-func requestOverFreshConn(t *testing.T, httpAddr, host string) string {
-	t.Helper()
+// TestIntegration_HTTPWildcardSubdomain proves that requests are routed
+// to the most specific of multi-level and wildcard subdomains, and that the
+// client is forwarded the registered subdomain to pick its local target by.
+func TestIntegration_HTTPWildcardSubdomain(t *testing.T) {
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+		BaseDomain:    "tunnel.example.com",
+		HTTPAddr:      "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(context.Background())
+	defer s.Stop()
 
-	conn, err := net.Dial("tcp", httpAddr)
+	time.Sleep(50 * time.Millisecond)
+
+	tcpProxy := tunnel.NewMultiStreamProxy(map[string]string{
+		"*.alice":   serveIdentity(t, "preview"),
+		"api.alice": serveIdentity(t, "api"),
+	}, log.NewStdLogger())
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"preview": {Protocol: proto.HTTP, Host: "*.alice"},
+			"api":     {Protocol: proto.HTTP, Host: "api.alice"},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Stream: tcpProxy.Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Start(ctx)
+
+	waitConnected(t, c, 5*time.Second)
+
+	for host, want := range map[string]string{
+		"pr-1.alice.tunnel.example.com":    "preview",
+		"Pr-2.Alice.tunnel.example.com":    "preview",
+		"v1.api.alice.tunnel.example.com":  "preview",
+		"api.alice.tunnel.example.com":     "api",
+		"api.alice.tunnel.example.com:443": "api",
+	} {
+		if body := requestOverFreshConn(t, s.HTTPAddr(), host); body != want {
+			t.Fatalf("%s: expected %q, got %q", host, want, body)
+		}
+	}
+
+	conn, err := net.Dial("tcp", s.HTTPAddr())
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer conn.Close()
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
-
-	return doRequest(t, conn, host)
+	req, _ := http.NewRequest(http.MethodGet, "http://alice.tunnel.example.com/", nil)
+	req.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for the wildcard's own domain, got %d", resp.StatusCode)
+	}
 }
 
-// doRequest writes a GET request with the given Host over conn and returns
-// the response body, leaving conn open for a possible next request.
-func doRequest(t *testing.T, conn net.Conn, host string) string {
-	t.Helper()
+// TestIntegration_HTTPPathRouting proves that requests for one host are
+// routed by longest path prefix to tunnels of different clients, one by one
+// on a keep-alive connection, and that an upgraded connection is passed
+// through after the 101 response.
+func TestIntegration_HTTPPathRouting(t *testing.T) {
+	serverTLS, clientTLS, caCertPEM, caKeyPEM, _ := caTLSConfigs(t)
 
-	req, err := http.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	otherCertPEM, otherKeyPEM, err := ca.IssueCert(caCertPEM, caKeyPEM, "other", nil, ca.ECDSAP256, time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := req.Write(conn); err != nil {
+	otherCert, err := tls.X509KeyPair(otherCertPEM, otherKeyPEM)
+	if err != nil {
 		t.Fatal(err)
 	}
+	otherTLS := clientTLS.Clone()
+	otherTLS.Certificates = []tls.Certificate{otherCert}
 
-	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          "127.0.0.1:0",
+		AutoSubscribe: true,
+		TLSConfig:     serverTLS,
+		Logger:        log.NewStdLogger(),
+		BaseDomain:    "tunnel.example.com",
+		HTTPAddr:      "127.0.0.1:0",
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer resp.Body.Close()
+	go s.Start(context.Background())
+	defer s.Stop()
 
-	body, err := io.ReadAll(resp.Body)
+	time.Sleep(50 * time.Millisecond)
+
+	api := http.NewServeMux()
+	api.Handle("/api/ws", websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	api.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "api %s %s", r.URL.Path, body)
+	})
+	apiLn, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
-	return string(body)
+	defer apiLn.Close()
+	go http.Serve(apiLn, api)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, cc := range []struct {
+		tls     *tls.Config
+		tunnels map[string]*proto.Tunnel
+		targets map[string]string
+	}{
+		{
+			tls:     clientTLS,
+			tunnels: map[string]*proto.Tunnel{"web": {Protocol: proto.HTTP, Host: "shop"}},
+			targets: map[string]string{"shop": serveIdentity(t, "web")},
+		},
+		{
+			tls:     otherTLS,
+			tunnels: map[string]*proto.Tunnel{"api": {Protocol: proto.HTTP, Host: "shop", PathPrefix: "/api"}},
+			targets: map[string]string{"shop/api": apiLn.Addr().String()},
+		},
+	} {
+		c, err := tunnel.NewClient(&tunnel.ClientConfig{
+			ServerAddr:      s.Addr(),
+			TLSClientConfig: cc.tls,
+			Tunnels:         cc.tunnels,
+			Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+				Stream: tunnel.NewMultiStreamProxy(cc.targets, log.NewStdLogger()).Proxy,
+			}),
+			Logger: log.NewStdLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go c.Start(ctx)
+		waitConnected(t, c, 5*time.Second)
+	}
+
+	conn, err := net.Dial("tcp", s.HTTPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	for _, tt := range []struct {
+		method, path, body, want string
+	}{
+		{http.MethodGet, "/", "", "web"},
+		{http.MethodPost, "/api/users", "alice", "api /api/users alice"},
+		{http.MethodGet, "/apix", "", "web"},
+		{http.MethodGet, "/api", "", "api /api "},
+		{http.MethodGet, "/index.html", "", "web"},
+	} {
+		req, _ := http.NewRequest(tt.method, "http://shop.tunnel.example.com"+tt.path, strings.NewReader(tt.body))
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("%s %s: %s", tt.method, tt.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tt.want {
+			t.Fatalf("%s %s: expected %q, got %q", tt.method, tt.path, tt.want, body)
+		}
+	}
+
+	wsConfig, err := websocket.NewConfig("ws://shop.tunnel.example.com/api/ws", "http://shop.tunnel.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		t.Fatalf("websocket upgrade failed: %v", err)
+	}
+	defer ws.Close()
+	if err := sendAndExpectEcho(ws, "hello over a path route"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIntegration_HTTPRouteEachRequest proves that the requests on one
+// keep-alive connection are routed to the tunnels of their own hosts, that
+// consecutive ones to the same tunnel share a local connection, and that
+// an idempotent request is retried once the local service closed an idle
+// one, while a POST isn't.
+func TestIntegration_HTTPRouteEachRequest(t *testing.T) {
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+		BaseDomain:    "tunnel.example.com",
+		HTTPAddr:      "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	var localConns atomic.Int32
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("alpha"))
+	})
+	local := &http.Server{
+		Handler:     mux,
+		IdleTimeout: 100 * time.Millisecond,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				localConns.Add(1)
+			}
+		},
+	}
+	go local.Serve(ln)
+	defer local.Close()
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"alpha": {Protocol: proto.HTTP, Host: "alpha"},
+			"beta":  {Protocol: proto.HTTP, Host: "beta"},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Stream: tunnel.NewMultiStreamProxy(map[string]string{
+				"alpha": ln.Addr().String(),
+				"beta":  serveIdentity(t, "beta"),
+			}, log.NewStdLogger()).Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Start(ctx)
+	waitConnected(t, c, 5*time.Second)
+
+	conn, err := net.Dial("tcp", s.HTTPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, host := range []string{"alpha", "alpha", "beta", "alpha"} {
+		if body := doRequest(t, conn, host+".tunnel.example.com"); body != host {
+			t.Fatalf("expected %q, got %q", host, body)
+		}
+	}
+	if n := localConns.Load(); n != 2 {
+		t.Fatalf("expected 2 local connections to alpha, got %d", n)
+	}
+
+	// The local service closes the stream of the last request meanwhile.
+	time.Sleep(300 * time.Millisecond)
+	if body := doRequest(t, conn, "alpha.tunnel.example.com"); body != "alpha" {
+		t.Fatalf("expected %q after the idle timeout, got %q", "alpha", body)
+	}
+
+	wsConfig, err := websocket.NewConfig("ws://alpha.tunnel.example.com/ws", "http://alpha.tunnel.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		t.Fatalf("websocket upgrade failed: %v", err)
+	}
+	defer ws.Close()
+	if err := sendAndExpectEcho(ws, "hello after routed requests"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err = net.Dial("tcp", s.HTTPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if body := doRequest(t, conn, "alpha.tunnel.example.com"); body != "alpha" {
+		t.Fatalf("expected %q, got %q", "alpha", body)
+	}
+	time.Sleep(300 * time.Millisecond)
+	req, err := http.NewRequest(http.MethodPost, "http://alpha.tunnel.example.com/", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected a POST over a closed stream not to be retried, got %s", resp.Status)
+	}
+}
+
+// TestIntegration_HTTPH2C proves that the streams of one HTTP/2 connection
+// with prior knowledge are routed to the tunnels of their own hosts and
+// paths, concurrently, and that a host without a tunnel is answered with
+// 404 without affecting the others.
+func TestIntegration_HTTPH2C(t *testing.T) {
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+		BaseDomain:    "tunnel.example.com",
+		HTTPAddr:      "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoLn.Close()
+	go http.Serve(echoLn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "echo %s %s %s", r.Host, r.URL.Path, body)
+	}))
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"alpha": {Protocol: proto.HTTP, Host: "alpha"},
+			"beta":  {Protocol: proto.HTTP, Host: "beta"},
+			"api":   {Protocol: proto.HTTP, Host: "beta", PathPrefix: "/api"},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Stream: tunnel.NewMultiStreamProxy(map[string]string{
+				"alpha":    serveIdentity(t, "alpha"),
+				"beta":     serveIdentity(t, "beta"),
+				"beta/api": echoLn.Addr().String(),
+			}, log.NewStdLogger()).Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Start(ctx)
+	waitConnected(t, c, 5*time.Second)
+
+	conn, err := net.Dial("tcp", s.HTTPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, url, body string
+		status            int
+		want              string
+	}{
+		{http.MethodGet, "http://alpha.tunnel.example.com/", "", http.StatusOK, "alpha"},
+		{http.MethodGet, "http://beta.tunnel.example.com/", "", http.StatusOK, "beta"},
+		{http.MethodPost, "http://beta.tunnel.example.com/api/users", "bob", http.StatusOK, "echo beta.tunnel.example.com /api/users bob"},
+		{http.MethodGet, "http://gamma.tunnel.example.com/", "", http.StatusNotFound, ""},
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(tests)*3)
+	for range 3 {
+		for _, tt := range tests {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				req, _ := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+				resp, err := cc.RoundTrip(req)
+				if err != nil {
+					errs <- fmt.Errorf("%s %s: %s", tt.method, tt.url, err)
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				if resp.StatusCode != tt.status || string(body) != tt.want {
+					errs <- fmt.Errorf("%s %s: expected %d %q, got %d %q", tt.method, tt.url, tt.status, tt.want, resp.StatusCode, body)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestIntegration_HTTPHeaderRules proves that the header rules of an http
+// tunnel and the X-Forwarded headers apply to every request on a keep-alive
+// connection and to HTTP/2 streams, while other tunnels are left as is.
+func TestIntegration_HTTPHeaderRules(t *testing.T) {
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+		BaseDomain:    "tunnel.example.com",
+		HTTPAddr:      "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "local")
+		fmt.Fprintf(w, "%s|%s|%s|%s|%s|%s", r.Host, r.Header.Get("X-Env"), r.Header.Get("Cookie"),
+			r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Host"))
+	}))
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"myapp": {
+				Protocol:        proto.HTTP,
+				Host:            "myapp",
+				HostHeader:      ln.Addr().String(),
+				RequestHeaders:  &proto.HeaderRules{Add: map[string]string{"X-Env": "dev"}, Remove: []string{"Cookie"}},
+				ResponseHeaders: &proto.HeaderRules{Add: map[string]string{"X-Tunnel": "myapp"}, Remove: []string{"Server"}},
+			},
+			"plain": {Protocol: proto.HTTP, Host: "plain"},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Stream: tunnel.NewMultiStreamProxy(map[string]string{
+				"myapp": ln.Addr().String(),
+				"plain": ln.Addr().String(),
+			}, log.NewStdLogger()).Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Start(ctx)
+	waitConnected(t, c, 5*time.Second)
+
+	rewritten := ln.Addr().String() + "|dev||127.0.0.1|http|myapp.tunnel.example.com"
+	check := func(resp *http.Response, want, server, xTunnel string) {
+		t.Helper()
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != want {
+			t.Fatalf("expected %q, got %q", want, body)
+		}
+		if got := resp.Header.Get("Server"); got != server {
+			t.Fatalf("expected Server %q, got %q", server, got)
+		}
+		if got := resp.Header.Get("X-Tunnel"); got != xTunnel {
+			t.Fatalf("expected X-Tunnel %q, got %q", xTunnel, got)
+		}
+	}
+
+	conn, err := net.Dial("tcp", s.HTTPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	for range 2 {
+		req, _ := http.NewRequest(http.MethodGet, "http://myapp.tunnel.example.com/", nil)
+		req.Header.Set("Cookie", "session=1")
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(resp, rewritten, "", "myapp")
+	}
+
+	// A tunnel without rules keeps its headers, gaining only the
+	// X-Forwarded ones.
+	plain, err := net.Dial("tcp", s.HTTPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest(http.MethodGet, "http://plain.tunnel.example.com/", nil)
+	req.Header.Set("Cookie", "session=1")
+	if err := req.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(plain), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(resp, "plain.tunnel.example.com||session=1|127.0.0.1|http|plain.tunnel.example.com", "local", "")
+
+	h2, err := net.Dial("tcp", s.HTTPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Close()
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(h2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, "http://myapp.tunnel.example.com/", nil)
+	req.Header.Set("Cookie", "session=1")
+	resp, err = cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(resp, rewritten, "", "myapp")
+}
+
+// TestIntegration_HTTPCustomHostname proves that an http tunnel on an
+// allowed custom hostname is routed like one on a subdomain, and that the
+// client is forwarded the hostname to pick its local target by.
+func TestIntegration_HTTPCustomHostname(t *testing.T) {
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+		BaseDomain:    "tunnel.example.com",
+		HTTPAddr:      "127.0.0.1:0",
+		Hostnames:     &tunnel.HostnameConfig{Allowed: []string{"*.example.org"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	tcpProxy := tunnel.NewMultiStreamProxy(map[string]string{
+		"shop.example.org": serveIdentity(t, "shop"),
+		"myapp":            serveIdentity(t, "myapp"),
+	}, log.NewStdLogger())
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"shop":  {Protocol: proto.HTTP, Hostname: "shop.example.org"},
+			"myapp": {Protocol: proto.HTTP, Host: "myapp"},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Stream: tcpProxy.Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Start(ctx)
+
+	waitConnected(t, c, 5*time.Second)
+
+	for host, want := range map[string]string{
+		"shop.example.org":         "shop",
+		"Shop.Example.org:80":      "shop",
+		"myapp.tunnel.example.com": "myapp",
+	} {
+		if body := requestOverFreshConn(t, s.HTTPAddr(), host); body != want {
+			t.Fatalf("%s: expected %q, got %q", host, want, body)
+		}
+	}
+}
+
+// TestIntegration_HTTPSTermination proves that the server terminates TLS
+// for http tunnels on the HTTPS listener with certificates issued by a local
+// CA, and routes the decrypted requests like those on the HTTP listener,
+// with X-Forwarded headers naming https and the requested host.
+func TestIntegration_HTTPSTermination(t *testing.T) {
+	forwarded := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s",
+			r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer forwarded.Close()
+
+	caCertPEM, caKeyPEM, err := ca.GenerateCA("test CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caCertPEM)
+
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+		BaseDomain:    "tunnel.example.com",
+		HTTPAddr:      "127.0.0.1:0",
+		HTTPS: &tunnel.HTTPSConfig{
+			Addr:      "127.0.0.1:0",
+			CACertPEM: caCertPEM,
+			CAKeyPEM:  caKeyPEM,
+			Validity:  time.Hour,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	tcpProxy := tunnel.NewMultiStreamProxy(map[string]string{
+		"myapp": serveIdentity(t, "myapp"),
+		"fwd":   forwarded.Listener.Addr().String(),
+	}, log.NewStdLogger())
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"myapp": {Protocol: proto.HTTP, Host: "myapp"},
+			"fwd":   {Protocol: proto.HTTP, Host: "fwd"},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Stream: tcpProxy.Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Start(ctx)
+
+	waitConnected(t, c, 5*time.Second)
+
+	for range 2 {
+		conn, err := tls.Dial("tcp", s.HTTPSAddr(), &tls.Config{
+			ServerName: "myapp.tunnel.example.com",
+			RootCAs:    roots,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		body := doRequest(t, conn, "myapp.tunnel.example.com")
+		conn.Close()
+		if body != "myapp" {
+			t.Fatalf("expected %q, got %q", "myapp", body)
+		}
+	}
+
+	// The address, protocol and host a client claims are replaced, it
+	// can't pass for another address, plain http or another host.
+	conn, err := tls.Dial("tcp", s.HTTPSAddr(), &tls.Config{
+		ServerName: "fwd.tunnel.example.com",
+		RootCAs:    roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest(http.MethodGet, "http://fwd.tunnel.example.com/", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Forwarded-Proto", "http")
+	req.Header.Set("X-Forwarded-Host", "other.example.com")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "127.0.0.1|https|fwd.tunnel.example.com"; string(body) != want {
+		t.Fatalf("expected %q, got %q", want, body)
+	}
+
+	if _, err := tls.Dial("tcp", s.HTTPSAddr(), &tls.Config{
+		ServerName: "other.tunnel.example.com",
+		RootCAs:    roots,
+	}); err == nil {
+		t.Fatal("expected handshake for a host without a tunnel to fail")
+	}
+}
+
+// serveIdentity starts a local HTTP server that always responds with body,
+// regardless of the request's Host header, and returns its address.
+func serveIdentity(t *testing.T, body string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	go http.Serve(ln, mux)
+
+	return ln.Addr().String()
+}
+
+// requestOverFreshConn dials a new connection to httpAddr, issues a single
+// request with the given host, and returns the response body.
+func requestOverFreshConn(t *testing.T, httpAddr, host string) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return doRequest(t, conn, host)
+}
+
+// doRequest writes a GET request with the given Host over conn and returns
+// the response body, leaving conn open for a possible next request.
+func doRequest(t *testing.T, conn net.Conn, host string) string {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// recordAccessLog is a tunnel.AccessLogger that hands every entry to a
+// channel.
+type recordAccessLog chan *tunnel.AccessLogEntry
+
+func (r recordAccessLog) LogAccess(e *tunnel.AccessLogEntry) error {
+	r <- e
+	return nil
+}
+
+// TestIntegration_HTTPSubdomainTunnel_AccessLog proves that each request
+// on a keep-alive connection gets an access log entry of its own.
+func TestIntegration_HTTPSubdomainTunnel_AccessLog(t *testing.T) {
+	backend := serveIdentity(t, "hello")
+	entries := make(recordAccessLog, 2)
+
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+		BaseDomain:    "tunnel.example.com",
+		HTTPAddr:      "127.0.0.1:0",
+		AccessLog:     entries,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	tcpProxy := tunnel.NewMultiStreamProxy(map[string]string{
+		"myapp": backend,
+	}, log.NewStdLogger())
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"myapp": {Protocol: proto.HTTP, Host: "myapp"},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Stream: tcpProxy.Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Start(ctx)
+
+	waitConnected(t, c, 5*time.Second)
+
+	conn, err := net.Dial("tcp", s.HTTPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for range 2 {
+		if got := doRequest(t, conn, "myapp.tunnel.example.com"); got != "hello" {
+			t.Fatalf("expected body hello, got %q", got)
+		}
+	}
+
+	var first *tunnel.AccessLogEntry
+	for range 2 {
+		var e *tunnel.AccessLogEntry
+		select {
+		case e = <-entries:
+		case <-time.After(15 * time.Second):
+			t.Fatal("no access log entry for the proxied request")
+		}
+		checkHTTPAccessLogEntry(t, e)
+		if first == nil {
+			first = e
+		} else if !e.Start.After(first.Start) {
+			t.Errorf("expected the second request to start after the first, got %v and %v", first.Start, e.Start)
+		}
+	}
+}
+
+// checkHTTPAccessLogEntry checks the entry of a GET / request answered by
+// serveIdentity's "hello".
+func checkHTTPAccessLogEntry(t *testing.T, e *tunnel.AccessLogEntry) {
+	t.Helper()
+
+	if e.Method != http.MethodGet || e.Path != "/" || e.Status != http.StatusOK {
+		t.Errorf("expected GET / 200, got %s %s %d", e.Method, e.Path, e.Status)
+	}
+	if e.Host != "myapp.tunnel.example.com" || e.Tunnel != "myapp" || e.Proto != proto.HTTP {
+		t.Errorf("unexpected tunnel fields: host=%q tunnel=%q proto=%q", e.Host, e.Tunnel, e.Proto)
+	}
+	if e.BytesIn == 0 || e.BytesOut == 0 {
+		t.Errorf("expected bytes in both directions, got in=%d out=%d", e.BytesIn, e.BytesOut)
+	}
+	if e.CloseReason != "response sent" {
+		t.Errorf("expected the response to have been sent, got %q", e.CloseReason)
+	}
+	if e.Start.IsZero() || e.Duration <= 0 || e.RemoteAddr == "" {
+		t.Errorf("expected start, duration and remote addr to be set, got %v %v %q", e.Start, e.Duration, e.RemoteAddr)
+	}
+}
+
+func TestIntegration_HTTPSubdomainTunnel_ConnLimit(t *testing.T) {
+	backend := serveIdentity(t, "hello")
+
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+		BaseDomain:    "tunnel.example.com",
+		HTTPAddr:      "127.0.0.1:0",
+		ConnLimits: &tunnel.ConnLimitConfig{
+			Tunnels: map[string]int{"myapp.tunnel.example.com": 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	tcpProxy := tunnel.NewMultiStreamProxy(map[string]string{
+		"myapp": backend,
+	}, log.NewStdLogger())
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"myapp": {Protocol: proto.HTTP, Host: "myapp"},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Stream: tcpProxy.Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Start(ctx)
+
+	waitConnected(t, c, 5*time.Second)
+
+	// the first connection stays open, holding the tunnel's only slot
+	held, err := net.Dial("tcp", s.HTTPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	held.SetDeadline(time.Now().Add(5 * time.Second))
+	if got := doRequest(t, held, "myapp.tunnel.example.com"); got != "hello" {
+		t.Fatalf("expected body hello, got %q", got)
+	}
+
+	conn, err := net.Dial("tcp", s.HTTPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://myapp.tunnel.example.com/", nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 over the connection limit, got %d", resp.StatusCode)
+	}
+	if n := s.ConnLimitStats().Tunnel; n != 1 {
+		t.Fatalf("expected 1 refused connection, got %d", n)
+	}
+
+	// closing the first connection frees the slot again
+	held.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", s.HTTPAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req.Write(conn)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		conn.Close()
+		if err == nil && resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot was not released after the connection closed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestIntegration_Quota(t *testing.T) {
+	tcp := makeEcho(t)
+	defer tcp.Close()
+
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+		Quotas: &tunnel.QuotaConfig{
+			Default: tunnel.Quota{Bytes: 4096, Period: tunnel.QuotaDaily},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	tcpLocalAddr := freeAddr()
+	tcpProxy := tunnel.NewMultiStreamProxy(map[string]string{
+		port(tcpLocalAddr): tcp.Addr().String(),
+	}, log.NewStdLogger())
+
+	newClient := func() *tunnel.Client {
+		c, err := tunnel.NewClient(&tunnel.ClientConfig{
+			ServerAddr:      s.Addr(),
+			TLSClientConfig: tlsConfig(),
+			Tunnels: map[string]*proto.Tunnel{
+				proto.TCP: {Protocol: proto.TCP, Addr: tcpLocalAddr.String()},
+			},
+			Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+				Stream: tcpProxy.Proxy,
+			}),
+			Logger: log.NewStdLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := newClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() { stopped <- c.Start(ctx) }()
+
+	waitConnected(t, c, 5*time.Second)
+
+	conn, err := net.Dial("tcp", tcpLocalAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// 1 KiB each way per round trip, the quota is used up after two
+	payload := randBytes(1024)
+	buf := make([]byte, len(payload))
+	var rerr error
+	for i := 0; i < 10 && rerr == nil; i++ {
+		if _, err := conn.Write(payload); err != nil {
+			break
+		}
+		_, rerr = io.ReadFull(conn, buf)
+	}
+	if rerr == nil {
+		t.Fatal("expected the connection to be closed once the quota was used up")
+	}
+
+	select {
+	case err := <-stopped:
+		if err == nil || !strings.Contains(err.Error(), "transfer quota exceeded") {
+			t.Fatalf("expected the client to stop with a quota error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("client was not disconnected")
+	}
+
+	// reconnecting is rejected until the quota resets
+	c = newClient()
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	if err := c.Start(ctx2); err == nil || !strings.Contains(err.Error(), "transfer quota exceeded") {
+		t.Fatalf("expected the handshake to be rejected, got %v", err)
+	}
+}
+
+// caTLSConfigs returns server and client TLS configs with certificates
+// issued by a fresh CA, along with the CA and client certificate PEM.
+func caTLSConfigs(t *testing.T) (server, client *tls.Config, caCertPEM, caKeyPEM, clientCertPEM []byte) {
+	t.Helper()
+
+	caCertPEM, caKeyPEM, err := ca.GenerateCA("test CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCertPEM, serverKeyPEM, err := ca.IssueCert(caCertPEM, caKeyPEM, "server", []string{"127.0.0.1"}, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCertPEM, clientKeyPEM, err := ca.IssueCert(caCertPEM, caKeyPEM, "client", nil, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caCertPEM)
+
+	serverCert, err := tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+		NextProtos:   []string{"h2"},
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      roots,
+		ServerName:   "127.0.0.1",
+		NextProtos:   []string{"h2"},
+	}
+	return server, client, caCertPEM, caKeyPEM, clientCertPEM
+}
+
+func parseCertPEM(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("failed to decode certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestIntegration_CRL(t *testing.T) {
+	serverTLS, clientTLS, caCertPEM, caKeyPEM, clientCertPEM := caTLSConfigs(t)
+
+	// start out with a CRL revoking some other certificate
+	other, _, err := ca.IssueCert(caCertPEM, caKeyPEM, "other", nil, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlPEM, err := ca.RevokeCert(caCertPEM, caKeyPEM, nil, other, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlFile := filepath.Join(t.TempDir(), "crl.pem")
+	if err := os.WriteFile(crlFile, crlPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(caCertPEM)
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := tunnel.NewCRL(crlFile, []*x509.Certificate{caCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:              "127.0.0.1:0",
+		AutoSubscribe:     true,
+		TLSConfig:         serverTLS,
+		Logger:            log.NewStdLogger(),
+		CRL:               crl,
+		CRLReloadInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	tcp := makeEcho(t)
+	defer tcp.Close()
+	tcpLocalAddr := freeAddr()
+
+	newClient := func() *tunnel.Client {
+		c, err := tunnel.NewClient(&tunnel.ClientConfig{
+			ServerAddr:      s.Addr(),
+			TLSClientConfig: clientTLS,
+			Tunnels: map[string]*proto.Tunnel{
+				proto.TCP: {Protocol: proto.TCP, Addr: tcpLocalAddr.String()},
+			},
+			Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+				Stream: tunnel.NewMultiStreamProxy(map[string]string{
+					port(tcpLocalAddr): tcp.Addr().String(),
+				}, log.NewStdLogger()).Proxy,
+			}),
+			Logger: log.NewStdLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := newClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() { stopped <- c.Start(ctx) }()
+
+	waitConnected(t, c, 5*time.Second)
+
+	// revoking the connected client's certificate disconnects it
+	crlPEM, err = ca.RevokeCert(caCertPEM, caKeyPEM, crlPEM, clientCertPEM, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(crlFile, crlPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Fatal("expected the client to stop with an error")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("revoked client was not disconnected")
+	}
+
+	// and it can't connect again
+	c = newClient()
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	go c.Start(ctx2)
+	time.Sleep(500 * time.Millisecond)
+	if c.Connected() {
+		t.Fatal("expected the revoked client to be rejected")
+	}
+}
+
+func TestIntegration_SPKIIdentity(t *testing.T) {
+	serverTLS, clientTLS, caCertPEM, caKeyPEM, clientCertPEM := caTLSConfigs(t)
+
+	block, _ := pem.Decode(clientCertPEM)
+	clientCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewedPEM, err := ca.RenewCert(caCertPEM, caKeyPEM, clientCertPEM, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ = pem.Decode(renewedPEM)
+	renewedTLS := clientTLS.Clone()
+	renewedTLS.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{block.Bytes},
+		PrivateKey:  clientTLS.Certificates[0].PrivateKey,
+	}}
+
+	connects := func(t *testing.T, subscribed id.ID, tlsConfig *tls.Config) bool {
+		t.Helper()
+
+		s, err := tunnel.NewServer(&tunnel.ServerConfig{
+			Addr:      "127.0.0.1:0",
+			IDMode:    id.ModeSPKI,
+			TLSConfig: serverTLS,
+			Logger:    log.NewStdLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Subscribe(subscribed)
+		go s.Start(context.Background())
+		defer s.Stop()
+
+		c, err := tunnel.NewClient(&tunnel.ClientConfig{
+			ServerAddr:      s.Addr(),
+			TLSClientConfig: tlsConfig,
+			Tunnels: map[string]*proto.Tunnel{
+				proto.TCP: {Protocol: proto.TCP, Addr: freeAddr().String()},
+			},
+			Proxy:  tunnel.Proxy(tunnel.ProxyFuncs{}),
+			Logger: log.NewStdLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go c.Start(ctx)
+
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if c.Connected() {
+				return true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	}
+
+	spkiID := id.FromCert(clientCert, id.ModeSPKI)
+	certID := id.FromCert(clientCert, id.ModeCert)
+
+	// the SPKI ID accepts the original and the renewed certificate
+	if !connects(t, spkiID, clientTLS) {
+		t.Fatal("expected the client to connect by its SPKI ID")
+	}
+	if !connects(t, spkiID, renewedTLS) {
+		t.Fatal("expected the renewed certificate to keep the SPKI ID")
+	}
+	// a legacy certificate ID still works, but only for that certificate
+	if !connects(t, certID, clientTLS) {
+		t.Fatal("expected the client to connect by its legacy certificate ID")
+	}
+	if connects(t, certID, renewedTLS) {
+		t.Fatal("expected the renewed certificate not to match the old certificate ID")
+	}
+}
+
+func TestIntegration_CertRenewal(t *testing.T) {
+	serverTLS, clientTLS, caCertPEM, caKeyPEM, clientCertPEM := caTLSConfigs(t)
+	clientCert := parseCertPEM(t, clientCertPEM)
+	indexFile := filepath.Join(t.TempDir(), "index.txt")
+
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:      "127.0.0.1:0",
+		IDMode:    id.ModeSPKI,
+		TLSConfig: serverTLS,
+		Logger:    log.NewStdLogger(),
+		CertRenewal: &tunnel.CertRenewalConfig{
+			CACertPEM: caCertPEM,
+			CAKeyPEM:  caKeyPEM,
+			// the test certificate, valid for an hour, is due right away
+			Validity:    48 * time.Hour,
+			RenewBefore: 2 * time.Hour,
+			IndexFile:   indexFile,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Subscribe(id.FromCert(clientCert, id.ModeSPKI))
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	certFile := filepath.Join(t.TempDir(), "tls.crt")
+	if err := os.WriteFile(certFile, clientCertPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: clientTLS,
+		Tunnels: map[string]*proto.Tunnel{
+			proto.TCP: {Protocol: proto.TCP, Addr: freeAddr().String()},
+		},
+		Proxy:    tunnel.Proxy(tunnel.ProxyFuncs{}),
+		CertFile: certFile,
+		Logger:   log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Start(ctx)
+
+	waitConnected(t, c, 5*time.Second)
+
+	var renewed *x509.Certificate
+	deadline := time.Now().Add(5 * time.Second)
+	for renewed == nil && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		buf, err := os.ReadFile(certFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert := parseCertPEM(t, buf); cert.SerialNumber.Cmp(clientCert.SerialNumber) != 0 {
+			renewed = cert
+		}
+	}
+	if renewed == nil {
+		t.Fatal("client certificate was not renewed")
+	}
+	if !renewed.NotAfter.After(clientCert.NotAfter) {
+		t.Fatalf("expected the renewed certificate to expire after %v, got %v", clientCert.NotAfter, renewed.NotAfter)
+	}
+	if id.FromCert(renewed, id.ModeSPKI) != id.FromCert(clientCert, id.ModeSPKI) {
+		t.Fatal("expected the renewed certificate to keep the client's SPKI ID")
+	}
+
+	// the renewal is recorded for 'ca revoke'
+	data, err := os.ReadFile(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ca.ParseIndex(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := idx.Lookup(renewed.SerialNumber); e == nil || e.Name != renewed.Subject.CommonName {
+		t.Fatalf("expected the renewed certificate in the index, got:\n%s", data)
+	}
+}
+
+func TestIntegration_CertRenewal_RequiresStableIDs(t *testing.T) {
+	serverTLS, _, caCertPEM, caKeyPEM, _ := caTLSConfigs(t)
+
+	_, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: serverTLS,
+		CertRenewal: &tunnel.CertRenewalConfig{
+			CACertPEM: caCertPEM,
+			CAKeyPEM:  caKeyPEM,
+			Validity:  time.Hour,
+		},
+	})
+	if err == nil {
+		t.Fatal("expected error for certificate renewal with certificate IDs and no auto subscribe")
+	}
+}
+
+func TestIntegration_Enrollment(t *testing.T) {
+	serverTLS, clientTLS, caCertPEM, caKeyPEM, _ := caTLSConfigs(t)
+
+	tokenFile := filepath.Join(t.TempDir(), "tokens.txt")
+	indexFile := filepath.Join(t.TempDir(), "index.txt")
+	var tokens ca.Tokens
+	token, entry, err := ca.NewToken(caCertPEM, "laptop", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the enrolled certificate may only open the tcp tunnel below
+	tcpAddr := freeAddr()
+	tcpPort := tcpAddr.(*net.TCPAddr).Port
+	entry.Permissions = &ca.Permissions{Ports: []ca.PortRange{{First: tcpPort, Last: tcpPort}}}
+	// a token pinning another CA, as for a server impersonating ours
+	otherCACertPEM, _, err := ca.GenerateCA("other CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, otherEntry, err := ca.NewToken(otherCACertPEM, "intruder", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []*ca.TokenEntry{entry, otherEntry} {
+		if err := tokens.Add(e, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(tokenFile, tokens.Marshal(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          "127.0.0.1:0",
+		AutoSubscribe: true,
+		TLSConfig:     serverTLS,
+		Logger:        log.NewStdLogger(),
+		Enrollment: &tunnel.EnrollmentConfig{
+			CACertPEM: caCertPEM,
+			CAKeyPEM:  caKeyPEM,
+			TokenFile: tokenFile,
+			Validity:  time.Hour,
+			IndexFile: indexFile,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	key, keyPEM, err := ca.GenerateKey(ca.ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, _, err := tunnel.Enroll(ctx, s.Addr(), otherToken, key); err == nil {
+		t.Fatal("expected enrollment to fail for a token pinning another CA")
+	}
+
+	certPEM, gotCACertPEM, err := tunnel.Enroll(ctx, s.Addr(), token, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotCACertPEM) != string(caCertPEM) {
+		t.Fatal("expected the server's CA certificate to be returned")
+	}
+	cert := parseCertPEM(t, certPEM)
+	if cert.Subject.CommonName != "laptop" {
+		t.Fatalf("expected a certificate named laptop, got %q", cert.Subject.CommonName)
+	}
+	if perms, err := ca.PermissionsFromCert(cert); err != nil || perms == nil || !perms.AllowsPort(tcpPort) || perms.AllowsPort(tcpPort+1) {
+		t.Fatalf("expected the certificate to carry the token's permissions, got %+v, %v", perms, err)
+	}
+	// the enrolled certificate is recorded so it can be revoked
+	data, err := os.ReadFile(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ca.ParseIndex(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := idx.Lookup(cert.SerialNumber); e == nil || e.Name != "laptop" || e.SPKIID != id.FromCert(cert, id.ModeSPKI) {
+		t.Fatalf("expected the enrolled certificate in the index, got:\n%s", data)
+	}
+
+	if _, _, err := tunnel.Enroll(ctx, s.Addr(), token, key); err == nil {
+		t.Fatal("expected a token to be usable once")
+	}
+
+	enrolled, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS.Certificates = []tls.Certificate{enrolled}
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: clientTLS,
+		Tunnels: map[string]*proto.Tunnel{
+			proto.TCP: {Protocol: proto.TCP, Addr: tcpAddr.String()},
+		},
+		Proxy:  tunnel.Proxy(tunnel.ProxyFuncs{}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go c.Start(cctx)
+
+	waitConnected(t, c, 5*time.Second)
+}
+
+func TestIntegration_IntermediateCA(t *testing.T) {
+	rootCertPEM, rootKeyPEM, err := ca.GenerateCA("root CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intCertPEM, intKeyPEM, err := ca.GenerateIntermediateCA(rootCertPEM, rootKeyPEM, "intermediate CA", ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCertPEM, serverKeyPEM, err := ca.IssueCert(intCertPEM, intKeyPEM, "server", []string{"127.0.0.1"}, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCertPEM, clientKeyPEM, err := ca.IssueCert(intCertPEM, intKeyPEM, "client", nil, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both sides only trust the root and present leaf+intermediate
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(rootCertPEM)
+	serverCert, err := tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clientCert.Certificate) != 2 {
+		t.Fatalf("expected the client to present 2 certificates, got %d", len(clientCert.Certificate))
+	}
+
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr: "127.0.0.1:0",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    roots,
+			NextProtos:   []string{"h2"},
+		},
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the identity is the leaf's
+	s.Subscribe(id.FromCert(parseCertPEM(t, clientCertPEM), id.ModeCert))
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr: s.Addr(),
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      roots,
+			ServerName:   "127.0.0.1",
+			NextProtos:   []string{"h2"},
+		},
+		Tunnels: map[string]*proto.Tunnel{
+			proto.TCP: {Protocol: proto.TCP, Addr: freeAddr().String()},
+		},
+		Proxy:  tunnel.Proxy(tunnel.ProxyFuncs{}),
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Start(ctx)
+
+	waitConnected(t, c, 5*time.Second)
+}
+
+func TestIntegration_CertPermissions(t *testing.T) {
+	serverTLS, clientTLS, caCertPEM, caKeyPEM, _ := caTLSConfigs(t)
+
+	allowed := freeAddr()
+	allowedPort, _ := strconv.Atoi(port(allowed))
+	perms := &ca.Permissions{Ports: []ca.PortRange{{First: allowedPort, Last: allowedPort}}}
+	certPEM, keyPEM, err := ca.IssueCert(caCertPEM, caKeyPEM, "alice", perms.SANs(), ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS.Certificates = []tls.Certificate{cert}
+
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          "127.0.0.1:0",
+		AutoSubscribe: true,
+		TLSConfig:     serverTLS,
+		Logger:        log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	newClient := func(addr net.Addr) *tunnel.Client {
+		c, err := tunnel.NewClient(&tunnel.ClientConfig{
+			ServerAddr:      s.Addr(),
+			TLSClientConfig: clientTLS,
+			Tunnels: map[string]*proto.Tunnel{
+				proto.TCP: {Protocol: proto.TCP, Addr: addr.String()},
+			},
+			Proxy:  tunnel.Proxy(tunnel.ProxyFuncs{}),
+			Logger: log.NewStdLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// a port the certificate doesn't allow is refused
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := newClient(freeAddr()).Start(ctx); err == nil || !strings.Contains(err.Error(), "not allowed by client certificate") {
+		t.Fatalf("expected the handshake to be rejected, got %v", err)
+	}
+
+	c := newClient(allowed)
+	go c.Start(ctx)
+	waitConnected(t, c, 5*time.Second)
+}
+
+func TestIntegration_ClientNames(t *testing.T) {
+	serverTLS, clientTLS, caCertPEM, caKeyPEM, _ := caTLSConfigs(t)
+
+	// room for the connections of waitTunnel and testTCP
+	entries := make(recordAccessLog, 2)
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: serverTLS,
+		AccessLog: entries,
+		Logger:    log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// caTLSConfigs issues the client certificate as "client"
+	s.SubscribeName("client")
+	go s.Start(context.Background())
+	defer s.Stop()
+
+	tcp := makeEcho(t)
+	defer tcp.Close()
+	tcpLocalAddr := freeAddr()
+
+	newClient := func(tlsConfig *tls.Config) *tunnel.Client {
+		c, err := tunnel.NewClient(&tunnel.ClientConfig{
+			ServerAddr:      s.Addr(),
+			TLSClientConfig: tlsConfig,
+			Tunnels: map[string]*proto.Tunnel{
+				proto.TCP: {Protocol: proto.TCP, Addr: tcpLocalAddr.String()},
+			},
+			Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+				Stream: tunnel.NewMultiStreamProxy(map[string]string{
+					port(tcpLocalAddr): tcp.Addr().String(),
+				}, log.NewStdLogger()).Proxy,
+			}),
+			Logger: log.NewStdLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// another name of the same CA isn't subscribed
+	otherPEM, otherKeyPEM, err := ca.IssueCert(caCertPEM, caKeyPEM, "other", nil, ca.ECDSAP256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := tls.X509KeyPair(otherPEM, otherKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherTLS := clientTLS.Clone()
+	otherTLS.Certificates = []tls.Certificate{other}
+
+	c := newClient(otherTLS)
+	go c.Start(ctx)
+	time.Sleep(500 * time.Millisecond)
+	if c.Connected() {
+		t.Fatal("expected a client with another name to be rejected")
+	}
+
+	c = newClient(clientTLS)
+	go c.Start(ctx)
+	waitConnected(t, c, 5*time.Second)
+	waitTunnel(t, tcpLocalAddr, 5*time.Second)
+
+	testTCP(t, tcpLocalAddr, randBytes(64), 1)
+
+	select {
+	case e := <-entries:
+		if e.Client != "client" {
+			t.Fatalf("expected the access log to name the client, got %q", e.Client)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("no access log entry for the proxied connection")
+	}
 }
@@ -0,0 +1,93 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Known log formats, as accepted by the server and client -log-format flag.
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// NewFormatLogger returns a Logger for the given format name. FormatText is
+// the historical NewStdLogger output, which goes through the standard "log"
+// package and therefore ignores w; the structured formats write one record
+// per line to w.
+func NewFormatLogger(format string, w io.Writer) (Logger, error) {
+	switch format {
+	case FormatText, "":
+		return NewStdLogger(), nil
+	case FormatJSON:
+		return NewJSONLogger(w), nil
+	case FormatLogfmt:
+		return NewLogfmtLogger(w), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected %s, %s or %s", format, FormatText, FormatJSON, FormatLogfmt)
+}
+
+// levelNames maps the numeric "level" values used across the code base
+// (see NewFilterLogger) to the names structured log consumers expect.
+var levelNames = []string{"error", "info", "debug", "trace"}
+
+func levelName(level int) string {
+	if level >= 0 && level < len(levelNames) {
+		return levelNames[level]
+	}
+	return strconv.Itoa(level)
+}
+
+// errMissingValue is rendered in place of the value of a trailing key
+// without a value, so an odd-length keyvals never silently drops a key.
+const errMissingValue = "(MISSING)"
+
+// field is a single normalized key/value pair ready for rendering.
+type field struct {
+	key   string
+	value any
+}
+
+// fields normalizes alternating keyvals into a list prefixed with a "ts"
+// timestamp: keys become strings, a numeric "level" becomes its name, and
+// errors and fmt.Stringers are reduced to their text, since neither JSON
+// nor logfmt has a better representation for e.g. an id.ID or net.Addr.
+func fields(keyvals []any) []field {
+	fs := make([]field, 0, len(keyvals)/2+2)
+	fs = append(fs, field{"ts", time.Now().UTC().Format(time.RFC3339Nano)})
+
+	for i := 0; i < len(keyvals); i += 2 {
+		k, ok := keyvals[i].(string)
+		if !ok {
+			k = fmt.Sprint(keyvals[i])
+		}
+
+		var v any = errMissingValue
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+
+		switch x := v.(type) {
+		case nil:
+		case int:
+			if k == "level" {
+				v = levelName(x)
+			}
+		case error:
+			v = x.Error()
+		case fmt.Stringer:
+			v = x.String()
+		}
+
+		fs = append(fs, field{k, v})
+	}
+
+	return fs
+}
@@ -0,0 +1,51 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+type jsonLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLogger returns a Logger that writes each log event to w as a
+// single-line JSON object, keys in the order they were logged, preceded by a
+// "ts" timestamp. A numeric "level" is rendered by name (error, info, debug,
+// trace).
+func NewJSONLogger(w io.Writer) Logger {
+	return &jsonLogger{w: w}
+}
+
+func (l *jsonLogger) Log(keyvals ...any) error {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range fields(keyvals) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.key)
+		buf.Write(k)
+		buf.WriteByte(':')
+
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(f.value))
+		}
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(buf.Bytes())
+	return err
+}
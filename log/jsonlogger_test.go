@@ -0,0 +1,124 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger_Log(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80}
+	if err := logger.Log("level", 0, "msg", "proxy error", "addr", addr, "err", errors.New("boom"), "bytes", 42); err != nil {
+		t.Fatal(err)
+	}
+
+	line := buf.String()
+	if !strings.HasSuffix(line, "}\n") || strings.Count(line, "\n") != 1 {
+		t.Fatalf("expected exactly one JSON line, got %q", line)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output is not valid JSON: %v: %q", err, line)
+	}
+
+	ts, ok := got["ts"].(string)
+	if !ok {
+		t.Fatalf("expected ts field, got %v", got)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+		t.Fatalf("ts %q is not RFC3339: %v", ts, err)
+	}
+
+	want := map[string]any{
+		"level": "error",
+		"msg":   "proxy error",
+		"addr":  "127.0.0.1:80",
+		"err":   "boom",
+		"bytes": float64(42),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, got[k])
+		}
+	}
+
+	// keys keep the order they were logged in
+	if strings.Index(line, `"level"`) > strings.Index(line, `"msg"`) {
+		t.Errorf("expected level before msg, got %q", line)
+	}
+}
+
+func TestJSONLogger_OddKeyvals(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	NewJSONLogger(&buf).Log("msg")
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["msg"] != errMissingValue {
+		t.Fatalf("expected %q for missing value, got %v", errMissingValue, got["msg"])
+	}
+}
+
+func TestJSONLogger_UnmarshalableValue(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	if err := NewJSONLogger(&buf).Log("ch", make(chan int)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("expected fallback to string for unmarshalable value: %v", err)
+	}
+}
+
+func TestLevelName(t *testing.T) {
+	t.Parallel()
+
+	tests := map[int]string{
+		0:  "error",
+		1:  "info",
+		2:  "debug",
+		3:  "trace",
+		4:  "4",
+		-1: "-1",
+	}
+	for level, want := range tests {
+		if got := levelName(level); got != want {
+			t.Errorf("levelName(%d) = %q, want %q", level, got, want)
+		}
+	}
+}
+
+func TestNewFormatLogger(t *testing.T) {
+	t.Parallel()
+
+	for _, format := range []string{FormatText, FormatJSON, FormatLogfmt} {
+		if _, err := NewFormatLogger(format, &bytes.Buffer{}); err != nil {
+			t.Errorf("%s: unexpected error: %v", format, err)
+		}
+	}
+
+	if _, err := NewFormatLogger("xml", &bytes.Buffer{}); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type logfmtLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLogfmtLogger returns a Logger that writes each log event to w as a
+// single logfmt line (key=value pairs separated by spaces), preceded by a
+// "ts" timestamp. A numeric "level" is rendered by name (error, info, debug,
+// trace).
+func NewLogfmtLogger(w io.Writer) Logger {
+	return &logfmtLogger{w: w}
+}
+
+func (l *logfmtLogger) Log(keyvals ...any) error {
+	var buf bytes.Buffer
+	for i, f := range fields(keyvals) {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(logfmtKey(f.key))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(f.value))
+	}
+	buf.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(buf.Bytes())
+	return err
+}
+
+// logfmtKey replaces characters that would break key=value parsing.
+func logfmtKey(k string) string {
+	if k == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, k)
+}
+
+// logfmtValue renders v, quoting it when it is empty or contains
+// whitespace, '=', '"' or control characters.
+func logfmtValue(v any) string {
+	var s string
+	if v == nil {
+		s = "null"
+	} else {
+		s = fmt.Sprint(v)
+	}
+
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogfmtLogger_Log(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := NewLogfmtLogger(&buf)
+
+	if err := logger.Log("level", 2, "action", "open listener", "err", errors.New(`bad "thing"`), "n", 7, "empty", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	line := buf.String()
+	if !strings.HasPrefix(line, "ts=") {
+		t.Fatalf("expected line to start with ts, got %q", line)
+	}
+	if !strings.HasSuffix(line, "\n") || strings.Count(line, "\n") != 1 {
+		t.Fatalf("expected exactly one line, got %q", line)
+	}
+
+	for _, want := range []string{
+		" level=debug ",
+		` action="open listener" `,
+		` err="bad \"thing\"" `,
+		" n=7 ",
+		` empty=""`,
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("expected %q in %q", want, line)
+		}
+	}
+}
+
+func TestLogfmtLogger_KeysAreSanitized(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	NewLogfmtLogger(&buf).Log("bad key=", 1, 42, "x")
+
+	line := buf.String()
+	if !strings.Contains(line, " bad_key_=1 ") {
+		t.Errorf("expected sanitized key, got %q", line)
+	}
+	if !strings.Contains(line, " 42=x") {
+		t.Errorf("expected non-string key to be stringified, got %q", line)
+	}
+}
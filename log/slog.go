@@ -0,0 +1,193 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// LevelTrace is the slog level the numeric level 3 (trace) maps to; slog
+// itself stops at Debug.
+const LevelTrace = slog.LevelDebug - 4
+
+// slogLevel maps a numeric "level" value (0 - error, 1 - info, 2 - debug,
+// 3 - trace) to its slog.Level.
+func slogLevel(level int) slog.Level {
+	switch {
+	case level <= 0:
+		return slog.LevelError
+	case level == 1:
+		return slog.LevelInfo
+	case level == 2:
+		return slog.LevelDebug
+	}
+	return LevelTrace
+}
+
+// numericLevel is the inverse of slogLevel. Warn has no numeric
+// counterpart and is reported as info.
+func numericLevel(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 0
+	case level >= slog.LevelInfo:
+		return 1
+	case level >= slog.LevelDebug:
+		return 2
+	}
+	return 3
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// FromSlog returns a Logger that forwards log events to logger. The numeric
+// "level" value is translated to a slog level (events without one are
+// logged at info), "msg" becomes the record message, falling back to
+// "action" when there is no "msg", and every other key/value pair,
+// including those added by a Context, becomes an attribute.
+func FromSlog(logger *slog.Logger) Logger {
+	return slogLogger{logger: logger}
+}
+
+func (l slogLogger) Log(keyvals ...any) error {
+	var (
+		level  = slog.LevelInfo
+		msg    string
+		hasMsg bool
+		action string
+		attrs  = make([]slog.Attr, 0, len(keyvals)/2)
+	)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		k, ok := keyvals[i].(string)
+		if !ok {
+			k = fmt.Sprint(keyvals[i])
+		}
+
+		var v any = errMissingValue
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+
+		switch k {
+		case "level":
+			if n, ok := v.(int); ok {
+				level = slogLevel(n)
+				continue
+			}
+		case "msg":
+			if !hasMsg {
+				msg, hasMsg = fmt.Sprint(v), true
+				continue
+			}
+		case "action":
+			if action == "" {
+				action = fmt.Sprint(v)
+			}
+		}
+
+		attrs = append(attrs, slog.Any(k, v))
+	}
+	if !hasMsg {
+		msg = action
+	}
+
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, level) {
+		return nil
+	}
+	l.logger.LogAttrs(ctx, level, msg, attrs...)
+	return nil
+}
+
+type slogHandler struct {
+	logger Logger
+	// keyvals holds attributes added with WithAttrs, already flattened
+	// and qualified by the groups open at the time.
+	keyvals []any
+	group   string
+}
+
+// NewSlogHandler returns a slog.Handler that renders records as keyvals for
+// logger: "level" as the numeric level (see NewFilterLogger), "msg" as the
+// record message, then the attributes, with group names joined to their
+// keys by dots. The record time is dropped, the Logger is expected to add
+// its own. Level filtering is left to logger, so Enabled always reports
+// true.
+func NewSlogHandler(logger Logger) slog.Handler {
+	return &slogHandler{logger: logger}
+}
+
+func (h *slogHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *slogHandler) Handle(_ context.Context, r slog.Record) error {
+	keyvals := make([]any, 0, 4+len(h.keyvals)+2*r.NumAttrs())
+	keyvals = append(keyvals, "level", numericLevel(r.Level), "msg", r.Message)
+	keyvals = append(keyvals, h.keyvals...)
+	r.Attrs(func(a slog.Attr) bool {
+		keyvals = appendAttr(keyvals, h.group, a)
+		return true
+	})
+	return h.logger.Log(keyvals...)
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	keyvals := make([]any, len(h.keyvals), len(h.keyvals)+2*len(attrs))
+	copy(keyvals, h.keyvals)
+	for _, a := range attrs {
+		keyvals = appendAttr(keyvals, h.group, a)
+	}
+	return &slogHandler{logger: h.logger, keyvals: keyvals, group: h.group}
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &slogHandler{logger: h.logger, keyvals: h.keyvals, group: qualify(h.group, name)}
+}
+
+// appendAttr appends a as a key/value pair qualified by group, flattening
+// group-valued attributes and dropping empty ones as slog.Handler requires.
+func appendAttr(keyvals []any, group string, a slog.Attr) []any {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return keyvals
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		g := group
+		if a.Key != "" {
+			g = qualify(group, a.Key)
+		}
+		for _, ga := range a.Value.Group() {
+			keyvals = appendAttr(keyvals, g, ga)
+		}
+		return keyvals
+	}
+
+	var v any
+	switch a.Value.Kind() {
+	case slog.KindTime:
+		v = a.Value.Time().Format(time.RFC3339Nano)
+	default:
+		v = a.Value.Any()
+	}
+	return append(keyvals, qualify(group, a.Key), v)
+}
+
+func qualify(group, key string) string {
+	if group == "" {
+		return key
+	}
+	return group + "." + key
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestFromSlog(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := FromSlog(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: LevelTrace})))
+
+	NewContext(logger).WithPrefix("proxy", "stream").With("addr", "127.0.0.1:80").Log(
+		"level", 2,
+		"msg", "dial failed",
+		"target", "localhost:8080",
+	)
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{
+		"level":  "DEBUG",
+		"msg":    "dial failed",
+		"proxy":  "stream",
+		"target": "localhost:8080",
+		"addr":   "127.0.0.1:80",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, got[k])
+		}
+	}
+}
+
+func TestFromSlog_ActionAsMessage(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := FromSlog(slog.New(slog.NewJSONHandler(&buf, nil)))
+	logger.Log("level", 1, "action", "connected")
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["msg"] != "connected" || got["action"] != "connected" || got["level"] != "INFO" {
+		t.Fatalf("unexpected record %v", got)
+	}
+}
+
+func TestFromSlog_RespectsHandlerLevel(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := FromSlog(slog.New(slog.NewJSONHandler(&buf, nil)))
+	logger.Log("level", 3, "msg", "trace")
+
+	if buf.Len() != 0 {
+		t.Fatalf("expected trace event to be dropped by an info handler, got %q", buf.String())
+	}
+}
+
+func TestSlogLevelRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for level := 0; level <= 3; level++ {
+		if got := numericLevel(slogLevel(level)); got != level {
+			t.Errorf("level %d round-tripped to %d", level, got)
+		}
+	}
+	if got := numericLevel(slog.LevelWarn); got != 1 {
+		t.Errorf("expected warn to map to info, got %d", got)
+	}
+}
+
+// recordLogger keeps every keyvals slice it is given.
+type recordLogger struct {
+	mu      sync.Mutex
+	records [][]any
+}
+
+func (l *recordLogger) Log(keyvals ...any) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, keyvals)
+	return nil
+}
+
+func TestSlogHandler(t *testing.T) {
+	t.Parallel()
+
+	rl := &recordLogger{}
+	logger := slog.New(NewSlogHandler(rl)).With("identifier", "abc").WithGroup("req")
+	logger.Error("proxy error", "status", 502, slog.Group("conn", "bytes", 10))
+
+	if len(rl.records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(rl.records))
+	}
+	want := []any{
+		"level", 0,
+		"msg", "proxy error",
+		"identifier", "abc",
+		"req.status", int64(502),
+		"req.conn.bytes", int64(10),
+	}
+	if !reflect.DeepEqual(rl.records[0], want) {
+		t.Fatalf("expected %v, got %v", want, rl.records[0])
+	}
+}
+
+func TestSlogHandler_DropsEmptyAttrs(t *testing.T) {
+	t.Parallel()
+
+	rl := &recordLogger{}
+	slog.New(NewSlogHandler(rl)).WithGroup("").Info("hello", slog.Attr{}, slog.Group("empty"))
+
+	want := []any{"level", 1, "msg", "hello"}
+	if !reflect.DeepEqual(rl.records[0], want) {
+		t.Fatalf("expected %v, got %v", want, rl.records[0])
+	}
+}
@@ -123,6 +123,33 @@ func (p *connPool) DeleteConn(identifier id.ID) {
 	}
 }
 
+// CloseIf closes every connection for which fn returns true, and returns
+// the identifiers of the closed connections.
+func (p *connPool) CloseIf(fn func(conn net.Conn) bool) []id.ID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var closed []id.ID
+	for addr, cp := range p.conns {
+		if fn(cp.conn) {
+			closed = append(closed, p.identifier(addr))
+			p.close(cp, addr)
+		}
+	}
+	return closed
+}
+
+// Each calls fn for every connection in the pool. fn must not call back
+// into the pool.
+func (p *connPool) Each(fn func(identifier id.ID, conn net.Conn)) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for addr, cp := range p.conns {
+		fn(p.identifier(addr), cp.conn)
+	}
+}
+
 func (p *connPool) Ping(identifier id.ID) (time.Duration, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -23,8 +23,22 @@ const (
 	// hostnames for that client's http tunnels, sent as a JSON object
 	// (tunnel name -> full hostname) in the request body.
 	HeaderTunnelInfo = "X-Tunnel-Info"
+
+	// HeaderCertRequest marks a server->client request for a PEM-encoded
+	// certificate signing request, sent when the client's certificate is
+	// due for renewal. Clients that don't renew their certificate answer
+	// 501 Not Implemented.
+	HeaderCertRequest = "X-Cert-Request"
+	// HeaderCert marks a server->client push of the renewed PEM-encoded
+	// client certificate in the request body.
+	HeaderCert = "X-Cert"
 )
 
+// EnrollProtocol is the ALPN protocol of enrollment connections, which
+// clients without a certificate open to the control address to exchange an
+// enrollment token for one.
+const EnrollProtocol = "go-stream-tunnel-enroll"
+
 // Known actions.
 const (
 	ActionProxy = "proxy"
@@ -38,6 +52,10 @@ const (
 	// HTTP is a subdomain-routed tunnel. Unlike TCP tunnels, it does not
 	// get a dedicated public port; the server routes to it by Host header.
 	HTTP = "http"
+	// TLS is a subdomain-routed tunnel for services terminating TLS
+	// themselves. The server routes to it by the SNI server name of the
+	// ClientHello and passes the connection through untouched.
+	TLS = "tls"
 )
 
 // ControlMessage is sent from server to client before streaming data. It's
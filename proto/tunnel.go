@@ -6,7 +6,14 @@
 
 package proto
 
-import "regexp"
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
 
 // Tunnel describes a single tunnel between client and server. When connecting
 // client sends tunnels to server. If client gets connected server proxies
@@ -16,8 +23,27 @@ type Tunnel struct {
 	// by the server.
 	Protocol string
 	// Host specified HTTP request host, it's required for HTTP and WS
-	// tunnels.
+	// tunnels. For TLS tunnels it's the subdomain matched against the SNI
+	// server name. See ValidSubdomain for multi-level and wildcard
+	// subdomains.
 	Host string
+	// Hostname, set instead of Host, is the full hostname outside of the
+	// server's base domain an HTTP tunnel is reachable at, e.g. one pointed
+	// at the server with a CNAME record. The server must allow it.
+	Hostname string
+	// PathPrefix, if set, limits an HTTP tunnel to the requests for paths
+	// under it on its host, e.g. "/api" for "/api" and "/api/users" but not
+	// "/apix". Other tunnels may serve the rest of the host, the longest
+	// matching prefix wins. See ValidPathPrefix.
+	PathPrefix string
+	// HostHeader, if set, replaces the Host header of the requests to an
+	// HTTP tunnel, e.g. with the address of the local service. See
+	// ValidHostHeader.
+	HostHeader string
+	// RequestHeaders and ResponseHeaders, if set, change the headers of the
+	// requests to and responses from an HTTP tunnel. See ValidHeaderRules.
+	RequestHeaders  *HeaderRules
+	ResponseHeaders *HeaderRules
 	// Auth specifies HTTP basic auth credentials in form "user:password",
 	// if set server would protect HTTP and WS tunnels with basic auth.
 	Auth string
@@ -27,16 +53,121 @@ type Tunnel struct {
 }
 
 // subdomainLabelRE matches a single valid DNS label: lowercase letters,
-// digits and hyphens, 1-63 chars, no leading/trailing hyphen. This is
-// intentionally stricter than a full DNS name (no dots allowed) since a
-// Tunnel's Host is meant to be one subdomain label, not a nested hostname.
+// digits and hyphens, 1-63 chars, no leading/trailing hyphen.
 var subdomainLabelRE = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
 
-// ValidSubdomainLabel reports whether s is a valid single DNS label suitable
-// for use as a Tunnel's Host (subdomain slug). It rejects empty strings,
-// uppercase letters, dots, and other characters that are not valid in a DNS
-// label, catching config mistakes (e.g. a stray dot nesting an unintended
-// subdomain) before they're accepted by client or server.
+// ValidSubdomainLabel reports whether s is a valid single DNS label. It
+// rejects empty strings, uppercase letters, dots, and other characters that
+// are not valid in a DNS label, catching config mistakes before they're
+// accepted by client or server.
 func ValidSubdomainLabel(s string) bool {
 	return subdomainLabelRE.MatchString(s)
 }
+
+// ValidSubdomain reports whether s is a valid subdomain for use as a
+// Tunnel's Host: one or more ValidSubdomainLabel labels separated by dots,
+// as in "api.alice". The first label may be the wildcard "*" if more
+// follow, as in "*.alice", which matches any subdomain below the rest.
+func ValidSubdomain(s string) bool {
+	if len(s) > 253 {
+		return false
+	}
+	labels := strings.Split(s, ".")
+	if labels[0] == "*" && len(labels) > 1 {
+		labels = labels[1:]
+	}
+	for _, label := range labels {
+		if !ValidSubdomainLabel(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidHostname reports whether s is a valid hostname of at least two
+// lowercase DNS labels, suitable for use as a Tunnel's Hostname.
+func ValidHostname(s string) bool {
+	if len(s) > 253 || !strings.Contains(s, ".") {
+		return false
+	}
+	for label := range strings.SplitSeq(s, ".") {
+		if !ValidSubdomainLabel(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// pathSegmentRE matches a path segment of URL path characters that don't
+// need escaping, except for ":", which would read as a port after a host.
+var pathSegmentRE = regexp.MustCompile(`^[A-Za-z0-9._~!$&'()*+,;=@-]+$`)
+
+// ValidPathPrefix reports whether s is a valid Tunnel PathPrefix: a clean
+// absolute URL path other than "/", without a trailing slash, like "/api"
+// or "/api/v1".
+func ValidPathPrefix(s string) bool {
+	if s == "/" || path.Clean(s) != s || !strings.HasPrefix(s, "/") {
+		return false
+	}
+	for segment := range strings.SplitSeq(s[1:], "/") {
+		if !pathSegmentRE.MatchString(segment) {
+			return false
+		}
+	}
+	return true
+}
+
+// HeaderRules change the headers of HTTP messages: the headers named in
+// Remove are deleted, then the values in Add are added, so removing and
+// adding a header replaces it.
+type HeaderRules struct {
+	Add    map[string]string
+	Remove []string
+}
+
+// framingHeaders are the headers delimiting HTTP messages on a connection,
+// which HeaderRules may not change.
+var framingHeaders = []string{"Connection", "Content-Length", "Host", "Transfer-Encoding", "Upgrade"}
+
+// ValidHeaderRules reports whether r only names valid header fields, other
+// than those delimiting messages like Content-Length, and adds valid values.
+func ValidHeaderRules(r *HeaderRules) bool {
+	validName := func(name string) bool {
+		for _, h := range framingHeaders {
+			if strings.EqualFold(name, h) {
+				return false
+			}
+		}
+		return httpguts.ValidHeaderFieldName(name)
+	}
+	for name, value := range r.Add {
+		if !validName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return false
+		}
+	}
+	for _, name := range r.Remove {
+		if !validName(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidHostHeader reports whether s is a valid Tunnel HostHeader, a host
+// optionally followed by a port like "localhost:8080".
+func ValidHostHeader(s string) bool {
+	return s != "" && httpguts.ValidHostHeader(s) && !strings.ContainsAny(s, "/?#@")
+}
+
+// Apply changes h as r says. A nil r changes nothing.
+func (r *HeaderRules) Apply(h http.Header) {
+	if r == nil {
+		return
+	}
+	for _, name := range r.Remove {
+		h.Del(name)
+	}
+	for name, value := range r.Add {
+		h.Add(name, value)
+	}
+}
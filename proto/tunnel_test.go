@@ -6,7 +6,11 @@
 
 package proto
 
-import "testing"
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
 
 func TestValidSubdomainLabel(t *testing.T) {
 	t.Parallel()
@@ -40,3 +44,183 @@ func TestValidSubdomainLabel(t *testing.T) {
 		})
 	}
 }
+
+func TestValidSubdomain(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		subdomain string
+		want      bool
+	}{
+		{"single label", "myapp", true},
+		{"multi-level", "api.alice", true},
+		{"wildcard", "*.alice", true},
+		{"multi-level wildcard", "*.preview.alice", true},
+		{"bare wildcard", "*", false},
+		{"inner wildcard", "api.*.alice", false},
+		{"partial wildcard", "pr-*.alice", false},
+		{"empty", "", false},
+		{"empty label", "api..alice", false},
+		{"trailing dot", "api.alice.", false},
+		{"uppercase", "Api.alice", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ValidSubdomain(tt.subdomain)
+			if got != tt.want {
+				t.Fatalf("ValidSubdomain(%q) = %v, want %v", tt.subdomain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidHostname(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		host string
+		want bool
+	}{
+		{"two labels", "example.com", true},
+		{"many labels", "app.dev.example.com", true},
+		{"single label", "localhost", false},
+		{"empty", "", false},
+		{"uppercase", "App.example.com", false},
+		{"empty label", "app..example.com", false},
+		{"trailing dot", "example.com.", false},
+		{"wildcard", "*.example.com", false},
+		{"with port", "example.com:80", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ValidHostname(tt.host)
+			if got != tt.want {
+				t.Fatalf("ValidHostname(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidPathPrefix(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		prefix string
+		want   bool
+	}{
+		{"single segment", "/api", true},
+		{"several segments", "/api/v1", true},
+		{"punctuation", "/~alice/a.b-c_d", true},
+		{"root", "/", false},
+		{"empty", "", false},
+		{"relative", "api", false},
+		{"trailing slash", "/api/", false},
+		{"double slash", "/api//v1", false},
+		{"dot segment", "/api/../admin", false},
+		{"query", "/api?x=1", false},
+		{"escaped", "/a%20b", false},
+		{"space", "/a b", false},
+		{"colon", "/a:b", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ValidPathPrefix(tt.prefix)
+			if got != tt.want {
+				t.Fatalf("ValidPathPrefix(%q) = %v, want %v", tt.prefix, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidHostHeader(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		host string
+		want bool
+	}{
+		{"host", "localhost", true},
+		{"host and port", "localhost:8080", true},
+		{"ip and port", "127.0.0.1:3000", true},
+		{"ipv6", "[::1]:3000", true},
+		{"empty", "", false},
+		{"space", "local host", false},
+		{"path", "localhost/admin", false},
+		{"userinfo", "alice@localhost", false},
+		{"newline", "localhost\r\nX-Evil: 1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ValidHostHeader(tt.host)
+			if got != tt.want {
+				t.Fatalf("ValidHostHeader(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidHeaderRules(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		rules *HeaderRules
+		want  bool
+	}{
+		{"empty", &HeaderRules{}, true},
+		{"add and remove", &HeaderRules{Add: map[string]string{"X-Env": "dev"}, Remove: []string{"Cookie"}}, true},
+		{"empty value", &HeaderRules{Add: map[string]string{"X-Env": ""}}, true},
+		{"invalid name", &HeaderRules{Add: map[string]string{"X Env": "dev"}}, false},
+		{"invalid value", &HeaderRules{Add: map[string]string{"X-Env": "dev\r\nX-Evil: 1"}}, false},
+		{"remove invalid name", &HeaderRules{Remove: []string{"X:Env"}}, false},
+		{"add host", &HeaderRules{Add: map[string]string{"Host": "evil"}}, false},
+		{"remove content length", &HeaderRules{Remove: []string{"content-length"}}, false},
+		{"add transfer encoding", &HeaderRules{Add: map[string]string{"Transfer-Encoding": "chunked"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ValidHeaderRules(tt.rules)
+			if got != tt.want {
+				t.Fatalf("ValidHeaderRules(%+v) = %v, want %v", tt.rules, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderRules_Apply(t *testing.T) {
+	t.Parallel()
+
+	h := http.Header{
+		"Cookie":  {"session=1"},
+		"X-Env":   {"prod"},
+		"X-Other": {"kept"},
+	}
+	(&HeaderRules{
+		Add:    map[string]string{"x-env": "dev", "X-Tunnel": "yes"},
+		Remove: []string{"cookie", "X-Env"},
+	}).Apply(h)
+
+	want := http.Header{
+		"X-Env":    {"dev"},
+		"X-Other":  {"kept"},
+		"X-Tunnel": {"yes"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Fatalf("expected %v, got %v", want, h)
+	}
+
+	var nilRules *HeaderRules
+	nilRules.Apply(h)
+	if !reflect.DeepEqual(h, want) {
+		t.Fatalf("nil rules changed headers: %v", h)
+	}
+}
@@ -19,9 +19,10 @@ type ProxyFunc func(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage)
 // ProxyFuncs is a collection of ProxyFunc.
 type ProxyFuncs struct {
 	// Stream is the proxying implementation for tcp/tcp4/tcp6 tunnels, and
-	// also for http tunnels: both need nothing more than an opaque byte
-	// pipe to a local address, since routing to the right client already
-	// happened server-side by the time a connection reaches this func.
+	// also for http and tls tunnels: all need nothing more than an opaque
+	// byte pipe to a local address, since routing to the right client
+	// already happened server-side by the time a connection reaches this
+	// func.
 	Stream ProxyFunc
 }
 
@@ -30,7 +31,7 @@ func Proxy(p ProxyFuncs) ProxyFunc {
 	return func(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
 		var f ProxyFunc
 		switch msg.ForwardedProto {
-		case proto.TCP, proto.TCP4, proto.TCP6, proto.HTTP:
+		case proto.TCP, proto.TCP4, proto.TCP6, proto.HTTP, proto.TLS:
 			f = p.Stream
 		}
 
@@ -0,0 +1,355 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+)
+
+// QuotaPeriod is the period a transfer quota is counted over.
+type QuotaPeriod string
+
+// Quota periods. Periods are rolling windows, the last 24 hours or the last
+// 30 days, counted in slots of an hour or a day respectively, so usage falls
+// out of the window gradually rather than resetting at once.
+const (
+	QuotaDaily   QuotaPeriod = "daily"
+	QuotaMonthly QuotaPeriod = "monthly"
+)
+
+// Quota is a limit on the bytes an identity may transfer per period, in
+// both directions combined.
+type Quota struct {
+	// Bytes is the number of bytes allowed per period. Zero means no quota.
+	Bytes int64
+	// Period is QuotaDaily or QuotaMonthly.
+	Period QuotaPeriod
+}
+
+// QuotaConfig defines transfer quotas per identity. Once an identity uses up
+// its quota its active connections are closed, its client is disconnected
+// and its handshakes are rejected until enough usage fell out of the
+// period's window.
+type QuotaConfig struct {
+	// Default applies to every identity not listed in Identities or Names.
+	Default Quota
+	// Identities sets quotas for specific identities.
+	Identities map[id.ID]Quota
+	// Names sets quotas of identities by certificate CommonName, see
+	// BandwidthConfig.Names. Usage is still counted per identity.
+	Names map[string]Quota
+	// File, if set, is where usage is persisted as JSON so it survives
+	// restarts. It's loaded by NewServer and written periodically and on
+	// Stop.
+	File string
+}
+
+var errQuotaExceeded = errors.New("transfer quota exceeded")
+
+// quotaSaveInterval is how often changed usage is written to
+// QuotaConfig.File.
+const quotaSaveInterval = 30 * time.Second
+
+// window returns how far back usage counts against a quota of period p,
+// and the length of the slots usage is counted in.
+func (p QuotaPeriod) window() (window, slot time.Duration) {
+	if p == QuotaMonthly {
+		return 30 * 24 * time.Hour, 24 * time.Hour
+	}
+	return 24 * time.Hour, time.Hour
+}
+
+// validate checks that the quota's period is known.
+func (q Quota) validate() error {
+	switch q.Period {
+	case QuotaDaily, QuotaMonthly:
+		return nil
+	case "":
+		if q.Bytes == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid quota period %q", q.Period)
+}
+
+// quotaUsage is the usage of one identity, as persisted.
+type quotaUsage struct {
+	// Slots maps the start of each slot, in Unix seconds, to the bytes
+	// transferred during it.
+	Slots map[int64]int64 `json:"slots"`
+}
+
+// total drops the slots of u that are out of the window of p at now, and
+// returns the bytes transferred in those left.
+func (u *quotaUsage) total(p QuotaPeriod, now time.Time) int64 {
+	// A slot counts until all of it is out of the window, so the window
+	// is up to a slot longer rather than shorter.
+	window, slot := p.window()
+	oldest := now.Add(-window - slot).Unix()
+
+	var n int64
+	for start, bytes := range u.Slots {
+		if start <= oldest {
+			delete(u.Slots, start)
+			continue
+		}
+		n += bytes
+	}
+	return n
+}
+
+// add counts n bytes transferred at now against the slot of p it falls in.
+func (u *quotaUsage) add(p QuotaPeriod, now time.Time, n int64) {
+	_, slot := p.window()
+	if u.Slots == nil {
+		u.Slots = make(map[int64]int64)
+	}
+	u.Slots[now.Truncate(slot).Unix()] += n
+}
+
+// quotaTracker counts transfer per identity against a QuotaConfig. Its
+// methods are safe to call on a nil quotaTracker, which imposes no quotas.
+type quotaTracker struct {
+	config *QuotaConfig
+	// exceeded is called, in its own goroutine, when an identity crosses
+	// its quota.
+	exceeded func(identifier id.ID)
+	// names returns the certificate CommonName of an identity.
+	names func(id.ID) string
+
+	mu      sync.Mutex
+	usage   map[id.ID]*quotaUsage
+	streams map[id.ID]map[*func()]struct{}
+	dirty   bool
+}
+
+func newQuotaTracker(config *QuotaConfig, exceeded func(id.ID)) (*quotaTracker, error) {
+	if err := config.Default.validate(); err != nil {
+		return nil, err
+	}
+	for identifier, q := range config.Identities {
+		if err := q.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s", identifier, err)
+		}
+	}
+	for name, q := range config.Names {
+		if err := q.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	t := &quotaTracker{
+		config:   config,
+		exceeded: exceeded,
+		usage:    make(map[id.ID]*quotaUsage),
+		streams:  make(map[id.ID]map[*func()]struct{}),
+	}
+
+	if config.File != "" {
+		buf, err := os.ReadFile(config.File)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(buf) > 0 {
+			var usage map[string]*quotaUsage
+			if err := json.Unmarshal(buf, &usage); err != nil {
+				return nil, fmt.Errorf("failed to parse %q: %s", config.File, err)
+			}
+			for k, u := range usage {
+				var identifier id.ID
+				if err := identifier.UnmarshalText([]byte(k)); err != nil {
+					return nil, fmt.Errorf("failed to parse %q: invalid identifier %q: %s", config.File, k, err)
+				}
+				t.usage[identifier] = u
+			}
+		}
+	}
+
+	return t, nil
+}
+
+// quota returns the quota of identifier, ok is false if it has none.
+func (t *quotaTracker) quota(identifier id.ID) (q Quota, ok bool) {
+	q, ok = lookupIdentity(t.config.Identities, t.config.Names, t.names, identifier)
+	if !ok {
+		q = t.config.Default
+	}
+	return q, q.Bytes > 0
+}
+
+// current returns the usage of identifier. t.mu must be held.
+func (t *quotaTracker) current(identifier id.ID) *quotaUsage {
+	u, ok := t.usage[identifier]
+	if !ok {
+		u = &quotaUsage{}
+		t.usage[identifier] = u
+	}
+	return u
+}
+
+// check returns errQuotaExceeded if identifier has used up its quota.
+func (t *quotaTracker) check(identifier id.ID) error {
+	if t == nil {
+		return nil
+	}
+	q, ok := t.quota(identifier)
+	if !ok {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.current(identifier).total(q.Period, time.Now()) >= q.Bytes {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// add counts n transferred bytes against identifier's quota. It returns
+// errQuotaExceeded once the quota is used up, and the first time that
+// happens closes every stream of identifier and calls exceeded.
+func (t *quotaTracker) add(identifier id.ID, n int) error {
+	q, ok := t.quota(identifier)
+	if !ok || n == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	u := t.current(identifier)
+	before := u.total(q.Period, now)
+	u.add(q.Period, now, int64(n))
+	t.dirty = true
+
+	if before+int64(n) < q.Bytes {
+		t.mu.Unlock()
+		return nil
+	}
+
+	var closers []func()
+	if before < q.Bytes {
+		for c := range t.streams[identifier] {
+			closers = append(closers, *c)
+		}
+	}
+	t.mu.Unlock()
+
+	if before < q.Bytes {
+		for _, c := range closers {
+			c()
+		}
+		if t.exceeded != nil {
+			go t.exceeded(identifier)
+		}
+	}
+
+	return errQuotaExceeded
+}
+
+// track registers closeStream to be called if identifier exceeds its quota
+// while the stream is open. The returned func unregisters it.
+func (t *quotaTracker) track(identifier id.ID, closeStream func()) func() {
+	if t == nil {
+		return func() {}
+	}
+	if _, ok := t.quota(identifier); !ok {
+		return func() {}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.streams[identifier]
+	if !ok {
+		s = make(map[*func()]struct{})
+		t.streams[identifier] = s
+	}
+	key := &closeStream
+	s[key] = struct{}{}
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		s := t.streams[identifier]
+		delete(s, key)
+		if len(s) == 0 {
+			delete(t.streams, identifier)
+		}
+	}
+}
+
+// save writes usage to config.File if it changed since the last save. The
+// file is replaced atomically so a crash never leaves it half written.
+func (t *quotaTracker) save() error {
+	if t == nil || t.config.File == "" {
+		return nil
+	}
+
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	usage := make(map[string]*quotaUsage, len(t.usage))
+	for identifier, u := range t.usage {
+		if q, ok := t.quota(identifier); ok && u.total(q.Period, time.Now()) == 0 {
+			// Nothing left in the window.
+			delete(t.usage, identifier)
+			continue
+		}
+		usage[identifier.String()] = u
+	}
+	buf, err := json.MarshalIndent(usage, "", "  ")
+	t.dirty = false
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := WriteFileAtomic(t.config.File, buf, 0600); err != nil {
+		t.mu.Lock()
+		t.dirty = true
+		t.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// quotaReader counts everything read through it against a quota.
+type quotaReader struct {
+	r          io.Reader
+	quotas     *quotaTracker
+	identifier id.ID
+}
+
+// newQuotaReader returns r counting against identifier's quota, or r itself
+// if identifier has none.
+func newQuotaReader(r io.Reader, quotas *quotaTracker, identifier id.ID) io.Reader {
+	if quotas == nil {
+		return r
+	}
+	if _, ok := quotas.quota(identifier); !ok {
+		return r
+	}
+	return &quotaReader{r: r, quotas: quotas, identifier: identifier}
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if qerr := r.quotas.add(r.identifier, n); qerr != nil {
+		return n, qerr
+	}
+	return n, err
+}
@@ -0,0 +1,214 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+)
+
+func TestQuotaUsage_Rolling(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2026, 10, 18, 23, 30, 0, 0, time.UTC)
+
+	// usage just before and after midnight counts against the same day
+	u := &quotaUsage{}
+	u.add(QuotaDaily, start, 60)
+	u.add(QuotaDaily, start.Add(time.Hour), 30)
+	if n := u.total(QuotaDaily, start.Add(time.Hour)); n != 90 {
+		t.Fatalf("expected 90 bytes in the window, got %d", n)
+	}
+	// and falls out of it slot by slot, once all of the slot is out
+	if n := u.total(QuotaDaily, start.Add(24*time.Hour)); n != 90 {
+		t.Fatalf("expected the first slot to still count after a day, got %d", n)
+	}
+	if n := u.total(QuotaDaily, start.Add(25*time.Hour)); n != 30 {
+		t.Fatalf("expected the first slot to fall out after 25 hours, got %d", n)
+	}
+	if n := u.total(QuotaDaily, start.Add(26*time.Hour)); n != 0 {
+		t.Fatalf("expected nothing left after 26 hours, got %d", n)
+	}
+	if len(u.Slots) != 0 {
+		t.Fatalf("expected slots out of the window to be dropped, got %v", u.Slots)
+	}
+
+	u = &quotaUsage{}
+	u.add(QuotaMonthly, start, 100)
+	if n := u.total(QuotaMonthly, start.Add(29*24*time.Hour)); n != 100 {
+		t.Fatalf("expected the usage to count for 30 days, got %d", n)
+	}
+	if n := u.total(QuotaMonthly, start.Add(31*24*time.Hour)); n != 0 {
+		t.Fatalf("expected the usage to fall out after 30 days, got %d", n)
+	}
+}
+
+func TestQuotaTracker_Add(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+	bob := id.New([]byte("bob"))
+
+	exceeded := make(chan id.ID, 1)
+	q, err := newQuotaTracker(&QuotaConfig{
+		Default:    Quota{Bytes: 100, Period: QuotaDaily},
+		Identities: map[id.ID]Quota{bob: {}},
+	}, func(identifier id.ID) { exceeded <- identifier })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := 0
+	untrack := q.track(alice, func() { closed++ })
+	defer untrack()
+
+	if err := q.add(alice, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.check(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.add(alice, 40); err != errQuotaExceeded {
+		t.Fatalf("expected %v, got %v", errQuotaExceeded, err)
+	}
+	if err := q.check(alice); err != errQuotaExceeded {
+		t.Fatalf("expected %v, got %v", errQuotaExceeded, err)
+	}
+	if closed != 1 {
+		t.Fatalf("expected the tracked stream to be closed once, got %d", closed)
+	}
+	select {
+	case got := <-exceeded:
+		if got != alice {
+			t.Fatalf("expected alice to exceed, got %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exceeded was not called")
+	}
+
+	// further transfer keeps failing, but only the first crossing reacts
+	if err := q.add(alice, 1); err != errQuotaExceeded {
+		t.Fatalf("expected %v, got %v", errQuotaExceeded, err)
+	}
+	if closed != 1 {
+		t.Fatalf("expected no further closes, got %d", closed)
+	}
+
+	// bob has no quota
+	if err := q.add(bob, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.check(bob); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuotaTracker_Window(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+
+	q, err := newQuotaTracker(&QuotaConfig{Default: Quota{Bytes: 100, Period: QuotaMonthly}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.usage[alice] = &quotaUsage{}
+	q.usage[alice].add(QuotaMonthly, time.Now().Add(-31*24*time.Hour), 1000)
+
+	if err := q.check(alice); err != nil {
+		t.Fatalf("expected usage out of the window not to count, got %v", err)
+	}
+
+	q.usage[alice].add(QuotaMonthly, time.Now().Add(-29*24*time.Hour), 1000)
+	if err := q.check(alice); err != errQuotaExceeded {
+		t.Fatalf("expected usage in the window to count, got %v", err)
+	}
+}
+
+func TestQuotaTracker_Persist(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+	config := &QuotaConfig{
+		Default: Quota{Bytes: 100, Period: QuotaDaily},
+		File:    filepath.Join(t.TempDir(), "quota.json"),
+	}
+
+	q, err := newQuotaTracker(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.add(alice, 70); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = newQuotaTracker(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.add(alice, 30); err != errQuotaExceeded {
+		t.Fatalf("expected usage to survive a restart, got %v", err)
+	}
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(config.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the quota file, got %v", entries)
+	}
+}
+
+func TestQuotaTracker_InvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newQuotaTracker(&QuotaConfig{Default: Quota{Bytes: 1}}, nil); err == nil {
+		t.Fatal("expected error for a quota without period")
+	}
+
+	f := filepath.Join(t.TempDir(), "quota.json")
+	if err := os.WriteFile(f, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newQuotaTracker(&QuotaConfig{File: f}, nil); err == nil {
+		t.Fatal("expected error for a corrupt quota file")
+	}
+}
+
+func TestQuotaReader(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+
+	q, err := newQuotaTracker(&QuotaConfig{Default: Quota{Bytes: 10, Period: QuotaDaily}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newQuotaReader(bytes.NewReader(make([]byte, 100)), q, alice)
+	n, err := io.Copy(io.Discard, io.LimitReader(r, 5))
+	if err != nil || n != 5 {
+		t.Fatalf("expected 5 bytes within quota, got %d, %v", n, err)
+	}
+	if _, err := io.Copy(io.Discard, r); err != errQuotaExceeded {
+		t.Fatalf("expected %v, got %v", errQuotaExceeded, err)
+	}
+
+	var nilTracker *quotaTracker
+	plain := bytes.NewReader(nil)
+	if r := newQuotaReader(plain, nilTracker, alice); r != plain {
+		t.Fatal("expected the reader to be returned as is without quotas")
+	}
+}
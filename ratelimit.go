@@ -0,0 +1,283 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+)
+
+// RateLimit is a token bucket bandwidth limit.
+type RateLimit struct {
+	// Rate is the sustained rate in bytes per second. Zero means no limit.
+	Rate int64
+	// Burst is the bucket size in bytes, i.e. how much may be sent at once
+	// after a quiet period. If zero, Rate is used.
+	Burst int64
+}
+
+// BandwidthConfig defines bandwidth limits for proxied connections. Each
+// limit applies separately to each direction (user to client, client to
+// user) and is shared by all connections it covers, so e.g. an identity's
+// parallel downloads split its rate between them. A connection subject to
+// both an identity and a tunnel limit is held to whichever is stricter at
+// the time.
+type BandwidthConfig struct {
+	// Default limits every identity not listed in Identities or Names.
+	Default RateLimit
+	// Identities limits specific identities.
+	Identities map[id.ID]RateLimit
+	// Names limits identities by the CommonName of their certificate, if
+	// it was verified against trusted CAs. Identities takes precedence.
+	Names map[string]RateLimit
+	// Tunnels limits specific tunnels, keyed by their public endpoint:
+	// the full hostname of an http tunnel, "*.alice.<BaseDomain>" for a
+	// wildcard one, followed by the path prefix of one routed by path, or
+	// the port number of a tcp tunnel's listener.
+	Tunnels map[string]RateLimit
+}
+
+// tokenBucket is a token bucket that may go into debt: take always
+// succeeds and instead reports how long to wait to pay the debt back. This
+// keeps concurrent takers fair without any queueing of their own.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(l RateLimit) *tokenBucket {
+	burst := l.Burst
+	if burst <= 0 {
+		burst = l.Rate
+	}
+	return &tokenBucket{
+		rate:   float64(l.Rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a single token if one is available, without going into
+// debt.
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// idle reports whether the bucket has been untouched long enough to have
+// refilled completely, so dropping it loses nothing.
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// take removes n tokens and returns how long the caller must wait before
+// using them.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// directedBuckets holds one bucket per direction.
+type directedBuckets struct {
+	in  *tokenBucket // user to client
+	out *tokenBucket // client to user
+}
+
+func newDirectedBuckets(l RateLimit) *directedBuckets {
+	return &directedBuckets{in: newTokenBucket(l), out: newTokenBucket(l)}
+}
+
+// bandwidthLimiter hands out the shared buckets for each identity and
+// tunnel, creating them on first use and dropping them once idle.
+type bandwidthLimiter struct {
+	config *BandwidthConfig
+	// names returns the certificate CommonName of an identity, see
+	// BandwidthConfig.Names.
+	names func(id.ID) string
+
+	mu         sync.Mutex
+	identities map[id.ID]*directedBuckets
+	tunnels    map[string]*directedBuckets
+	lastPrune  time.Time
+}
+
+func newBandwidthLimiter(config *BandwidthConfig) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		config:     config,
+		identities: make(map[id.ID]*directedBuckets),
+		tunnels:    make(map[string]*directedBuckets),
+		lastPrune:  time.Now(),
+	}
+}
+
+// idle reports whether both buckets of b are idle, see tokenBucket.idle.
+func (b *directedBuckets) idle(now time.Time) bool {
+	return b.in.idle(now) && b.out.idle(now)
+}
+
+// prune drops the idle buckets every pruneInterval, so identities and
+// tunnels that are gone don't keep theirs. A dropped bucket was full, so
+// recreating it on next use changes nothing. l.mu must be held.
+func (l *bandwidthLimiter) prune() {
+	now := time.Now()
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	for k, b := range l.identities {
+		if b.idle(now) {
+			delete(l.identities, k)
+		}
+	}
+	for k, b := range l.tunnels {
+		if b.idle(now) {
+			delete(l.tunnels, k)
+		}
+	}
+	l.lastPrune = now
+}
+
+// buckets returns the buckets a connection of identifier to tunnel is
+// subject to, or nil if it's unlimited.
+func (l *bandwidthLimiter) buckets(identifier id.ID, tunnel string) []*directedBuckets {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune()
+
+	var bs []*directedBuckets
+
+	limit, ok := lookupIdentity(l.config.Identities, l.config.Names, l.names, identifier)
+	if !ok {
+		limit = l.config.Default
+	}
+	if limit.Rate > 0 {
+		b, ok := l.identities[identifier]
+		if !ok {
+			b = newDirectedBuckets(limit)
+			l.identities[identifier] = b
+		}
+		bs = append(bs, b)
+	}
+
+	if limit, ok := l.config.Tunnels[tunnel]; ok && limit.Rate > 0 {
+		b, ok := l.tunnels[tunnel]
+		if !ok {
+			b = newDirectedBuckets(limit)
+			l.tunnels[tunnel] = b
+		}
+		bs = append(bs, b)
+	}
+
+	return bs
+}
+
+// splitDirections returns the user to client and client to user buckets of
+// bs.
+func splitDirections(bs []*directedBuckets) (in, out []*tokenBucket) {
+	for _, b := range bs {
+		in = append(in, b.in)
+		out = append(out, b.out)
+	}
+	return in, out
+}
+
+// tunnelKey returns the key connections to the tcp tunnel listening on
+// addr are looked up by in BandwidthConfig.Tunnels and
+// ConnLimitConfig.Tunnels, its port. http and tls tunnels are looked up by
+// their registered host instead.
+func tunnelKey(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return port
+}
+
+// rateLimitedReader delays reads from r so the bytes read never exceed what
+// every one of buckets allows.
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*tokenBucket
+	// chunk is the largest read attempted at once, the smallest burst of
+	// buckets, so a single read can't overdraw a bucket by a lot.
+	chunk int
+}
+
+func newRateLimitedReader(ctx context.Context, r io.Reader, buckets []*tokenBucket) io.Reader {
+	if len(buckets) == 0 {
+		return r
+	}
+
+	chunk := int(buckets[0].burst)
+	for _, b := range buckets[1:] {
+		chunk = min(chunk, int(b.burst))
+	}
+	chunk = max(chunk, 1)
+
+	return &rateLimitedReader{ctx: ctx, r: r, buckets: buckets, chunk: chunk}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+
+	n, err := r.r.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	var wait time.Duration
+	for _, b := range r.buckets {
+		wait = max(wait, b.take(n))
+	}
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		}
+	}
+
+	return n, err
+}
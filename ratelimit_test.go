@@ -0,0 +1,204 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ChacheGS/go-stream-tunnel/id"
+)
+
+func TestTokenBucket_Take(t *testing.T) {
+	t.Parallel()
+
+	b := newTokenBucket(RateLimit{Rate: 1000, Burst: 500})
+
+	if d := b.take(500); d != 0 {
+		t.Fatalf("expected the initial burst to be free, got wait %v", d)
+	}
+
+	// 500 bytes of debt at 1000 B/s is half a second, give or take the
+	// refill since the previous take.
+	d := b.take(500)
+	if d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("expected about 500ms wait, got %v", d)
+	}
+}
+
+func TestTokenBucket_BurstDefaultsToRate(t *testing.T) {
+	t.Parallel()
+
+	b := newTokenBucket(RateLimit{Rate: 100})
+	if b.burst != 100 {
+		t.Fatalf("expected burst 100, got %v", b.burst)
+	}
+}
+
+func TestRateLimitedReader_Throughput(t *testing.T) {
+	t.Parallel()
+
+	b := newTokenBucket(RateLimit{Rate: 20000, Burst: 2000})
+	r := newRateLimitedReader(context.Background(), bytes.NewReader(make([]byte, 6000)), []*tokenBucket{b})
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6000 {
+		t.Fatalf("expected 6000 bytes, got %d", n)
+	}
+
+	// 2000 bytes of burst are free, the other 4000 take 200ms at 20 kB/s.
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Fatalf("expected reads to be throttled to about 200ms, took %v", elapsed)
+	}
+}
+
+func TestRateLimitedReader_ContextCancel(t *testing.T) {
+	t.Parallel()
+
+	b := newTokenBucket(RateLimit{Rate: 1, Burst: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newRateLimitedReader(ctx, bytes.NewReader(make([]byte, 10)), []*tokenBucket{b})
+
+	buf := make([]byte, 10)
+	r.Read(buf) // free burst
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := r.Read(buf); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRateLimitedReader_Unlimited(t *testing.T) {
+	t.Parallel()
+
+	src := bytes.NewReader(nil)
+	if r := newRateLimitedReader(context.Background(), src, nil); r != src {
+		t.Fatal("expected reader without buckets to be returned unchanged")
+	}
+}
+
+func TestBandwidthLimiter_Buckets(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+	bob := id.New([]byte("bob"))
+	carol := id.New([]byte("carol"))
+
+	l := newBandwidthLimiter(&BandwidthConfig{
+		Default: RateLimit{Rate: 1000},
+		Identities: map[id.ID]RateLimit{
+			bob:   {Rate: 5000},
+			carol: {},
+		},
+		Tunnels: map[string]RateLimit{
+			"myapp.tunnel.example.com": {Rate: 100},
+		},
+	})
+
+	if bs := l.buckets(alice, "2222"); len(bs) != 1 || bs[0].in.rate != 1000 {
+		t.Fatalf("expected alice to get the default limit, got %v", bs)
+	}
+	if bs := l.buckets(bob, "2222"); len(bs) != 1 || bs[0].in.rate != 5000 {
+		t.Fatalf("expected bob to get their own limit, got %v", bs)
+	}
+	if bs := l.buckets(carol, "2222"); len(bs) != 0 {
+		t.Fatalf("expected carol to be unlimited, got %v", bs)
+	}
+	if bs := l.buckets(carol, "myapp.tunnel.example.com"); len(bs) != 1 || bs[0].in.rate != 100 {
+		t.Fatalf("expected the tunnel limit to apply, got %v", bs)
+	}
+
+	// every connection of an identity shares its buckets
+	if a, b := l.buckets(alice, "1"), l.buckets(alice, "2"); a[0] != b[0] {
+		t.Fatal("expected connections of the same identity to share buckets")
+	}
+
+	var nilLimiter *bandwidthLimiter
+	if bs := nilLimiter.buckets(alice, "2222"); bs != nil {
+		t.Fatalf("expected no buckets without a config, got %v", bs)
+	}
+}
+
+func TestBandwidthLimiter_Prune(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+	bob := id.New([]byte("bob"))
+
+	l := newBandwidthLimiter(&BandwidthConfig{
+		Default: RateLimit{Rate: 1000},
+		Tunnels: map[string]RateLimit{"2222": {Rate: 1000}},
+	})
+
+	l.buckets(alice, "2222")
+	busy := l.buckets(bob, "1111")
+	busy[0].in.take(500)
+
+	l.mu.Lock()
+	l.lastPrune = time.Now().Add(-pruneInterval)
+	l.prune()
+	_, aliceKept := l.identities[alice]
+	_, bobKept := l.identities[bob]
+	_, tunnelKept := l.tunnels["2222"]
+	l.mu.Unlock()
+
+	if aliceKept || tunnelKept {
+		t.Fatal("expected idle buckets to be dropped")
+	}
+	if !bobKept {
+		t.Fatal("expected a bucket in use to be kept")
+	}
+}
+
+func TestBandwidthLimiter_Names(t *testing.T) {
+	t.Parallel()
+
+	alice := id.New([]byte("alice"))
+	bob := id.New([]byte("bob"))
+	dave := id.New([]byte("dave"))
+
+	l := newBandwidthLimiter(&BandwidthConfig{
+		Default:    RateLimit{Rate: 1000},
+		Identities: map[id.ID]RateLimit{bob: {Rate: 5000}},
+		Names:      map[string]RateLimit{"laptop": {Rate: 2000}},
+	})
+	l.names = func(identifier id.ID) string {
+		if identifier == dave {
+			return ""
+		}
+		return "laptop"
+	}
+
+	if bs := l.buckets(alice, "2222"); len(bs) != 1 || bs[0].in.rate != 2000 {
+		t.Fatalf("expected alice to get the limit of her name, got %v", bs)
+	}
+	if bs := l.buckets(bob, "2222"); len(bs) != 1 || bs[0].in.rate != 5000 {
+		t.Fatalf("expected the identity limit to take precedence, got %v", bs)
+	}
+	if bs := l.buckets(dave, "2222"); len(bs) != 1 || bs[0].in.rate != 1000 {
+		t.Fatalf("expected a client without a name to get the default limit, got %v", bs)
+	}
+}
+
+func TestTunnelKey(t *testing.T) {
+	t.Parallel()
+
+	for addr, want := range map[string]string{
+		"[::]:2222":    "2222",
+		"0.0.0.0:8080": "8080",
+		"bogus":        "bogus",
+	} {
+		if got := tunnelKey(addr); got != want {
+			t.Errorf("tunnelKey(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
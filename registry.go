@@ -9,6 +9,9 @@ package tunnel
 import (
 	"fmt"
 	"net"
+	"path"
+	"slices"
+	"strings"
 	"sync"
 
 	"github.com/ChacheGS/go-stream-tunnel/id"
@@ -18,19 +21,37 @@ import (
 // RegistryItem holds information about hosts and listeners associated with a
 // client.
 type RegistryItem struct {
-	Hosts     []string
+	// Hosts are the routes of http tunnels: a host, optionally followed by
+	// a path prefix as in "myapp.<base domain>/api".
+	Hosts []string
+	// TLSHosts are the hosts of TLS passthrough tunnels, routed by SNI
+	// server name instead of Host header.
+	TLSHosts  []string
 	Listeners []net.Listener
+	// headers are the header rules of the routes in Hosts that have any.
+	headers map[string]*headerRules
+	// Client describes the certificate the client connected with, it's nil
+	// unless the certificate was verified against trusted CAs.
+	Client *id.Info
 }
 
 type hostInfo struct {
 	identifier id.ID
+	// tls is set for hosts of TLS passthrough tunnels.
+	tls bool
+	// headers are the header rules of an http tunnel, if any.
+	headers *headerRules
 }
 
 type registry struct {
-	items  map[id.ID]*RegistryItem
-	hosts  map[string]*hostInfo
-	mu     sync.RWMutex
-	logger log.Logger
+	items map[id.ID]*RegistryItem
+	hosts map[string]*hostInfo
+	// pathHosts counts the routes with a path prefix of each host.
+	pathHosts map[string]int
+	infos     map[id.ID]*id.Info
+	names     map[string]bool
+	mu        sync.RWMutex
+	logger    log.Logger
 }
 
 func newRegistry(logger log.Logger) *registry {
@@ -39,9 +60,12 @@ func newRegistry(logger log.Logger) *registry {
 	}
 
 	return &registry{
-		items:  make(map[id.ID]*RegistryItem),
-		hosts:  make(map[string]*hostInfo),
-		logger: logger,
+		items:     make(map[id.ID]*RegistryItem),
+		hosts:     make(map[string]*hostInfo),
+		pathHosts: make(map[string]int),
+		infos:     make(map[id.ID]*id.Info),
+		names:     make(map[string]bool),
+		logger:    logger,
 	}
 }
 
@@ -65,6 +89,50 @@ func (r *registry) Subscribe(identifier id.ID) {
 	r.items[identifier] = voidRegistryItem
 }
 
+// SubscribeName allows to connect clients presenting a certificate with the
+// CommonName name. Only certificates verified against trusted CAs are
+// matched by name; a client connecting this way is subscribed by its
+// identifier.
+func (r *registry) SubscribeName(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		return
+	}
+
+	r.logger.Log(
+		"level", 1,
+		"action", "subscribe",
+		"client", name,
+	)
+
+	r.names[name] = true
+}
+
+// isSubscribedName returns true if clients named name are subscribed.
+func (r *registry) isSubscribedName(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.names[name]
+}
+
+// setInfo records the certificate info of the client identified by
+// identifier.
+func (r *registry) setInfo(identifier id.ID, info *id.Info) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.infos[identifier] = info
+}
+
+// clientName returns the CommonName of the verified certificate the client
+// identified by identifier connected with, or "" if there's none.
+func (r *registry) clientName(identifier id.ID) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return infoName(r.infos[identifier])
+}
+
 // IsSubscribed returns true if client is subscribed.
 func (r *registry) IsSubscribed(identifier id.ID) bool {
 	r.mu.RLock()
@@ -78,12 +146,118 @@ func (r *registry) Subscriber(hostPort string) (id.ID, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	h, ok := r.hosts[trimPort(hostPort)]
-	if !ok {
+	_, h := r.match(trimPort(hostPort))
+	if h == nil {
 		return id.ID{}, false
 	}
 
-	return h.identifier, ok
+	return h.identifier, true
+}
+
+// subscriberTLS is Subscriber for the hosts of a single kind of tunnel,
+// TLS passthrough ones if tls is set, http ones otherwise.
+func (r *registry) subscriberTLS(hostPort string, tls bool) (id.ID, bool) {
+	identifier, _, ok := r.matchHost(hostPort, tls)
+	return identifier, ok
+}
+
+// matchHost is subscriberTLS also returning the registered host that
+// matched, hostPort itself or a wildcard host like "*.alice.<base domain>".
+func (r *registry) matchHost(hostPort string, tls bool) (identifier id.ID, host string, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	host, h := r.match(trimPort(hostPort))
+	if h == nil || h.tls != tls {
+		return id.ID{}, "", false
+	}
+
+	return h.identifier, host, true
+}
+
+// matchRoute returns the client and the registered route the http request
+// for path on hostPort is routed to. Hosts are tried like by match, and on
+// each the route with the longest path prefix matching whole segments of
+// path wins, then the one without a prefix.
+func (r *registry) matchRoute(hostPort, reqPath string) (identifier id.ID, route string, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	reqPath = path.Clean("/" + reqPath)
+	for _, host := range hostPatterns(trimPort(hostPort)) {
+		if r.pathHosts[host] > 0 {
+			for p := reqPath; p != "/"; p = path.Dir(p) {
+				if h, ok := r.hosts[host+p]; ok {
+					return h.identifier, host + p, true
+				}
+			}
+		}
+		if h, ok := r.hosts[host]; ok && !h.tls {
+			return h.identifier, host, true
+		}
+	}
+
+	return id.ID{}, "", false
+}
+
+// hasHTTPHost reports whether an http tunnel is registered for hostPort
+// itself, not only through a wildcard host covering it.
+func (r *registry) hasHTTPHost(hostPort string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	host := trimPort(hostPort)
+	h, ok := r.hosts[host]
+	return ok && !h.tls || r.pathHosts[host] > 0
+}
+
+// headers returns the header rules of the http tunnel of route, or nil if
+// it has none.
+func (r *registry) headers(route string) *headerRules {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if h, ok := r.hosts[route]; ok {
+		return h.headers
+	}
+	return nil
+}
+
+// match returns the registered host matching host and its hostInfo, or a
+// nil hostInfo if there's none. An exact registration wins, then the
+// wildcard one with the longest domain, so "*.api.alice" wins over
+// "*.alice" for "v1.api.alice". r.mu must be held.
+func (r *registry) match(host string) (string, *hostInfo) {
+	for _, pattern := range hostPatterns(host) {
+		if h, ok := r.hosts[pattern]; ok {
+			return pattern, h
+		}
+	}
+	return "", nil
+}
+
+// hostPatterns returns the registered hosts that may match host, most
+// specific first: host itself, then the wildcard hosts of its parent
+// domains.
+func hostPatterns(host string) []string {
+	patterns := []string{host}
+	for domain := host; ; {
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			return patterns
+		}
+		patterns = append(patterns, "*."+parent)
+		domain = parent
+	}
+}
+
+// splitRoute splits an http tunnel route, see RegistryItem.Hosts, into its
+// host and path prefix.
+func splitRoute(route string) (host, prefix string) {
+	if i := strings.IndexByte(route, '/'); i >= 0 {
+		return route[:i], route[i:]
+	}
+	return route, ""
 }
 
 // Unsubscribe removes client from registry and returns it's RegistryItem.
@@ -100,15 +274,13 @@ func (r *registry) Unsubscribe(identifier id.ID) *RegistryItem {
 		"level", 1,
 		"action", "unsubscribe",
 		"identifier", identifier,
+		"client", infoName(r.infos[identifier]),
 	)
 
-	if i.Hosts != nil {
-		for _, h := range i.Hosts {
-			delete(r.hosts, trimPort(h))
-		}
-	}
+	r.removeHosts(i)
 
 	delete(r.items, identifier)
+	delete(r.infos, identifier)
 
 	return i
 }
@@ -118,6 +290,7 @@ func (r *registry) set(i *RegistryItem, identifier id.ID) error {
 		"level", 2,
 		"action", "set registry item",
 		"identifier", identifier,
+		"client", r.clientName(identifier),
 	)
 
 	r.mu.Lock()
@@ -131,30 +304,95 @@ func (r *registry) set(i *RegistryItem, identifier id.ID) error {
 		return fmt.Errorf("attempt to overwrite registry item")
 	}
 
-	if i.Hosts != nil {
-		for _, h := range i.Hosts {
-			if _, ok := r.hosts[trimPort(h)]; ok {
-				return fmt.Errorf("host %q is occupied", h)
+	for _, h := range slices.Concat(i.Hosts, i.TLSHosts) {
+		if _, ok := r.hosts[trimPort(h)]; ok {
+			return fmt.Errorf("host %q is occupied", h)
+		}
+		if host, _ := splitRoute(trimPort(h)); r.overlaps(host, identifier) {
+			return fmt.Errorf("host %q is occupied", h)
+		}
+	}
+	// TLS passthrough connections can't be routed by path.
+	for _, h := range i.Hosts {
+		if host, prefix := splitRoute(h); prefix != "" {
+			if j, ok := r.hosts[host]; (ok && j.tls) || slices.Contains(i.TLSHosts, host) {
+				return fmt.Errorf("host %q is occupied", host)
 			}
 		}
+	}
+	for _, h := range i.TLSHosts {
+		if r.pathHosts[h] > 0 {
+			return fmt.Errorf("host %q is occupied", h)
+		}
+	}
 
-		for _, h := range i.Hosts {
-			r.hosts[trimPort(h)] = &hostInfo{
-				identifier: identifier,
-			}
+	for _, h := range i.Hosts {
+		r.hosts[trimPort(h)] = &hostInfo{
+			identifier: identifier,
+			headers:    i.headers[h],
+		}
+		host, prefix := splitRoute(h)
+		if prefix != "" {
+			r.pathHosts[host]++
+		}
+	}
+	for _, h := range i.TLSHosts {
+		r.hosts[trimPort(h)] = &hostInfo{
+			identifier: identifier,
+			tls:        true,
 		}
 	}
 
+	i.Client = r.infos[identifier]
 	r.items[identifier] = i
 
 	return nil
 }
 
+// overlaps reports whether host, to be registered for identifier, falls
+// under a wildcard host of another client, or is a wildcard host covering a
+// host of another client. Either would let one client take over traffic
+// meant for the other. r.mu must be held.
+func (r *registry) overlaps(host string, identifier id.ID) bool {
+	for _, pattern := range hostPatterns(host)[1:] {
+		if h, ok := r.hosts[pattern]; ok && h.identifier != identifier {
+			return true
+		}
+	}
+
+	domain, ok := strings.CutPrefix(host, "*.")
+	if !ok {
+		return false
+	}
+	for route, h := range r.hosts {
+		if other, _ := splitRoute(route); h.identifier != identifier && strings.HasSuffix(other, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeHosts removes the hosts of i. r.mu must be held.
+func (r *registry) removeHosts(i *RegistryItem) {
+	for _, h := range slices.Concat(i.Hosts, i.TLSHosts) {
+		delete(r.hosts, trimPort(h))
+	}
+	for _, h := range i.Hosts {
+		host, prefix := splitRoute(h)
+		if prefix != "" {
+			if r.pathHosts[host]--; r.pathHosts[host] == 0 {
+				delete(r.pathHosts, host)
+			}
+		}
+	}
+}
+
 func (r *registry) clear(identifier id.ID) *RegistryItem {
 	r.logger.Log(
 		"level", 2,
 		"action", "clear registry item",
 		"identifier", identifier,
+		"client", r.clientName(identifier),
 	)
 
 	r.mu.Lock()
@@ -165,17 +403,37 @@ func (r *registry) clear(identifier id.ID) *RegistryItem {
 		return nil
 	}
 
-	if i.Hosts != nil {
-		for _, h := range i.Hosts {
-			delete(r.hosts, trimPort(h))
-		}
-	}
+	r.removeHosts(i)
 
 	r.items[identifier] = voidRegistryItem
 
 	return i
 }
 
+// lookupIdentity returns the entry of identifier in byID or, failing that,
+// the entry of its certificate CommonName, as returned by name, in byName.
+func lookupIdentity[V any](byID map[id.ID]V, byName map[string]V, name func(id.ID) string, identifier id.ID) (V, bool) {
+	if v, ok := byID[identifier]; ok {
+		return v, true
+	}
+	if len(byName) > 0 && name != nil {
+		if n := name(identifier); n != "" {
+			v, ok := byName[n]
+			return v, ok
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// infoName returns the CommonName of info, or "" if info is nil.
+func infoName(info *id.Info) string {
+	if info == nil {
+		return ""
+	}
+	return info.CommonName
+}
+
 func trimPort(hostPort string) (host string) {
 	host, _, _ = net.SplitHostPort(hostPort)
 	if host == "" {
@@ -83,6 +83,142 @@ func TestRegistry_Subscriber(t *testing.T) {
 	}
 }
 
+func TestRegistry_SubscriberTLS(t *testing.T) {
+	t.Parallel()
+
+	r := newRegistry(nil)
+	identifier := newTestID("client1")
+
+	r.Subscribe(identifier)
+
+	item := &RegistryItem{Hosts: []string{"web.example.com"}, TLSHosts: []string{"secure.example.com"}}
+	if err := r.set(item, identifier); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := r.subscriberTLS("secure.example.com:443", true); !ok || got != identifier {
+		t.Fatal("expected to find tls subscriber")
+	}
+	if _, ok := r.subscriberTLS("secure.example.com", false); ok {
+		t.Fatal("should not find http subscriber for a tls host")
+	}
+	if _, ok := r.subscriberTLS("web.example.com", true); ok {
+		t.Fatal("should not find tls subscriber for an http host")
+	}
+
+	r.clear(identifier)
+	if _, ok := r.subscriberTLS("secure.example.com", true); ok {
+		t.Fatal("expected tls hosts to be removed on clear")
+	}
+}
+
+func TestRegistry_MatchHost(t *testing.T) {
+	t.Parallel()
+
+	r := newRegistry(nil)
+	alice := newTestID("alice")
+
+	r.Subscribe(alice)
+
+	if err := r.set(&RegistryItem{Hosts: []string{"*.alice.example.com", "*.api.alice.example.com", "v1.api.alice.example.com"}}, alice); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host       string
+		identifier id.ID
+		registered string
+	}{
+		{"pr-1.alice.example.com:80", alice, "*.alice.example.com"},
+		{"a.b.alice.example.com", alice, "*.alice.example.com"},
+		{"v2.api.alice.example.com", alice, "*.api.alice.example.com"},
+		{"v1.api.alice.example.com", alice, "v1.api.alice.example.com"},
+	}
+	for _, tt := range tests {
+		identifier, registered, ok := r.matchHost(tt.host, false)
+		if !ok || identifier != tt.identifier || registered != tt.registered {
+			t.Errorf("matchHost(%q) = %s, %q, %v, want %s, %q", tt.host, identifier, registered, ok, tt.identifier, tt.registered)
+		}
+	}
+
+	for _, host := range []string{"alice.example.com", "example.com", "bob.example.com"} {
+		if _, _, ok := r.matchHost(host, false); ok {
+			t.Errorf("expected no match for %q", host)
+		}
+	}
+}
+
+func TestRegistry_MatchRoute(t *testing.T) {
+	t.Parallel()
+
+	r := newRegistry(nil)
+	alice := newTestID("alice")
+	bob := newTestID("bob")
+
+	r.Subscribe(alice)
+	r.Subscribe(bob)
+
+	if err := r.set(&RegistryItem{Hosts: []string{"shop.example.com", "*.example.com/static"}}, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.set(&RegistryItem{Hosts: []string{"shop.example.com/api", "shop.example.com/api/v2"}}, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host, path string
+		identifier id.ID
+		route      string
+	}{
+		{"shop.example.com", "/", alice, "shop.example.com"},
+		{"shop.example.com:80", "/api", bob, "shop.example.com/api"},
+		{"shop.example.com", "/api/v1/users", bob, "shop.example.com/api"},
+		{"shop.example.com", "/api/v2/users", bob, "shop.example.com/api/v2"},
+		{"shop.example.com", "/apix", alice, "shop.example.com"},
+		{"shop.example.com", "/api/../admin", alice, "shop.example.com"},
+		{"shop.example.com", "/static/app.js", alice, "shop.example.com"},
+		{"blog.example.com", "/static", alice, "*.example.com/static"},
+	}
+	for _, tt := range tests {
+		identifier, route, ok := r.matchRoute(tt.host, tt.path)
+		if !ok || identifier != tt.identifier || route != tt.route {
+			t.Errorf("matchRoute(%q, %q) = %s, %q, %v, want %s, %q", tt.host, tt.path, identifier, route, ok, tt.identifier, tt.route)
+		}
+	}
+
+	if _, _, ok := r.matchRoute("blog.example.com", "/"); ok {
+		t.Error("expected no route outside of the path prefix")
+	}
+	// blog.example.com is only covered by a wildcard route
+	if !r.hasHTTPHost("shop.example.com:80") || r.hasHTTPHost("blog.example.com") || r.hasHTTPHost("example.com") {
+		t.Error("unexpected hasHTTPHost results")
+	}
+
+	// a tls host can't be routed by path
+	carol := newTestID("carol")
+	r.Subscribe(carol)
+	if err := r.set(&RegistryItem{TLSHosts: []string{"blog.example.com"}}, carol); err != nil {
+		t.Fatal(err)
+	}
+	if r.hasHTTPHost("blog.example.com") {
+		t.Error("expected a tls host not to count as an http one")
+	}
+	dave := newTestID("dave")
+	r.Subscribe(dave)
+	if err := r.set(&RegistryItem{Hosts: []string{"blog.example.com/api"}}, dave); err == nil {
+		t.Error("expected error for a path route on a tls host")
+	}
+
+	r.clear(bob)
+	if _, route, _ := r.matchRoute("shop.example.com", "/api"); route != "shop.example.com" {
+		t.Errorf("expected path routes to be removed on clear, got %q", route)
+	}
+	r.clear(alice)
+	if r.hasHTTPHost("shop.example.com") {
+		t.Error("expected no routes left")
+	}
+}
+
 func TestRegistry_Set(t *testing.T) {
 	t.Parallel()
 
@@ -117,6 +253,41 @@ func TestRegistry_Set(t *testing.T) {
 	}
 }
 
+func TestRegistry_SetWildcardOwnership(t *testing.T) {
+	t.Parallel()
+
+	r := newRegistry(nil)
+	alice, bob := newTestID("alice"), newTestID("bob")
+	r.Subscribe(alice)
+	r.Subscribe(bob)
+
+	if err := r.set(&RegistryItem{Hosts: []string{"*.alice.example.com", "*.api.alice.example.com"}}, alice); err != nil {
+		t.Fatalf("expected a client to nest its own wildcards, got %v", err)
+	}
+	for _, hosts := range [][]string{
+		{"x.alice.example.com"},
+		{"x.alice.example.com/api"},
+		{"*.v1.alice.example.com"},
+		{"*.example.com"},
+		{"bob.example.com", "*.example.com"},
+	} {
+		if err := r.set(&RegistryItem{Hosts: hosts}, bob); err == nil {
+			t.Fatalf("expected %v to be refused under alice's wildcard", hosts)
+		}
+	}
+	if err := r.set(&RegistryItem{TLSHosts: []string{"db.alice.example.com"}}, bob); err == nil {
+		t.Fatal("expected a tls host to be refused under alice's wildcard")
+	}
+
+	if err := r.set(&RegistryItem{Hosts: []string{"bob.example.com", "alice.example.com"}}, bob); err != nil {
+		t.Fatalf("expected hosts outside alice's wildcards to be accepted, got %v", err)
+	}
+	r.clear(alice)
+	if err := r.set(&RegistryItem{Hosts: []string{"*.example.com"}}, alice); err == nil {
+		t.Fatal("expected a wildcard covering bob's hosts to be refused")
+	}
+}
+
 func TestRegistry_Clear(t *testing.T) {
 	t.Parallel()
 
@@ -202,3 +373,39 @@ func TestTrimPort(t *testing.T) {
 		}
 	}
 }
+
+func TestRegistry_Names(t *testing.T) {
+	t.Parallel()
+
+	r := newRegistry(nil)
+	identifier := newTestID("client1")
+
+	r.SubscribeName("laptop")
+	if !r.isSubscribedName("laptop") || r.isSubscribedName("desktop") {
+		t.Fatal("expected only laptop to be subscribed by name")
+	}
+
+	if name := r.clientName(identifier); name != "" {
+		t.Fatalf("expected no name before the client connected, got %q", name)
+	}
+
+	r.Subscribe(identifier)
+	info := &id.Info{CommonName: "laptop"}
+	r.setInfo(identifier, info)
+	if name := r.clientName(identifier); name != "laptop" {
+		t.Fatalf("expected laptop, got %q", name)
+	}
+
+	item := &RegistryItem{Hosts: []string{"example.com:80"}}
+	if err := r.set(item, identifier); err != nil {
+		t.Fatal(err)
+	}
+	if item.Client != info {
+		t.Fatal("expected the registry item to carry the client info")
+	}
+
+	r.Unsubscribe(identifier)
+	if name := r.clientName(identifier); name != "" {
+		t.Fatalf("expected the name to be dropped on unsubscribe, got %q", name)
+	}
+}
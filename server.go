@@ -7,20 +7,26 @@
 package tunnel
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/http2"
 
+	"github.com/ChacheGS/go-stream-tunnel/ca"
 	"github.com/ChacheGS/go-stream-tunnel/id"
 	"github.com/ChacheGS/go-stream-tunnel/log"
 	"github.com/ChacheGS/go-stream-tunnel/proto"
@@ -34,6 +40,12 @@ type ServerConfig struct {
 	// AutoSubscribe if enabled will automatically subscribe new clients on
 	// first call.
 	AutoSubscribe bool
+	// IDMode selects how client identities are derived from certificates.
+	// With id.ModeSPKI a client keeps its identity across certificate
+	// renewals that reuse its key. Clients subscribed by their id.ModeCert
+	// ID are still accepted in id.ModeSPKI, with a warning, to allow
+	// migrating existing deployments. If empty id.ModeCert is used.
+	IDMode id.Mode
 	// TLSConfig specifies the tls configuration to use with tls.Listener.
 	TLSConfig *tls.Config
 	// Listener specifies optional listener for client connections. If nil
@@ -45,9 +57,46 @@ type ServerConfig struct {
 	BaseDomain string
 	// HTTPAddr is the internal address the server listens on for
 	// subdomain-routed http tunnel traffic, e.g. from a reverse proxy that
-	// terminates public TLS for *.<BaseDomain>. Only used if BaseDomain is
-	// also set.
+	// terminates public TLS for *.<BaseDomain>. TLS passthrough tunnel
+	// traffic is accepted on it too, and routed by SNI, as is HTTP/2 with
+	// prior knowledge, routed per stream. Only used if BaseDomain is also
+	// set.
 	HTTPAddr string
+	// HTTPS, if set, makes the server terminate TLS for http tunnels on a
+	// public address itself. Only used if BaseDomain is also set.
+	HTTPS *HTTPSConfig
+	// Hostnames, if set, lets clients expose http tunnels on custom
+	// hostnames outside of BaseDomain. Without it only subdomains of
+	// BaseDomain may be used.
+	Hostnames *HostnameConfig
+	// AccessLog, if set, receives one entry per proxied public connection
+	// once it's closed, and for http tunnels one per request.
+	AccessLog AccessLogger
+	// Bandwidth, if set, limits the bandwidth of proxied connections per
+	// identity and per tunnel.
+	Bandwidth *BandwidthConfig
+	// ConnLimits, if set, limits concurrent public connections per identity
+	// and per tunnel, and the rate of new ones per source IP.
+	ConnLimits *ConnLimitConfig
+	// Quotas, if set, limits the bytes each identity may transfer per day
+	// or month.
+	Quotas *QuotaConfig
+	// CRL, if set, lists revoked client certificates. Clients presenting
+	// one, or one issued by a revoked intermediate, are rejected, and
+	// connected ones are disconnected as soon as a reload of the list
+	// revokes them. A CRL past its next update is logged as an error but
+	// still enforced.
+	CRL *CRL
+	// CRLReloadInterval is how often the CRL file is checked for changes.
+	// If zero, once a minute.
+	CRLReloadInterval time.Duration
+	// CertRenewal, if set, lets clients renew their certificates over the
+	// control connection. Renewal changes a certificate's id.ModeCert ID, so
+	// it requires IDMode id.ModeSPKI or AutoSubscribe.
+	CertRenewal *CertRenewalConfig
+	// Enrollment, if set, lets clients without a certificate get one in
+	// exchange for a one-time token.
+	Enrollment *EnrollmentConfig
 	// Logger is optional logger. If nil logging is disabled.
 	Logger log.Logger
 }
@@ -58,11 +107,29 @@ type Server struct {
 	*registry
 	config *ServerConfig
 
-	listener     net.Listener
+	listener  net.Listener
+	tlsConfig *tls.Config
+	// lnMu guards httpListener, httpsListener and cancel, set by Start.
+	lnMu         sync.Mutex
 	httpListener net.Listener
-	connPool     *connPool
-	httpClient   *http.Client
-	logger       log.Logger
+	// httpsListener accepts the TLS connections of HTTPS, with certificates
+	// from https.
+	httpsListener net.Listener
+	// cancel stops the background loops of Start.
+	cancel     context.CancelFunc
+	stopOnce   sync.Once
+	https      *httpsCerts
+	connPool   *connPool
+	httpClient *http.Client
+	bandwidth  *bandwidthLimiter
+	connLimits *connLimiter
+	quotas     *quotaTracker
+	logger     log.Logger
+
+	renewMu  sync.Mutex
+	renewing map[id.ID]bool
+	enrollMu sync.Mutex
+	indexMu  sync.Mutex
 }
 
 // NewServer creates a new Server.
@@ -78,10 +145,76 @@ func NewServer(config *ServerConfig) (*Server, error) {
 	}
 
 	s := &Server{
-		registry: newRegistry(logger),
-		config:   config,
-		listener: listener,
-		logger:   logger,
+		registry:  newRegistry(logger),
+		config:    config,
+		listener:  listener,
+		tlsConfig: config.TLSConfig,
+		logger:    logger,
+		renewing:  make(map[id.ID]bool),
+	}
+
+	if config.CertRenewal != nil {
+		err := config.CertRenewal.validate()
+		if err == nil && config.IDMode != id.ModeSPKI && !config.AutoSubscribe {
+			err = errors.New("renewed certificates get new IDs, use IDMode spki or AutoSubscribe")
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("certificate renewal failed: %s", err)
+		}
+	}
+	if config.Enrollment != nil {
+		err := config.Enrollment.validate()
+		if err == nil && config.TLSConfig == nil {
+			err = errors.New("missing TLSConfig")
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("enrollment failed: %s", err)
+		}
+		s.tlsConfig = enrollmentTLSConfig(config.TLSConfig, config.Enrollment.CACertPEM)
+	}
+	if config.CRLReloadInterval < 0 {
+		listener.Close()
+		return nil, errors.New("CRL failed: reload interval must not be negative")
+	}
+	if config.Hostnames != nil {
+		if err := config.Hostnames.validate(); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("hostnames failed: %s", err)
+		}
+	}
+	if config.HTTPS != nil && config.BaseDomain != "" {
+		err := config.HTTPS.validate()
+		if err == nil {
+			s.https, err = newHTTPSCerts(config.HTTPS, s.registry.hasHTTPHost)
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("https failed: %s", err)
+		}
+		if config.HTTPAddr != "" {
+			s.https.enableHTTPChallenge()
+		} else if s.https.acme != nil && config.HTTPS.ACME.HTTPChallenge {
+			listener.Close()
+			return nil, errors.New("https failed: the ACME http-01 challenge requires HTTPAddr")
+		}
+	}
+
+	if config.Bandwidth != nil {
+		s.bandwidth = newBandwidthLimiter(config.Bandwidth)
+		s.bandwidth.names = s.clientName
+	}
+	if config.ConnLimits != nil {
+		s.connLimits = newConnLimiter(config.ConnLimits)
+		s.connLimits.names = s.clientName
+	}
+	if config.Quotas != nil {
+		if s.quotas, err = newQuotaTracker(config.Quotas, s.quotaExceeded); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("quotas failed: %s", err)
+		}
+		s.quotas.names = s.clientName
 	}
 
 	t := &http2.Transport{}
@@ -120,17 +253,26 @@ func (s *Server) disconnected(identifier id.ID) {
 		"level", 1,
 		"action", "disconnected",
 		"identifier", identifier,
+		"client", s.clientName(identifier),
 	)
 
+	s.renewMu.Lock()
+	delete(s.renewing, identifier)
+	s.renewMu.Unlock()
+
 	i := s.registry.clear(identifier)
 	if i == nil {
 		return
 	}
+	if s.https != nil {
+		s.https.prune()
+	}
 	for _, l := range i.Listeners {
 		s.logger.Log(
 			"level", 2,
 			"action", "close listener",
 			"identifier", identifier,
+			"client", s.clientName(identifier),
 			"addr", l.Addr(),
 		)
 		l.Close()
@@ -158,7 +300,9 @@ func (s *Server) Start(ctx context.Context) error {
 			s.listener.Close()
 			return fmt.Errorf("failed to start http listener: %s", err)
 		}
+		s.lnMu.Lock()
 		s.httpListener = httpLn
+		s.lnMu.Unlock()
 
 		s.logger.Log(
 			"level", 1,
@@ -170,6 +314,51 @@ func (s *Server) Start(ctx context.Context) error {
 		go s.listenHTTP(httpLn)
 	}
 
+	if s.https != nil {
+		httpsLn, err := net.Listen("tcp", s.config.HTTPS.Addr)
+		if err != nil {
+			s.listener.Close()
+			s.lnMu.Lock()
+			if s.httpListener != nil {
+				s.httpListener.Close()
+			}
+			s.lnMu.Unlock()
+			return fmt.Errorf("failed to start https listener: %s", err)
+		}
+		tlsLn := tls.NewListener(httpsLn, s.https.tlsConfig())
+		s.lnMu.Lock()
+		s.httpsListener = tlsLn
+		s.lnMu.Unlock()
+
+		s.logger.Log(
+			"level", 1,
+			"action", "start https listener",
+			"addr", httpsLn.Addr().String(),
+			"base_domain", s.config.BaseDomain,
+		)
+
+		go s.listenHTTP(tlsLn)
+	}
+
+	// The loops below end with Stop, not only with the caller's ctx.
+	ctx, cancel := context.WithCancel(ctx)
+	s.lnMu.Lock()
+	s.cancel = cancel
+	s.lnMu.Unlock()
+
+	if s.connLimits != nil {
+		go s.reportRefused(ctx)
+	}
+	if s.quotas != nil {
+		go s.saveQuotas(ctx)
+	}
+	if s.config.CRL != nil {
+		go s.reloadCRL(ctx)
+	}
+	if s.config.CertRenewal != nil {
+		go s.checkCertRenewals(ctx)
+	}
+
 	go func() {
 		<-ctx.Done()
 		s.Stop()
@@ -207,7 +396,7 @@ func (s *Server) Start(ctx context.Context) error {
 			}
 		}
 
-		go s.handleClient(tls.Server(conn, s.config.TLSConfig))
+		go s.handleClient(tls.Server(conn, s.tlsConfig))
 	}
 }
 
@@ -220,6 +409,9 @@ func (s *Server) handleClient(conn net.Conn) {
 	)
 
 	var (
+		cert       *x509.Certificate
+		info       *id.Info
+		perms      *ca.Permissions
 		identifier id.ID
 		req        *http.Request
 		resp       *http.Response
@@ -240,7 +432,13 @@ func (s *Server) handleClient(conn net.Conn) {
 		goto reject
 	}
 
-	identifier, err = id.PeerID(tlsConn)
+	if s.config.Enrollment != nil && tlsConn.Handshake() == nil &&
+		tlsConn.ConnectionState().NegotiatedProtocol == proto.EnrollProtocol {
+		s.handleEnrollment(tlsConn, logger)
+		return
+	}
+
+	cert, err = id.PeerCert(tlsConn)
 	if err != nil {
 		logger.Log(
 			"level", 2,
@@ -250,18 +448,48 @@ func (s *Server) handleClient(conn net.Conn) {
 		goto reject
 	}
 
+	identifier = s.identify(cert, logger)
 	logger = logger.With("identifier", identifier)
+	// Names are only taken from certificates issued by a trusted CA.
+	info = id.VerifiedInfo(tlsConn)
+	if info != nil {
+		logger = logger.With("client", info.CommonName)
+	}
 
-	if s.config.AutoSubscribe {
-		s.Subscribe(identifier)
-	} else if !s.IsSubscribed(identifier) {
+	if s.config.CRL != nil && s.config.CRL.IsConnRevoked(tlsConn.ConnectionState()) {
 		logger.Log(
-			"level", 2,
-			"msg", "unknown client",
+			"level", 1,
+			"msg", "certificate revoked",
 		)
 		goto reject
 	}
 
+	// A certificate that can't be read for its permissions isn't taken to
+	// allow everything.
+	perms, err = ca.PermissionsFromCert(cert)
+	if err != nil {
+		logger.Log(
+			"level", 1,
+			"msg", "invalid certificate permissions",
+			"err", err,
+		)
+		goto reject
+	}
+
+	if s.config.AutoSubscribe {
+		s.Subscribe(identifier)
+	} else if !s.IsSubscribed(identifier) {
+		if info == nil || !s.isSubscribedName(info.CommonName) {
+			logger.Log(
+				"level", 2,
+				"msg", "unknown client",
+			)
+			goto reject
+		}
+		s.Subscribe(identifier)
+	}
+	s.setInfo(identifier, info)
+
 	if err = conn.SetDeadline(time.Time{}); err != nil {
 		logger.Log(
 			"level", 2,
@@ -347,7 +575,16 @@ func (s *Server) handleClient(conn net.Conn) {
 		goto reject
 	}
 
-	if err = s.addTunnels(tunnels, identifier); err != nil {
+	if err = s.quotas.check(identifier); err != nil {
+		logger.Log(
+			"level", 1,
+			"msg", "handshake rejected",
+			"err", err,
+		)
+		goto reject
+	}
+
+	if err = s.addTunnels(tunnels, identifier, perms); err != nil {
 		logger.Log(
 			"level", 2,
 			"msg", "handshake failed",
@@ -359,8 +596,8 @@ func (s *Server) handleClient(conn net.Conn) {
 	{
 		hosts := make(map[string]string)
 		for name, t := range tunnels {
-			if t.Protocol == proto.HTTP {
-				hosts[name] = httpFullHost(s.config.BaseDomain, t.Host)
+			if t.Protocol == proto.HTTP || t.Protocol == proto.TLS {
+				hosts[name] = tunnelRoute(s.config.BaseDomain, t)
 			}
 		}
 		s.notifyTunnelInfo(hosts, identifier)
@@ -371,6 +608,8 @@ func (s *Server) handleClient(conn net.Conn) {
 		"action", "connected",
 	)
 
+	s.renewCertIfDue(identifier, cert)
+
 	return
 
 reject:
@@ -387,6 +626,34 @@ reject:
 	}
 }
 
+// identify returns the identity of a client presenting cert. In id.ModeSPKI
+// a client not subscribed by its SPKI ID, but by the ID of the certificate
+// itself, is identified by the latter so existing -client-ids lists keep
+// working while they're migrated.
+func (s *Server) identify(cert *x509.Certificate, logger log.Logger) id.ID {
+	if s.config.IDMode != id.ModeSPKI {
+		return id.FromCert(cert, id.ModeCert)
+	}
+
+	identifier := id.FromCert(cert, id.ModeSPKI)
+	if s.config.AutoSubscribe || s.IsSubscribed(identifier) {
+		return identifier
+	}
+
+	legacy := id.FromCert(cert, id.ModeCert)
+	if !s.IsSubscribed(legacy) {
+		return identifier
+	}
+
+	logger.Log(
+		"level", 1,
+		"msg", "client subscribed by certificate ID, subscribe its SPKI ID instead",
+		"identifier", legacy,
+		"spki_identifier", identifier,
+	)
+	return legacy
+}
+
 // notifyError tries to send error to client.
 func (s *Server) notifyError(serverError error, identifier id.ID) {
 	if serverError == nil {
@@ -405,24 +672,33 @@ func (s *Server) notifyError(serverError error, identifier id.ID) {
 // sending the request are logged under logAction and swallowed; callers have
 // no synchronous way to know whether the client received the push.
 func (s *Server) pushToClient(identifier id.ID, body io.Reader, logAction string, setHeader func(http.Header)) {
-	req, err := http.NewRequest(http.MethodConnect, s.connPool.URL(identifier), body)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	resp, err := s.requestClient(ctx, identifier, body, setHeader)
 	if err != nil {
 		s.logger.Log(
 			"level", 2,
 			"action", logAction,
 			"identifier", identifier,
+			"client", s.clientName(identifier),
 			"err", err,
 		)
 		return
 	}
-	setHeader(req.Header)
-
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
-	defer cancel()
+	resp.Body.Close()
+}
 
-	if resp, err := s.httpClient.Do(req.WithContext(ctx)); err == nil {
-		resp.Body.Close()
+// requestClient sends a CONNECT request with body to the client, the
+// caller must close the response body.
+func (s *Server) requestClient(ctx context.Context, identifier id.ID, body io.Reader, setHeader func(http.Header)) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, s.connPool.URL(identifier), body)
+	if err != nil {
+		return nil, err
 	}
+	setHeader(req.Header)
+
+	return s.httpClient.Do(req)
 }
 
 // notifyTunnelInfo sends resolved public hostnames for a client's http
@@ -439,6 +715,7 @@ func (s *Server) notifyTunnelInfo(hosts map[string]string, identifier id.ID) {
 			"level", 1,
 			"action", "tunnel info notification failed",
 			"identifier", identifier,
+			"client", s.clientName(identifier),
 			"err", err,
 		)
 		return
@@ -450,17 +727,27 @@ func (s *Server) notifyTunnelInfo(hosts map[string]string, identifier id.ID) {
 }
 
 // addTunnels invokes addHost or addListener based on data from proto.Tunnel. If
-// a tunnel cannot be added whole batch is reverted.
-func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID) error {
+// a tunnel cannot be added whole batch is reverted. Tunnels not allowed by
+// perms, the permissions of the client certificate, are refused; nil perms
+// allow any tunnel.
+func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID, perms *ca.Permissions) error {
 	i := &RegistryItem{
 		Hosts:     []string{},
 		Listeners: []net.Listener{},
+		headers:   make(map[string]*headerRules),
 	}
 
 	var err error
 	for name, t := range tunnels {
 		switch t.Protocol {
 		case proto.TCP, proto.TCP4, proto.TCP6:
+			if perms != nil {
+				if err = checkPortAllowed(perms, t.Addr); err != nil {
+					err = fmt.Errorf("tunnel %s: %s", name, err)
+					goto rollback
+				}
+			}
+
 			var l net.Listener
 			l, err = net.Listen(t.Protocol, t.Addr)
 			if err != nil {
@@ -471,34 +758,78 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 				"level", 2,
 				"action", "open listener",
 				"identifier", identifier,
+				"client", s.clientName(identifier),
 				"addr", l.Addr(),
 			)
 
 			i.Listeners = append(i.Listeners, l)
-		case proto.HTTP:
+		case proto.HTTP, proto.TLS:
 			if s.config.BaseDomain == "" {
-				err = fmt.Errorf("tunnel %s: server has no base domain configured for http tunnels", name)
+				err = fmt.Errorf("tunnel %s: server has no base domain configured for %s tunnels", name, t.Protocol)
 				goto rollback
 			}
-			if t.Host == "" {
-				err = fmt.Errorf("tunnel %s: missing host", name)
-				goto rollback
+			if t.Hostname != "" {
+				if err = s.checkHostname(t, identifier, perms); err != nil {
+					err = fmt.Errorf("tunnel %s: %s", name, err)
+					goto rollback
+				}
+			} else {
+				if t.Host == "" {
+					err = fmt.Errorf("tunnel %s: missing host", name)
+					goto rollback
+				}
+				if !proto.ValidSubdomain(t.Host) {
+					err = fmt.Errorf("tunnel %s: %q is not a valid subdomain", name, t.Host)
+					goto rollback
+				}
+				if perms != nil && !perms.AllowsSubdomain(t.Host) {
+					err = fmt.Errorf("tunnel %s: subdomain %q not allowed by client certificate", name, t.Host)
+					goto rollback
+				}
 			}
-			if !proto.ValidSubdomainLabel(t.Host) {
-				err = fmt.Errorf("tunnel %s: %q is not a valid DNS label", name, t.Host)
-				goto rollback
+
+			if t.PathPrefix != "" {
+				if t.Protocol != proto.HTTP {
+					err = fmt.Errorf("tunnel %s: path prefix not supported for %s tunnels", name, t.Protocol)
+					goto rollback
+				}
+				if !proto.ValidPathPrefix(t.PathPrefix) {
+					err = fmt.Errorf("tunnel %s: %q is not a valid path prefix", name, t.PathPrefix)
+					goto rollback
+				}
+			}
+
+			headers := newHeaderRules(t)
+			if headers != nil {
+				if err = checkHeaderRules(t); err != nil {
+					err = fmt.Errorf("tunnel %s: %s", name, err)
+					goto rollback
+				}
 			}
 
-			fullHost := httpFullHost(s.config.BaseDomain, t.Host)
+			route := tunnelRoute(s.config.BaseDomain, t)
+			if slices.Contains(i.Hosts, route) || slices.Contains(i.TLSHosts, route) {
+				err = fmt.Errorf("tunnel %s: host %q used by more than one tunnel", name, route)
+				goto rollback
+			}
+			if headers != nil {
+				i.headers[route] = headers
+			}
 
 			s.logger.Log(
 				"level", 2,
 				"action", "register host",
 				"identifier", identifier,
-				"host", fullHost,
+				"client", s.clientName(identifier),
+				"host", route,
+				"proto", t.Protocol,
 			)
 
-			i.Hosts = append(i.Hosts, fullHost)
+			if t.Protocol == proto.TLS {
+				i.TLSHosts = append(i.TLSHosts, route)
+			} else {
+				i.Hosts = append(i.Hosts, route)
+			}
 		default:
 			err = fmt.Errorf("unsupported protocol for tunnel %s: %s", name, t.Protocol)
 			goto rollback
@@ -524,11 +855,74 @@ rollback:
 	return err
 }
 
+// checkHeaderRules returns an error unless the header rules of the tunnel
+// t are valid.
+func checkHeaderRules(t *proto.Tunnel) error {
+	if t.Protocol != proto.HTTP {
+		return fmt.Errorf("header rules not supported for %s tunnels", t.Protocol)
+	}
+	if t.HostHeader != "" && !proto.ValidHostHeader(t.HostHeader) {
+		return fmt.Errorf("%q is not a valid host header", t.HostHeader)
+	}
+	if t.RequestHeaders != nil && !proto.ValidHeaderRules(t.RequestHeaders) {
+		return errors.New("invalid request header rules")
+	}
+	if t.ResponseHeaders != nil && !proto.ValidHeaderRules(t.ResponseHeaders) {
+		return errors.New("invalid response header rules")
+	}
+	return nil
+}
+
+// checkHostname returns an error unless identifier may expose the http
+// tunnel t on its custom Hostname. Certificate permissions only list
+// subdomains of the base domain, so a certificate carrying any refuses
+// custom hostnames.
+func (s *Server) checkHostname(t *proto.Tunnel, identifier id.ID, perms *ca.Permissions) error {
+	if t.Protocol != proto.HTTP {
+		return fmt.Errorf("hostname not supported for %s tunnels", t.Protocol)
+	}
+	if t.Host != "" {
+		return errors.New("both host and hostname set")
+	}
+	if !proto.ValidHostname(t.Hostname) {
+		return fmt.Errorf("%q is not a valid hostname", t.Hostname)
+	}
+	if t.Hostname == s.config.BaseDomain || strings.HasSuffix(t.Hostname, "."+s.config.BaseDomain) {
+		return fmt.Errorf("hostname %q is in the base domain, use host", t.Hostname)
+	}
+	if !s.config.Hostnames.allows(t.Hostname, identifier, s.clientName) {
+		return fmt.Errorf("hostname %q not allowed", t.Hostname)
+	}
+	if perms != nil {
+		return fmt.Errorf("hostname %q not allowed by client certificate", t.Hostname)
+	}
+	return nil
+}
+
+// checkPortAllowed returns an error unless perms allow listening on addr.
+// Port 0 is refused, since the port the system picks can't be checked
+// before listening.
+func checkPortAllowed(perms *ca.Permissions, addr string) error {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port == 0 || !perms.AllowsPort(port) {
+		return fmt.Errorf("port %q not allowed by client certificate", portStr)
+	}
+	return nil
+}
+
 // Unsubscribe removes client from registry, disconnects client if already
 // connected and returns it's RegistryItem.
 func (s *Server) Unsubscribe(identifier id.ID) *RegistryItem {
 	s.connPool.DeleteConn(identifier)
-	return s.registry.Unsubscribe(identifier)
+	i := s.registry.Unsubscribe(identifier)
+	if i != nil && s.https != nil {
+		s.https.prune()
+	}
+	return i
 }
 
 // Ping measures the RTT response time.
@@ -547,6 +941,7 @@ func (s *Server) listen(l net.Listener, identifier id.ID) {
 					"level", 2,
 					"action", "listener closed",
 					"identifier", identifier,
+					"client", s.clientName(identifier),
 					"addr", addr,
 				)
 				return
@@ -556,12 +951,18 @@ func (s *Server) listen(l net.Listener, identifier id.ID) {
 				"level", 0,
 				"msg", "accept of connection failed",
 				"identifier", identifier,
+				"client", s.clientName(identifier),
 				"addr", addr,
 				"err", err,
 			)
 			continue
 		}
 
+		if err := s.connLimits.accept(conn.RemoteAddr()); err != nil {
+			s.refuse(conn, err, "identifier", identifier, "client", s.clientName(identifier), "addr", addr)
+			continue
+		}
+
 		msg := &proto.ControlMessage{
 			Action:         proto.ActionProxy,
 			ForwardedProto: l.Addr().Network(),
@@ -569,12 +970,22 @@ func (s *Server) listen(l net.Listener, identifier id.ID) {
 
 		msg.ForwardedHost = l.Addr().String()
 
+		key := tunnelKey(msg.ForwardedHost)
+		release, err := s.connLimits.acquire(identifier, key)
+		if err != nil {
+			s.refuse(conn, err, "identifier", identifier, "client", s.clientName(identifier), "addr", addr)
+			continue
+		}
+
+		entry := s.newAccessLogEntry(identifier, conn, msg)
+
 		if tcpConn, ok := conn.(*net.TCPConn); ok {
 			if err := keepAlive(tcpConn); err != nil {
 				s.logger.Log(
 					"level", 1,
 					"msg", "TCP keepalive for tunneled connection failed",
 					"identifier", identifier,
+					"client", s.clientName(identifier),
 					"ctrlMsg", msg,
 					"err", err,
 				)
@@ -582,11 +993,13 @@ func (s *Server) listen(l net.Listener, identifier id.ID) {
 		}
 
 		go func() {
-			if err := s.proxyConn(identifier, conn, msg); err != nil {
+			defer release()
+			if err := s.proxyConn(identifier, conn, msg, key, entry); err != nil {
 				s.logger.Log(
 					"level", 0,
 					"msg", "proxy error",
 					"identifier", identifier,
+					"client", s.clientName(identifier),
 					"ctrlMsg", msg,
 					"err", err,
 				)
@@ -622,7 +1035,16 @@ func (s *Server) listenHTTP(l net.Listener) {
 			continue
 		}
 
-		if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := s.connLimits.accept(conn.RemoteAddr()); err != nil {
+			s.refuse(conn, err, "addr", addr)
+			continue
+		}
+
+		raw := conn
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			raw = tlsConn.NetConn()
+		}
+		if tcpConn, ok := raw.(*net.TCPConn); ok {
 			if err := keepAlive(tcpConn); err != nil {
 				s.logger.Log(
 					"level", 1,
@@ -637,11 +1059,14 @@ func (s *Server) listenHTTP(l net.Listener) {
 	}
 }
 
-// handleHTTPConn reads the Host header off a freshly accepted connection,
-// finds which client registered that subdomain, and hands the connection to
-// proxyConn with the already-consumed bytes replayed first so the client
-// receives the exact original request.
+// handleHTTPConn serves a freshly accepted connection on an http listener,
+// routing each of its requests to the client that registered its host and
+// path, see serveHTTPRequests. Connections starting with a TLS handshake
+// are handed to handleTLSConn instead, unless conn is already decrypted by
+// the HTTPS listener, and HTTP/2 ones to serveH2C.
 func (s *Server) handleHTTPConn(conn net.Conn) {
+	start := time.Now()
+
 	if err := conn.SetReadDeadline(time.Now().Add(DefaultTimeout)); err != nil {
 		s.logger.Log(
 			"level", 1,
@@ -652,7 +1077,24 @@ func (s *Server) handleHTTPConn(conn net.Conn) {
 		return
 	}
 
-	host, replay, err := peekHostHeader(conn)
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		s.logger.Log(
+			"level", 1,
+			"msg", "failed to read request host",
+			"err", err,
+		)
+		conn.Close()
+		return
+	}
+	r := io.MultiReader(bytes.NewReader(first), conn)
+
+	if _, decrypted := conn.(*tls.Conn); !decrypted && first[0] == tlsRecordHandshake {
+		s.handleTLSConn(conn, r, start)
+		return
+	}
+
+	req, replay, err := peekRequest(r)
 	if err != nil {
 		s.logger.Log(
 			"level", 1,
@@ -663,6 +1105,57 @@ func (s *Server) handleHTTPConn(conn net.Conn) {
 		return
 	}
 
+	if s.https.isHTTPChallenge(req) {
+		if err := s.https.serveHTTPChallenge(conn, req); err != nil {
+			s.logger.Log(
+				"level", 1,
+				"msg", "failed to answer ACME challenge",
+				"host", req.Host,
+				"err", err,
+			)
+		}
+		return
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		s.logger.Log(
+			"level", 1,
+			"msg", "failed to clear read deadline after host sniffing",
+			"err", err,
+		)
+		conn.Close()
+		return
+	}
+
+	// An HTTP/2 connection carries streams for any host, each is routed by
+	// its :authority on its own.
+	if isH2CPreface(req) {
+		s.serveH2C(conn, replay)
+		return
+	}
+
+	// A keep-alive connection, e.g. from a reverse proxy in front, may ask
+	// for hosts and paths of different tunnels, and header rules apply to
+	// each request, so every request is routed on its own.
+	s.serveHTTPRequests(conn, bufio.NewReader(replay), start)
+}
+
+// handleTLSConn is handleHTTPConn for TLS passthrough tunnels: it routes
+// conn by the SNI server name of the ClientHello read from r, which
+// replays what was already read from conn, and passes the connection
+// through untouched. conn's read deadline must be set.
+func (s *Server) handleTLSConn(conn net.Conn, r io.Reader, start time.Time) {
+	serverName, replay, err := peekServerName(r)
+	if err != nil {
+		s.logger.Log(
+			"level", 1,
+			"msg", "failed to read TLS server name",
+			"err", err,
+		)
+		conn.Close()
+		return
+	}
+
 	if err := conn.SetReadDeadline(time.Time{}); err != nil {
 		s.logger.Log(
 			"level", 1,
@@ -673,54 +1166,85 @@ func (s *Server) handleHTTPConn(conn net.Conn) {
 		return
 	}
 
-	// Host headers are case-insensitive (RFC 9110 §4.2.3), but registered
-	// subdomains are always lowercase (proto.ValidSubdomainLabel rejects
-	// uppercase), so the incoming value must be folded to match.
-	fullHost := strings.ToLower(trimPort(host))
+	fullHost := strings.ToLower(serverName)
 
-	identifier, ok := s.registry.Subscriber(fullHost)
+	// There's no way to answer with an error before the handshake, the
+	// connection is just closed.
+	identifier, registered, ok := s.registry.matchHost(fullHost, true)
 	if !ok {
 		s.logger.Log(
 			"level", 1,
-			"msg", "no tunnel registered for host",
+			"msg", "no tls tunnel registered for host",
 			"host", fullHost,
 		)
-		io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
 		conn.Close()
 		return
 	}
 
-	slug := httpSlugFromHost(s.config.BaseDomain, fullHost)
-
 	msg := &proto.ControlMessage{
 		Action:         proto.ActionProxy,
-		ForwardedHost:  slug,
-		ForwardedProto: proto.HTTP,
+		ForwardedHost:  httpSlugFromHost(s.config.BaseDomain, registered),
+		ForwardedProto: proto.TLS,
 	}
 
-	rc := &replayConn{Conn: conn, r: replay}
+	release, err := s.connLimits.acquire(identifier, registered)
+	if err != nil {
+		s.refuse(conn, err, "identifier", identifier, "client", s.clientName(identifier), "host", fullHost)
+		return
+	}
+	defer release()
 
-	if err := s.proxyConn(identifier, rc, msg); err != nil {
+	entry := s.newAccessLogEntry(identifier, conn, msg)
+	entry.Start = start
+	entry.Host = fullHost
+
+	if err := s.proxyConn(identifier, &replayConn{Conn: conn, r: replay}, msg, registered, entry); err != nil {
 		s.logger.Log(
 			"level", 0,
-			"msg", "http proxy error",
+			"msg", "tls proxy error",
 			"identifier", identifier,
+			"client", s.clientName(identifier),
 			"ctrlMsg", msg,
 			"err", err,
 		)
 	}
 }
 
-func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMessage) error {
+// proxyConn proxies conn to the client identified by identifier as
+// described by msg. key is the tunnel's key in per tunnel limits, see
+// BandwidthConfig.Tunnels. entry, if not nil, is completed and logged once
+// conn is done.
+func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMessage, key string, entry *AccessLogEntry) (err error) {
 	s.logger.Log(
 		"level", 2,
 		"action", "proxy conn",
 		"identifier", identifier,
+		"client", s.clientName(identifier),
 		"ctrlMsg", msg,
 	)
 
 	defer conn.Close()
 
+	// httpConn logs its requests itself.
+	logEntry := entry != nil
+	if !logEntry {
+		entry = &AccessLogEntry{}
+	}
+	in := &countingReader{r: conn}
+	defer func() {
+		entry.BytesIn = in.n.Load()
+		if err != nil {
+			entry.CloseReason = err.Error()
+		}
+		if logEntry {
+			s.logAccess(entry)
+		}
+	}()
+
+	if err := s.quotas.check(identifier); err != nil {
+		return err
+	}
+
 	pr, pw := io.Pipe()
 	defer pr.Close()
 	defer pw.Close()
@@ -734,15 +1258,26 @@ func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMe
 	defer cancel()
 	req = req.WithContext(ctx)
 
+	untrack := s.quotas.track(identifier, func() {
+		cancel()
+		conn.Close()
+	})
+	defer untrack()
+
+	inBuckets, outBuckets := splitDirections(s.bandwidth.buckets(identifier, key))
+
 	done := make(chan struct{})
 	go func() {
-		transfer(pw, conn, log.NewContext(s.logger).With(
+		transfer(pw, newRateLimitedReader(ctx, newQuotaReader(in, s.quotas, identifier), inBuckets), log.NewContext(s.logger).With(
 			"dir", "user to client",
 			"dst", identifier,
 			"src", conn.RemoteAddr(),
 		))
-		cancel()
+		// Without closing pw the transport stays blocked reading the
+		// request body, and cancel alone can't end the stream.
+		pw.Close()
 		close(done)
+		cancel()
 	}()
 
 	resp, err := s.httpClient.Do(req)
@@ -751,12 +1286,40 @@ func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMe
 	}
 	defer resp.Body.Close()
 
-	transfer(conn, resp.Body, log.NewContext(s.logger).With(
+	var dst io.Writer = conn
+	var sniffer *statusSniffer
+	if msg.ForwardedProto == proto.HTTP {
+		sniffer = &statusSniffer{w: conn}
+		dst = sniffer
+	}
+
+	var copyErr error
+	entry.BytesOut, copyErr = transfer(dst, newRateLimitedReader(ctx, newQuotaReader(resp.Body, s.quotas, identifier), outBuckets), log.NewContext(s.logger).With(
 		"dir", "client to user",
 		"dst", conn.RemoteAddr(),
 		"src", identifier,
 	))
 
+	if sniffer != nil {
+		entry.Status = sniffer.status
+	}
+
+	// A stream of a connection routed per request has nothing left to
+	// read once the client is done, and is only replaced after EOF.
+	if _, ok := conn.(*pipeConn); ok {
+		conn.Close()
+	}
+
+	select {
+	case <-done:
+		entry.CloseReason = closeUser
+	default:
+		entry.CloseReason = closeClient
+	}
+	if copyErr != nil {
+		entry.CloseReason = copyErr.Error()
+	}
+
 	select {
 	case <-done:
 	case <-time.After(DefaultTimeout):
@@ -766,12 +1329,46 @@ func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMe
 		"level", 2,
 		"action", "proxy conn done",
 		"identifier", identifier,
+		"client", s.clientName(identifier),
 		"ctrlMsg", msg,
 	)
 
 	return nil
 }
 
+// newAccessLogEntry starts the access log entry for a public connection
+// that is about to be proxied to identifier.
+func (s *Server) newAccessLogEntry(identifier id.ID, conn net.Conn, msg *proto.ControlMessage) *AccessLogEntry {
+	return &AccessLogEntry{
+		Start:      time.Now(),
+		RemoteAddr: conn.RemoteAddr().String(),
+		Identifier: identifier,
+		Client:     s.clientName(identifier),
+		Proto:      msg.ForwardedProto,
+		Tunnel:     msg.ForwardedHost,
+	}
+}
+
+// logAccess completes entry and hands it to the configured AccessLogger,
+// if any.
+func (s *Server) logAccess(entry *AccessLogEntry) {
+	if s.config.AccessLog == nil {
+		return
+	}
+
+	entry.Duration = time.Since(entry.Start)
+
+	if err := s.config.AccessLog.LogAccess(entry); err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "access log write failed",
+			"identifier", entry.Identifier,
+			"client", s.clientName(entry.Identifier),
+			"err", err,
+		)
+	}
+}
+
 // connectRequest creates HTTP request to client with a given identifier having
 // control message and data input stream, output data stream results from
 // response the created request.
@@ -785,6 +1382,182 @@ func (s *Server) connectRequest(identifier id.ID, msg *proto.ControlMessage, r i
 	return req, nil
 }
 
+// refuse closes conn, turned away by a ConnLimitConfig limit. The refusal
+// is only logged at debug level so a flood can't flood the log as well;
+// reportRefused logs the totals. keyvals identify where the connection was headed.
+func (s *Server) refuse(conn net.Conn, reason error, keyvals ...any) {
+	conn.Close()
+
+	s.logger.Log(append([]any{
+		"level", 2,
+		"action", "connection refused",
+		"remote_addr", conn.RemoteAddr(),
+		"reason", reason,
+	}, keyvals...)...)
+}
+
+// refusedReportInterval is how often reportRefused logs refused connection
+// counts.
+const refusedReportInterval = time.Minute
+
+// reportRefused periodically logs how many connections were refused by
+// connection limits since the last report, until ctx is done.
+func (s *Server) reportRefused(ctx context.Context) {
+	t := time.NewTicker(refusedReportInterval)
+	defer t.Stop()
+
+	var last ConnLimitStats
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+
+		cur := s.connLimits.stats()
+		if cur == last {
+			continue
+		}
+		s.logger.Log(
+			"level", 1,
+			"action", "connections refused",
+			"accept_rate", cur.AcceptRate-last.AcceptRate,
+			"identity", cur.Identity-last.Identity,
+			"tunnel", cur.Tunnel-last.Tunnel,
+			"interval", refusedReportInterval,
+		)
+		last = cur
+	}
+}
+
+// quotaExceeded disconnects identifier once it used up its transfer quota.
+// Its streams are already closed by then; the error tells the client why it's
+// being disconnected, and handleClient rejects it until the quota resets.
+func (s *Server) quotaExceeded(identifier id.ID) {
+	s.logger.Log(
+		"level", 1,
+		"action", "quota exceeded",
+		"identifier", identifier,
+		"client", s.clientName(identifier),
+	)
+
+	s.notifyError(errQuotaExceeded, identifier)
+	s.connPool.DeleteConn(identifier)
+
+	if err := s.quotas.save(); err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "saving quota usage failed",
+			"err", err,
+		)
+	}
+}
+
+// saveQuotas periodically persists quota usage until ctx is done.
+func (s *Server) saveQuotas(ctx context.Context) {
+	t := time.NewTicker(quotaSaveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := s.quotas.save(); err != nil {
+			s.logger.Log(
+				"level", 0,
+				"msg", "saving quota usage failed",
+				"err", err,
+			)
+		}
+	}
+}
+
+// reloadCRL periodically reloads the CRL until ctx is done, disconnecting
+// clients whose certificates became revoked.
+func (s *Server) reloadCRL(ctx context.Context) {
+	interval := s.config.CRLReloadInterval
+	if interval == 0 {
+		interval = defaultCRLReloadInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	stale := s.checkCRLStale(false)
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+
+		changed, err := s.config.CRL.Reload()
+		stale = s.checkCRLStale(stale)
+		if err != nil {
+			s.logger.Log(
+				"level", 0,
+				"msg", "CRL reload failed",
+				"err", err,
+			)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		s.logger.Log(
+			"level", 1,
+			"action", "CRL reloaded",
+		)
+
+		revoked := s.connPool.CloseIf(func(conn net.Conn) bool {
+			tlsConn, ok := conn.(*tls.Conn)
+			if !ok {
+				return false
+			}
+			return s.config.CRL.IsConnRevoked(tlsConn.ConnectionState())
+		})
+		for _, identifier := range revoked {
+			s.logger.Log(
+				"level", 1,
+				"action", "revoked client disconnected",
+				"identifier", identifier,
+				"client", s.clientName(identifier),
+			)
+		}
+	}
+}
+
+// checkCRLStale logs when the CRL goes past its NextUpdate, as certificates
+// revoked since then are still accepted, and when a fresh one replaces it.
+// wasStale is the result of the previous check.
+func (s *Server) checkCRLStale(wasStale bool) bool {
+	stale := s.config.CRL.Stale(time.Now())
+	switch {
+	case stale && !wasStale:
+		s.logger.Log(
+			"level", 0,
+			"msg", "CRL is past its next update, recently revoked certificates may still be accepted",
+			"next_update", s.config.CRL.NextUpdate(),
+		)
+	case !stale && wasStale:
+		s.logger.Log(
+			"level", 1,
+			"action", "CRL updated",
+			"next_update", s.config.CRL.NextUpdate(),
+		)
+	}
+	return stale
+}
+
+// ConnLimitStats returns the number of connections refused so far because
+// of ServerConfig.ConnLimits.
+func (s *Server) ConnLimitStats() ConnLimitStats {
+	return s.connLimits.stats()
+}
+
 // Addr returns network address clients connect to.
 func (s *Server) Addr() string {
 	if s.listener == nil {
@@ -796,14 +1569,33 @@ func (s *Server) Addr() string {
 // HTTPAddr returns the address of the internal subdomain-routing listener,
 // or "" if it is not running.
 func (s *Server) HTTPAddr() string {
+	s.lnMu.Lock()
+	defer s.lnMu.Unlock()
+
 	if s.httpListener == nil {
 		return ""
 	}
 	return s.httpListener.Addr().String()
 }
 
-// Stop closes the server.
+// HTTPSAddr returns the address of the HTTPS listener, or "" if it is not
+// running.
+func (s *Server) HTTPSAddr() string {
+	s.lnMu.Lock()
+	defer s.lnMu.Unlock()
+
+	if s.httpsListener == nil {
+		return ""
+	}
+	return s.httpsListener.Addr().String()
+}
+
+// Stop closes the server. Calls after the first have no effect.
 func (s *Server) Stop() {
+	s.stopOnce.Do(s.stop)
+}
+
+func (s *Server) stop() {
 	s.logger.Log(
 		"level", 1,
 		"action", "stop",
@@ -812,7 +1604,23 @@ func (s *Server) Stop() {
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	s.lnMu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
 	if s.httpListener != nil {
 		s.httpListener.Close()
 	}
+	if s.httpsListener != nil {
+		s.httpsListener.Close()
+	}
+	s.lnMu.Unlock()
+
+	if err := s.quotas.save(); err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "saving quota usage failed",
+			"err", err,
+		)
+	}
 }
@@ -18,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ChacheGS/go-stream-tunnel/ca"
 	"github.com/ChacheGS/go-stream-tunnel/id"
 	"github.com/ChacheGS/go-stream-tunnel/proto"
 )
@@ -309,6 +310,25 @@ func waitConnected(t *testing.T, c *Client, timeout time.Duration) {
 	}
 }
 
+// waitRegistered waits until a tunnel is registered for host, which happens
+// a little after its client got connected.
+func waitRegistered(t *testing.T, s *Server, host string, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		if _, ok := s.registry.Subscriber(host); ok {
+			return
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("no tunnel registered for %s within timeout", host)
+		default:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
 func TestServer_addTunnels_TCP(t *testing.T) {
 	t.Parallel()
 
@@ -330,7 +350,7 @@ func TestServer_addTunnels_TCP(t *testing.T) {
 		"web": {Protocol: proto.TCP, Addr: "127.0.0.1:0"},
 	}
 
-	err = s.addTunnels(tunnels, identifier)
+	err = s.addTunnels(tunnels, identifier, nil)
 	if err != nil {
 		t.Fatalf("addTunnels failed: %v", err)
 	}
@@ -360,7 +380,7 @@ func TestServer_addTunnels_UnsupportedProto(t *testing.T) {
 		"web": {Protocol: "udp", Addr: "127.0.0.1:0"},
 	}
 
-	err = s.addTunnels(tunnels, identifier)
+	err = s.addTunnels(tunnels, identifier, nil)
 	if err == nil {
 		t.Fatal("expected error for unsupported protocol")
 	}
@@ -387,7 +407,7 @@ func TestServer_addTunnels_ListenError(t *testing.T) {
 		"web": {Protocol: proto.TCP, Addr: "invalid-addr-no-port"},
 	}
 
-	err = s.addTunnels(tunnels, identifier)
+	err = s.addTunnels(tunnels, identifier, nil)
 	if err == nil {
 		t.Fatal("expected error for invalid listen address")
 	}
@@ -802,7 +822,7 @@ func TestServer_addTunnels_HTTP(t *testing.T) {
 		"myapp": {Protocol: proto.HTTP, Host: "myapp"},
 	}
 
-	if err := s.addTunnels(tunnels, identifier); err != nil {
+	if err := s.addTunnels(tunnels, identifier, nil); err != nil {
 		t.Fatalf("addTunnels failed: %v", err)
 	}
 
@@ -817,6 +837,205 @@ func TestServer_addTunnels_HTTP(t *testing.T) {
 	s.disconnected(identifier)
 }
 
+func TestServer_addTunnels_TLS(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s, err := NewServer(&ServerConfig{
+		Listener:   ln,
+		BaseDomain: "tunnel.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identifier := id.New([]byte("test-client"))
+	s.Subscribe(identifier)
+
+	// an http and a tls tunnel can't share a host
+	if err := s.addTunnels(map[string]*proto.Tunnel{
+		"web":    {Protocol: proto.HTTP, Host: "myapp"},
+		"secure": {Protocol: proto.TLS, Host: "myapp"},
+	}, identifier, nil); err == nil {
+		t.Fatal("expected error for a host used by two tunnels")
+	}
+
+	if err := s.addTunnels(map[string]*proto.Tunnel{
+		"secure": {Protocol: proto.TLS, Host: "myapp"},
+	}, identifier, nil); err != nil {
+		t.Fatalf("addTunnels failed: %v", err)
+	}
+
+	got, ok := s.registry.subscriberTLS("myapp.tunnel.example.com", true)
+	if !ok || got != identifier {
+		t.Fatal("expected host to be registered for tls")
+	}
+	if _, ok := s.registry.subscriberTLS("myapp.tunnel.example.com", false); ok {
+		t.Fatal("expected host not to be routed for http")
+	}
+
+	s.disconnected(identifier)
+}
+
+func TestServer_addTunnels_Hostname(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	identifier := id.New([]byte("test-client"))
+	s, err := NewServer(&ServerConfig{
+		Listener:   ln,
+		BaseDomain: "tunnel.example.com",
+		Hostnames: &HostnameConfig{
+			Allowed:    []string{"shop.example.org"},
+			Identities: map[id.ID][]string{identifier: {"*.client.example.net"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Subscribe(identifier)
+
+	for name, tun := range map[string]*proto.Tunnel{
+		"not allowed":    {Protocol: proto.HTTP, Hostname: "other.example.org"},
+		"in base domain": {Protocol: proto.HTTP, Hostname: "myapp.tunnel.example.com"},
+		"with host":      {Protocol: proto.HTTP, Host: "myapp", Hostname: "shop.example.org"},
+		"tls":            {Protocol: proto.TLS, Hostname: "shop.example.org"},
+		"invalid":        {Protocol: proto.HTTP, Hostname: "Shop.example.org"},
+	} {
+		if err := s.addTunnels(map[string]*proto.Tunnel{"web": tun}, identifier, nil); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+
+	// certificate permissions only allow subdomains
+	if err := s.addTunnels(map[string]*proto.Tunnel{
+		"web": {Protocol: proto.HTTP, Hostname: "shop.example.org"},
+	}, identifier, &ca.Permissions{Subdomains: []string{"*"}}); err == nil {
+		t.Fatal("expected error for a hostname with certificate permissions")
+	}
+
+	if err := s.addTunnels(map[string]*proto.Tunnel{
+		"shop": {Protocol: proto.HTTP, Hostname: "shop.example.org"},
+		"app":  {Protocol: proto.HTTP, Hostname: "app.client.example.net"},
+		"web":  {Protocol: proto.HTTP, Host: "myapp"},
+	}, identifier, nil); err != nil {
+		t.Fatalf("addTunnels failed: %v", err)
+	}
+
+	for _, host := range []string{"shop.example.org", "app.client.example.net", "myapp.tunnel.example.com"} {
+		if got, ok := s.registry.subscriberTLS(host, false); !ok || got != identifier {
+			t.Fatalf("expected %s to be registered", host)
+		}
+	}
+
+	s.disconnected(identifier)
+}
+
+func TestServer_addTunnels_PathPrefix(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s, err := NewServer(&ServerConfig{
+		Listener:   ln,
+		BaseDomain: "tunnel.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identifier := id.New([]byte("test-client"))
+	s.Subscribe(identifier)
+
+	for name, tun := range map[string]*proto.Tunnel{
+		"tls":            {Protocol: proto.TLS, Host: "myapp", PathPrefix: "/api"},
+		"trailing slash": {Protocol: proto.HTTP, Host: "myapp", PathPrefix: "/api/"},
+		"relative":       {Protocol: proto.HTTP, Host: "myapp", PathPrefix: "api"},
+	} {
+		if err := s.addTunnels(map[string]*proto.Tunnel{"web": tun}, identifier, nil); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+
+	if err := s.addTunnels(map[string]*proto.Tunnel{
+		"web": {Protocol: proto.HTTP, Host: "myapp"},
+		"api": {Protocol: proto.HTTP, Host: "myapp", PathPrefix: "/api"},
+	}, identifier, nil); err != nil {
+		t.Fatalf("addTunnels failed: %v", err)
+	}
+
+	if _, route, ok := s.registry.matchRoute("myapp.tunnel.example.com", "/api/users"); !ok || route != "myapp.tunnel.example.com/api" {
+		t.Fatalf("expected the path route, got %q", route)
+	}
+
+	s.disconnected(identifier)
+}
+
+func TestServer_addTunnels_HeaderRules(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s, err := NewServer(&ServerConfig{
+		Listener:   ln,
+		BaseDomain: "tunnel.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identifier := id.New([]byte("test-client"))
+	s.Subscribe(identifier)
+
+	for name, tun := range map[string]*proto.Tunnel{
+		"tls":             {Protocol: proto.TLS, Host: "myapp", HostHeader: "localhost"},
+		"host header":     {Protocol: proto.HTTP, Host: "myapp", HostHeader: "local host"},
+		"request header":  {Protocol: proto.HTTP, Host: "myapp", RequestHeaders: &proto.HeaderRules{Remove: []string{"Content-Length"}}},
+		"response header": {Protocol: proto.HTTP, Host: "myapp", ResponseHeaders: &proto.HeaderRules{Add: map[string]string{"X-A": "a\nb"}}},
+	} {
+		if err := s.addTunnels(map[string]*proto.Tunnel{"web": tun}, identifier, nil); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+
+	if err := s.addTunnels(map[string]*proto.Tunnel{
+		"web": {Protocol: proto.HTTP, Host: "myapp", HostHeader: "localhost:3000"},
+		"api": {Protocol: proto.HTTP, Host: "api"},
+	}, identifier, nil); err != nil {
+		t.Fatalf("addTunnels failed: %v", err)
+	}
+
+	if h := s.registry.headers("myapp.tunnel.example.com"); h == nil || h.host != "localhost:3000" {
+		t.Fatalf("expected the header rules of myapp, got %+v", h)
+	}
+	if h := s.registry.headers("api.tunnel.example.com"); h != nil {
+		t.Fatalf("expected no header rules for api, got %+v", h)
+	}
+
+	s.disconnected(identifier)
+	if h := s.registry.headers("myapp.tunnel.example.com"); h != nil {
+		t.Fatal("expected no header rules left after disconnect")
+	}
+}
+
 func TestServer_addTunnels_HTTP_MissingBaseDomain(t *testing.T) {
 	t.Parallel()
 
@@ -838,7 +1057,7 @@ func TestServer_addTunnels_HTTP_MissingBaseDomain(t *testing.T) {
 		"myapp": {Protocol: proto.HTTP, Host: "myapp"},
 	}
 
-	err = s.addTunnels(tunnels, identifier)
+	err = s.addTunnels(tunnels, identifier, nil)
 	if err == nil {
 		t.Fatal("expected error when server has no base domain configured")
 	}
@@ -868,7 +1087,7 @@ func TestServer_addTunnels_HTTP_MissingHost(t *testing.T) {
 		"myapp": {Protocol: proto.HTTP, Host: ""},
 	}
 
-	err = s.addTunnels(tunnels, identifier)
+	err = s.addTunnels(tunnels, identifier, nil)
 	if err == nil {
 		t.Fatal("expected error for missing host")
 	}
@@ -894,18 +1113,68 @@ func TestServer_addTunnels_HTTP_InvalidHost(t *testing.T) {
 	identifier := id.New([]byte("test-client"))
 	s.Subscribe(identifier)
 
-	// A malicious or misconfigured client could send a Host containing a
-	// dot, attempting to register a nested/unintended subdomain, or other
-	// characters invalid in a DNS label; the server must reject these
+	// A malicious or misconfigured client could send a Host with a bare
+	// wildcard, attempting to capture the whole base domain, or other
+	// characters invalid in a DNS name; the server must reject these
 	// rather than trust wire data from any connected client.
-	tunnels := map[string]*proto.Tunnel{
-		"myapp": {Protocol: proto.HTTP, Host: "evil.attacker"},
+	for _, host := range []string{"*", "evil..attacker", "Evil", "evil.*"} {
+		tunnels := map[string]*proto.Tunnel{
+			"myapp": {Protocol: proto.HTTP, Host: host},
+		}
+
+		err = s.addTunnels(tunnels, identifier, nil)
+		if err == nil {
+			t.Fatalf("expected error for invalid host %q", host)
+		}
 	}
+}
 
-	err = s.addTunnels(tunnels, identifier)
-	if err == nil {
-		t.Fatal("expected error for invalid host")
+func TestServer_addTunnels_HTTP_Wildcard(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer ln.Close()
+
+	s, err := NewServer(&ServerConfig{
+		Listener:   ln,
+		BaseDomain: "tunnel.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identifier := id.New([]byte("test-client"))
+	s.Subscribe(identifier)
+
+	// certificate permissions apply to the label right below the base
+	// domain
+	perms := &ca.Permissions{Subdomains: []string{"alice"}}
+	if err := s.addTunnels(map[string]*proto.Tunnel{
+		"preview": {Protocol: proto.HTTP, Host: "*.bob"},
+	}, identifier, perms); err == nil {
+		t.Fatal("expected error for a wildcard outside the allowed subdomain")
+	}
+
+	if err := s.addTunnels(map[string]*proto.Tunnel{
+		"api":     {Protocol: proto.HTTP, Host: "api.alice"},
+		"preview": {Protocol: proto.HTTP, Host: "*.alice"},
+	}, identifier, perms); err != nil {
+		t.Fatalf("addTunnels failed: %v", err)
+	}
+
+	for _, host := range []string{"api.alice.tunnel.example.com", "pr-1.alice.tunnel.example.com", "a.b.alice.tunnel.example.com"} {
+		if got, ok := s.registry.subscriberTLS(host, false); !ok || got != identifier {
+			t.Fatalf("expected %s to be routed", host)
+		}
+	}
+	if _, ok := s.registry.subscriberTLS("alice.tunnel.example.com", false); ok {
+		t.Fatal("expected a wildcard not to match its own domain")
+	}
+
+	s.disconnected(identifier)
 }
 
 func TestServer_addTunnels_HTTP_HostCollision(t *testing.T) {
@@ -929,7 +1198,7 @@ func TestServer_addTunnels_HTTP_HostCollision(t *testing.T) {
 	s.Subscribe(first)
 	if err := s.addTunnels(map[string]*proto.Tunnel{
 		"myapp": {Protocol: proto.HTTP, Host: "myapp"},
-	}, first); err != nil {
+	}, first, nil); err != nil {
 		t.Fatalf("first addTunnels failed: %v", err)
 	}
 	defer s.disconnected(first)
@@ -938,7 +1207,7 @@ func TestServer_addTunnels_HTTP_HostCollision(t *testing.T) {
 	s.Subscribe(second)
 	err = s.addTunnels(map[string]*proto.Tunnel{
 		"myapp": {Protocol: proto.HTTP, Host: "myapp"},
-	}, second)
+	}, second, nil)
 	if err == nil {
 		t.Fatal("expected error for colliding subdomain")
 	}
@@ -1100,11 +1369,11 @@ func TestServer_handleHTTPConn_KnownHost_RoutesToClient(t *testing.T) {
 	defer clientCancel()
 	go c.Start(clientCtx)
 
-	waitConnected(t, c, 5*time.Second)
+	waitRegistered(t, s, "myapp.tunnel.example.com", 5*time.Second)
 
 	// Dial the server's internal HTTP router directly (simulating the
 	// reverse proxy) and request the registered subdomain.
-	conn, err := net.Dial("tcp", s.httpListener.Addr().String())
+	conn, err := net.Dial("tcp", s.HTTPAddr())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1194,9 +1463,9 @@ func TestServer_handleHTTPConn_HostHeaderIsCaseInsensitive(t *testing.T) {
 	defer clientCancel()
 	go c.Start(clientCtx)
 
-	waitConnected(t, c, 5*time.Second)
+	waitRegistered(t, s, "myapp.tunnel.example.com", 5*time.Second)
 
-	conn, err := net.Dial("tcp", s.httpListener.Addr().String())
+	conn, err := net.Dial("tcp", s.HTTPAddr())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1300,3 +1569,60 @@ func TestServer_notifyTunnelInfo_SendsPushMessage(t *testing.T) {
 		t.Fatal("did not receive tunnel info push within timeout")
 	}
 }
+
+func TestServer_addTunnels_Permissions(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s, err := NewServer(&ServerConfig{
+		Listener:   ln,
+		BaseDomain: "tunnel.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	perms := &ca.Permissions{
+		Ports:      []ca.PortRange{{First: allowed, Last: allowed}},
+		Subdomains: []string{"alice-*"},
+	}
+
+	identifier := id.New([]byte("alice"))
+	s.Subscribe(identifier)
+
+	for name, tunnels := range map[string]map[string]*proto.Tunnel{
+		"port":      {"tcp": {Protocol: proto.TCP, Addr: fmt.Sprintf("127.0.0.1:%d", allowed+1)}},
+		"any port":  {"tcp": {Protocol: proto.TCP, Addr: "127.0.0.1:0"}},
+		"subdomain": {"web": {Protocol: proto.HTTP, Host: "bob-app"}},
+		// one disallowed tunnel rejects the batch
+		"batch": {
+			"tcp": {Protocol: proto.TCP, Addr: fmt.Sprintf("127.0.0.1:%d", allowed)},
+			"web": {Protocol: proto.HTTP, Host: "bob-app"},
+		},
+	} {
+		if err := s.addTunnels(tunnels, identifier, perms); err == nil {
+			s.disconnected(identifier)
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	if err := s.addTunnels(map[string]*proto.Tunnel{
+		"tcp": {Protocol: proto.TCP, Addr: fmt.Sprintf("127.0.0.1:%d", allowed)},
+		"web": {Protocol: proto.HTTP, Host: "alice-app"},
+	}, identifier, perms); err != nil {
+		t.Fatalf("addTunnels failed: %v", err)
+	}
+	s.disconnected(identifier)
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// tlsRecordHandshake is the content type of TLS handshake records, and so
+// the first byte of every TLS connection. No HTTP method starts with it.
+const tlsRecordHandshake = 0x16
+
+var errClientHelloPeeked = errors.New("client hello peeked")
+
+// peekServerName reads a TLS ClientHello from r, returning its SNI server
+// name and a reader that reproduces the exact bytes consumed followed by the
+// remainder of r, like peekHostHeader does for HTTP. The ClientHello is
+// parsed by crypto/tls, which is stopped as soon as it has it, so the
+// handshake itself is left to whoever gets replay.
+func peekServerName(r io.Reader) (serverName string, replay io.Reader, err error) {
+	var buf bytes.Buffer
+	peeked := false
+
+	err = tls.Server(readOnlyConn{r: io.TeeReader(r, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			peeked = true
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+	if !peeked {
+		return "", nil, err
+	}
+
+	return serverName, io.MultiReader(&buf, r), nil
+}
+
+// readOnlyConn is a net.Conn reading from r, for peekServerName. Writes,
+// i.e. the alert crypto/tls sends when peekServerName stops it, fail.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)       { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)      { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                     { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr             { return nil }
+func (c readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
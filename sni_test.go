@@ -0,0 +1,61 @@
+// Copyright (C) 2026 ChacheGS
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// helloRecorder is a net.Conn recording what a tls.Client writes to it,
+// reads fail so the handshake stops after the ClientHello.
+type helloRecorder struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *helloRecorder) Write(p []byte) (int, error) { return c.buf.Write(p) }
+func (c *helloRecorder) Read(p []byte) (int, error)  { return 0, io.EOF }
+
+func TestPeekServerName_ExtractsServerNameAndReplaysBytes(t *testing.T) {
+	t.Parallel()
+
+	conn := &helloRecorder{}
+	tls.Client(conn, &tls.Config{ServerName: "myapp.tunnel.example.com"}).Handshake()
+	if conn.buf.Len() == 0 || conn.buf.Bytes()[0] != tlsRecordHandshake {
+		t.Fatal("expected a ClientHello to be recorded")
+	}
+	raw := append(conn.buf.Bytes(), "trailing"...)
+
+	serverName, replay, err := peekServerName(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "myapp.tunnel.example.com" {
+		t.Fatalf("expected server name %q, got %q", "myapp.tunnel.example.com", serverName)
+	}
+
+	got, err := io.ReadAll(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, raw) {
+		t.Fatal("expected replayed bytes to equal the original stream verbatim")
+	}
+}
+
+func TestPeekServerName_NotTLS(t *testing.T) {
+	t.Parallel()
+
+	r := strings.NewReader("GET / HTTP/1.1\r\nHost: myapp.tunnel.example.com\r\n\r\n")
+
+	if _, _, err := peekServerName(r); err == nil {
+		t.Fatal("expected error for a non-TLS stream")
+	}
+}
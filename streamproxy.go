@@ -63,7 +63,7 @@ func NewMultiStreamProxy(localAddrMap map[string]string, logger log.Logger) *Str
 // Proxy is a ProxyFunc.
 func (p *StreamProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
 	switch msg.ForwardedProto {
-	case proto.TCP, proto.TCP4, proto.TCP6, proto.HTTP:
+	case proto.TCP, proto.TCP4, proto.TCP6, proto.HTTP, proto.TLS:
 		// ok
 	default:
 		p.logger.Log(
@@ -113,6 +113,12 @@ func (p *StreamProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMess
 			"dst", msg.ForwardedHost,
 			"src", target,
 		))
+		// An http server closing the connection is done with it, while
+		// the server may hold on to a stream routed per request until
+		// this one ends.
+		if msg.ForwardedProto == proto.HTTP {
+			r.Close()
+		}
 		close(done)
 	}()
 
@@ -14,22 +14,28 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/ChacheGS/go-stream-tunnel/log"
 )
 
-func transfer(dst io.Writer, src io.Reader, logger log.Logger) {
+// transfer copies src to dst, returning the number of bytes copied and the
+// copy error, if any. Cancellation of the request backing one side is how a
+// proxied connection normally ends, so context.Canceled is not reported.
+func transfer(dst io.Writer, src io.Reader, logger log.Logger) (int64, error) {
 	n, err := io.Copy(dst, src)
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
 	if err != nil {
-		if !errors.Is(err, context.Canceled) {
-			logger.Log(
-				"level", 2,
-				"msg", "copy error",
-				"err", err,
-			)
-		}
+		logger.Log(
+			"level", 2,
+			"msg", "copy error",
+			"err", err,
+		)
 	}
 
 	logger.Log(
@@ -37,6 +43,21 @@ func transfer(dst io.Writer, src io.Reader, logger log.Logger) {
 		"action", "transferred",
 		"bytes", n,
 	)
+
+	return n, err
+}
+
+// countingReader counts the bytes read through it. The count may be read
+// concurrently with Read.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
 }
 
 type flushWriter struct {
@@ -96,3 +117,27 @@ func CheckPrivateKeyPermissions(path string) error {
 
 	return nil
 }
+
+// WriteFileAtomic writes data to path through a temporary file in the same
+// directory, so a reader of path never sees it half written, e.g. a server
+// reloading a CRL or a client reconnecting with a renewed certificate.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}